@@ -0,0 +1,105 @@
+package abandonment
+
+import (
+	"fmt"
+	"log"
+	"owl_server/db"
+	"owl_server/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Periodically marks the events which didn't receive their end update
+// within their timeout as abandoned (see models.AbandonmentPolicy).
+type Sweeper struct {
+	database db.Sweeper
+	policy models.AbandonmentPolicy
+	interval time.Duration
+
+	lock sync.Mutex
+	stats Stats
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+// Counters of the sweeper since the server started
+type Stats struct {
+	Runs int64
+	FailedRuns int64
+	AbandonedEvents int64
+}
+
+// Creates a sweeper looking for abandoned events every interval.
+// Call Start to start it.
+func NewSweeper(database db.Sweeper, policy models.AbandonmentPolicy, interval time.Duration) *Sweeper {
+	return &Sweeper{
+		database: database,
+		policy: policy,
+		interval: interval,
+		stop: make(chan struct{}),
+	}
+}
+
+func (s *Sweeper) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			s.Sweep()
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the sweeper, waiting for the ongoing sweep (if any) to finish
+func (s *Sweeper) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Marks the abandoned events now, and returns how many were marked
+func (s *Sweeper) Sweep() ([]models.AbandonedEvents, error) {
+	abandoned, err := s.database.MarkAbandoned(s.policy, time.Now())
+	total := int64(0)
+	for _, a := range abandoned {
+		total += a.Count
+	}
+	if err != nil {
+		log.Printf("unable to mark the abandoned events, will retry in %v: %s", s.interval, err)
+	}
+	if total > 0 {
+		log.Printf("Marked %d events as abandoned: %s", total, describe(abandoned))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Runs++
+	if err != nil {
+		s.stats.FailedRuns++
+	}
+	s.stats.AbandonedEvents += total
+	return abandoned, err
+}
+
+func (s *Sweeper) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// Formats the counts for the logs, e.g. "morel/checkout: 12, morel/onboarding: 3"
+func describe(abandoned []models.AbandonedEvents) string {
+	var parts []string
+	for _, a := range abandoned {
+		parts = append(parts, fmt.Sprintf("%s/%s: %d", a.Tenant, a.EventName, a.Count))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,97 @@
+package abandonment
+
+import (
+	"errors"
+	"fmt"
+	"owl_server/db/memory"
+	"owl_server/models"
+	"testing"
+	"time"
+)
+
+// Marks the events of the memory database, then fails if asked to,
+// as a database failing partway through would
+type failingSweeper struct {
+	*memory.MemoryDB
+	fail bool
+}
+
+func (s *failingSweeper) MarkAbandoned(policy models.AbandonmentPolicy, now time.Time) ([]models.AbandonedEvents, error) {
+	abandoned, err := s.MemoryDB.MarkAbandoned(policy, now)
+	if err == nil && s.fail {
+		err = errors.New("connection lost")
+	}
+	return abandoned, err
+}
+
+// Saves events of the tenant started at the time
+func startEvents(t *testing.T, database *memory.MemoryDB, tenant string, eventName string, count int, startedAt time.Time) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		err := database.InsertUpdate(tenant, models.Update{
+			UpdateType: models.UPDATE_TYPE_START,
+			EventName: eventName,
+			EventId: fmt.Sprintf("%s%d_%d", eventName, i, startedAt.UnixNano()),
+			Timestamp: startedAt.Sub(models.TIMESTAMP_REFERENCE_DATE).Milliseconds(),
+		})
+		if err != nil {
+			t.Fatalf("inserting: %v", err)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	database := &failingSweeper{MemoryDB: memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)}
+	database.Connect()
+	inactive := time.Now().Add(-2 * time.Hour)
+	policy := models.AbandonmentPolicy{Timeouts: map[string]time.Duration{"onboarding": 0}, Default: time.Hour}
+	sweeper := NewSweeper(database, policy, time.Minute)
+
+	steps := []struct {
+		name string
+		// inserts the events of the step
+		prepare func()
+		fail bool
+		wantAbandoned string
+		wantErr bool
+		wantStats Stats
+	}{
+		{
+			name: "inactive events",
+			prepare: func() {
+				startEvents(t, database.MemoryDB, "acme", "checkout", 2, inactive)
+				startEvents(t, database.MemoryDB, "globex", "checkout", 1, inactive)
+				// waited for forever
+				startEvents(t, database.MemoryDB, "acme", "onboarding", 1, inactive)
+				startEvents(t, database.MemoryDB, "acme", "checkout", 1, time.Now())
+			},
+			wantAbandoned: "[{acme checkout 2} {globex checkout 1}]",
+			wantStats: Stats{Runs: 1, AbandonedEvents: 3},
+		},
+		// abandoned events aren't marked twice
+		{name: "already marked", prepare: func() {}, wantAbandoned: "[]", wantStats: Stats{Runs: 2, AbandonedEvents: 3}},
+		{
+			// what was marked before the failure is counted
+			name: "failed",
+			prepare: func() { startEvents(t, database.MemoryDB, "acme", "checkout", 2, inactive.Add(-time.Minute)) },
+			fail: true,
+			wantAbandoned: "[{acme checkout 2}]",
+			wantErr: true,
+			wantStats: Stats{Runs: 3, FailedRuns: 1, AbandonedEvents: 5},
+		},
+	}
+	for _, step := range steps {
+		step.prepare()
+		database.fail = step.fail
+		abandoned, err := sweeper.Sweep()
+		if abandoned == nil {
+			abandoned = []models.AbandonedEvents{}
+		}
+		if got := fmt.Sprint(abandoned); got != step.wantAbandoned || (err != nil) != step.wantErr {
+			t.Errorf("%s: got %s (error %v), want %s", step.name, got, err, step.wantAbandoned)
+		}
+		if stats := sweeper.Stats(); stats != step.wantStats {
+			t.Errorf("%s: stats: got %+v, want %+v", step.name, stats, step.wantStats)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package alerting
+
+import (
+	"fmt"
+	"log"
+	"owl_server/db"
+	"owl_server/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Periodically evaluates the alert rules against the stored events, moves
+// their alerts through the pending, firing and resolved states (see
+// models.Alert.Update), saves the alerts, and notifies their webhooks.
+type Engine struct {
+	database db.Analyzer
+	rules []models.AlertRule
+	// abandonment timeouts of the events, for the abandoned rules
+	abandonment models.AbandonmentPolicy
+	interval time.Duration
+	statePath string
+	notifier *Notifier
+
+	lock sync.Mutex
+	// rule name -> alert
+	alerts map[string]*models.Alert
+	stats Stats
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+// Counters of the engine since the server started
+type Stats struct {
+	Evaluations int64
+	FailedEvaluations int64
+	Notifications int64
+	FailedNotifications int64
+	// alerts currently firing
+	Firing int64
+}
+
+// Creates an engine evaluating the rules every interval, restoring the
+// alerts saved in the state file. Call Start to start it.
+func NewEngine(database db.Analyzer, rules []models.AlertRule, abandonment models.AbandonmentPolicy, interval time.Duration, statePath string, notifier *Notifier) (*Engine, error) {
+	saved, err := loadAlerts(statePath)
+	if err != nil {
+		return nil, err
+	}
+	// the alerts of the removed rules are dropped
+	alerts := map[string]*models.Alert{}
+	now := time.Now()
+	for _, rule := range rules {
+		alert, ok := saved[rule.Name]
+		if !ok {
+			alert = models.NewAlert(rule.Name, now)
+		}
+		alerts[rule.Name] = alert
+	}
+	return &Engine{
+		database: database,
+		rules: rules,
+		abandonment: abandonment,
+		interval: interval,
+		statePath: statePath,
+		notifier: notifier,
+		alerts: alerts,
+		stop: make(chan struct{}),
+	}, nil
+}
+
+func (e *Engine) Start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			e.Evaluate(time.Now())
+			select {
+			case <-ticker.C:
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the engine, waiting for the ongoing evaluation (if any) to finish
+func (e *Engine) Stop() {
+	close(e.stop)
+	e.wg.Wait()
+}
+
+// Evaluates every rule at the given time, then sends the pending
+// notifications and saves the alerts
+func (e *Engine) Evaluate(now time.Time) {
+	for _, rule := range e.rules {
+		value, err := e.value(rule, now)
+
+		e.lock.Lock()
+		alert := e.alerts[rule.Name]
+		e.stats.Evaluations++
+		if err != nil {
+			e.stats.FailedEvaluations++
+			alert.EvaluatedAt = &now
+			alert.Error = err.Error()
+			log.Printf("unable to evaluate the alert rule %s, will retry in %v: %s", rule.Name, e.interval, err)
+		} else if alert.Update(rule, value, now) {
+			log.Printf("Alert %s is %s (%s of %s/%s: %s, threshold %v).", rule.Name, alert.State, rule.Kind, rule.Tenant, rule.EventName, formatValue(value), rule.Threshold)
+		}
+		e.lock.Unlock()
+
+		e.notify(rule)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.stats.Firing = 0
+	for _, alert := range e.alerts {
+		if alert.State == models.ALERT_FIRING {
+			e.stats.Firing++
+		}
+	}
+	err := saveAlerts(e.statePath, e.alerts)
+	if err != nil {
+		log.Printf("unable to save the alerts: %s", err)
+	}
+}
+
+// Computes the value of the rule over the events created within its
+// window. Returns nil if there were too few events.
+//
+// Events are only abandoned once their timeout has passed, so the abandoned
+// rules count the events created within their window and the abandonment
+// timeout of the name: the window alone would only hold events too recent
+// to be abandoned yet.
+func (e *Engine) value(rule models.AlertRule, now time.Time) (*float64, error) {
+	query := models.AnalyticsQuery{EventName: rule.EventName, From: now.Add(-rule.Window), To: now}
+	var value float64
+	switch rule.Kind {
+	case models.ALERT_FAILURE_RATE:
+		breakdown, err := e.database.EventResults(rule.Tenant, models.ResultQuery{AnalyticsQuery: query, SuccessResults: rule.SuccessResults})
+		if err != nil {
+			return nil, err
+		}
+		if breakdown.Overall.Events - breakdown.Overall.Unended < rule.MinEvents {
+			return nil, nil
+		}
+		value = 1 - breakdown.Overall.SuccessRate
+	case models.ALERT_P95_DURATION:
+		durations, err := e.database.EventDurations(rule.Tenant, query)
+		if err != nil {
+			return nil, err
+		}
+		if durations.Duration.Count < rule.MinEvents {
+			return nil, nil
+		}
+		value = float64(durations.Duration.P95Ms)
+	case models.ALERT_ABANDONED:
+		query.From = query.From.Add(-e.abandonment.Timeout(rule.EventName))
+		abandonment, err := e.database.Abandonment(rule.Tenant, query)
+		if err != nil {
+			return nil, err
+		}
+		value = float64(abandonment.Abandoned)
+	default:
+		return nil, fmt.Errorf("unknown rule kind %q", rule.Kind)
+	}
+	return &value, nil
+}
+
+// Sends the notification of the current state of the alert of the rule,
+// if it wasn't delivered yet. Failed notifications are retried at the
+// next evaluation.
+func (e *Engine) notify(rule models.AlertRule) {
+	e.lock.Lock()
+	alert := *e.alerts[rule.Name]
+	e.lock.Unlock()
+	if !alert.NeedsNotification() {
+		return
+	}
+
+	var err error
+	if rule.WebhookURL != "" {
+		err = e.notifier.Notify(rule, alert)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if rule.WebhookURL != "" {
+		e.stats.Notifications++
+	}
+	if err != nil {
+		e.stats.FailedNotifications++
+		log.Printf("unable to notify that alert %s is %s, will retry in %v: %s", rule.Name, alert.State, e.interval, err)
+		return
+	}
+	e.alerts[rule.Name].Notified = alert.State
+}
+
+// Returns the alerts of every rule, ordered by rule name
+func (e *Engine) Alerts() []models.Alert {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	alerts := []models.Alert{}
+	for _, alert := range e.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Rule < alerts[j].Rule })
+	return alerts
+}
+
+func (e *Engine) Stats() Stats {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.stats
+}
+
+func formatValue(value *float64) string {
+	if value == nil {
+		return "too few events"
+	}
+	return fmt.Sprintf("%v", *value)
+}
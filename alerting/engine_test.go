@@ -0,0 +1,199 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"owl_server/db/memory"
+	"owl_server/models"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_TENANT = "acme"
+
+// Client timestamp of the time
+func timestamp(t time.Time) int64 {
+	return t.Sub(models.TIMESTAMP_REFERENCE_DATE).Milliseconds()
+}
+
+// An event of the test database, created some time before the evaluation
+type testEvent struct {
+	age time.Duration
+	// end result, none if empty
+	result string
+	duration time.Duration
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	events := []testEvent{
+		{age: 5 * time.Minute, result: "success", duration: 2 * time.Second},
+		{age: 6 * time.Minute, result: "success", duration: 4 * time.Second},
+		{age: 7 * time.Minute, result: "failure", duration: 8 * time.Second},
+		{age: 8 * time.Minute, result: "success", duration: time.Second},
+		// not abandoned yet
+		{age: 20 * time.Minute},
+		// abandoned, within the window plus the timeout
+		{age: 35 * time.Minute},
+		{age: 39 * time.Minute},
+		// abandoned, too long ago
+		{age: 50 * time.Minute},
+	}
+	abandonment := models.AbandonmentPolicy{Timeouts: map[string]time.Duration{"checkout": 30 * time.Minute}}
+	tests := []struct {
+		name string
+		rule models.AlertRule
+		// nil if too few events
+		wantValue *float64
+	}{
+		{
+			name: "failure rate",
+			rule: models.AlertRule{Kind: models.ALERT_FAILURE_RATE, Window: 10 * time.Minute, MinEvents: 4, SuccessResults: []string{"success"}},
+			wantValue: value(0.25),
+		},
+		{
+			name: "other successes",
+			rule: models.AlertRule{Kind: models.ALERT_FAILURE_RATE, Window: 10 * time.Minute, MinEvents: 1, SuccessResults: []string{"success", "failure"}},
+			wantValue: value(0),
+		},
+		{
+			name: "too few ended events",
+			rule: models.AlertRule{Kind: models.ALERT_FAILURE_RATE, Window: 10 * time.Minute, MinEvents: 5, SuccessResults: []string{"success"}},
+			wantValue: nil,
+		},
+		{
+			name: "p95 duration",
+			rule: models.AlertRule{Kind: models.ALERT_P95_DURATION, Window: 10 * time.Minute, MinEvents: 1},
+			wantValue: value(8000),
+		},
+		{
+			// the window alone only holds events too recent to be abandoned
+			name: "abandoned",
+			rule: models.AlertRule{Kind: models.ALERT_ABANDONED, Window: 10 * time.Minute},
+			wantValue: value(2),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+			database.Connect()
+			for i, event := range events {
+				id := string(rune('a' + i))
+				createdAt := now.Add(-event.age)
+				updates := []models.Update{{UpdateType: models.UPDATE_TYPE_START, EventName: "checkout", EventId: id, Timestamp: timestamp(createdAt)}}
+				if event.result != "" {
+					updates = append(updates, models.Update{UpdateType: models.UPDATE_TYPE_END, EventName: "checkout", EventId: id, StepNumber: 1, Timestamp: timestamp(createdAt.Add(event.duration)), Result: event.result})
+				}
+				err := database.InsertUpdates(TEST_TENANT, updates)
+				if err != nil {
+					t.Fatalf("inserting: %v", err)
+				}
+			}
+			_, err := database.MarkAbandoned(abandonment, now)
+			if err != nil {
+				t.Fatalf("marking the abandoned events: %v", err)
+			}
+
+			rule := test.rule
+			rule.Name, rule.Tenant, rule.EventName, rule.Threshold = "rule", TEST_TENANT, "checkout", 1_000_000
+			engine, err := NewEngine(database, []models.AlertRule{rule}, abandonment, time.Minute, filepath.Join(t.TempDir(), "alerts.json"), NewNotifier(time.Second))
+			if err != nil {
+				t.Fatalf("creating the engine: %v", err)
+			}
+			engine.Evaluate(now)
+
+			alert := engine.Alerts()[0]
+			if alert.Error != "" {
+				t.Fatalf("evaluation failed: %s", alert.Error)
+			}
+			if formatValue(alert.Value) != formatValue(test.wantValue) {
+				t.Errorf("value: got %s, want %s", formatValue(alert.Value), formatValue(test.wantValue))
+			}
+		})
+	}
+}
+
+// Notifications are sent when the alert fires, retried until they are
+// delivered, and the alerts survive a restart
+func TestNotifications(t *testing.T) {
+	var lock sync.Mutex
+	received := []models.AlertState{}
+	// answers of the webhook, in turn, then 200
+	statuses := []int{http.StatusInternalServerError}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		var body notification
+		json.NewDecoder(r.Body).Decode(&body)
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		if status == http.StatusOK {
+			received = append(received, body.State)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+	database.Connect()
+	rule := models.AlertRule{Name: "abandoned", Tenant: TEST_TENANT, EventName: "checkout", Kind: models.ALERT_ABANDONED, Window: time.Hour, Threshold: 0, WebhookURL: server.URL}
+	abandonment := models.AbandonmentPolicy{Default: time.Minute}
+	statePath := filepath.Join(t.TempDir(), "alerts.json")
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	engine, err := NewEngine(database, []models.AlertRule{rule}, abandonment, time.Minute, statePath, NewNotifier(time.Second))
+	if err != nil {
+		t.Fatalf("creating the engine: %v", err)
+	}
+
+	steps := []struct {
+		name string
+		// events abandoned before the evaluation
+		abandoned int
+		wantState models.AlertState
+		wantReceived []models.AlertState
+	}{
+		{name: "inactive", wantState: models.ALERT_INACTIVE, wantReceived: []models.AlertState{}},
+		// the webhook fails the first time
+		{name: "firing", abandoned: 1, wantState: models.ALERT_FIRING, wantReceived: []models.AlertState{}},
+		{name: "retried", wantState: models.ALERT_FIRING, wantReceived: []models.AlertState{models.ALERT_FIRING}},
+		{name: "not sent twice", wantState: models.ALERT_FIRING, wantReceived: []models.AlertState{models.ALERT_FIRING}},
+	}
+	for i, step := range steps {
+		for j := 0; j < step.abandoned; j++ {
+			database.InsertUpdate(TEST_TENANT, models.Update{UpdateType: models.UPDATE_TYPE_START, EventName: "checkout", EventId: step.name, Timestamp: timestamp(now.Add(-2 * time.Minute))})
+			database.MarkAbandoned(abandonment, now)
+		}
+		engine.Evaluate(now)
+		now = now.Add(time.Minute)
+
+		alert := engine.Alerts()[0]
+		lock.Lock()
+		got := append([]models.AlertState{}, received...)
+		lock.Unlock()
+		if alert.State != step.wantState || fmt.Sprint(got) != fmt.Sprint(step.wantReceived) {
+			t.Fatalf("step %d (%s): got %s and notifications %v, want %s and %v", i, step.name, alert.State, got, step.wantState, step.wantReceived)
+		}
+	}
+	if stats := engine.Stats(); stats.Notifications != 2 || stats.FailedNotifications != 1 || stats.Firing != 1 {
+		t.Errorf("stats: got %+v", stats)
+	}
+
+	// restarted: the delivered notification isn't sent again
+	engine, err = NewEngine(database, []models.AlertRule{rule}, abandonment, time.Minute, statePath, NewNotifier(time.Second))
+	if err != nil {
+		t.Fatalf("restarting the engine: %v", err)
+	}
+	if alert := engine.Alerts()[0]; alert.State != models.ALERT_FIRING || alert.NeedsNotification() {
+		t.Errorf("restored alert: got %+v", alert)
+	}
+}
+
+func value(v float64) *float64 {
+	return &v
+}
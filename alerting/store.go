@@ -0,0 +1,55 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"owl_server/models"
+	"path/filepath"
+	"sort"
+)
+
+// Reads the alerts saved in the given file, by rule name.
+// Returns no alerts if the file doesn't exist yet.
+func loadAlerts(path string) (map[string]*models.Alert, error) {
+	alerts := map[string]*models.Alert{}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return alerts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the alerts. Underlying error: %w", err)
+	}
+	var saved []*models.Alert
+	err = json.Unmarshal(content, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the alerts file %s. Underlying error: %w", path, err)
+	}
+	for _, alert := range saved {
+		alerts[alert.Rule] = alert
+	}
+	return alerts, nil
+}
+
+// Writes the alerts to the file, atomically
+func saveAlerts(path string, alerts map[string]*models.Alert) error {
+	saved := []*models.Alert{}
+	for _, alert := range alerts {
+		saved = append(saved, alert)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Rule < saved[j].Rule })
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to save the alerts. Underlying error: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,67 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"owl_server/models"
+	"time"
+)
+
+// Body of the notifications POSTed to the webhooks
+type notification struct {
+	Rule string `json:"rule"`
+	Tenant string `json:"tenant"`
+	EventName string `json:"eventName"`
+	Kind string `json:"kind"`
+	Window string `json:"window"`
+	Threshold float64 `json:"threshold"`
+	// "firing" or "resolved"
+	State models.AlertState `json:"state"`
+	Value *float64 `json:"value"`
+	Since time.Time `json:"since"`
+	FiredAt *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// Sends the notifications of the alerts to the webhooks of their rules
+type Notifier struct {
+	client *http.Client
+}
+
+func NewNotifier(timeout time.Duration) *Notifier {
+	return &Notifier{client: &http.Client{Timeout: timeout}}
+}
+
+// POSTs the current state of the alert to the webhook of the rule.
+// Responses other than 2xx are errors.
+func (n *Notifier) Notify(rule models.AlertRule, alert models.Alert) error {
+	body, err := json.Marshal(notification{
+		Rule: rule.Name,
+		Tenant: rule.Tenant,
+		EventName: rule.EventName,
+		Kind: rule.Kind,
+		Window: rule.Window.String(),
+		Threshold: rule.Threshold,
+		State: alert.State,
+		Value: alert.Value,
+		Since: alert.Since,
+		FiredAt: alert.FiredAt,
+		ResolvedAt: alert.ResolvedAt,
+	})
+	if err != nil {
+		return err
+	}
+	response, err := n.client.Post(rule.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64 << 10))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("the webhook answered %s", response.Status)
+	}
+	return nil
+}
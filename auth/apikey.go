@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"net/http"
+	"owl_server/tenants"
+)
+
+// Header carrying the API key identifying the tenant of a request
+const API_KEY_HEADER = "X-API-Key"
+
+// Authenticates requests with the API keys issued to the tenants
+// (see tenants.KeyStore), sent in the X-API-Key header.
+type APIKeyAuthenticator struct {
+	keys *tenants.KeyStore
+}
+
+func NewAPIKeyAuthenticator(keys *tenants.KeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request, body []byte) (string, error) {
+	key := r.Header.Get(API_KEY_HEADER)
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	tenant, ok := a.keys.Lookup(key)
+	if !ok {
+		return "", unauthorized("invalid or revoked API key")
+	}
+	return tenant, nil
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"owl_server/config"
+	"owl_server/tenants"
+)
+
+// Names of the authentication methods, as listed in the auth.methods setting
+const METHOD_API_KEY = "apikey"
+const METHOD_BEARER = "bearer"
+const METHOD_HMAC = "hmac"
+
+// Returned by an Authenticator when the request doesn't carry
+// the kind of credentials it handles
+var ErrNoCredentials = fmt.Errorf("no credentials")
+
+// Returned by an Authenticator when the request carries credentials it
+// handles, but they are not valid.
+type Error struct {
+	// http.StatusUnauthorized if the credentials are unknown,
+	// http.StatusForbidden if they are known but the request is refused
+	// (wrong signature, expired or replayed request, ...)
+	Status int
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+func unauthorized(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusUnauthorized, Reason: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusForbidden, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Identifies the tenant of a request from its credentials.
+type Authenticator interface {
+	// Returns the tenant of the request, given its (already read) body.
+	// Returns ErrNoCredentials if the request doesn't carry credentials
+	// handled by this authenticator, or an *Error if they are invalid.
+	Authenticate(r *http.Request, body []byte) (string, error)
+}
+
+// Creates the authenticators of the methods listed in the configuration, in order.
+func NewAuthenticators(cfg config.AuthConfig, keys *tenants.KeyStore) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, method := range cfg.Methods {
+		switch method {
+		case METHOD_API_KEY:
+			authenticators = append(authenticators, NewAPIKeyAuthenticator(keys))
+		case METHOD_BEARER:
+			authenticators = append(authenticators, NewBearerAuthenticator(cfg.BearerTokens))
+		case METHOD_HMAC:
+			authenticators = append(authenticators, NewHMACAuthenticator(cfg.HMACKeys, cfg.ReplayWindow.Duration()))
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return authenticators, nil
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"owl_server/config"
+	"owl_server/tenants"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const TEST_BODY = `[{"updateType": "start"}]`
+
+// Signs the body as a client would
+func sign(secret string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the tenant (or the status of the error) returned for the request
+func check(t *testing.T, tenant string, err error, wantTenant string, wantStatus int) {
+	t.Helper()
+	switch {
+	case wantStatus == 0 && err != nil:
+		t.Errorf("got error %v, want tenant %q", err, wantTenant)
+	case wantStatus == 0 && tenant != wantTenant:
+		t.Errorf("tenant: got %q, want %q", tenant, wantTenant)
+	case wantStatus == -1 && err != ErrNoCredentials:
+		t.Errorf("got %q, %v, want ErrNoCredentials", tenant, err)
+	case wantStatus > 0:
+		authError, ok := err.(*Error)
+		if !ok || authError.Status != wantStatus {
+			t.Errorf("got %q, %v, want an error with status %d", tenant, err, wantStatus)
+		}
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	signedAt := strconv.FormatInt(now.Unix(), 10)
+	keys := []config.HMACKey{{ID: "k1", Secret: "s3cret", Tenant: "acme"}}
+	tests := []struct {
+		name string
+		headers map[string]string
+		body string
+		// the request is received a second time
+		replayed bool
+		wantTenant string
+		// -1 for ErrNoCredentials
+		wantStatus int
+	}{
+		{
+			name: "valid",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: sign("s3cret", signedAt, TEST_BODY)},
+			wantTenant: "acme",
+		},
+		{
+			name: "prefixed signature",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: "sha256=" + sign("s3cret", signedAt, TEST_BODY)},
+			wantTenant: "acme",
+		},
+		{name: "no credentials", headers: map[string]string{}, wantStatus: -1},
+		{
+			name: "missing header",
+			headers: map[string]string{KEY_ID_HEADER: "k1", SIGNATURE_HEADER: sign("s3cret", signedAt, TEST_BODY)},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown key",
+			headers: map[string]string{KEY_ID_HEADER: "k2", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: sign("s3cret", signedAt, TEST_BODY)},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "not hex",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: "zz"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong secret",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: sign("other", signedAt, TEST_BODY)},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "modified body",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: sign("s3cret", signedAt, TEST_BODY)},
+			body: TEST_BODY + " ",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "expired",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: "1799999000", SIGNATURE_HEADER: sign("s3cret", "1799999000", TEST_BODY)},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "in the future",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: "1800001000", SIGNATURE_HEADER: sign("s3cret", "1800001000", TEST_BODY)},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "replayed",
+			headers: map[string]string{KEY_ID_HEADER: "k1", TIMESTAMP_HEADER: signedAt, SIGNATURE_HEADER: sign("s3cret", signedAt, TEST_BODY)},
+			replayed: true,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := NewHMACAuthenticator(keys, 5 * time.Minute)
+			authenticator.now = func() time.Time { return now }
+			body := test.body
+			if body == "" {
+				body = TEST_BODY
+			}
+			request := httptest.NewRequest(http.MethodPost, "/receive", nil)
+			for header, value := range test.headers {
+				request.Header.Set(header, value)
+			}
+			tenant, err := authenticator.Authenticate(request, []byte(body))
+			if test.replayed {
+				if err != nil {
+					t.Fatalf("first request: %v", err)
+				}
+				tenant, err = authenticator.Authenticate(request, []byte(body))
+			}
+			check(t, tenant, err, test.wantTenant, test.wantStatus)
+		})
+	}
+}
+
+// Signatures are forgotten once out of the replay window, when
+// the timestamp check refuses them anyway
+func TestHMACReplaySweep(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	authenticator := NewHMACAuthenticator([]config.HMACKey{{ID: "k1", Secret: "s3cret", Tenant: "acme"}}, time.Minute)
+	authenticator.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		request := httptest.NewRequest(http.MethodPost, "/receive", nil)
+		request.Header.Set(KEY_ID_HEADER, "k1")
+		request.Header.Set(TIMESTAMP_HEADER, timestamp)
+		request.Header.Set(SIGNATURE_HEADER, sign("s3cret", timestamp, TEST_BODY))
+		_, err := authenticator.Authenticate(request, []byte(TEST_BODY))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		now = now.Add(2 * time.Minute)
+	}
+	if len(authenticator.seen) != 1 {
+		t.Errorf("remembered signatures: got %d, want 1", len(authenticator.seen))
+	}
+}
+
+func TestBearerAuthenticator(t *testing.T) {
+	authenticator := NewBearerAuthenticator([]config.BearerToken{{Token: "t1", Tenant: "acme"}, {Token: "t2", Tenant: "globex"}})
+	tests := []struct {
+		name string
+		authorization string
+		wantTenant string
+		wantStatus int
+	}{
+		{name: "first token", authorization: "Bearer t1", wantTenant: "acme"},
+		{name: "second token", authorization: "Bearer t2", wantTenant: "globex"},
+		{name: "no credentials", authorization: "", wantStatus: -1},
+		{name: "other scheme", authorization: "Basic dXNlcjpwYXNz", wantStatus: -1},
+		{name: "unknown token", authorization: "Bearer t3", wantStatus: http.StatusUnauthorized},
+		{name: "prefix of a token", authorization: "Bearer t", wantStatus: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/events", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			tenant, err := authenticator.Authenticate(request, nil)
+			check(t, tenant, err, test.wantTenant, test.wantStatus)
+		})
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	keys, err := tenants.OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("opening the key store: %v", err)
+	}
+	acmeKey, _, err := keys.Issue("acme", "")
+	if err != nil {
+		t.Fatalf("issuing a key: %v", err)
+	}
+	revokedKey, revoked, err := keys.Issue("globex", "")
+	if err != nil {
+		t.Fatalf("issuing a key: %v", err)
+	}
+	err = keys.Revoke(revoked.ID)
+	if err != nil {
+		t.Fatalf("revoking a key: %v", err)
+	}
+	authenticator := NewAPIKeyAuthenticator(keys)
+	tests := []struct {
+		name string
+		key string
+		wantTenant string
+		wantStatus int
+	}{
+		{name: "issued", key: acmeKey, wantTenant: "acme"},
+		{name: "no credentials", key: "", wantStatus: -1},
+		{name: "revoked", key: revokedKey, wantStatus: http.StatusUnauthorized},
+		{name: "unknown", key: tenants.API_KEY_PREFIX + "unknown", wantStatus: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/events", nil)
+			if test.key != "" {
+				request.Header.Set(API_KEY_HEADER, test.key)
+			}
+			tenant, err := authenticator.Authenticate(request, nil)
+			check(t, tenant, err, test.wantTenant, test.wantStatus)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"owl_server/config"
+	"strings"
+)
+
+// Authenticates requests with static tokens set in the configuration,
+// sent as "Authorization: Bearer <token>".
+type BearerAuthenticator struct {
+	tokens []config.BearerToken
+}
+
+func NewBearerAuthenticator(tokens []config.BearerToken) *BearerAuthenticator {
+	return &BearerAuthenticator{tokens: tokens}
+}
+
+func (a *BearerAuthenticator) Authenticate(r *http.Request, body []byte) (string, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return "", ErrNoCredentials
+	}
+	// Compare against every token, in constant time, to not leak which prefix matched
+	tenant := ""
+	for _, candidate := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate.Token)) == 1 {
+			tenant = candidate.Tenant
+		}
+	}
+	if tenant == "" {
+		return "", unauthorized("invalid bearer token")
+	}
+	return tenant, nil
+}
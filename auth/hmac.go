@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"owl_server/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request
+const KEY_ID_HEADER = "X-Owl-Key-Id"
+// Unix time, in seconds, at which the request was signed
+const TIMESTAMP_HEADER = "X-Owl-Timestamp"
+// Hex encoded HMAC-SHA256 of "<timestamp>.<body>", optionally prefixed by "sha256="
+const SIGNATURE_HEADER = "X-Owl-Signature"
+
+// Authenticates requests whose body is signed with HMAC-SHA256.
+//
+// The client signs "<timestamp>.<body>" with the secret of its key, and sends
+// the key ID, the timestamp and the signature in the X-Owl-* headers.
+// Requests signed more than the replay window ago (or in the future), and
+// requests already received within the replay window, are refused.
+type HMACAuthenticator struct {
+	// key ID -> key
+	keys map[string]config.HMACKey
+	window time.Duration
+	now func() time.Time
+
+	lock sync.Mutex
+	// signature -> time after which it can be forgotten
+	seen map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewHMACAuthenticator(keys []config.HMACKey, window time.Duration) *HMACAuthenticator {
+	byID := map[string]config.HMACKey{}
+	for _, key := range keys {
+		byID[key.ID] = key
+	}
+	return &HMACAuthenticator{
+		keys: byID,
+		window: window,
+		now: time.Now,
+		seen: map[string]time.Time{},
+	}
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request, body []byte) (string, error) {
+	keyID := r.Header.Get(KEY_ID_HEADER)
+	timestamp := r.Header.Get(TIMESTAMP_HEADER)
+	signature := strings.TrimPrefix(r.Header.Get(SIGNATURE_HEADER), "sha256=")
+	if keyID == "" && timestamp == "" && signature == "" {
+		return "", ErrNoCredentials
+	}
+	if keyID == "" || timestamp == "" || signature == "" {
+		return "", unauthorized("signed requests need the %s, %s and %s headers", KEY_ID_HEADER, TIMESTAMP_HEADER, SIGNATURE_HEADER)
+	}
+	key, ok := a.keys[keyID]
+	if !ok {
+		return "", unauthorized("unknown signing key %q", keyID)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", unauthorized("invalid %s header, expected a unix time in seconds", TIMESTAMP_HEADER)
+	}
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", unauthorized("invalid %s header, expected a hex encoded signature", SIGNATURE_HEADER)
+	}
+
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	if !hmac.Equal(decoded, mac.Sum(nil)) {
+		return "", forbidden("signature mismatch")
+	}
+
+	now := a.now()
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-a.window)) || signedAt.After(now.Add(a.window)) {
+		return "", forbidden("request timestamp outside the %v replay window", a.window)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if now.Sub(a.lastSweep) > a.window {
+		for seenSignature, expiry := range a.seen {
+			if now.After(expiry) {
+				delete(a.seen, seenSignature)
+			}
+		}
+		a.lastSweep = now
+	}
+	if _, replayed := a.seen[string(decoded)]; replayed {
+		return "", forbidden("request already received")
+	}
+	// The timestamp check refuses the request once it is out of the window
+	a.seen[string(decoded)] = signedAt.Add(a.window)
+	return key.Tenant, nil
+}
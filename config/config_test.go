@@ -0,0 +1,174 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Settings are taken, in increasing order of precedence, from the defaults,
+// the configuration file, the environment variables and the flags
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		// content of the configuration file, none if empty
+		file string
+		env map[string]string
+		args []string
+		check func(t *testing.T, c Config)
+		// substring of the expected error
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c Config) {
+				if c.ListenAddress != ":3030" || c.Queue.Capacity != 1000 || !c.Auth.Required {
+					t.Errorf("got %s, %d, %v, want the defaults", c.ListenAddress, c.Queue.Capacity, c.Auth.Required)
+				}
+			},
+		},
+		{
+			name: "file",
+			file: `{"listenAddress": ":4000", "queue": {"capacity": 10}}`,
+			check: func(t *testing.T, c Config) {
+				if c.ListenAddress != ":4000" || c.Queue.Capacity != 10 {
+					t.Errorf("got %s, %d, want the file values", c.ListenAddress, c.Queue.Capacity)
+				}
+				// the other settings of the section keep their default
+				if c.Queue.Workers != 0 || c.Spool.Dir != "data/spool" {
+					t.Errorf("got %d, %s, want the defaults", c.Queue.Workers, c.Spool.Dir)
+				}
+			},
+		},
+		{
+			name: "environment over file",
+			file: `{"listenAddress": ":4000", "queue": {"capacity": 10}}`,
+			env: map[string]string{"OWL_QUEUE_CAPACITY": "20"},
+			check: func(t *testing.T, c Config) {
+				if c.ListenAddress != ":4000" || c.Queue.Capacity != 20 {
+					t.Errorf("got %s, %d, want :4000, 20", c.ListenAddress, c.Queue.Capacity)
+				}
+			},
+		},
+		{
+			name: "flags over environment",
+			file: `{"listenAddress": ":4000", "queue": {"capacity": 10}}`,
+			env: map[string]string{"OWL_QUEUE_CAPACITY": "20", "OWL_LISTEN": ":5000"},
+			args: []string{"-queue-capacity", "30"},
+			check: func(t *testing.T, c Config) {
+				if c.ListenAddress != ":5000" || c.Queue.Capacity != 30 {
+					t.Errorf("got %s, %d, want :5000, 30", c.ListenAddress, c.Queue.Capacity)
+				}
+			},
+		},
+		{
+			name: "boolean flag",
+			env: map[string]string{"OWL_REQUIRE_AUTH": "false"},
+			args: []string{"-require-auth"},
+			check: func(t *testing.T, c Config) {
+				if !c.Auth.Required {
+					t.Errorf("got auth not required, want the flag to win")
+				}
+			},
+		},
+		{
+			name: "boolean environment variable",
+			env: map[string]string{"OWL_REQUIRE_AUTH": "false"},
+			check: func(t *testing.T, c Config) {
+				if c.Auth.Required {
+					t.Errorf("got auth required, want the environment variable to win")
+				}
+			},
+		},
+		{
+			name: "lists and maps",
+			file: `{"abandonment": {"timeouts": {"checkout": "1h"}}}`,
+			args: []string{"-auth-methods", "hmac, bearer", "-abandonment-timeouts", "checkout=30m,onboarding=24h", "-dedupe-window", "1m"},
+			check: func(t *testing.T, c Config) {
+				if strings.Join(c.Auth.Methods, ",") != "hmac,bearer" {
+					t.Errorf("methods: got %v", c.Auth.Methods)
+				}
+				timeouts := c.Abandonment.Timeouts
+				if len(timeouts) != 2 || timeouts["checkout"] != Duration(30 * time.Minute) || timeouts["onboarding"] != Duration(24 * time.Hour) {
+					t.Errorf("timeouts: got %v, want the flag to replace the file", timeouts)
+				}
+				if c.Dedupe.Window != Duration(time.Minute) {
+					t.Errorf("dedupe window: got %v", c.Dedupe.Window)
+				}
+			},
+		},
+		{name: "unknown field", file: `{"listenAdress": ":4000"}`, wantErr: "unknown field"},
+		{name: "invalid environment variable", env: map[string]string{"OWL_QUEUE_CAPACITY": "many"}, wantErr: "invalid OWL_QUEUE_CAPACITY"},
+		{name: "invalid flag", args: []string{"-dedupe-window", "10"}, wantErr: "invalid -dedupe-window"},
+		{name: "invalid map entry", args: []string{"-retention-events", "checkout"}, wantErr: `invalid retention "checkout"`},
+		{name: "unlimited spool", args: []string{"-spool-max-bytes", "0"}, check: func(t *testing.T, c Config) {}},
+		{name: "spool of a single segment", args: []string{"-spool-segment-bytes", "1000", "-spool-max-bytes", "1000"}, wantErr: "spool.maxBytes must be 0 (no limit) or at least twice"},
+		{name: "unknown flag", args: []string{"-nope", "1"}, wantErr: "flag provided but not defined"},
+		{
+			name: "invalid configuration",
+			file: `{"listenAddress": "nowhere", "queue": {"capacity": 10}}`,
+			args: []string{"-merge-policy", "random"},
+			wantErr: `listenAddress "nowhere" must be host:port`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := []string{"-backend", "memory"}
+			if test.file != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				err := os.WriteFile(path, []byte(test.file), 0o644)
+				if err != nil {
+					t.Fatalf("writing the configuration file: %v", err)
+				}
+				t.Setenv(envName(CONFIG_FILE_SETTING), path)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			c, err := Load(append(args, test.args...))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loading: %v", err)
+			}
+			test.check(t, c)
+		})
+	}
+}
+
+// The -config flag takes precedence over OWL_CONFIG
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	fromEnv := filepath.Join(dir, "env.json")
+	fromFlag := filepath.Join(dir, "flag.json")
+	os.WriteFile(fromEnv, []byte(`{"listenAddress": ":4000"}`), 0o644)
+	os.WriteFile(fromFlag, []byte(`{"listenAddress": ":5000"}`), 0o644)
+	tests := []struct {
+		name string
+		env string
+		args []string
+		want string
+	}{
+		{name: "environment", env: fromEnv, want: ":4000"},
+		{name: "flag", args: []string{"-config", fromFlag}, want: ":5000"},
+		{name: "both", env: fromEnv, args: []string{"-config", fromFlag}, want: ":5000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(envName(CONFIG_FILE_SETTING), test.env)
+			c, err := Load(append([]string{"-backend", "memory"}, test.args...))
+			if err != nil {
+				t.Fatalf("loading: %v", err)
+			}
+			if c.ListenAddress != test.want {
+				t.Errorf("got %s, want %s", c.ListenAddress, test.want)
+			}
+		})
+	}
+}
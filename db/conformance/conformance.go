@@ -0,0 +1,1474 @@
+// Conformance suite for db.DB backends.
+//
+// Every backend must read back the same events for the same updates,
+// whatever the order in which the updates arrive. The suite feeds
+// scripted and randomized update sequences to a backend, and checks
+// what GetEvent, GetSteps, GetLabels and ListEvents return.
+//
+// Backends run it from their tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, func(t *testing.T, mergePolicy models.MergePolicy) db.DB { ... })
+//	}
+package conformance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"owl_server/db"
+	"owl_server/models"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Environment variable fixing the seed of the randomized scenarios,
+// to replay a failure. By default a new seed is picked (and logged) every run.
+const SEED_ENV = "OWL_TEST_SEED"
+
+// Number of random events, and of orderings of their updates,
+// checked by the randomized scenarios.
+const (
+	RANDOM_EVENTS = 20
+	RANDOM_ORDERINGS = 5
+)
+
+// First client timestamp used by the scenarios
+// (milliseconds since the reference date, in 2026).
+const BASE_TIMESTAMP int64 = 800_000_000_000
+
+// Returns a connected database, applying the given merge policy.
+// The suite doesn't disconnect it: the factory registers the
+// cleanup it needs with t.Cleanup.
+type Factory func(t *testing.T, mergePolicy models.MergePolicy) db.DB
+
+// Runs the whole suite against the databases returned by newDB.
+//
+// Each scenario writes to its own tenant, with a name unique to the run,
+// so the suite can run against a database holding other data
+// (or the data of previous runs).
+func Run(t *testing.T, newDB Factory) {
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	s := &suite{
+		db: newDB(t, models.MERGE_LAST_WRITER_WINS),
+		mergePolicy: models.MERGE_LAST_WRITER_WINS,
+		run: run + "_0",
+	}
+
+	t.Run("OrderedLifecycle", s.testOrderedLifecycle)
+	t.Run("LabelBeforeStep", s.testLabelBeforeStep)
+	t.Run("StepBeforeStart", s.testStepBeforeStart)
+	t.Run("EndFirst", s.testEndFirst)
+	t.Run("SameStepNumber", s.testSameStepNumber)
+	t.Run("MillisecondPrecision", s.testMillisecondPrecision)
+	t.Run("MissingEvent", s.testMissingEvent)
+	t.Run("UnknownUpdateType", s.testUnknownUpdateType)
+	t.Run("Replay", s.testReplay)
+	t.Run("ConcurrentDuplicates", s.testConcurrentDuplicates)
+	t.Run("ListEvents", s.testListEvents)
+	t.Run("TenantIsolation", s.testTenantIsolation)
+	t.Run("Retention", s.testRetention)
+	t.Run("Abandonment", s.testAbandonment)
+	t.Run("DurationAnalytics", s.testDurationAnalytics)
+	t.Run("Funnel", s.testFunnel)
+	t.Run("ResultBreakdown", s.testResultBreakdown)
+
+	// scenarios where updates set the same values: the result depends on the policy
+	for i, policy := range models.MERGE_POLICIES {
+		t.Run(string(policy), func(t *testing.T) {
+			s := &suite{
+				db: newDB(t, policy),
+				mergePolicy: policy,
+				run: fmt.Sprintf("%s_%d", run, i + 1),
+			}
+			t.Run("ConflictingUpdates", s.testConflictingUpdates)
+			t.Run("RandomOrderings", s.testRandomOrderings)
+		})
+	}
+}
+
+type suite struct {
+	db db.DB
+	mergePolicy models.MergePolicy
+	// unique to the run (and the database), part of every tenant name
+	run string
+	tenants int
+}
+
+// Returns a tenant no other scenario (of any run) writes to.
+func (s *suite) tenant() string {
+	s.tenants++
+	return fmt.Sprintf("conformance_%s_%d", s.run, s.tenants)
+}
+
+// Picks the expected value: the first one for
+// MERGE_FIRST_WRITER_WINS, the last one for MERGE_LAST_WRITER_WINS.
+func pick[V any](policy models.MergePolicy, first V, last V) V {
+	if policy.FirstWriterWins() {
+		return first
+	}
+	return last
+}
+
+// Client timestamp offset by the given number of milliseconds.
+func ts(offset int64) int64 {
+	return BASE_TIMESTAMP + offset
+}
+
+// Time the backends should return for a client timestamp.
+func at(offset int64) *time.Time {
+	t := models.TimestampToTime(ts(offset))
+	return &t
+}
+
+func start(name string, id string, offset int64) models.Update {
+	return models.Update{EventName: name, EventId: id, UpdateType: models.UPDATE_TYPE_START, Timestamp: ts(offset)}
+}
+
+func step(name string, id string, stepName string, number int, offset int64) models.Update {
+	return models.Update{EventName: name, EventId: id, UpdateType: models.UPDATE_TYPE_STEP, Timestamp: ts(offset), StepName: stepName, StepNumber: number}
+}
+
+func label(name string, id string, stepName string, number int, key string, val string) models.Update {
+	return models.Update{EventName: name, EventId: id, UpdateType: models.UPDATE_TYPE_LABEL, StepName: stepName, StepNumber: number, LabelKey: key, LabelVal: val}
+}
+
+func end(name string, id string, number int, offset int64, result string) models.Update {
+	return models.Update{EventName: name, EventId: id, UpdateType: models.UPDATE_TYPE_END, Timestamp: ts(offset), StepNumber: number, Result: result}
+}
+
+// Returns the update with the given sequence number.
+func seq(update models.Update, sequence int64) models.Update {
+	update.Sequence = sequence
+	return update
+}
+
+// Step expected to be read back. creationTime is nil for steps
+// only created by a label.
+func expectedStep(name string, number int, creationTime *time.Time, labels ...models.Label) models.Step {
+	if labels == nil {
+		labels = []models.Label{}
+	}
+	for i := range labels {
+		labels[i].StepName = name
+		labels[i].StepNumber = number
+	}
+	return models.Step{Name: name, Number: number, CreationTime: creationTime, Labels: labels}
+}
+
+func kv(key string, val string) models.Label {
+	return models.Label{Key: key, Val: val}
+}
+
+// Inserts the updates one by one, failing the test on error.
+func (s *suite) insert(t *testing.T, tenant string, updates ...models.Update) {
+	t.Helper()
+	for i, update := range updates {
+		err := s.db.InsertUpdate(tenant, update)
+		if err != nil {
+			t.Fatalf("inserting update %d (%+v): %v", i, update, err)
+		}
+	}
+}
+
+// Checks that GetEvent, GetSteps and GetLabels all return the expected event.
+func (s *suite) expectEvent(t *testing.T, tenant string, expected models.Event) {
+	t.Helper()
+	event, err := s.db.GetEvent(tenant, expected.Name, expected.Id)
+	if err != nil {
+		t.Fatalf("GetEvent(%s, %s): %v", expected.Name, expected.Id, err)
+	}
+	if event == nil {
+		t.Fatalf("GetEvent(%s, %s): event not found", expected.Name, expected.Id)
+	}
+	if diff := diffEvents(expected, *event); diff != "" {
+		t.Errorf("GetEvent(%s, %s) mismatch:\n%s", expected.Name, expected.Id, diff)
+	}
+
+	steps, err := s.db.GetSteps(tenant, expected.Name, expected.Id)
+	if err != nil {
+		t.Fatalf("GetSteps(%s, %s): %v", expected.Name, expected.Id, err)
+	}
+	if diff := diffSteps(expected.Steps, steps); diff != "" {
+		t.Errorf("GetSteps(%s, %s) mismatch:\n%s", expected.Name, expected.Id, diff)
+	}
+
+	expectedLabels := []models.Label{}
+	for _, step := range expected.Steps {
+		expectedLabels = append(expectedLabels, step.Labels...)
+	}
+	labels, err := s.db.GetLabels(tenant, expected.Name, expected.Id)
+	if err != nil {
+		t.Fatalf("GetLabels(%s, %s): %v", expected.Name, expected.Id, err)
+	}
+	if !reflect.DeepEqual(normalizeLabels(expectedLabels), normalizeLabels(labels)) {
+		t.Errorf("GetLabels(%s, %s) mismatch:\nexpected %+v\ngot      %+v", expected.Name, expected.Id, expectedLabels, labels)
+	}
+}
+
+func (s *suite) testOrderedLifecycle(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		start("checkout", "e1", 0),
+		step("checkout", "e1", "cart", 1, 100),
+		label("checkout", "e1", "cart", 1, "items", "3"),
+		label("checkout", "e1", "cart", 1, "currency", "EUR"),
+		step("checkout", "e1", "payment", 2, 250),
+		label("checkout", "e1", "payment", 2, "method", "card"),
+		end("checkout", "e1", 3, 400, "success"),
+	)
+	s.expectEvent(t, tenant, models.Event{
+		Name: "checkout",
+		Id: "e1",
+		CreationTime: at(0),
+		Result: "success",
+		Steps: []models.Step{
+			expectedStep("cart", 1, at(100), kv("currency", "EUR"), kv("items", "3")),
+			expectedStep("payment", 2, at(250), kv("method", "card")),
+			expectedStep("end", 3, at(400)),
+		},
+	})
+}
+
+func (s *suite) testLabelBeforeStep(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		start("login", "e1", 0),
+		label("login", "e1", "form", 1, "provider", "google"),
+	)
+	// until its step update arrives, the step has no creation time
+	s.expectEvent(t, tenant, models.Event{
+		Name: "login",
+		Id: "e1",
+		CreationTime: at(0),
+		Steps: []models.Step{
+			expectedStep("form", 1, nil, kv("provider", "google")),
+		},
+	})
+
+	s.insert(t, tenant, step("login", "e1", "form", 1, 50))
+	s.expectEvent(t, tenant, models.Event{
+		Name: "login",
+		Id: "e1",
+		CreationTime: at(0),
+		Steps: []models.Step{
+			expectedStep("form", 1, at(50), kv("provider", "google")),
+		},
+	})
+}
+
+func (s *suite) testStepBeforeStart(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant, step("search", "e1", "query", 1, 20))
+	// the event exists, without creation time
+	s.expectEvent(t, tenant, models.Event{
+		Name: "search",
+		Id: "e1",
+		Steps: []models.Step{
+			expectedStep("query", 1, at(20)),
+		},
+	})
+
+	s.insert(t, tenant, start("search", "e1", 0))
+	s.expectEvent(t, tenant, models.Event{
+		Name: "search",
+		Id: "e1",
+		CreationTime: at(0),
+		Steps: []models.Step{
+			expectedStep("query", 1, at(20)),
+		},
+	})
+}
+
+func (s *suite) testEndFirst(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		end("upload", "e1", 2, 900, "failure"),
+		label("upload", "e1", "send", 1, "size", "12MB"),
+		step("upload", "e1", "send", 1, 300),
+		start("upload", "e1", 0),
+	)
+	s.expectEvent(t, tenant, models.Event{
+		Name: "upload",
+		Id: "e1",
+		CreationTime: at(0),
+		Result: "failure",
+		Steps: []models.Step{
+			expectedStep("send", 1, at(300), kv("size", "12MB")),
+			expectedStep("end", 2, at(900)),
+		},
+	})
+}
+
+// Several updates set the same values, in every order.
+// The stored event must only depend on the merge policy.
+func (s *suite) testConflictingUpdates(t *testing.T) {
+	updates := []models.Update{
+		seq(start("sync", "e1", 0), 1),
+		seq(start("sync", "e1", 5), 2),
+		// the sequence decides, not the timestamp
+		seq(step("sync", "e1", "fetch", 1, 20), 3),
+		seq(step("sync", "e1", "fetch", 1, 10), 4),
+		seq(label("sync", "e1", "fetch", 1, "retries", "1"), 5),
+		seq(label("sync", "e1", "fetch", 1, "retries", "0"), 6),
+		// without sequence, labels have the same version: the values decide
+		label("sync", "e1", "fetch", 1, "mode", "b"),
+		label("sync", "e1", "fetch", 1, "mode", "a"),
+		// without sequence, the timestamps are the versions
+		step("sync", "e1", "store", 2, 40),
+		step("sync", "e1", "store", 2, 30),
+		seq(end("sync", "e1", 3, 100, "failure"), 7),
+		seq(end("sync", "e1", 3, 100, "success"), 8),
+	}
+	expected := models.Event{
+		Name: "sync",
+		Id: "e1",
+		CreationTime: pick(s.mergePolicy, at(0), at(5)),
+		Result: pick(s.mergePolicy, "failure", "success"),
+		Steps: []models.Step{
+			expectedStep("fetch", 1, pick(s.mergePolicy, at(20), at(10)),
+				kv("mode", pick(s.mergePolicy, "a", "b")),
+				kv("retries", pick(s.mergePolicy, "1", "0")),
+			),
+			expectedStep("store", 2, pick(s.mergePolicy, at(30), at(40))),
+			expectedStep("end", 3, at(100)),
+		},
+	}
+
+	reversed := []models.Update{}
+	for i := len(updates) - 1; i >= 0; i-- {
+		reversed = append(reversed, updates[i])
+	}
+	random := rand.New(rand.NewSource(int64(len(updates))))
+	orderings := map[string][]models.Update{"in order": updates, "reversed": reversed}
+	for i := 0; i < 3; i++ {
+		shuffled := append([]models.Update{}, updates...)
+		random.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		orderings[fmt.Sprintf("shuffled %d", i)] = shuffled
+	}
+
+	for name, ordering := range orderings {
+		t.Run(name, func(t *testing.T) {
+			tenant := s.tenant()
+			s.insert(t, tenant, ordering...)
+			s.expectEvent(t, tenant, expected)
+
+			// replaying the updates doesn't change the event
+			err := s.db.InsertUpdates(tenant, ordering)
+			if err != nil {
+				t.Fatalf("InsertUpdates: %v", err)
+			}
+			s.expectEvent(t, tenant, expected)
+		})
+	}
+}
+
+func (s *suite) testSameStepNumber(t *testing.T) {
+	tenant := s.tenant()
+	// steps are identified by their name and number
+	s.insert(t, tenant,
+		start("render", "e1", 0),
+		step("render", "e1", "layout", 1, 10),
+		step("render", "e1", "fetch", 1, 20),
+		label("render", "e1", "layout", 1, "nodes", "42"),
+		label("render", "e1", "fetch", 1, "cached", "true"),
+		step("render", "e1", "fetch", 2, 30),
+	)
+	s.expectEvent(t, tenant, models.Event{
+		Name: "render",
+		Id: "e1",
+		CreationTime: at(0),
+		Steps: []models.Step{
+			expectedStep("fetch", 1, at(20), kv("cached", "true")),
+			expectedStep("layout", 1, at(10), kv("nodes", "42")),
+			expectedStep("fetch", 2, at(30)),
+		},
+	})
+}
+
+func (s *suite) testMillisecondPrecision(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		start("tap", "e1", 1),
+		step("tap", "e1", "down", 1, 7),
+		end("tap", "e1", 2, 999, "success"),
+	)
+	s.expectEvent(t, tenant, models.Event{
+		Name: "tap",
+		Id: "e1",
+		CreationTime: at(1),
+		Result: "success",
+		Steps: []models.Step{
+			expectedStep("down", 1, at(7)),
+			expectedStep("end", 2, at(999)),
+		},
+	})
+}
+
+func (s *suite) testMissingEvent(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant, start("present", "e1", 0))
+
+	for _, key := range [][2]string{{"present", "e2"}, {"absent", "e1"}} {
+		event, err := s.db.GetEvent(tenant, key[0], key[1])
+		if err != nil {
+			t.Fatalf("GetEvent(%s, %s): %v", key[0], key[1], err)
+		}
+		if event != nil {
+			t.Errorf("GetEvent(%s, %s): expected no event, got %+v", key[0], key[1], *event)
+		}
+		steps, err := s.db.GetSteps(tenant, key[0], key[1])
+		if err != nil {
+			t.Fatalf("GetSteps(%s, %s): %v", key[0], key[1], err)
+		}
+		if len(steps) != 0 {
+			t.Errorf("GetSteps(%s, %s): expected no steps, got %+v", key[0], key[1], steps)
+		}
+		labels, err := s.db.GetLabels(tenant, key[0], key[1])
+		if err != nil {
+			t.Fatalf("GetLabels(%s, %s): %v", key[0], key[1], err)
+		}
+		if len(labels) != 0 {
+			t.Errorf("GetLabels(%s, %s): expected no labels, got %+v", key[0], key[1], labels)
+		}
+	}
+}
+
+func (s *suite) testUnknownUpdateType(t *testing.T) {
+	tenant := s.tenant()
+	update := start("bogus", "e1", 0)
+	update.UpdateType = "restart"
+
+	err := s.db.InsertUpdate(tenant, update)
+	if !errors.Is(err, models.ErrUnknownUpdateType) {
+		t.Fatalf("InsertUpdate: expected ErrUnknownUpdateType, got %v", err)
+	}
+	err = s.db.InsertUpdates(tenant, []models.Update{update})
+	if !errors.Is(err, models.ErrUnknownUpdateType) {
+		t.Fatalf("InsertUpdates: expected ErrUnknownUpdateType, got %v", err)
+	}
+	// the update didn't create the event
+	event, err := s.db.GetEvent(tenant, "bogus", "e1")
+	if err != nil {
+		t.Fatalf("GetEvent: %v", err)
+	}
+	if event != nil {
+		t.Errorf("GetEvent: expected no event, got %+v", *event)
+	}
+}
+
+// Updates of a whole event, and the event they produce
+func lifecycle(name string, id string) ([]models.Update, models.Event) {
+	updates := []models.Update{
+		start(name, id, 0),
+		label(name, id, "cart", 1, "items", "3"),
+		step(name, id, "cart", 1, 100),
+		step(name, id, "payment", 2, 250),
+		label(name, id, "payment", 2, "method", "card"),
+		end(name, id, 3, 400, "success"),
+	}
+	event := models.Event{
+		Name: name,
+		Id: id,
+		CreationTime: at(0),
+		Result: "success",
+		Steps: []models.Step{
+			expectedStep("cart", 1, at(100), kv("items", "3")),
+			expectedStep("payment", 2, at(250), kv("method", "card")),
+			expectedStep("end", 3, at(400)),
+		},
+	}
+	return updates, event
+}
+
+// Inserting updates again (as when clients retry their requests, or the
+// spool is replayed) neither fails nor changes the event.
+func (s *suite) testReplay(t *testing.T) {
+	tenant := s.tenant()
+	updates, expected := lifecycle("checkout", "e1")
+	err := s.db.InsertUpdates(tenant, updates)
+	if err != nil {
+		t.Fatalf("InsertUpdates: %v", err)
+	}
+	err = s.db.InsertUpdates(tenant, updates)
+	if err != nil {
+		t.Fatalf("InsertUpdates (replayed): %v", err)
+	}
+	s.insert(t, tenant, updates...)
+	// a batch holding the same updates several times
+	err = s.db.InsertUpdates(tenant, append(append([]models.Update{}, updates...), updates...))
+	if err != nil {
+		t.Fatalf("InsertUpdates (duplicated): %v", err)
+	}
+	s.expectEvent(t, tenant, expected)
+
+	events, err := s.db.ListEvents(tenant, models.EventQuery{})
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	if diff := diffEventLists(listed([]models.Event{expected}), events); diff != "" {
+		t.Errorf("ListEvents mismatch:\n%s", diff)
+	}
+}
+
+// The same updates inserted concurrently (as by several ingestion
+// workers) neither fail nor create the event, its steps or labels twice.
+func (s *suite) testConcurrentDuplicates(t *testing.T) {
+	const WRITERS = 8
+	tenant := s.tenant()
+	updates, expected := lifecycle("checkout", "e1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, WRITERS)
+	for i := 0; i < WRITERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, update := range updates {
+				err := s.db.InsertUpdate(tenant, update)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("InsertUpdate: %v", err)
+	}
+	s.expectEvent(t, tenant, expected)
+}
+
+func (s *suite) testListEvents(t *testing.T) {
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		start("checkout", "a", 0),
+		label("checkout", "a", "cart", 1, "country", "FR"),
+		end("checkout", "a", 2, 50, "success"),
+
+		start("checkout", "b", 1000),
+		label("checkout", "b", "cart", 1, "country", "US"),
+		end("checkout", "b", 2, 1050, "failure"),
+
+		start("checkout", "c", 2000),
+		label("checkout", "c", "cart", 1, "country", "FR"),
+		label("checkout", "c", "payment", 2, "method", "card"),
+
+		start("login", "a", 500),
+		end("login", "a", 1, 600, "success"),
+
+		// no creation time: never matches a time range
+		step("login", "b", "form", 1, 700),
+	)
+
+	all := []models.Event{
+		{Name: "checkout", Id: "a", CreationTime: at(0), Result: "success"},
+		{Name: "checkout", Id: "b", CreationTime: at(1000), Result: "failure"},
+		{Name: "checkout", Id: "c", CreationTime: at(2000)},
+		{Name: "login", Id: "a", CreationTime: at(500), Result: "success"},
+		{Name: "login", Id: "b"},
+	}
+	pick := func(indexes ...int) []models.Event {
+		events := []models.Event{}
+		for _, i := range indexes {
+			events = append(events, all[i])
+		}
+		return events
+	}
+
+	cases := []struct {
+		name string
+		query models.EventQuery
+		expected []models.Event
+	}{
+		{"all", models.EventQuery{}, all},
+		{"by name", models.EventQuery{EventName: "login"}, pick(3, 4)},
+		{"by result", models.EventQuery{Result: "success"}, pick(0, 3)},
+		{"by label", models.EventQuery{Labels: map[string]string{"country": "FR"}}, pick(0, 2)},
+		{"by labels on different steps", models.EventQuery{Labels: map[string]string{"country": "FR", "method": "card"}}, pick(2)},
+		{"by missing label", models.EventQuery{Labels: map[string]string{"country": "DE"}}, pick()},
+		{"from", models.EventQuery{From: *at(500)}, pick(1, 2, 3)},
+		{"to (exclusive)", models.EventQuery{To: *at(1000)}, pick(0, 3)},
+		{"time range", models.EventQuery{From: *at(500), To: *at(2000)}, pick(1, 3)},
+		{"combined", models.EventQuery{EventName: "checkout", Result: "success", Labels: map[string]string{"country": "FR"}}, pick(0)},
+		{"limit", models.EventQuery{Limit: 2}, pick(0, 1)},
+		{"after", models.EventQuery{AfterName: "checkout", AfterId: "b"}, pick(2, 3, 4)},
+		{"after with limit", models.EventQuery{AfterName: "checkout", AfterId: "c", Limit: 1}, pick(3)},
+		{"after the last", models.EventQuery{AfterName: "login", AfterId: "b"}, pick()},
+	}
+	for _, c := range cases {
+		events, err := s.db.ListEvents(tenant, c.query)
+		if err != nil {
+			t.Fatalf("ListEvents(%s): %v", c.name, err)
+		}
+		if diff := diffEventLists(c.expected, events); diff != "" {
+			t.Errorf("ListEvents(%s) mismatch:\n%s", c.name, diff)
+		}
+	}
+
+	// paging through all the events returns each of them once
+	var paged []models.Event
+	query := models.EventQuery{Limit: 2}
+	for page := 0; page < len(all); page++ {
+		events, err := s.db.ListEvents(tenant, query)
+		if err != nil {
+			t.Fatalf("ListEvents(page %d): %v", page, err)
+		}
+		paged = append(paged, events...)
+		if len(events) < query.Limit {
+			break
+		}
+		last := events[len(events) - 1]
+		query.AfterName, query.AfterId = last.Name, last.Id
+	}
+	if diff := diffEventLists(all, paged); diff != "" {
+		t.Errorf("paging through ListEvents mismatch:\n%s", diff)
+	}
+}
+
+func (s *suite) testTenantIsolation(t *testing.T) {
+	first, second := s.tenant(), s.tenant()
+	s.insert(t, first,
+		start("checkout", "e1", 0),
+		label("checkout", "e1", "cart", 1, "owner", "first"),
+		end("checkout", "e1", 2, 10, "success"),
+	)
+	s.insert(t, second,
+		start("checkout", "e1", 100),
+		label("checkout", "e1", "cart", 1, "owner", "second"),
+		start("checkout", "e2", 200),
+	)
+
+	s.expectEvent(t, first, models.Event{
+		Name: "checkout",
+		Id: "e1",
+		CreationTime: at(0),
+		Result: "success",
+		Steps: []models.Step{
+			expectedStep("cart", 1, nil, kv("owner", "first")),
+			expectedStep("end", 2, at(10)),
+		},
+	})
+	s.expectEvent(t, second, models.Event{
+		Name: "checkout",
+		Id: "e1",
+		CreationTime: at(100),
+		Steps: []models.Step{
+			expectedStep("cart", 1, nil, kv("owner", "second")),
+		},
+	})
+
+	event, err := s.db.GetEvent(first, "checkout", "e2")
+	if err != nil {
+		t.Fatalf("GetEvent: %v", err)
+	}
+	if event != nil {
+		t.Errorf("GetEvent: event of another tenant returned: %+v", *event)
+	}
+	events, err := s.db.ListEvents(first, models.EventQuery{Labels: map[string]string{"owner": "second"}})
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("ListEvents: events of another tenant returned: %+v", events)
+	}
+	events, err = s.db.ListEvents(s.tenant(), models.EventQuery{})
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("ListEvents: empty tenant returned events: %+v", events)
+	}
+}
+
+// Client timestamp of the given time.
+func timestampOf(t time.Time) int64 {
+	return t.Sub(models.TIMESTAMP_REFERENCE_DATE).Milliseconds()
+}
+
+// Checks that PurgeExpired deletes the events created before their
+// retention (with their steps and labels), and only them.
+// Skipped for backends which don't implement db.Purger.
+func (s *suite) testRetention(t *testing.T) {
+	purger, ok := s.db.(db.Purger)
+	if !ok {
+		t.Skip("the backend doesn't implement db.Purger")
+	}
+	tenant := s.tenant()
+	// only this name has a retention, so the events of the
+	// other scenarios and runs are kept
+	name := "retention_" + s.run
+	now := time.Now()
+	old := timestampOf(now.Add(-2 * time.Hour))
+	recent := timestampOf(now.Add(-30 * time.Minute))
+	s.insert(t, tenant,
+		models.Update{EventName: name, EventId: "old", UpdateType: models.UPDATE_TYPE_START, Timestamp: old},
+		models.Update{EventName: name, EventId: "old", UpdateType: models.UPDATE_TYPE_STEP, Timestamp: old + 10, StepName: "cart", StepNumber: 1},
+		label(name, "old", "cart", 1, "country", "FR"),
+		models.Update{EventName: name, EventId: "recent", UpdateType: models.UPDATE_TYPE_START, Timestamp: recent},
+		label(name, "unstarted", "cart", 1, "country", "FR"),
+		models.Update{EventName: "checkout", EventId: "old", UpdateType: models.UPDATE_TYPE_START, Timestamp: old},
+	)
+
+	policy := models.RetentionPolicy{Events: map[string]time.Duration{name: time.Hour}}
+	purged, err := purger.PurgeExpired(policy, now)
+	if err != nil {
+		t.Fatalf("PurgeExpired: %v", err)
+	}
+	var reported []models.PurgedEvents
+	for _, p := range purged {
+		if p.Tenant == tenant {
+			reported = append(reported, p)
+		}
+	}
+	expected := []models.PurgedEvents{{Tenant: tenant, EventName: name, Count: 1}}
+	if !reflect.DeepEqual(expected, reported) {
+		t.Errorf("PurgeExpired reported %+v, expected %+v", reported, expected)
+	}
+
+	event, err := s.db.GetEvent(tenant, name, "old")
+	if err != nil {
+		t.Fatalf("GetEvent: %v", err)
+	}
+	if event != nil {
+		t.Errorf("GetEvent: expired event returned: %s", formatEvent(*event))
+	}
+	labels, err := s.db.GetLabels(tenant, name, "old")
+	if err != nil {
+		t.Fatalf("GetLabels: %v", err)
+	}
+	if len(labels) != 0 {
+		t.Errorf("GetLabels: labels of an expired event returned: %+v", labels)
+	}
+	events, err := s.db.ListEvents(tenant, models.EventQuery{})
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	var kept []string
+	for _, event := range events {
+		kept = append(kept, event.Name+"/"+event.Id)
+	}
+	expectedKept := []string{"checkout/old", name + "/recent", name + "/unstarted"}
+	if !reflect.DeepEqual(expectedKept, kept) {
+		t.Errorf("events kept: %v, expected %v", kept, expectedKept)
+	}
+
+	// purging again deletes nothing
+	purged, err = purger.PurgeExpired(policy, now)
+	if err != nil {
+		t.Fatalf("PurgeExpired: %v", err)
+	}
+	for _, p := range purged {
+		if p.Tenant == tenant {
+			t.Errorf("second PurgeExpired reported %+v", p)
+		}
+	}
+}
+
+// Checks that MarkAbandoned marks the events inactive for longer than their
+// timeout, that a later end update replaces the mark, and (for analyzers)
+// that the abandoned events are counted by last step.
+// Skipped for backends which don't implement db.Sweeper.
+func (s *suite) testAbandonment(t *testing.T) {
+	sweeper, ok := s.db.(db.Sweeper)
+	if !ok {
+		t.Skip("the backend doesn't implement db.Sweeper")
+	}
+	tenant := s.tenant()
+	// only these names have a timeout, so the events of the
+	// other scenarios and runs are left alone
+	name := "abandoned_" + s.run
+	other := "abandoned_other_" + s.run
+	now := time.Now()
+	ago := func(d time.Duration) int64 { return timestampOf(now.Add(-d)) }
+	startAgo := func(name string, id string, d time.Duration) models.Update {
+		return models.Update{EventName: name, EventId: id, UpdateType: models.UPDATE_TYPE_START, Timestamp: ago(d)}
+	}
+	stepAgo := func(name string, id string, stepName string, number int, d time.Duration) models.Update {
+		return models.Update{EventName: name, EventId: id, UpdateType: models.UPDATE_TYPE_STEP, Timestamp: ago(d), StepName: stepName, StepNumber: number}
+	}
+	s.insert(t, tenant,
+		// inactive for an hour
+		startAgo(name, "a1", 2 * time.Hour),
+		stepAgo(name, "a1", "cart", 1, 119 * time.Minute),
+		stepAgo(name, "a1", "pay", 2, time.Hour),
+		// ended
+		startAgo(name, "a2", 2 * time.Hour),
+		models.Update{EventName: name, EventId: "a2", UpdateType: models.UPDATE_TYPE_END, Timestamp: ago(time.Hour), StepNumber: 1, Result: "success"},
+		// its only step has no creation time
+		startAgo(name, "a3", 2 * time.Hour),
+		label(name, "a3", "cart", 1, "country", "FR"),
+		// still active
+		startAgo(name, "a4", 2 * time.Hour),
+		stepAgo(name, "a4", "cart", 1, 10 * time.Minute),
+		// no creation time, but an inactive step
+		stepAgo(name, "a5", "cart", 1, time.Hour),
+		// no creation time at all
+		label(name, "a6", "cart", 1, "country", "FR"),
+		// no step
+		startAgo(name, "a7", 2 * time.Hour),
+		// another timeout
+		startAgo(other, "o1", 3 * time.Hour),
+		startAgo(other, "o2", time.Hour),
+	)
+
+	policy := models.AbandonmentPolicy{Timeouts: map[string]time.Duration{name: 30 * time.Minute, other: 2 * time.Hour}}
+	abandoned, err := sweeper.MarkAbandoned(policy, now)
+	if err != nil {
+		t.Fatalf("MarkAbandoned: %v", err)
+	}
+	reported := []models.AbandonedEvents{}
+	for _, a := range abandoned {
+		if a.Tenant == tenant {
+			reported = append(reported, a)
+		}
+	}
+	expected := models.SortAbandonedEvents([]models.AbandonedEvents{
+		{Tenant: tenant, EventName: name, Count: 4},
+		{Tenant: tenant, EventName: other, Count: 1},
+	})
+	if !reflect.DeepEqual(expected, reported) {
+		t.Errorf("MarkAbandoned reported %+v, expected %+v", reported, expected)
+	}
+
+	events, err := s.db.ListEvents(tenant, models.EventQuery{Result: models.ABANDONED_RESULT})
+	if err != nil {
+		t.Fatalf("ListEvents: %v", err)
+	}
+	var listed []string
+	for _, event := range events {
+		listed = append(listed, event.Name+"/"+event.Id)
+	}
+	expectedListed := []string{name + "/a1", name + "/a3", name + "/a5", name + "/a7", other + "/o1"}
+	if !reflect.DeepEqual(expectedListed, listed) {
+		t.Errorf("abandoned events: %v, expected %v", listed, expectedListed)
+	}
+
+	event, err := s.db.GetEvent(tenant, name, "a1")
+	if err != nil {
+		t.Fatalf("GetEvent: %v", err)
+	}
+	switch {
+	case event == nil || event.Result != models.ABANDONED_RESULT || event.Abandoned == nil:
+		t.Errorf("GetEvent: expected an abandoned event, got %+v", event)
+	case event.Abandoned.Time.Sub(now).Abs() > time.Second:
+		t.Errorf("abandoned at %s, expected %s", event.Abandoned.Time, now)
+	case !reflect.DeepEqual(event.Abandoned.LastStep, &models.StepRef{Name: "pay", Number: 2}):
+		t.Errorf("last step %+v, expected pay #2", event.Abandoned.LastStep)
+	}
+
+	// the end update arriving late replaces the mark, and the next sweep leaves the event alone
+	s.insert(t, tenant, end(name, "a1", 3, 0, "failure"))
+	abandoned, err = sweeper.MarkAbandoned(policy, now)
+	if err != nil {
+		t.Fatalf("MarkAbandoned: %v", err)
+	}
+	for _, a := range abandoned {
+		if a.Tenant == tenant {
+			t.Errorf("second MarkAbandoned reported %+v", a)
+		}
+	}
+	event, err = s.db.GetEvent(tenant, name, "a1")
+	if err != nil {
+		t.Fatalf("GetEvent: %v", err)
+	}
+	if event == nil || event.Result != "failure" || event.Abandoned != nil {
+		t.Errorf("GetEvent: expected a failed event, got %+v", event)
+	}
+
+	analyzer, ok := s.db.(db.Analyzer)
+	if !ok {
+		return
+	}
+	breakdown, err := analyzer.Abandonment(tenant, models.AnalyticsQuery{EventName: name})
+	if err != nil {
+		t.Fatalf("Abandonment: %v", err)
+	}
+	// a5 has no creation time
+	expectedBreakdown := &models.AbandonmentBreakdown{
+		EventName: name,
+		Abandoned: 2,
+		ByLastStep: []models.LastStepCount{{Count: 1}, {Step: &models.StepRef{Name: "cart", Number: 1}, Count: 1}},
+	}
+	if !reflect.DeepEqual(expectedBreakdown, breakdown) {
+		t.Errorf("Abandonment returned %+v, expected %+v", breakdown, expectedBreakdown)
+	}
+}
+
+func stats(count int64, min int64, p50 int64, p90 int64, p95 int64, p99 int64, max int64) models.DurationStats {
+	return models.DurationStats{Count: count, MinMs: min, P50Ms: p50, P90Ms: p90, P95Ms: p95, P99Ms: p99, MaxMs: max}
+}
+
+func transition(fromName string, fromNumber int, toName string, toNumber int, latency models.DurationStats) models.StepTransition {
+	return models.StepTransition{
+		From: models.StepRef{Name: fromName, Number: fromNumber},
+		To: models.StepRef{Name: toName, Number: toNumber},
+		Latency: latency,
+	}
+}
+
+// Checks the durations, step latencies and series returned by EventDurations.
+// Skipped for backends which don't implement db.Analyzer.
+func (s *suite) testDurationAnalytics(t *testing.T) {
+	analyzer, ok := s.db.(db.Analyzer)
+	if !ok {
+		t.Skip("the backend doesn't implement db.Analyzer")
+	}
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		// duration 6000, cart -> pay 2000, pay -> end 3000
+		start("checkout", "e1", 0),
+		step("checkout", "e1", "cart", 1, 1_000),
+		step("checkout", "e1", "pay", 2, 3_000),
+		end("checkout", "e1", 3, 6_000, "success"),
+		// duration 10000, cart -> pay 4000, pay -> end 5500
+		start("checkout", "e2", 10_000),
+		step("checkout", "e2", "cart", 1, 10_500),
+		step("checkout", "e2", "pay", 2, 14_500),
+		end("checkout", "e2", 3, 20_000, "failure"),
+		// not ended, and no step 2
+		start("checkout", "e3", 20_000),
+		step("checkout", "e3", "cart", 1, 21_000),
+		// next bucket: duration 2000, pay -> end 1000 (cart has no creation time)
+		start("checkout", "e4", 3_600_000),
+		label("checkout", "e4", "cart", 1, "country", "FR"),
+		step("checkout", "e4", "pay", 2, 3_601_000),
+		end("checkout", "e4", 3, 3_602_000, "success"),
+		// duration 350, two steps numbered 2: cart -> coupon 100, cart -> pay 200,
+		// coupon -> end 200, pay -> end 100
+		start("checkout", "e5", 50),
+		step("checkout", "e5", "cart", 1, 100),
+		step("checkout", "e5", "coupon", 2, 200),
+		step("checkout", "e5", "pay", 2, 300),
+		end("checkout", "e5", 3, 400, "success"),
+		// no creation time
+		end("checkout", "e6", 3, 500, "success"),
+		// after the range
+		start("checkout", "e7", 4_000_000),
+		end("checkout", "e7", 1, 4_001_000, "success"),
+		// another name
+		start("signup", "e1", 0),
+		end("signup", "e1", 1, 99_000, "success"),
+	)
+
+	query := models.AnalyticsQuery{EventName: "checkout", From: *at(0), To: *at(4_000_000), Bucket: time.Hour}
+	analytics, err := analyzer.EventDurations(tenant, query)
+	if err != nil {
+		t.Fatalf("EventDurations: %v", err)
+	}
+	// buckets are aligned on the Unix epoch: BASE_TIMESTAMP is 800s after an hour
+	expected := models.DurationAnalytics{
+		EventName: "checkout",
+		Duration: stats(4, 350, 2_000, 10_000, 10_000, 10_000, 10_000),
+		Transitions: []models.StepTransition{
+			transition("cart", 1, "coupon", 2, stats(1, 100, 100, 100, 100, 100, 100)),
+			transition("cart", 1, "pay", 2, stats(3, 200, 2_000, 4_000, 4_000, 4_000, 4_000)),
+			transition("coupon", 2, "end", 3, stats(1, 200, 200, 200, 200, 200, 200)),
+			transition("pay", 2, "end", 3, stats(4, 100, 1_000, 5_500, 5_500, 5_500, 5_500)),
+		},
+		Series: []models.DurationBucket{
+			{Start: *at(-800_000), Duration: stats(3, 350, 6_000, 10_000, 10_000, 10_000, 10_000)},
+			{Start: *at(2_800_000), Duration: stats(1, 2_000, 2_000, 2_000, 2_000, 2_000, 2_000)},
+		},
+	}
+	if diff := diffDurationAnalytics(expected, *analytics); diff != "" {
+		t.Errorf("EventDurations mismatch:\n%s", diff)
+	}
+
+	analytics, err = analyzer.EventDurations(tenant, models.AnalyticsQuery{EventName: "nothing", Bucket: time.Hour})
+	if err != nil {
+		t.Fatalf("EventDurations: %v", err)
+	}
+	expected = models.DurationAnalytics{EventName: "nothing", Transitions: []models.StepTransition{}, Series: []models.DurationBucket{}}
+	if diff := diffDurationAnalytics(expected, *analytics); diff != "" {
+		t.Errorf("EventDurations of an unknown name mismatch:\n%s", diff)
+	}
+}
+
+func diffDurationAnalytics(expected models.DurationAnalytics, got models.DurationAnalytics) string {
+	for i := range got.Series {
+		got.Series[i].Start = got.Series[i].Start.UTC()
+	}
+	for i := range expected.Series {
+		expected.Series[i].Start = expected.Series[i].Start.UTC()
+	}
+	if reflect.DeepEqual(expected, got) {
+		return ""
+	}
+	return fmt.Sprintf("expected %+v\ngot      %+v", expected, got)
+}
+
+func funnelCounts(segment *string, events int64, stages ...int64) models.FunnelCounts {
+	return models.FunnelCounts{Segment: segment, Events: events, Stages: stages}
+}
+
+// Checks the stage counts returned by Funnel, with and without segments.
+// Skipped for backends which don't implement db.Analyzer.
+func (s *suite) testFunnel(t *testing.T) {
+	analyzer, ok := s.db.(db.Analyzer)
+	if !ok {
+		t.Skip("the backend doesn't implement db.Analyzer")
+	}
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		// FR: cart, pay, end
+		start("checkout", "f1", 0),
+		step("checkout", "f1", "cart", 1, 1_000),
+		label("checkout", "f1", "cart", 1, "country", "FR"),
+		step("checkout", "f1", "pay", 2, 2_000),
+		end("checkout", "f1", 3, 3_000, "success"),
+		// US: cart, pay
+		start("checkout", "f2", 0),
+		step("checkout", "f2", "cart", 1, 1_000),
+		label("checkout", "f2", "cart", 1, "country", "US"),
+		step("checkout", "f2", "pay", 2, 2_000),
+		// no country: cart
+		start("checkout", "f3", 0),
+		step("checkout", "f3", "cart", 1, 1_000),
+		label("checkout", "f3", "cart", 1, "plan", "pro"),
+		// FR (the label of the first step): cart, but pay comes before it
+		start("checkout", "f4", 0),
+		step("checkout", "f4", "pay", 1, 1_000),
+		label("checkout", "f4", "pay", 1, "country", "FR"),
+		step("checkout", "f4", "cart", 2, 2_000),
+		label("checkout", "f4", "cart", 2, "country", "US"),
+		// US: cart (only created by its label), pay, end
+		start("checkout", "f5", 0),
+		label("checkout", "f5", "cart", 1, "country", "US"),
+		step("checkout", "f5", "pay", 2, 2_000),
+		end("checkout", "f5", 3, 3_000, "failure"),
+		// no country: cart, pay (following the first cart), and no end
+		start("checkout", "f6", 0),
+		step("checkout", "f6", "cart", 1, 1_000),
+		step("checkout", "f6", "cart", 3, 3_000),
+		step("checkout", "f6", "pay", 2, 2_000),
+		// no creation time
+		step("checkout", "f7", "cart", 1, 1_000),
+		// after the range
+		start("checkout", "f8", 2_000_000),
+		step("checkout", "f8", "cart", 1, 2_001_000),
+		// another name
+		start("signup", "f1", 0),
+		step("signup", "f1", "cart", 1, 1_000),
+	)
+
+	fr, us := "FR", "US"
+	query := models.FunnelQuery{
+		AnalyticsQuery: models.AnalyticsQuery{EventName: "checkout", From: *at(0), To: *at(1_000_000)},
+		Steps: []string{"cart", "pay", "end"},
+		SegmentBy: "country",
+	}
+	funnel, err := analyzer.Funnel(tenant, query)
+	if err != nil {
+		t.Fatalf("Funnel: %v", err)
+	}
+	expected := models.NewFunnel(query, []models.FunnelCounts{
+		funnelCounts(nil, 2, 2, 1, 0),
+		funnelCounts(&fr, 2, 2, 1, 1),
+		funnelCounts(&us, 2, 2, 2, 1),
+	})
+	if !reflect.DeepEqual(expected, funnel) {
+		t.Errorf("Funnel mismatch:\nexpected %s\ngot      %s", formatFunnel(expected), formatFunnel(funnel))
+	}
+	if len(funnel.Stages) == 3 && (funnel.Stages[2].Count != 2 || funnel.Stages[2].StepConversion != 0.5 || funnel.Stages[2].DropOff != 0.5) {
+		t.Errorf("unexpected end stage %+v", funnel.Stages[2])
+	}
+
+	query = models.FunnelQuery{AnalyticsQuery: models.AnalyticsQuery{EventName: "checkout"}, Steps: []string{"pay", "cart"}}
+	funnel, err = analyzer.Funnel(tenant, query)
+	if err != nil {
+		t.Fatalf("Funnel: %v", err)
+	}
+	expected = models.NewFunnel(query, []models.FunnelCounts{funnelCounts(nil, 7, 5, 2)})
+	if !reflect.DeepEqual(expected, funnel) {
+		t.Errorf("Funnel without segments mismatch:\nexpected %s\ngot      %s", formatFunnel(expected), formatFunnel(funnel))
+	}
+
+	query = models.FunnelQuery{AnalyticsQuery: models.AnalyticsQuery{EventName: "nothing"}, Steps: []string{"cart"}, SegmentBy: "country"}
+	funnel, err = analyzer.Funnel(tenant, query)
+	if err != nil {
+		t.Fatalf("Funnel: %v", err)
+	}
+	expected = models.NewFunnel(query, nil)
+	if !reflect.DeepEqual(expected, funnel) {
+		t.Errorf("Funnel of an unknown name mismatch:\nexpected %s\ngot      %s", formatFunnel(expected), formatFunnel(funnel))
+	}
+}
+
+func formatFunnel(funnel *models.Funnel) string {
+	data, _ := json.Marshal(funnel)
+	return string(data)
+}
+
+// Checks the result counts and success rates returned by EventResults.
+// Skipped for backends which don't implement db.Analyzer.
+func (s *suite) testResultBreakdown(t *testing.T) {
+	analyzer, ok := s.db.(db.Analyzer)
+	if !ok {
+		t.Skip("the backend doesn't implement db.Analyzer")
+	}
+	tenant := s.tenant()
+	s.insert(t, tenant,
+		start("checkout", "r1", 0),
+		end("checkout", "r1", 1, 500, "success"),
+		start("checkout", "r2", 1_000),
+		end("checkout", "r2", 1, 1_500, "failure"),
+		start("checkout", "r3", 2_000),
+		end("checkout", "r3", 1, 2_500, "success"),
+		// no end update
+		start("checkout", "r4", 3_000),
+		step("checkout", "r4", "cart", 1, 3_500),
+		// next bucket
+		start("checkout", "r5", 3_600_000),
+		end("checkout", "r5", 1, 3_600_500, "timeout"),
+		start("checkout", "r6", 3_601_000),
+		// no creation time
+		end("checkout", "r7", 1, 1_000, "failure"),
+		// after the range
+		start("checkout", "r8", 4_000_000),
+		end("checkout", "r8", 1, 4_000_500, "failure"),
+		// another name
+		start("signup", "r1", 0),
+		end("signup", "r1", 1, 500, "failure"),
+	)
+
+	query := models.ResultQuery{
+		AnalyticsQuery: models.AnalyticsQuery{EventName: "checkout", From: *at(0), To: *at(4_000_000), Bucket: time.Hour},
+		SuccessResults: []string{"success"},
+	}
+	breakdown, err := analyzer.EventResults(tenant, query)
+	if err != nil {
+		t.Fatalf("EventResults: %v", err)
+	}
+	// buckets are aligned on the Unix epoch: BASE_TIMESTAMP is 800s after an hour
+	expected := models.ResultBreakdown{
+		EventName: "checkout",
+		SuccessResults: []string{"success"},
+		Overall: models.ResultStats{Events: 6, ByResult: map[string]int64{"success": 2, "failure": 1, "timeout": 1}, Unended: 2, SuccessRate: 0.5},
+		Series: []models.ResultBucket{
+			{Start: *at(-800_000), Stats: models.ResultStats{Events: 4, ByResult: map[string]int64{"success": 2, "failure": 1}, Unended: 1, SuccessRate: 2.0 / 3}},
+			{Start: *at(2_800_000), Stats: models.ResultStats{Events: 2, ByResult: map[string]int64{"timeout": 1}, Unended: 1, SuccessRate: 0}},
+		},
+	}
+	if diff := diffResultBreakdowns(expected, *breakdown); diff != "" {
+		t.Errorf("EventResults mismatch:\n%s", diff)
+	}
+
+	query = models.ResultQuery{
+		AnalyticsQuery: models.AnalyticsQuery{EventName: "checkout", From: *at(0), To: *at(4_000_000)},
+		SuccessResults: []string{"success", "timeout"},
+	}
+	breakdown, err = analyzer.EventResults(tenant, query)
+	if err != nil {
+		t.Fatalf("EventResults: %v", err)
+	}
+	expected = models.ResultBreakdown{
+		EventName: "checkout",
+		SuccessResults: []string{"success", "timeout"},
+		Overall: models.ResultStats{Events: 6, ByResult: map[string]int64{"success": 2, "failure": 1, "timeout": 1}, Unended: 2, SuccessRate: 0.75},
+		Series: []models.ResultBucket{},
+	}
+	if diff := diffResultBreakdowns(expected, *breakdown); diff != "" {
+		t.Errorf("EventResults without buckets mismatch:\n%s", diff)
+	}
+}
+
+func diffResultBreakdowns(expected models.ResultBreakdown, got models.ResultBreakdown) string {
+	for i := range expected.Series {
+		expected.Series[i].Start = expected.Series[i].Start.UTC()
+	}
+	if reflect.DeepEqual(expected, got) {
+		return ""
+	}
+	return fmt.Sprintf("expected %+v\ngot      %+v", expected, got)
+}
+
+// Generates random events, and checks they are read back identically
+// whatever the order of their updates, and whether they are inserted
+// one by one or in batches.
+//
+// Some step timestamps and labels are sent several times with different
+// values: the value kept must be the one picked by the merge policy.
+func (s *suite) testRandomOrderings(t *testing.T) {
+	seed := time.Now().UnixNano()
+	if value := os.Getenv(SEED_ENV); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid %s: %v", SEED_ENV, err)
+		}
+		seed = parsed
+	}
+	t.Logf("seed: %d (set %s to replay)", seed, SEED_ENV)
+	random := rand.New(rand.NewSource(seed))
+
+	var updates []models.Update
+	var expected []models.Event
+	for i := 0; i < RANDOM_EVENTS; i++ {
+		eventUpdates, event := randomEvent(random, s.mergePolicy, i)
+		updates = append(updates, eventUpdates...)
+		expected = append(expected, event)
+	}
+
+	for ordering := 0; ordering < RANDOM_ORDERINGS; ordering++ {
+		tenant := s.tenant()
+		shuffled := append([]models.Update{}, updates...)
+		if ordering > 0 {
+			// the first ordering keeps the order of the generator
+			random.Shuffle(len(shuffled), func(i, j int) {
+				shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+			})
+		}
+		if ordering % 2 == 0 {
+			s.insert(t, tenant, shuffled...)
+		} else {
+			for len(shuffled) > 0 {
+				size := 1 + random.Intn(len(shuffled))
+				err := s.db.InsertUpdates(tenant, shuffled[:size])
+				if err != nil {
+					t.Fatalf("ordering %d: InsertUpdates: %v", ordering, err)
+				}
+				shuffled = shuffled[size:]
+			}
+		}
+
+		t.Run(fmt.Sprintf("ordering %d", ordering), func(t *testing.T) {
+			for _, event := range expected {
+				s.expectEvent(t, tenant, event)
+			}
+			events, err := s.db.ListEvents(tenant, models.EventQuery{})
+			if err != nil {
+				t.Fatalf("ListEvents: %v", err)
+			}
+			if diff := diffEventLists(listed(expected), events); diff != "" {
+				t.Errorf("ListEvents mismatch:\n%s", diff)
+			}
+		})
+	}
+}
+
+var (
+	randomEventNames = []string{"checkout", "login", "search", "upload"}
+	randomStepNames = []string{"init", "fetch", "parse", "render", "save"}
+	randomResults = []string{"success", "failure", "cancelled"}
+)
+
+// Returns the updates of a random event, in chronological order,
+// and the event they should produce with the given merge policy.
+func randomEvent(random *rand.Rand, policy models.MergePolicy, index int) ([]models.Update, models.Event) {
+	name := randomEventNames[random.Intn(len(randomEventNames))]
+	id := fmt.Sprintf("event-%d", index)
+	event := models.Event{Name: name, Id: id, Steps: []models.Step{}}
+	var updates []models.Update
+
+	offset := int64(index) * 100_000
+	hasStart := random.Intn(5) > 0
+	if hasStart {
+		updates = append(updates, start(name, id, offset))
+		event.CreationTime = at(offset)
+	}
+
+	stepCount := random.Intn(4)
+	number := 1
+	for i := 0; i < stepCount; i++ {
+		stepName := randomStepNames[random.Intn(len(randomStepNames))]
+		// sometimes several steps share a number
+		if i > 0 && random.Intn(4) > 0 {
+			number++
+		}
+		if stepExists(event.Steps, stepName, number) {
+			continue
+		}
+		offset += 1 + random.Int63n(5_000)
+
+		var creationTime *time.Time
+		// steps only known through their labels have no creation time
+		if random.Intn(4) > 0 {
+			updates = append(updates, step(name, id, stepName, number, offset))
+			creationTime = at(offset)
+			// sometimes the step is sent again, with another timestamp
+			if random.Intn(4) == 0 {
+				other := offset + 1 + random.Int63n(1_000)
+				updates = append(updates, step(name, id, stepName, number, other))
+				creationTime = pick(policy, creationTime, at(other))
+			}
+		}
+		var labels []models.Label
+		for l, labelCount := 0, random.Intn(3); l < labelCount; l++ {
+			key := fmt.Sprintf("key%d", l)
+			val := fmt.Sprintf("%x", random.Int63())
+			update := label(name, id, stepName, number, key, val)
+			// sometimes the label is sent again, with another value
+			if random.Intn(3) == 0 {
+				update.Sequence = random.Int63n(3)
+				other := label(name, id, stepName, number, key, fmt.Sprintf("%x", random.Int63()))
+				other.Sequence = random.Int63n(3)
+				updates = append(updates, other)
+				if models.Overrides(policy, other.Version(), other.LabelVal, update.Version(), update.LabelVal) {
+					val = other.LabelVal
+				}
+			}
+			updates = append(updates, update)
+			labels = append(labels, kv(key, val))
+		}
+		if creationTime == nil && labels == nil {
+			// the step would never be created
+			continue
+		}
+		event.Steps = append(event.Steps, expectedStep(stepName, number, creationTime, labels...))
+	}
+
+	if random.Intn(3) > 0 || len(updates) == 0 {
+		offset += 1 + random.Int63n(5_000)
+		result := randomResults[random.Intn(len(randomResults))]
+		updates = append(updates, end(name, id, number + 1, offset, result))
+		event.Result = result
+		event.Steps = append(event.Steps, expectedStep("end", number + 1, at(offset)))
+	}
+	sortSteps(event.Steps)
+	return updates, event
+}
+
+func stepExists(steps []models.Step, name string, number int) bool {
+	for _, step := range steps {
+		if step.Name == name && step.Number == number {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the events as returned by ListEvents: ordered by name then ID, without steps.
+func listed(events []models.Event) []models.Event {
+	result := []models.Event{}
+	for _, event := range events {
+		event.Steps = nil
+		result = append(result, event)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func sortSteps(steps []models.Step) {
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].Number != steps[j].Number {
+			return steps[i].Number < steps[j].Number
+		}
+		return steps[i].Name < steps[j].Name
+	})
+}
+
+// Returns a copy of the event the backends can be compared on:
+// times in UTC, and empty slices instead of nil ones.
+func normalizeEvent(event models.Event) models.Event {
+	event.CreationTime = normalizeTime(event.CreationTime)
+	if event.Steps != nil {
+		event.Steps = normalizeSteps(event.Steps)
+	}
+	return event
+}
+
+func normalizeSteps(steps []models.Step) []models.Step {
+	result := []models.Step{}
+	for _, step := range steps {
+		step.CreationTime = normalizeTime(step.CreationTime)
+		step.Labels = normalizeLabels(step.Labels)
+		result = append(result, step)
+	}
+	return result
+}
+
+func normalizeLabels(labels []models.Label) []models.Label {
+	return append([]models.Label{}, labels...)
+}
+
+func normalizeTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	normalized := t.UTC()
+	return &normalized
+}
+
+// Returns a description of the differences between the events,
+// or "" if they are identical.
+func diffEvents(expected models.Event, got models.Event) string {
+	expected, got = normalizeEvent(expected), normalizeEvent(got)
+	if expected.Steps == nil {
+		expected.Steps = []models.Step{}
+	}
+	if got.Steps == nil {
+		got.Steps = []models.Step{}
+	}
+	if reflect.DeepEqual(expected, got) {
+		return ""
+	}
+	return fmt.Sprintf("expected %s\ngot      %s", formatEvent(expected), formatEvent(got))
+}
+
+func diffSteps(expected []models.Step, got []models.Step) string {
+	expected, got = normalizeSteps(expected), normalizeSteps(got)
+	if reflect.DeepEqual(expected, got) {
+		return ""
+	}
+	return fmt.Sprintf("expected %s\ngot      %s", formatSteps(expected), formatSteps(got))
+}
+
+func diffEventLists(expected []models.Event, got []models.Event) string {
+	var lines []string
+	for i := 0; i < len(expected) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			lines = append(lines, fmt.Sprintf("#%d: missing %s", i, formatEvent(normalizeEvent(expected[i]))))
+		case i >= len(expected):
+			lines = append(lines, fmt.Sprintf("#%d: unexpected %s", i, formatEvent(normalizeEvent(got[i]))))
+		default:
+			e, g := normalizeEvent(expected[i]), normalizeEvent(got[i])
+			if !reflect.DeepEqual(e, g) {
+				lines = append(lines, fmt.Sprintf("#%d: expected %s\n    got      %s", i, formatEvent(e), formatEvent(g)))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatEvent(event models.Event) string {
+	return fmt.Sprintf("{%s %s created=%s result=%q steps=%s}", event.Name, event.Id, formatTime(event.CreationTime), event.Result, formatSteps(event.Steps))
+}
+
+func formatSteps(steps []models.Step) string {
+	if steps == nil {
+		return "none"
+	}
+	var parts []string
+	for _, step := range steps {
+		var labels []string
+		for _, label := range step.Labels {
+			labels = append(labels, fmt.Sprintf("%s/%d:%s=%s", label.StepName, label.StepNumber, label.Key, label.Val))
+		}
+		parts = append(parts, fmt.Sprintf("{%s #%d created=%s labels=[%s]}", step.Name, step.Number, formatTime(step.CreationTime), strings.Join(labels, " ")))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "none"
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
@@ -5,14 +5,37 @@ import (
 )
 
 // Interface for databases
+//
+// Every event belongs to a tenant (the application that sent it).
+// Events of different tenants never mix: each method only reads or
+// writes the events of the given tenant.
 type DB interface {
 	// Connects to the given database
 	Connect() error
 
 	// Inserts the given update in the database.
 	// Returns an error if the insertion fails
-	InsertUpdate(update models.Update) error
+	InsertUpdate(tenant string, update models.Update) error
+
+	// Inserts the given updates in the database, in order.
+	// Returns an error if the insertion of any of them fails.
+	// Implementations should make the insertion atomic when
+	// the database supports it.
+	InsertUpdates(tenant string, updates []models.Update) error
+
+	// Retrieves an event, with its steps (ordered by step number) and their labels.
+	// Returns (nil, nil) if there is no event with that name and ID.
+	GetEvent(tenant string, eventName string, eventId string) (*models.Event, error)
+
+	// Lists the events matching the given query, without their steps.
+	ListEvents(tenant string, query models.EventQuery) ([]models.Event, error)
+
+	// Retrieves the steps of an event, ordered by step number, with their labels.
+	GetSteps(tenant string, eventName string, eventId string) ([]models.Step, error)
+
+	// Retrieves all the labels of an event, ordered by step number.
+	GetLabels(tenant string, eventName string, eventId string) ([]models.Label, error)
 
 	// Disconnects from the database.
 	Disconnect() error
-}
\ No newline at end of file
+}
@@ -0,0 +1,216 @@
+package memory
+
+import (
+	"fmt"
+	"owl_server/models"
+	"sort"
+	"time"
+)
+
+func (db *MemoryDB) EventDurations(tenant string, query models.AnalyticsQuery) (*models.DurationAnalytics, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+
+	var durations []int64
+	buckets := map[time.Time][]int64{}
+	transitions := map[[2]models.StepRef][]int64{}
+	for key, rec := range db.events[tenant] {
+		event := &rec.event
+		if key.name != query.EventName || event.CreationTime == nil || !query.Contains(*event.CreationTime) {
+			continue
+		}
+		if end := lastEnd(event); end != nil {
+			duration := end.Sub(*event.CreationTime).Milliseconds()
+			durations = append(durations, duration)
+			if query.Bucket > 0 {
+				bucket := models.BucketStart(*event.CreationTime, query.Bucket)
+				buckets[bucket] = append(buckets[bucket], duration)
+			}
+		}
+		for _, from := range event.Steps {
+			for _, to := range event.Steps {
+				if to.Number != from.Number + 1 || from.CreationTime == nil || to.CreationTime == nil {
+					continue
+				}
+				key := [2]models.StepRef{{Name: from.Name, Number: from.Number}, {Name: to.Name, Number: to.Number}}
+				transitions[key] = append(transitions[key], to.CreationTime.Sub(*from.CreationTime).Milliseconds())
+			}
+		}
+	}
+
+	result := &models.DurationAnalytics{
+		EventName: query.EventName,
+		Duration: models.NewDurationStats(durations),
+		Transitions: []models.StepTransition{},
+		Series: []models.DurationBucket{},
+	}
+	for key, latencies := range transitions {
+		result.Transitions = append(result.Transitions, models.StepTransition{
+			From: key[0],
+			To: key[1],
+			Latency: models.NewDurationStats(latencies),
+		})
+	}
+	models.SortTransitions(result.Transitions)
+	for start, bucketDurations := range buckets {
+		result.Series = append(result.Series, models.DurationBucket{Start: start, Duration: models.NewDurationStats(bucketDurations)})
+	}
+	sort.Slice(result.Series, func(i, j int) bool { return result.Series[i].Start.Before(result.Series[j].Start) })
+	return result, nil
+}
+
+// Returns the latest creation time of the "end" steps of the event,
+// nil if it has none
+func lastEnd(event *models.Event) *time.Time {
+	var end *time.Time
+	for _, step := range event.Steps {
+		if step.Name == "end" && step.CreationTime != nil && (end == nil || step.CreationTime.After(*end)) {
+			end = step.CreationTime
+		}
+	}
+	return end
+}
+
+func (db *MemoryDB) Funnel(tenant string, query models.FunnelQuery) (*models.Funnel, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+
+	// segments by value, prefixed with "=" to tell the empty value from the missing label
+	segments := map[string]*models.FunnelCounts{}
+	for key, rec := range db.events[tenant] {
+		event := &rec.event
+		if key.name != query.EventName || event.CreationTime == nil || !query.Contains(*event.CreationTime) {
+			continue
+		}
+		var segment *string
+		if query.SegmentBy != "" {
+			segment = segmentOf(event, query.SegmentBy)
+		}
+		segmentKey := ""
+		if segment != nil {
+			segmentKey = "=" + *segment
+		}
+		counts, ok := segments[segmentKey]
+		if !ok {
+			counts = &models.FunnelCounts{Segment: segment, Stages: make([]int64, len(query.Steps))}
+			segments[segmentKey] = counts
+		}
+		counts.Events++
+		previous := -1
+		for i, stepName := range query.Steps {
+			number := -1
+			for _, step := range event.Steps {
+				if step.Name == stepName && step.Number > previous && (number < 0 || step.Number < number) {
+					number = step.Number
+				}
+			}
+			if number < 0 {
+				break
+			}
+			counts.Stages[i]++
+			previous = number
+		}
+	}
+
+	counts := []models.FunnelCounts{}
+	for _, segment := range segments {
+		counts = append(counts, *segment)
+	}
+	return models.NewFunnel(query, counts), nil
+}
+
+func (db *MemoryDB) EventResults(tenant string, query models.ResultQuery) (*models.ResultBreakdown, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+
+	type countKey struct {
+		bucket time.Time
+		result string
+	}
+	counts := map[countKey]int64{}
+	for key, rec := range db.events[tenant] {
+		event := &rec.event
+		if key.name != query.EventName || event.CreationTime == nil || !query.Contains(*event.CreationTime) {
+			continue
+		}
+		k := countKey{result: event.Result}
+		if query.Bucket > 0 {
+			k.bucket = models.BucketStart(*event.CreationTime, query.Bucket)
+		}
+		counts[k]++
+	}
+
+	result := []models.ResultCount{}
+	for k, count := range counts {
+		c := models.ResultCount{Result: k.result, Count: count}
+		if query.Bucket > 0 {
+			bucket := k.bucket
+			c.Bucket = &bucket
+		}
+		result = append(result, c)
+	}
+	return models.NewResultBreakdown(query, result), nil
+}
+
+func (db *MemoryDB) Abandonment(tenant string, query models.AnalyticsQuery) (*models.AbandonmentBreakdown, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+
+	// counts by last step, nil for the events without step
+	counts := map[models.StepRef]int64{}
+	withoutStep := int64(0)
+	for key, rec := range db.events[tenant] {
+		event := &rec.event
+		if key.name != query.EventName || event.Abandoned == nil || event.CreationTime == nil || !query.Contains(*event.CreationTime) {
+			continue
+		}
+		if event.Abandoned.LastStep == nil {
+			withoutStep++
+		} else {
+			counts[*event.Abandoned.LastStep]++
+		}
+	}
+
+	result := []models.LastStepCount{}
+	if withoutStep > 0 {
+		result = append(result, models.LastStepCount{Count: withoutStep})
+	}
+	for step, count := range counts {
+		step := step
+		result = append(result, models.LastStepCount{Step: &step, Count: count})
+	}
+	return models.NewAbandonmentBreakdown(query.EventName, result), nil
+}
+
+// Returns the value of the label of the given key on the smallest step
+// (by number then name) having it, nil if no step has it
+func segmentOf(event *models.Event, key string) *string {
+	var segment *string
+	var first *models.Step
+	for i := range event.Steps {
+		step := &event.Steps[i]
+		if first != nil && (step.Number > first.Number || step.Number == first.Number && step.Name > first.Name) {
+			continue
+		}
+		for _, label := range step.Labels {
+			if label.Key == key {
+				value := label.Val
+				segment, first = &value, step
+				break
+			}
+		}
+	}
+	return segment
+}
@@ -0,0 +1,390 @@
+package memory
+
+import (
+	"fmt"
+	"owl_server/config"
+	"owl_server/db"
+	"owl_server/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Name of the backend, as set in the "backend" setting
+const BACKEND_NAME = "memory"
+
+func init() {
+	db.Register(BACKEND_NAME, func(cfg config.Config) (db.DB, error) {
+		return NewMemoryDB(cfg.MergePolicy), nil
+	})
+}
+
+// Database keeping the events in memory, for tests and local development.
+// Everything is lost when the server stops.
+//
+// Updates are applied with the same semantics as TimescaleDB: updates can
+// arrive in any order, a label creates its step (without creation time) and
+// a step creates its event (without creation time) if they don't exist yet,
+// and when several updates set the same value the merge policy decides
+// which one is kept.
+type MemoryDB struct {
+	lock sync.RWMutex
+	connected bool
+	mergePolicy models.MergePolicy
+	// tenant -> event key -> event
+	events map[string]map[eventKey]*record
+}
+
+type eventKey struct {
+	name string
+	id string
+}
+
+type stepKey struct {
+	name string
+	number int
+}
+
+type labelKey struct {
+	step stepKey
+	key string
+}
+
+// An event, with the versions of the updates which set its values
+// (see models.MergePolicy).
+type record struct {
+	event models.Event
+	creationVersion int64
+	resultVersion int64
+	stepVersions map[stepKey]int64
+	labelVersions map[labelKey]int64
+}
+
+func NewMemoryDB(mergePolicy models.MergePolicy) *MemoryDB {
+	return &MemoryDB{
+		mergePolicy: mergePolicy,
+		events: map[string]map[eventKey]*record{},
+	}
+}
+
+func (db *MemoryDB) Connect() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.connected = true
+	return nil
+}
+
+// Disconnects from the database. The events are kept, and
+// available again after the next Connect.
+func (db *MemoryDB) Disconnect() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.connected = false
+	return nil
+}
+
+func (db *MemoryDB) InsertUpdate(tenant string, update models.Update) error {
+	return db.InsertUpdates(tenant, []models.Update{update})
+}
+
+// Inserts the updates atomically: if one of them is invalid, none is saved.
+func (db *MemoryDB) InsertUpdates(tenant string, updates []models.Update) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if !db.connected {
+		return fmt.Errorf("database is disconnected")
+	}
+	for _, update := range updates {
+		switch update.UpdateType {
+		case models.UPDATE_TYPE_START, models.UPDATE_TYPE_STEP, models.UPDATE_TYPE_LABEL, models.UPDATE_TYPE_END:
+		default:
+			return fmt.Errorf("%w: %v", models.ErrUnknownUpdateType, update.UpdateType)
+		}
+	}
+
+	for _, update := range updates {
+		switch update.UpdateType {
+		case models.UPDATE_TYPE_START:
+			db.insertStartUpdate(tenant, update)
+		case models.UPDATE_TYPE_STEP:
+			db.insertStepUpdate(tenant, update)
+		case models.UPDATE_TYPE_LABEL:
+			db.insertLabelUpdate(tenant, update)
+		case models.UPDATE_TYPE_END:
+			db.insertEndUpdate(tenant, update)
+		}
+	}
+	return nil
+}
+
+// Returns the event, creating it if it doesn't exist yet.
+// If timestamp is positive, it is written as the event creation time,
+// unless the merge policy keeps the current one.
+func (db *MemoryDB) createEvent(tenant string, eventName string, eventId string, timestamp int64, version int64) *record {
+	events, ok := db.events[tenant]
+	if !ok {
+		events = map[eventKey]*record{}
+		db.events[tenant] = events
+	}
+	key := eventKey{name: eventName, id: eventId}
+	rec, ok := events[key]
+	if !ok {
+		rec = &record{
+			event: models.Event{Name: eventName, Id: eventId, Steps: []models.Step{}},
+			stepVersions: map[stepKey]int64{},
+			labelVersions: map[labelKey]int64{},
+		}
+		events[key] = rec
+	}
+	if timestamp > 0 {
+		creationTime := models.TimestampToTime(timestamp)
+		current := rec.event.CreationTime
+		if current == nil || models.Overrides(db.mergePolicy, version, creationTime.UnixMilli(), rec.creationVersion, current.UnixMilli()) {
+			rec.event.CreationTime = &creationTime
+			rec.creationVersion = version
+		}
+	}
+	return rec
+}
+
+// Returns the step, creating it (and its event) if it doesn't exist yet.
+// If timestamp is positive, it is written as the step creation time,
+// unless the merge policy keeps the current one.
+func (db *MemoryDB) createStep(tenant string, eventName string, eventId string, stepName string, stepNumber int, timestamp int64, version int64) (*record, *models.Step) {
+	rec := db.createEvent(tenant, eventName, eventId, -1, 0)
+	var step *models.Step
+	for i := range rec.event.Steps {
+		if rec.event.Steps[i].Name == stepName && rec.event.Steps[i].Number == stepNumber {
+			step = &rec.event.Steps[i]
+			break
+		}
+	}
+	if step == nil {
+		rec.event.Steps = append(rec.event.Steps, models.Step{Name: stepName, Number: stepNumber, Labels: []models.Label{}})
+		step = &rec.event.Steps[len(rec.event.Steps) - 1]
+	}
+	if timestamp > 0 {
+		creationTime := models.TimestampToTime(timestamp)
+		key := stepKey{name: stepName, number: stepNumber}
+		current := step.CreationTime
+		if current == nil || models.Overrides(db.mergePolicy, version, creationTime.UnixMilli(), rec.stepVersions[key], current.UnixMilli()) {
+			step.CreationTime = &creationTime
+			rec.stepVersions[key] = version
+		}
+	}
+	return rec, step
+}
+
+func (db *MemoryDB) insertStartUpdate(tenant string, update models.Update) {
+	db.createEvent(tenant, update.EventName, update.EventId, update.Timestamp, update.Version())
+}
+
+func (db *MemoryDB) insertStepUpdate(tenant string, update models.Update) {
+	db.createStep(tenant, update.EventName, update.EventId, update.StepName, update.StepNumber, update.Timestamp, update.Version())
+}
+
+func (db *MemoryDB) insertLabelUpdate(tenant string, update models.Update) {
+	rec, step := db.createStep(tenant, update.EventName, update.EventId, update.StepName, update.StepNumber, -1, 0)
+	key := labelKey{step: stepKey{name: update.StepName, number: update.StepNumber}, key: update.LabelKey}
+	version := update.Version()
+	for i := range step.Labels {
+		if step.Labels[i].Key == update.LabelKey {
+			if models.Overrides(db.mergePolicy, version, update.LabelVal, rec.labelVersions[key], step.Labels[i].Val) {
+				step.Labels[i].Val = update.LabelVal
+				rec.labelVersions[key] = version
+			}
+			return
+		}
+	}
+	step.Labels = append(step.Labels, models.Label{
+		StepName: update.StepName,
+		StepNumber: update.StepNumber,
+		Key: update.LabelKey,
+		Val: update.LabelVal,
+	})
+	rec.labelVersions[key] = version
+}
+
+func (db *MemoryDB) insertEndUpdate(tenant string, update models.Update) {
+	rec := db.createEvent(tenant, update.EventName, update.EventId, -1, 0)
+	version := update.Version()
+	// the result of an abandoned event is replaced by the first end update
+	if rec.event.Result == "" || rec.event.Abandoned != nil || models.Overrides(db.mergePolicy, version, update.Result, rec.resultVersion, rec.event.Result) {
+		rec.event.Result = update.Result
+		rec.resultVersion = version
+		rec.event.Abandoned = nil
+	}
+	db.createStep(tenant, update.EventName, update.EventId, "end", update.StepNumber, update.Timestamp, version)
+}
+
+func (db *MemoryDB) GetEvent(tenant string, eventName string, eventId string) (*models.Event, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	rec, ok := db.events[tenant][eventKey{name: eventName, id: eventId}]
+	if !ok {
+		return nil, nil
+	}
+	result := copyEvent(&rec.event, true)
+	return &result, nil
+}
+
+// Lists the events matching the query, ordered by name then ID.
+// Steps are not returned.
+func (db *MemoryDB) ListEvents(tenant string, query models.EventQuery) ([]models.Event, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+
+	events := []models.Event{}
+	for _, rec := range db.events[tenant] {
+		if matches(&rec.event, query) {
+			events = append(events, copyEvent(&rec.event, false))
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Name != events[j].Name {
+			return events[i].Name < events[j].Name
+		}
+		return events[i].Id < events[j].Id
+	})
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[:query.Limit]
+	}
+	return events, nil
+}
+
+func (db *MemoryDB) GetSteps(tenant string, eventName string, eventId string) ([]models.Step, error) {
+	event, err := db.GetEvent(tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return []models.Step{}, nil
+	}
+	return event.Steps, nil
+}
+
+func (db *MemoryDB) GetLabels(tenant string, eventName string, eventId string) ([]models.Label, error) {
+	steps, err := db.GetSteps(tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	labels := []models.Label{}
+	for _, step := range steps {
+		labels = append(labels, step.Labels...)
+	}
+	return labels, nil
+}
+
+// Deletes the events created before their retention.
+// Events without creation time are kept.
+func (db *MemoryDB) PurgeExpired(policy models.RetentionPolicy, now time.Time) ([]models.PurgedEvents, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	purged := []models.PurgedEvents{}
+	for tenant, events := range db.events {
+		for key, rec := range events {
+			retention := policy.Retention(key.name)
+			creationTime := rec.event.CreationTime
+			if retention > 0 && creationTime != nil && creationTime.Before(now.Add(-retention)) {
+				delete(events, key)
+				purged = append(purged, models.PurgedEvents{Tenant: tenant, EventName: key.name, Count: 1})
+			}
+		}
+	}
+	return models.MergePurgedEvents(purged), nil
+}
+
+// Marks the events without end update inactive for longer than their
+// timeout as abandoned. Events without any creation time are kept waiting.
+func (db *MemoryDB) MarkAbandoned(policy models.AbandonmentPolicy, now time.Time) ([]models.AbandonedEvents, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if !db.connected {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	abandoned := []models.AbandonedEvents{}
+	for tenant, events := range db.events {
+		counts := map[string]int64{}
+		for key, rec := range events {
+			timeout := policy.Timeout(key.name)
+			lastActivity := models.LastActivity(&rec.event)
+			if rec.event.Result != "" || timeout <= 0 || lastActivity == nil || !lastActivity.Before(now.Add(-timeout)) {
+				continue
+			}
+			rec.event.Result = models.ABANDONED_RESULT
+			rec.resultVersion = 0
+			rec.event.Abandoned = &models.Abandonment{Time: now, LastStep: models.LastStep(rec.event.Steps)}
+			counts[key.name]++
+		}
+		for name, count := range counts {
+			abandoned = append(abandoned, models.AbandonedEvents{Tenant: tenant, EventName: name, Count: count})
+		}
+	}
+	return models.SortAbandonedEvents(abandoned), nil
+}
+
+// Returns true if the event passes the filters of the query
+func matches(event *models.Event, query models.EventQuery) bool {
+	if query.EventName != "" && event.Name != query.EventName {
+		return false
+	}
+	if !query.From.IsZero() && (event.CreationTime == nil || event.CreationTime.Before(query.From)) {
+		return false
+	}
+	if !query.To.IsZero() && (event.CreationTime == nil || !event.CreationTime.Before(query.To)) {
+		return false
+	}
+	if query.Result != "" && event.Result != query.Result {
+		return false
+	}
+	for key, value := range query.Labels {
+		if !event.HasLabel(key, value) {
+			return false
+		}
+	}
+	if query.AfterName != "" {
+		if event.Name < query.AfterName || (event.Name == query.AfterName && event.Id <= query.AfterId) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a deep copy of the event, so it can't be modified by the caller.
+// Steps are sorted by number then name, labels by key.
+func copyEvent(event *models.Event, withSteps bool) models.Event {
+	result := *event
+	result.Steps = nil
+	if event.Abandoned != nil {
+		abandoned := *event.Abandoned
+		result.Abandoned = &abandoned
+	}
+	if !withSteps {
+		return result
+	}
+	result.Steps = []models.Step{}
+	for _, step := range event.Steps {
+		stepCopy := step
+		stepCopy.Labels = append([]models.Label{}, step.Labels...)
+		sort.Slice(stepCopy.Labels, func(i, j int) bool {
+			return stepCopy.Labels[i].Key < stepCopy.Labels[j].Key
+		})
+		result.Steps = append(result.Steps, stepCopy)
+	}
+	sort.SliceStable(result.Steps, func(i, j int) bool {
+		if result.Steps[i].Number != result.Steps[j].Number {
+			return result.Steps[i].Number < result.Steps[j].Number
+		}
+		return result.Steps[i].Name < result.Steps[j].Name
+	})
+	return result
+}
@@ -0,0 +1,20 @@
+package memory
+
+import (
+	"owl_server/db"
+	"owl_server/db/conformance"
+	"owl_server/models"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T, mergePolicy models.MergePolicy) db.DB {
+		database := NewMemoryDB(mergePolicy)
+		err := database.Connect()
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		t.Cleanup(func() { database.Disconnect() })
+		return database
+	})
+}
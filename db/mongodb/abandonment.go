@@ -0,0 +1,102 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"owl_server/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Marks the events without end update inactive for longer than their
+// timeout as abandoned, in the collections of every tenant, recording
+// the step with the highest number. Events without any creation time
+// are kept waiting.
+func (db *MongoDB) MarkAbandoned(policy models.AbandonmentPolicy, now time.Time) ([]models.AbandonedEvents, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.TODO()
+	tenants, err := db.database.ListCollectionNames(ctx, bson.M{"type": "collection"})
+	if err != nil {
+		return nil, err
+	}
+	abandoned := []models.AbandonedEvents{}
+	names := policy.Names()
+	for _, tenant := range tenants {
+		// the other collections don't hold events
+		if !models.TENANT_PATTERN.MatchString(tenant) {
+			continue
+		}
+		collection := db.database.Collection(tenant)
+		for _, name := range names {
+			count, err := markAbandoned(ctx, collection, name, now.Add(-policy.Timeouts[name]), now)
+			if err != nil {
+				return models.SortAbandonedEvents(abandoned), fmt.Errorf("unable to mark the abandoned %s events of %s. Underlying error: %w", name, tenant, err)
+			}
+			abandoned = append(abandoned, models.AbandonedEvents{Tenant: tenant, EventName: name, Count: count})
+		}
+		if policy.Default <= 0 {
+			continue
+		}
+		// the other names are marked one at a time, to count them by name
+		others, err := collection.Distinct(ctx, "name", bson.M{
+			"name": bson.M{"$nin": names},
+			"result": nil,
+		})
+		if err != nil {
+			return models.SortAbandonedEvents(abandoned), fmt.Errorf("unable to list the unended events of %s. Underlying error: %w", tenant, err)
+		}
+		for _, other := range others {
+			name, ok := other.(string)
+			if !ok {
+				continue
+			}
+			count, err := markAbandoned(ctx, collection, name, now.Add(-policy.Default), now)
+			if err != nil {
+				return models.SortAbandonedEvents(abandoned), fmt.Errorf("unable to mark the abandoned %s events of %s. Underlying error: %w", name, tenant, err)
+			}
+			abandoned = append(abandoned, models.AbandonedEvents{Tenant: tenant, EventName: name, Count: count})
+		}
+	}
+	return models.SortAbandonedEvents(abandoned), nil
+}
+
+// Marks the events of the given name without end update, whose
+// last activity is before the cutoff, as abandoned
+func markAbandoned(ctx context.Context, collection *mongo.Collection, eventName string, cutoff time.Time, now time.Time) (int64, error) {
+	creation := bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{bson.M{"$type": "$creationTime"}, "date"}}, toTimestamp("$creationTime"), nil}}
+	// steps created by a label have a timestamp of -1
+	lastStepTimestamp := bson.M{"$max": bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{"input": "$steps", "cond": bson.M{"$gte": bson.A{"$$this.timestamp", 0}}}},
+		"in": "$$this.timestamp",
+	}}}
+	lastActivity := bson.M{"$max": bson.A{creation, lastStepTimestamp}}
+	cutoffTimestamp := cutoff.UnixMilli() - models.TIMESTAMP_REFERENCE_DATE.UnixMilli()
+
+	lastStep := bson.M{"$arrayElemAt": bson.A{bson.M{"$map": bson.M{
+		"input": bson.M{"$sortArray": bson.M{"input": "$steps", "sortBy": bson.D{{Key: "number", Value: -1}, {Key: "name", Value: -1}}}},
+		"in": bson.M{"name": "$$this.name", "number": "$$this.number"},
+	}}, 0}}
+	result, err := collection.UpdateMany(ctx, bson.M{
+		"name": eventName,
+		"result": nil,
+		// null (no creation time) is lower than every timestamp
+		"$expr": bson.M{"$and": bson.A{
+			bson.M{"$not": bson.A{isNull(lastActivity)}},
+			bson.M{"$lt": bson.A{lastActivity, cutoffTimestamp}},
+		}},
+	}, bson.A{
+		bson.M{"$set": bson.M{
+			"result": models.ABANDONED_RESULT,
+			"resultVersion": 0,
+			"abandoned": bson.M{"time": now, "lastStep": lastStep},
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
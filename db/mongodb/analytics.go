@@ -0,0 +1,334 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"owl_server/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Statistics computed by durationStatsStages
+type durationStats struct {
+	Count int64 `bson:"count"`
+	Min int64 `bson:"min"`
+	P50 int64 `bson:"p50"`
+	P90 int64 `bson:"p90"`
+	P95 int64 `bson:"p95"`
+	P99 int64 `bson:"p99"`
+	Max int64 `bson:"max"`
+}
+
+func (s durationStats) toModel() models.DurationStats {
+	return models.DurationStats{Count: s.Count, MinMs: s.Min, P50Ms: s.P50, P90Ms: s.P90, P95Ms: s.P95, P99Ms: s.P99, MaxMs: s.Max}
+}
+
+// Computes the durations and latencies with aggregation pipelines.
+// Step timestamps are client timestamps, while creation times are dates:
+// creation times are converted to client timestamps to subtract them.
+func (db *MongoDB) EventDurations(tenant string, query models.AnalyticsQuery) (*models.DurationAnalytics, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.TODO()
+	collection := db.collection(tenant)
+	result := &models.DurationAnalytics{
+		EventName: query.EventName,
+		Transitions: []models.StepTransition{},
+		Series: []models.DurationBucket{},
+	}
+
+	var overall []durationStats
+	err := aggregate(ctx, collection, &overall, analyticsMatch(query), eventDurations(), durationStatsStages(nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(overall) > 0 {
+		result.Duration = overall[0].toModel()
+	}
+
+	var transitions []struct {
+		Id struct {
+			FromName string `bson:"fromName"`
+			FromNumber int `bson:"fromNumber"`
+			ToName string `bson:"toName"`
+			ToNumber int `bson:"toNumber"`
+		} `bson:"_id"`
+		Stats durationStats `bson:",inline"`
+	}
+	err = aggregate(ctx, collection, &transitions, analyticsMatch(query), stepLatencies(), durationStatsStages(bson.M{
+		"fromName": "$fromName",
+		"fromNumber": "$fromNumber",
+		"toName": "$toName",
+		"toNumber": "$toNumber",
+	}), []bson.M{
+		{"$sort": bson.D{{Key: "_id.fromNumber", Value: 1}, {Key: "_id.fromName", Value: 1}, {Key: "_id.toNumber", Value: 1}, {Key: "_id.toName", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, transition := range transitions {
+		result.Transitions = append(result.Transitions, models.StepTransition{
+			From: models.StepRef{Name: transition.Id.FromName, Number: transition.Id.FromNumber},
+			To: models.StepRef{Name: transition.Id.ToName, Number: transition.Id.ToNumber},
+			Latency: transition.Stats.toModel(),
+		})
+	}
+
+	if query.Bucket <= 0 {
+		return result, nil
+	}
+	var series []struct {
+		Start time.Time `bson:"_id"`
+		Stats durationStats `bson:",inline"`
+	}
+	err = aggregate(ctx, collection, &series, analyticsMatch(query), eventDurations(),
+		durationStatsStages(bucketStart("$creationTime", query.Bucket)),
+		[]bson.M{{"$sort": bson.M{"_id": 1}}})
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range series {
+		result.Series = append(result.Series, models.DurationBucket{Start: bucket.Start.UTC(), Duration: bucket.Stats.toModel()})
+	}
+	return result, nil
+}
+
+// Runs the pipeline made of the given stages, and decodes all its results
+func aggregate(ctx context.Context, collection *mongo.Collection, results interface{}, stages ...[]bson.M) error {
+	pipeline := []bson.M{}
+	for _, s := range stages {
+		pipeline = append(pipeline, s...)
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+// Stage selecting the events of the query name whose creation time is within its range
+func analyticsMatch(query models.AnalyticsQuery) []bson.M {
+	creationTime := bson.M{"$type": "date"}
+	if !query.From.IsZero() {
+		creationTime["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		creationTime["$lt"] = query.To
+	}
+	return []bson.M{{"$match": bson.M{"name": query.EventName, "creationTime": creationTime}}}
+}
+
+// Client timestamp (milliseconds since models.TIMESTAMP_REFERENCE_DATE) of a date
+func toTimestamp(date interface{}) bson.M {
+	return bson.M{"$subtract": bson.A{bson.M{"$toLong": date}, models.TIMESTAMP_REFERENCE_DATE.UnixMilli()}}
+}
+
+// Start of the bucket holding the date, aligned on the Unix epoch (see models.BucketStart)
+func bucketStart(date interface{}, width time.Duration) bson.M {
+	millis := bson.M{"$toLong": date}
+	return bson.M{"$toDate": bson.M{"$subtract": bson.A{millis, bson.M{"$mod": bson.A{millis, width.Milliseconds()}}}}}
+}
+
+// Stages computing the creation time and duration of the events having an end step
+func eventDurations() []bson.M {
+	lastEnd := bson.M{"$max": bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{"input": "$steps", "cond": bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{"$$this.name", "end"}},
+			bson.M{"$gte": bson.A{"$$this.timestamp", 0}},
+		}}}},
+		"in": "$$this.timestamp",
+	}}}
+	return []bson.M{
+		{"$project": bson.M{"_id": 0, "creationTime": 1, "duration": bson.M{"$subtract": bson.A{lastEnd, toTimestamp("$creationTime")}}}},
+		{"$match": bson.M{"duration": bson.M{"$ne": nil}}},
+	}
+}
+
+// Stages computing the latencies between the steps of consecutive numbers
+func stepLatencies() []bson.M {
+	return []bson.M{
+		{"$project": bson.M{"steps": bson.M{"$filter": bson.M{"input": "$steps", "cond": bson.M{"$gte": bson.A{"$$this.timestamp", 0}}}}}},
+		{"$addFields": bson.M{"from": "$steps"}},
+		{"$unwind": "$from"},
+		{"$project": bson.M{"from": 1, "to": bson.M{"$filter": bson.M{
+			"input": "$steps",
+			"cond": bson.M{"$eq": bson.A{"$$this.number", bson.M{"$add": bson.A{"$from.number", 1}}}},
+		}}}},
+		{"$unwind": "$to"},
+		{"$project": bson.M{
+			"fromName": "$from.name",
+			"fromNumber": "$from.number",
+			"toName": "$to.name",
+			"toNumber": "$to.number",
+			"duration": bson.M{"$subtract": bson.A{"$to.timestamp", "$from.timestamp"}},
+		}},
+	}
+}
+
+// Stages grouping the documents by groupId, and computing the statistics
+// of their duration field (see durationStats). The percentiles are picked
+// from the sorted durations as percentile_disc does.
+func durationStatsStages(groupId interface{}) []bson.M {
+	percentile := func(p float64) bson.M {
+		index := bson.M{"$subtract": bson.A{bson.M{"$toInt": bson.M{"$ceil": bson.M{"$multiply": bson.A{p, "$count"}}}}, 1}}
+		return bson.M{"$arrayElemAt": bson.A{"$durations", bson.M{"$max": bson.A{index, 0}}}}
+	}
+	return []bson.M{
+		{"$group": bson.M{"_id": groupId, "durations": bson.M{"$push": "$duration"}}},
+		{"$addFields": bson.M{
+			"durations": bson.M{"$sortArray": bson.M{"input": "$durations", "sortBy": 1}},
+			"count": bson.M{"$size": "$durations"},
+		}},
+		{"$project": bson.M{
+			"count": 1,
+			"min": bson.M{"$arrayElemAt": bson.A{"$durations", 0}},
+			"p50": percentile(0.5),
+			"p90": percentile(0.9),
+			"p95": percentile(0.95),
+			"p99": percentile(0.99),
+			"max": bson.M{"$arrayElemAt": bson.A{"$durations", -1}},
+		}},
+	}
+}
+
+// Computes the funnel with an aggregation pipeline: the number of the
+// step matching each stage is added to the events, one stage at a time
+// (null when the event doesn't reach the stage), then counted by segment.
+func (db *MongoDB) Funnel(tenant string, query models.FunnelQuery) (*models.Funnel, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.TODO()
+
+	project := bson.M{"steps": 1}
+	var segment interface{}
+	if query.SegmentBy != "" {
+		project["segment"] = funnelSegment(query.SegmentBy)
+		segment = "$segment"
+	}
+	stages := []bson.M{{"$project": project}}
+	group := bson.M{"_id": segment, "events": bson.M{"$sum": 1}}
+	counts := bson.A{}
+	for i, step := range query.Steps {
+		field := fmt.Sprintf("n%d", i)
+		matching := bson.M{"$eq": bson.A{"$$this.name", step}}
+		previous := fmt.Sprintf("$n%d", i - 1)
+		if i > 0 {
+			matching = bson.M{"$and": bson.A{matching, bson.M{"$gt": bson.A{"$$this.number", previous}}}}
+		}
+		var number interface{} = bson.M{"$min": bson.M{"$map": bson.M{
+			"input": bson.M{"$filter": bson.M{"input": "$steps", "cond": matching}},
+			"in": "$$this.number",
+		}}}
+		if i > 0 {
+			// numbers are greater than null: keeps the events which didn't reach the previous stage out
+			number = bson.M{"$cond": bson.A{isNull(previous), nil, number}}
+		}
+		stages = append(stages, bson.M{"$addFields": bson.M{field: number}})
+		group[field] = bson.M{"$sum": bson.M{"$cond": bson.A{isNull("$" + field), 0, 1}}}
+		counts = append(counts, "$" + field)
+	}
+	stages = append(stages, bson.M{"$group": group}, bson.M{"$project": bson.M{"events": 1, "stages": counts}})
+
+	var results []struct {
+		Segment *string `bson:"_id"`
+		Events int64 `bson:"events"`
+		Stages []int64 `bson:"stages"`
+	}
+	err := aggregate(ctx, db.collection(tenant), &results, analyticsMatch(query.AnalyticsQuery), stages)
+	if err != nil {
+		return nil, err
+	}
+	result := []models.FunnelCounts{}
+	for _, r := range results {
+		result = append(result, models.FunnelCounts{Segment: r.Segment, Events: r.Events, Stages: r.Stages})
+	}
+	return models.NewFunnel(query, result), nil
+}
+
+func (db *MongoDB) EventResults(tenant string, query models.ResultQuery) (*models.ResultBreakdown, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.TODO()
+
+	var bucket interface{}
+	if query.Bucket > 0 {
+		bucket = bucketStart("$creationTime", query.Bucket)
+	}
+	var results []struct {
+		Id struct {
+			Bucket *time.Time `bson:"bucket"`
+			Result string `bson:"result"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	err := aggregate(ctx, db.collection(tenant), &results, analyticsMatch(query.AnalyticsQuery), []bson.M{
+		{"$group": bson.M{
+			"_id": bson.M{"bucket": bucket, "result": bson.M{"$ifNull": bson.A{"$result", ""}}},
+			"count": bson.M{"$sum": 1},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := []models.ResultCount{}
+	for _, r := range results {
+		counts = append(counts, models.ResultCount{Bucket: r.Id.Bucket, Result: r.Id.Result, Count: r.Count})
+	}
+	return models.NewResultBreakdown(query, counts), nil
+}
+
+func (db *MongoDB) Abandonment(tenant string, query models.AnalyticsQuery) (*models.AbandonmentBreakdown, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	var results []struct {
+		Step *StepRef `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	err := aggregate(context.TODO(), db.collection(tenant), &results, analyticsMatch(query), []bson.M{
+		{"$match": bson.M{"abandoned": bson.M{"$exists": true}}},
+		{"$group": bson.M{"_id": "$abandoned.lastStep", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := []models.LastStepCount{}
+	for _, r := range results {
+		c := models.LastStepCount{Count: r.Count}
+		if r.Step != nil {
+			c.Step = &models.StepRef{Name: r.Step.Name, Number: r.Step.Number}
+		}
+		counts = append(counts, c)
+	}
+	return models.NewAbandonmentBreakdown(query.EventName, counts), nil
+}
+
+// Expression of the value of the label of the given key on the smallest
+// step (by number then name) having it. Missing if no step has it
+func funnelSegment(key string) bson.M {
+	labels := bson.M{"$reduce": bson.M{
+		"input": "$steps",
+		"initialValue": bson.A{},
+		"in": bson.M{"$concatArrays": bson.A{"$$value", bson.M{"$map": bson.M{
+			"input": bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$$this.labels", bson.A{}}},
+				"as": "label",
+				"cond": bson.M{"$eq": bson.A{"$$label.key", key}},
+			}},
+			"as": "label",
+			"in": bson.M{"number": "$$this.number", "name": "$$this.name", "val": "$$label.val"},
+		}}}},
+	}}
+	sorted := bson.M{"$sortArray": bson.M{"input": labels, "sortBy": bson.D{{Key: "number", Value: 1}, {Key: "name", Value: 1}}}}
+	return bson.M{"$arrayElemAt": bson.A{bson.M{"$map": bson.M{"input": sorted, "in": "$$this.val"}}, 0}}
+}
+
+// Expression true if the value is null or missing
+func isNull(value interface{}) bson.M {
+	return bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{value, nil}}, nil}}
+}
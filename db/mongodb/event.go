@@ -2,7 +2,9 @@ package mongodb
 
 import (
 	"fmt"
+	"owl_server/models"
 	"strings"
+	"time"
 )
 
 // Represents an event as saved in the mongoDB database.
@@ -12,7 +14,15 @@ type Event struct {
 	Name string `bson:"name"`
 	Id string `bson:"_id"`
 	Result string `bson:"result"`
+	CreationTime *time.Time `bson:"creationTime,omitempty"`
 	Steps []Step `bson:"steps"`
+	// set if the event was marked as abandoned before its end update
+	Abandoned *Abandonment `bson:"abandoned,omitempty"`
+
+	// versions of the updates which set the creation time
+	// and the result, compared by the merge policy
+	CreationVersion int64 `bson:"creationVersion"`
+	ResultVersion int64 `bson:"resultVersion"`
 }
 
 func (e Event) String() string {
@@ -30,6 +40,41 @@ func (e Event) String() string {
 }
 
 
+// Converts the event, owned by the given tenant, to the common models.Event format.
+func (e Event) toModel(tenant string) models.Event {
+	steps := []models.Step{}
+	for _, step := range e.Steps {
+		steps = append(steps, step.toModel())
+	}
+	event := models.Event{
+		Name: e.Name,
+		Id: getClientEventID(tenant, e.Name, e.Id),
+		CreationTime: e.CreationTime,
+		Result: e.Result,
+		Steps: steps,
+	}
+	if e.Abandoned != nil {
+		event.Abandoned = &models.Abandonment{Time: e.Abandoned.Time}
+		if e.Abandoned.LastStep != nil {
+			event.Abandoned.LastStep = &models.StepRef{Name: e.Abandoned.LastStep.Name, Number: e.Abandoned.LastStep.Number}
+		}
+	}
+	return event
+}
+
+// Represents the abandonment of an event as saved in the mongoDB database.
+type Abandonment struct {
+	Time time.Time `bson:"time"`
+	// missing if the event has no step
+	LastStep *StepRef `bson:"lastStep,omitempty"`
+}
+
+// Identifies a step of an event
+type StepRef struct {
+	Name string `bson:"name"`
+	Number int `bson:"number"`
+}
+
 // Represents a step as saved in the mongoDB database.
 // Steps retrieved from the database will have this
 // format.
@@ -38,6 +83,8 @@ type Step struct {
 	Number int `bson:"number"`
 	Timestamp int64 `bson:"timestamp"`
 	Labels []Label `bson:"labels"`
+	// version of the update which set the timestamp
+	Version int64 `bson:"version"`
 }
 
 func (s Step) String() string {
@@ -54,12 +101,37 @@ func (s Step) String() string {
 	return fmt.Sprintf("Step{name: %s, number: %d, timestamp: %d, labels: %v}", s.Name, s.Number, s.Timestamp, builder.String())
 }
 
+// Converts the step to the common models.Step format.
+func (s Step) toModel() models.Step {
+	step := models.Step{
+		Name: s.Name,
+		Number: s.Number,
+		Labels: []models.Label{},
+	}
+	// steps created by a label have a timestamp of -1
+	if s.Timestamp >= 0 {
+		creationTime := models.TimestampToTime(s.Timestamp)
+		step.CreationTime = &creationTime
+	}
+	for _, label := range s.Labels {
+		step.Labels = append(step.Labels, models.Label{
+			StepName: s.Name,
+			StepNumber: s.Number,
+			Key: label.Key,
+			Val: label.Val,
+		})
+	}
+	return step
+}
+
 // Represents a label as saved in the mongoDB database.
 // Labels retrieved from the database will have this
 // format.
 type Label struct {
 	Key string `bson:"key"`
 	Val string `bson:"val"`
+	// version of the update which set the value
+	Version int64 `bson:"version"`
 }
 
 func (l Label) String() string {
@@ -0,0 +1,272 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"owl_server/db"
+	"owl_server/models"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection recording the applied migrations. Its name doesn't match
+// models.TENANT_PATTERN, so it is never taken for the events of a tenant.
+const MIGRATIONS_COLLECTION = "schema-migrations"
+
+// A versioned change of the layout of the events, applied to the
+// collection of every tenant. Migrations are written so that running
+// them twice (e.g. by servers starting at the same time) is harmless.
+// They can't be reverted.
+type migration struct {
+	version int
+	name string
+	up func(ctx context.Context, collection *mongo.Collection) error
+}
+
+// Migrations known by the server, ordered by version.
+// A migration must never be modified once released: change the
+// layout by adding a new one.
+var MIGRATIONS = []migration{
+	{version: 1, name: "event_layout", up: migrateEventLayout},
+}
+
+// Version of the latest migration known by the server
+func latestVersion() int {
+	return len(MIGRATIONS)
+}
+
+// Brings the events written by older servers to the layout of the
+// latest version known by the server.
+//
+// Refuses to start on a database migrated by a newer server.
+func (db *MongoDB) CreateTables() error {
+	if db.database == nil {
+		return fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+	current, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	latest := latestVersion()
+	if current > latest {
+		return fmt.Errorf("the database has version %d, newer than the latest version known by this server (%d): upgrade the server", current, latest)
+	}
+	if current < latest {
+		log.Printf("Migrating the events from version %d to version %d...", current, latest)
+		err = db.migrate(ctx, current, latest)
+		if err != nil {
+			return err
+		}
+		log.Printf("Migration done.")
+	}
+	return nil
+}
+
+// Lists the migrations known by the server, and the ones applied
+// to the database by a newer server, ordered by version.
+func (db *MongoDB) Migrations() ([]db.Migration, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	applied, err := appliedMigrations(context.Background(), db.database)
+	if err != nil {
+		return nil, err
+	}
+	return listMigrations(applied), nil
+}
+
+// Merges the known migrations with the applied ones
+func listMigrations(applied map[int]db.Migration) []db.Migration {
+	result := []db.Migration{}
+	for _, m := range MIGRATIONS {
+		entry := db.Migration{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			entry.AppliedAt = a.AppliedAt
+		}
+		result = append(result, entry)
+	}
+	for version, a := range applied {
+		if version > latestVersion() {
+			a.Unknown = true
+			result = append(result, a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result
+}
+
+// Applies the migrations until the database has the given version.
+// The migrations can't be reverted.
+func (db *MongoDB) Migrate(version int) error {
+	if db.database == nil {
+		return fmt.Errorf("database is disconnected")
+	}
+	if version < 0 || version > latestVersion() {
+		return fmt.Errorf("unknown schema version %d, the latest version is %d", version, latestVersion())
+	}
+	ctx := context.Background()
+	current, err := db.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version < current {
+		return fmt.Errorf("the MongoDB migrations can't be reverted")
+	}
+	return db.migrate(ctx, current, version)
+}
+
+// Migrations recorded in the migrations collection, by version
+func appliedMigrations(ctx context.Context, database *mongo.Database) (map[int]db.Migration, error) {
+	cursor, err := database.Collection(MIGRATIONS_COLLECTION).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []struct {
+		Version int `bson:"_id"`
+		Name string `bson:"name"`
+		AppliedAt time.Time `bson:"appliedAt"`
+	}
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]db.Migration{}
+	for _, record := range records {
+		appliedAt := record.AppliedAt
+		applied[record.Version] = db.Migration{Version: record.Version, Name: record.Name, AppliedAt: &appliedAt}
+	}
+	return applied, nil
+}
+
+// Version of the last migration applied to the database, 0 if none
+func (db *MongoDB) schemaVersion(ctx context.Context) (int, error) {
+	applied, err := appliedMigrations(ctx, db.database)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// Applies the migrations following the current version, up to the target
+// version, to the collection of every tenant, then records them
+func (db *MongoDB) migrate(ctx context.Context, current int, target int) error {
+	if current > latestVersion() {
+		return fmt.Errorf("the database has version %d, newer than the latest version known by this server (%d): upgrade the server", current, latestVersion())
+	}
+	if current >= target {
+		return nil
+	}
+	tenants, err := db.database.ListCollectionNames(ctx, bson.M{"type": "collection"})
+	if err != nil {
+		return err
+	}
+	for version := current + 1; version <= target; version++ {
+		m := MIGRATIONS[version-1]
+		log.Printf("Applying migration %d (%s)...", m.version, m.name)
+		for _, tenant := range tenants {
+			// the other collections don't hold events
+			if !models.TENANT_PATTERN.MatchString(tenant) {
+				continue
+			}
+			err = m.up(ctx, db.database.Collection(tenant))
+			if err != nil {
+				return fmt.Errorf("unable to apply migration %d (%s) to %s. Underlying error: %w", m.version, m.name, tenant, err)
+			}
+		}
+		_, err = db.database.Collection(MIGRATIONS_COLLECTION).UpdateOne(ctx,
+			bson.M{"_id": m.version},
+			bson.M{"$setOnInsert": bson.M{"name": m.name, "appliedAt": time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to record migration %d (%s). Underlying error: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// Converts the events written before the merge policy existed:
+//   - their creation time was saved as if the start timestamp (milliseconds
+//     since 2001) was a number of seconds since 1970
+//   - their start update was also saved as a step, with the start timestamp
+//   - their values have no version. They are given version 0, so that
+//     they are the oldest values for the merge policy
+//
+// The start step is recognized by its timestamp, equal to the start
+// timestamp, and removed unless it has labels (it is then a step the
+// client logged labels on).
+func migrateEventLayout(ctx context.Context, collection *mongo.Collection) error {
+	// the events written since have a creation version along with their creation time
+	cursor, err := collection.Find(ctx,
+		bson.M{"creationTime": bson.M{"$ne": nil}, "creationVersion": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"creationTime": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var event struct {
+			Id string `bson:"_id"`
+			CreationTime time.Time `bson:"creationTime"`
+		}
+		err = cursor.Decode(&event)
+		if err != nil {
+			return err
+		}
+		startTimestamp := event.CreationTime.UnixMilli() / 1000
+		_, err = collection.UpdateOne(ctx,
+			bson.M{"_id": event.Id, "creationVersion": bson.M{"$exists": false}, "creationTime": event.CreationTime},
+			bson.M{
+				"$set": bson.M{
+					"creationTime": models.TimestampToTime(startTimestamp),
+					"creationVersion": int64(0),
+				},
+				"$pull": bson.M{"steps": bson.M{"timestamp": startTimestamp, "labels": bson.M{"$size": 0}}},
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	err = cursor.Err()
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"resultVersion": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"resultVersion": int64(0)}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"steps": bson.M{"$elemMatch": bson.M{"version": bson.M{"$exists": false}}}},
+		bson.M{"$set": bson.M{"steps.$[step].version": int64(0)}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"step.version": bson.M{"$exists": false}},
+		}}),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"steps.labels": bson.M{"$elemMatch": bson.M{"version": bson.M{"$exists": false}}}},
+		bson.M{"$set": bson.M{"steps.$[].labels.$[label].version": int64(0)}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"label.version": bson.M{"$exists": false}},
+		}}),
+	)
+	return err
+}
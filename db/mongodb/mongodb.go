@@ -2,54 +2,57 @@ package mongodb
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/url"
-	"os"
+	"strings"
+	"sync"
+	"owl_server/config"
 	"owl_server/models"
-	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const PORT = 27017
-const USER string = "morel"
-const DB_NAME string = "owl_users"
-
 type MongoDB struct {
+	config config.MongoDBConfig
+	mergePolicy models.MergePolicy
 	client *mongo.Client
-	collection *mongo.Collection
+	database *mongo.Database
+
+	// tenant -> *mongo.Collection, for the tenants whose
+	// collection indexes have already been created
+	collections sync.Map
+}
+
+// Creates a (disconnected) MongoDB.
+func NewMongoDB(dbConfig config.MongoDBConfig, mergePolicy models.MergePolicy) *MongoDB {
+	return &MongoDB{config: dbConfig, mergePolicy: mergePolicy}
 }
 
-// Connects to the MongoDB server, accesses the database
-// and the user's collection. Stores a pointer to the user's
-// collection for later use.
+// Connects to the MongoDB server and accesses the database.
+// Stores a pointer to the database for later use. The events
+// of each tenant are stored in a collection named after the tenant.
 //
 // Returns an error if any of these steps fail.
 func (db *MongoDB) Connect() error {
 	// log.Println("Connecting to mongodb.")
-	var uri, err = getConnectionString()
-	if err != nil {
-		return err
+	clientOptions := options.Client().ApplyURI(db.config.URI)
+	if db.config.PoolSize > 0 {
+		clientOptions.SetMaxPoolSize(uint64(db.config.PoolSize))
 	}
-
-	clientOptions := options.Client().ApplyURI(uri)
+	if db.config.ConnectTimeout > 0 {
+		clientOptions.SetConnectTimeout(db.config.ConnectTimeout.Duration())
+	}
+	var err error
 	db.client, err = mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		return err
 	}
 
-	database := db.client.Database(DB_NAME)
-	if database == nil {
-		return fmt.Errorf("could not open the database %v", DB_NAME)
-	}
-
-	db.collection = database.Collection(USER)
-	if db.collection == nil {
-		return fmt.Errorf("could not open the collection %v", USER)
+	db.database = db.client.Database(db.config.Database)
+	if db.database == nil {
+		return fmt.Errorf("could not open the database %v", db.config.Database)
 	}
 
 	// log.Println("Connected to mongodb.")
@@ -72,41 +75,45 @@ func (db *MongoDB) Disconnect() error {
 	return nil
 }
 
-type ConnectionConfig struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	RemainingURI string `json:remainingURI`
-}
-
-func getConnectionString() (string, error) {
-	configString, err := os.ReadFile("connectionConfigs/mongodbConnectionConfig.json")
-	if err != nil {
-		return "", fmt.Errorf("unable to retrieve connection string. Underlying error: %s", err.Error())
+// Returns the collection holding the events of the tenant.
+// The first time a tenant is seen, the indexes used to list
+// and search events are created (MongoDB creates the collection
+// itself on first use).
+func (db *MongoDB) collection(tenant string) *mongo.Collection {
+	if collection, ok := db.collections.Load(tenant); ok {
+		return collection.(*mongo.Collection)
 	}
-	var config ConnectionConfig
-	err = json.Unmarshal(configString, &config)
+	collection := db.database.Collection(tenant)
+	_, err := collection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "creationTime", Value: 1}}},
+		{Keys: bson.D{{Key: "steps.labels.key", Value: 1}, {Key: "steps.labels.val", Value: 1}}},
+	})
 	if err != nil {
-		return "", fmt.Errorf("unable to retrieve connection string. Underlying error: %s", err.Error())
+		// Not fatal, queries are just slower. Will be retried on next use
+		log.Printf("unable to create the indexes of collection %s: %s", tenant, err)
+		return collection
 	}
-	return "mongodb+srv://" + config.Username + ":" + url.QueryEscape(config.Password) + "@" + config.RemainingURI, nil
+	db.collections.Store(tenant, collection)
+	return collection
 }
 
-// Creates an stores the event in the database.
+// Creates and stores the event in the database, if it doesn't exist yet.
+// The event is upserted, so concurrent creations of the same event
+// don't fail with a duplicate key error.
 // Returns an error if the db insertion fails.
-func (db *MongoDB) createEvent(eventName string, eventId string) error {
+func (db *MongoDB) createEvent(tenant string, eventName string, eventId string) error {
 	// log.Printf("Creating event %v, %v", eventName, eventId)
+	filter := bson.M{"_id": GetID(tenant, eventName, eventId)}
 	query := bson.M{
-		"_id": GetID(eventName, eventId),
-		"name": eventName,
-		"steps": []interface{}{},
-		"result": nil,
-	}
-	_, err := db.collection.InsertOne(context.TODO(), query)
-	if err != nil {
-		return err
+		"$setOnInsert": bson.M{
+			"name": eventName,
+			"steps": []interface{}{},
+			"result": nil,
+		},
 	}
-	// log.Printf("Inserted ID: %v", result.InsertedID)
-	return nil
+	_, err := db.collection(tenant).UpdateOne(context.TODO(), filter, query, options.Update().SetUpsert(true))
+	return err
 }
 
 // Retrieves an event from the database.
@@ -115,11 +122,11 @@ func (db *MongoDB) createEvent(eventName string, eventId string) error {
 // if the db retrieval fails.
 // However, if the retrieval succeeds but there is no event with that (name, ID)
 // in the database, it returns (nil, nil)
-func (db *MongoDB) getEvent(eventName string, eventId string) (*Event, error) {
+func (db *MongoDB) getEvent(tenant string, eventName string, eventId string) (*Event, error) {
 	// log.Printf("Getting event %v, %v", eventName, eventId)
 
-	query := bson.M{"_id": GetID(eventName, eventId)}
-	result := db.collection.FindOne(context.TODO(), query)
+	query := bson.M{"_id": GetID(tenant, eventName, eventId)}
+	result := db.collection(tenant).FindOne(context.TODO(), query)
 	
 	var event Event
 	err := result.Decode(&event)
@@ -141,237 +148,244 @@ func (db *MongoDB) getEvent(eventName string, eventId string) (*Event, error) {
 //
 // If any error occurs during the insertion of the update
 // to the db, an error is returned as well.
-func (db *MongoDB) InsertUpdate(update models.Update) error {
+func (db *MongoDB) InsertUpdate(tenant string, update models.Update) error {
+	if db.database == nil {
+		return fmt.Errorf("database is disconnected")
+	}
+	switch update.UpdateType {
+	case models.UPDATE_TYPE_START, models.UPDATE_TYPE_STEP, models.UPDATE_TYPE_LABEL, models.UPDATE_TYPE_END:
+	default:
+		return fmt.Errorf("%w: %v", models.ErrUnknownUpdateType, update.UpdateType)
+	}
 	// log.Printf("Inserting update %s\n", update)
-	// Get or create event
-	event, err := db.getEvent(update.EventName, update.EventId)
+	// Create the event if it doesn't exist
+	err := db.createEvent(tenant, update.EventName, update.EventId)
 	if err != nil {
 		return err
 	}
-	if event == nil {
-		err := db.createEvent(update.EventName, update.EventId)
-		if err != nil {
-			return err
-		}
-	}
 	switch update.UpdateType {
 	case models.UPDATE_TYPE_START:
-		return db.insertStartUpdate(update)
+		return db.insertStartUpdate(tenant, update)
 	case models.UPDATE_TYPE_STEP:
-		return db.insertStepUpdate(update)
+		return db.insertStepUpdate(tenant, update)
 	case models.UPDATE_TYPE_LABEL:
-		return db.insertLabelUpdate(update)
+		return db.insertLabelUpdate(tenant, update)
 	case models.UPDATE_TYPE_END:
-		return db.insertEndUpdate(update)
+		return db.insertEndUpdate(tenant, update)
 	default:
-		return fmt.Errorf("unknown update: %v", update.UpdateType)
+		return fmt.Errorf("%w: %v", models.ErrUnknownUpdateType, update.UpdateType)
 	}
 }
 
-// Inserts the start update to the database
-func (db *MongoDB) insertStartUpdate(update models.Update) error {
-	// A start is basically a step
-	err := db.insertStepUpdate(update)
-	if err != nil {
-		return err
+// Inserts the given updates one by one, in order.
+// Stops at the first update that fails to be inserted,
+// so the updates preceding it stay saved.
+func (db *MongoDB) InsertUpdates(tenant string, updates []models.Update) error {
+	for i, update := range updates {
+		err := db.InsertUpdate(tenant, update)
+		if err != nil {
+			return fmt.Errorf("update %d: %w", i, err)
+		}
 	}
-	
-	// update creation time. The event should have been created already
-	creationTime := time.UnixMilli(update.Timestamp * 1000)
-	log.Printf("Updating creation time %v, %v for event %v", update.Timestamp * 1000, creationTime.Format("2006-01-02 15:04:05"), GetID(update.EventName, update.EventId))
+	return nil
+}
+
+// Filter matching the documents (or, with the field of an array filter,
+// the array elements) whose current value is replaced by the value set by
+// an update of the given version, according to the merge policy.
+// Same as models.Overrides, but evaluated by MongoDB in the same operation
+// as the write, so that concurrent updates can't overwrite a newer value.
+func (db *MongoDB) overrides(versionField string, valueField string, version int64, value interface{}) bson.M {
+	// the current value is replaced if it is lower (or greater) than the new one
+	operator := "$lt"
+	if db.mergePolicy.FirstWriterWins() {
+		operator = "$gt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{versionField: bson.M{operator: version}},
+		bson.M{versionField: version, valueField: bson.M{operator: value}},
+	}}
+}
+
+// Inserts the start update to the database.
+// The start only sets the creation time of the event
+// (which should have been created already), it isn't a step.
+// The current creation time is kept if the merge policy says so.
+func (db *MongoDB) insertStartUpdate(tenant string, update models.Update) error {
+	if update.Timestamp <= 0 {
+		return nil
+	}
+	creationTime := models.TimestampToTime(update.Timestamp)
 	filter := bson.M{
-		"_id": GetID(update.EventName, update.EventId),
+		"_id": GetID(tenant, update.EventName, update.EventId),
+		"$or": bson.A{
+			bson.M{"creationTime": nil},
+			db.overrides("creationVersion", "creationTime", update.Version(), creationTime),
+		},
 	}
 	query := bson.M{
 		"$set": bson.M{
 			"creationTime": creationTime,
+			"creationVersion": update.Version(),
 		},
 	}
-	res, err := db.collection.UpdateOne(context.TODO(), filter, query)
-	log.Printf("Update result: %v", res)
+	_, err := db.collection(tenant).UpdateOne(context.TODO(), filter, query)
 	return err
 }
 
 // Inserts the step update to the database.
-func (db *MongoDB) insertStepUpdate(update models.Update) error {
-	return db.createStep(update.EventName, update.EventId, update.StepName, update.StepNumber, update.Timestamp)
+func (db *MongoDB) insertStepUpdate(tenant string, update models.Update) error {
+	return db.createStep(tenant, update.EventName, update.EventId, update.StepName, update.StepNumber, update.Timestamp, update.Version())
 }
 
 // Inserts the given label update to the database.
 // If the corresponding step doesn't exist yet, it will create it with a timestamp of -1
 // When the step update will be inserted, the timestamp will be updated.
-func (db *MongoDB) insertLabelUpdate(update models.Update) error {
+func (db *MongoDB) insertLabelUpdate(tenant string, update models.Update) error {
 	// If step doesn't exist yet, create it
-	// log.Printf("Creating corresponding step %v, %v (if it doesn't exist)", update.StepName, update.StepNumber)
-	err := db.createStep(update.EventName, update.EventId, update.StepName, update.StepNumber, -1)
+	err := db.createStep(tenant, update.EventName, update.EventId, update.StepName, update.StepNumber, -1, 0)
 	if (err != nil) {
 		return err
 	}
 
-	// retrieve the step
-	// log.Printf("Retrieving corresponding step %v, %v", update.StepName, update.StepNumber)
-	step, err := db.getStep(update.EventName, update.EventId, update.StepNumber)
-	if err != nil {
-		return err
+	// New label. Create it, unless the step already has it
+	filter := bson.M{
+		"_id": GetID(tenant, update.EventName, update.EventId),
+		"steps": bson.M{"$elemMatch": bson.M{
+			"number": update.StepNumber,
+			"name": update.StepName,
+			"labels.key": bson.M{"$ne": update.LabelKey},
+		}},
 	}
-	if step == nil {
-		// If step doesn't exist at this point, there is a bug
-		return fmt.Errorf("could not retrieve step with name %v and number %d", update.StepName, update.StepNumber)
+	query := bson.M{
+		"$push": bson.M{
+			"steps.$.labels": bson.M{
+				"key": update.LabelKey,
+				"val": update.LabelVal,
+				"version": update.Version(),
+			},
+		},
 	}
-
-	for _, label := range step.Labels {
-		if label.Key == update.LabelKey {
-			// duplicate label: this means the client logged the same label multiple times
-			// update the label value
-			// Note: Since these updates can come out of order, there's no guarantee that
-			// this will be the latest label value
-			// log.Printf("Label %v, %v had already been inserted in the db. Will override", update.LabelKey, update.LabelVal)
-
-			filter := bson.M{
-				"_id": GetID(update.EventName, update.EventId),
-			}
-
-			query := bson.M{
-				"$set": bson.M{
-					"steps.$[elem1].labels.$[elem2].val": update.LabelVal,
-				},
-			}
-
-			options := options.Update().SetArrayFilters(options.ArrayFilters{
-				Filters: []interface{}{
-					bson.M{"elem1.number": update.StepNumber},
-					bson.M{"elem2.key": update.LabelKey},
-				},
-			})
-
-			_, err = db.collection.UpdateOne(context.TODO(), filter, query, options)
-			return err
-		}
+	result, err := db.collection(tenant).UpdateOne(context.TODO(), filter, query)
+	if err != nil || result.MatchedCount > 0 {
+		return err
 	}
 
-	// New label. Create it
-	// log.Printf("Label %v, %v is new. Creating it and inserting into the db", update.LabelKey, update.LabelVal)
-	filter := bson.M{
-        "_id": GetID(update.EventName, update.EventId),
-        "steps.number": update.StepNumber,
-    }
-
-    query := bson.M{
-        "$push": bson.M{
-            "steps.$.labels": bson.M{
-                "key": update.LabelKey,
-                "val": update.LabelVal,
-            },
-        },
-    }
-
-    // Execute the update operation
-    _, err = db.collection.UpdateOne(context.TODO(), filter, query)
+	// duplicate label: this means the client logged the same label multiple times.
+	// Since these updates can come out of order, the merge policy
+	// decides which value is kept
+	filter = bson.M{"_id": GetID(tenant, update.EventName, update.EventId)}
+	query = bson.M{
+		"$set": bson.M{
+			"steps.$[elem1].labels.$[elem2].val": update.LabelVal,
+			"steps.$[elem1].labels.$[elem2].version": update.Version(),
+		},
+	}
+	labelFilter := db.overrides("elem2.version", "elem2.val", update.Version(), update.LabelVal)
+	labelFilter["elem2.key"] = update.LabelKey
+	options := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{
+			bson.M{"elem1.number": update.StepNumber, "elem1.name": update.StepName},
+			labelFilter,
+		},
+	})
+	_, err = db.collection(tenant).UpdateOne(context.TODO(), filter, query, options)
 	return err
 }
 
 // Inserts the given end update to the database.
-// Creates an 'end' step and saves the result.
+// Creates an 'end' step and saves the result
+// (unless the merge policy keeps the current one).
 // Returns an error if any of these steps failed.
-func (db *MongoDB) insertEndUpdate(update models.Update) error {
+func (db *MongoDB) insertEndUpdate(tenant string, update models.Update) error {
 	// Add end step
-	// log.Println("Creating end step")
-	err := db.createStep(update.EventName, update.EventId, "end", update.StepNumber, update.Timestamp)
+	err := db.createStep(tenant, update.EventName, update.EventId, "end", update.StepNumber, update.Timestamp, update.Version())
 	if err != nil {
 		return err
 	}
 
-	// Save result
-	// log.Printf("Saving result %s", update.Result)
+	// Save result. The result of an abandoned event is replaced by the first end update
 	filter := bson.M{
-		"_id": GetID(update.EventName, update.EventId),
+		"_id": GetID(tenant, update.EventName, update.EventId),
+		"$or": bson.A{
+			bson.M{"result": bson.M{"$in": bson.A{nil, ""}}},
+			bson.M{"abandoned": bson.M{"$exists": true}},
+			db.overrides("resultVersion", "result", update.Version(), update.Result),
+		},
 	}
 	query := bson.M{
 		"$set": bson.M{
 			"result": update.Result,
+			"resultVersion": update.Version(),
 		},
+		"$unset": bson.M{"abandoned": ""},
 	}
-	_, err = db.collection.UpdateOne(context.TODO(), filter, query)
+	_, err = db.collection(tenant).UpdateOne(context.TODO(), filter, query)
 	return err
 }
 
-// Retrieves the step from the database, given the event name, event Id
-// and step number.
-// If there is an error retrieving the step, the error is returned.
-// Otherwise a pointer to the given step is returned.
-func (db *MongoDB) getStep(eventName string, eventId string, stepNumber int) (*Step, error) {
-	// log.Printf("Looking for step #%d in the database", stepNumber)
-	event, err := db.getEvent(eventName, eventId)
-	if err != nil {
-		return nil, err
-	}
-	if event == nil {
-		return nil, fmt.Errorf("couldn't find the event with event name %s and id %s", eventName, eventId)
+// Creates a step if it doesn't exist.
+// If the step does exist and the given timestamp is set (> 0),
+// the timestamp is written, unless the merge policy keeps the current one.
+// Steps added by a label have no timestamp (timestamp == -1) until
+// their step update arrives.
+// Returns an error if any of these steps fails
+func (db *MongoDB) createStep(tenant string, eventName string, eventId string, stepName string, stepNumber int, timestamp int64, version int64) error {
+	if timestamp <= 0 {
+		timestamp = -1
+		version = 0
 	}
 
-	for _, step := range event.Steps {
-		if step.Number == stepNumber {
-			// log.Printf("Step retrieved: %v", step)
-			return &step, nil
-		}
+	// Create the step, unless it already exists
+	filter := bson.M{
+		"_id": GetID(tenant, eventName, eventId),
+		"steps": bson.M{"$not": bson.M{"$elemMatch": bson.M{"number": stepNumber, "name": stepName}}},
 	}
-	return nil, nil
-}
-
-// Creates a step if it doesn't exist.
-// If the step does exist, but the timestamp doesn't (timestamp == -1),
-// the timestamp is updated.
-// Returns an error if any of these steps fails
-func (db *MongoDB) createStep(eventName string, eventId string, stepName string, stepNumber int, timestamp int64) error {
-	// log.Printf("Creating step %s", stepName)
-	step, err := db.getStep(eventName, eventId, stepNumber)
-	if err != nil {
+	query := bson.M{
+		"$push": bson.M{
+			"steps": bson.M{
+				"name": stepName,
+				"number": stepNumber,
+				"timestamp": timestamp,
+				"version": version,
+				"labels": []string{},
+			},
+		},
+	}
+	result, err := db.collection(tenant).UpdateOne(context.TODO(), filter, query)
+	if err != nil || result.MatchedCount > 0 || timestamp <= 0 {
 		return err
 	}
 
-	filter := bson.M{"_id": GetID(eventName, eventId)}
-
-	if step != nil {
-		if (step.Timestamp == -1) {
-			// step was previously added by a label,
-			// so it has no timestamp. Update the timestamp
-			// log.Printf("step %s had no timestamp. Updating the timestamp", stepName)
-			query := bson.M{
-				"$set": bson.M{
-					"steps.$[elem].timestamp": timestamp,
-				},
-			}
-			options := options.Update().SetArrayFilters(options.ArrayFilters{
-				Filters: []interface{}{bson.M{"elem.number": stepNumber}},
-			})
-
-			_, err := db.collection.UpdateOne(context.TODO(), filter, query, options)
-			return err
-		}
-		// step already exists. Return
-		// log.Printf("step %s already exists", stepName)
-		return nil
+	// The step exists: write its timestamp, unless it has one to keep
+	filter = bson.M{"_id": GetID(tenant, eventName, eventId)}
+	query = bson.M{
+		"$set": bson.M{
+			"steps.$[elem].timestamp": timestamp,
+			"steps.$[elem].version": version,
+		},
 	}
-
-	// The step doesn't exist. Create it
-	update := bson.M{
-        "$push": bson.M{
-            "steps": bson.M{
-                "name":      stepName,
-                "number":    stepNumber,
-                "timestamp": timestamp,
-                "labels":    []string{},
-            },
-        },
-    }
-
-    _, err = db.collection.UpdateOne(context.TODO(), filter, update)
-	// log.Printf("step %s created", stepName)
+	stepFilter := bson.M{
+		"elem.number": stepNumber,
+		"elem.name": stepName,
+		"$or": bson.A{
+			bson.M{"elem.timestamp": -1},
+			db.overrides("elem.version", "elem.timestamp", version, timestamp),
+		},
+	}
+	options := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{stepFilter}})
+	_, err = db.collection(tenant).UpdateOne(context.TODO(), filter, query, options)
 	return err
 }
 
+// Converts a db identifier back to the event ID generated by the client.
+// Inverse of GetID.
+func getClientEventID(tenant string, eventName string, id string) string {
+	return strings.TrimPrefix(id, GetID(tenant, eventName, ""))
+}
+
 // Returns a unique db identifier in the format
-// <user_collection_name>-<event_name>-<event_id>
-func GetID(eventName string, eventId string) string {
-	return fmt.Sprintf("%s-%s-%s", USER, eventName, eventId)
+// <tenant_collection_name>-<event_name>-<event_id>
+func GetID(tenant string, eventName string, eventId string) string {
+	return fmt.Sprintf("%s-%s-%s", tenant, eventName, eventId)
 }
\ No newline at end of file
@@ -0,0 +1,114 @@
+package mongodb
+
+import (
+	"context"
+	"os"
+	"owl_server/config"
+	"owl_server/db"
+	"owl_server/db/conformance"
+	"owl_server/models"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// URI of the MongoDB server the conformance suite runs against.
+// The suite is skipped when it isn't set.
+const TEST_URI_ENV = "OWL_TEST_MONGODB_URI"
+
+// Database holding the collections of the suite, dropped afterwards.
+const TEST_DATABASE = "owl_conformance"
+
+func TestConformance(t *testing.T) {
+	uri := os.Getenv(TEST_URI_ENV)
+	if uri == "" {
+		t.Skipf("%s is not set", TEST_URI_ENV)
+	}
+	conformance.Run(t, func(t *testing.T, mergePolicy models.MergePolicy) db.DB {
+		database := NewMongoDB(config.MongoDBConfig{
+			URI: uri,
+			Database: TEST_DATABASE,
+			PoolSize: 4,
+			ConnectTimeout: config.Duration(10 * time.Second),
+		}, mergePolicy)
+		err := database.Connect()
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		t.Cleanup(func() {
+			database.database.Drop(context.Background())
+			database.Disconnect()
+		})
+		return database
+	})
+}
+
+// Events written by the servers older than the merge policy are read
+// back as the other backends would once migrated
+func TestMigrateEventLayout(t *testing.T) {
+	uri := os.Getenv(TEST_URI_ENV)
+	if uri == "" {
+		t.Skipf("%s is not set", TEST_URI_ENV)
+	}
+	database := NewMongoDB(config.MongoDBConfig{
+		URI: uri,
+		Database: TEST_DATABASE + "_migrations",
+		PoolSize: 4,
+		ConnectTimeout: config.Duration(10 * time.Second),
+	}, models.MERGE_LAST_WRITER_WINS)
+	err := database.Connect()
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() {
+		database.database.Drop(context.Background())
+		database.Disconnect()
+	})
+
+	const start, step = int64(800_000_000_000), int64(800_000_005_000)
+	_, err = database.database.Collection("legacy").InsertOne(context.Background(), bson.M{
+		"_id": GetID("legacy", "checkout", "1"),
+		"name": "checkout",
+		"result": "success",
+		"creationTime": time.UnixMilli(start * 1000),
+		"steps": bson.A{
+			bson.M{"name": "start", "number": 0, "timestamp": start, "labels": bson.A{}},
+			bson.M{"name": "pay", "number": 1, "timestamp": step, "labels": bson.A{bson.M{"key": "method", "val": "card"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("inserting the legacy event: %v", err)
+	}
+	// twice, as servers starting at the same time would
+	for i := 0; i < 2; i++ {
+		err = database.migrate(context.Background(), 0, latestVersion())
+		if err != nil {
+			t.Fatalf("migrating: %v", err)
+		}
+	}
+
+	// newer updates override the legacy values
+	err = database.InsertUpdate("legacy", models.Update{UpdateType: models.UPDATE_TYPE_LABEL, EventName: "checkout", EventId: "1", StepName: "pay", StepNumber: 1, LabelKey: "method", LabelVal: "cash", Sequence: 1})
+	if err != nil {
+		t.Fatalf("inserting a label: %v", err)
+	}
+	event, err := database.GetEvent("legacy", "checkout", "1")
+	if err != nil || event == nil {
+		t.Fatalf("reading the event: %v, %v", event, err)
+	}
+	if !event.CreationTime.Equal(models.TimestampToTime(start)) {
+		t.Errorf("creation time: got %v, want %v", event.CreationTime, models.TimestampToTime(start))
+	}
+	if len(event.Steps) != 1 || event.Steps[0].Name != "pay" {
+		t.Fatalf("steps: got %+v, want only the pay step", event.Steps)
+	}
+	if !event.HasLabel("method", "cash") {
+		t.Errorf("labels: got %+v, want method=cash", event.Steps[0].Labels)
+	}
+
+	migrations, err := database.Migrations()
+	if err != nil || len(migrations) != latestVersion() || migrations[0].AppliedAt == nil {
+		t.Errorf("migrations: got %+v, %v", migrations, err)
+	}
+}
@@ -0,0 +1,136 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"owl_server/models"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Retrieves an event, with its steps and labels.
+// Returns (nil, nil) if the event doesn't exist.
+func (db *MongoDB) GetEvent(tenant string, eventName string, eventId string) (*models.Event, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	event, err := db.getEvent(tenant, eventName, eventId)
+	if err != nil || event == nil {
+		return nil, err
+	}
+	result := event.toModel(tenant)
+	sortSteps(result.Steps)
+	for _, step := range result.Steps {
+		sortLabels(step.Labels)
+	}
+	return &result, nil
+}
+
+// Lists the events matching the query, ordered by name then ID.
+// Steps are not retrieved.
+func (db *MongoDB) ListEvents(tenant string, query models.EventQuery) ([]models.Event, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	filter := bson.M{}
+	if query.EventName != "" {
+		filter["name"] = query.EventName
+	}
+	creationTime := bson.M{}
+	if !query.From.IsZero() {
+		creationTime["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		creationTime["$lt"] = query.To
+	}
+	if len(creationTime) > 0 {
+		filter["creationTime"] = creationTime
+	}
+	if query.Result != "" {
+		filter["result"] = query.Result
+	}
+	var and []bson.M
+	for key, value := range query.Labels {
+		and = append(and, bson.M{
+			"steps.labels": bson.M{"$elemMatch": bson.M{"key": key, "val": value}},
+		})
+	}
+	if query.AfterName != "" {
+		and = append(and, bson.M{"$or": []bson.M{
+			{"name": bson.M{"$gt": query.AfterName}},
+			{"name": query.AfterName, "_id": bson.M{"$gt": GetID(tenant, query.AfterName, query.AfterId)}},
+		}})
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"steps": 0})
+	if query.Limit > 0 {
+		findOptions.SetLimit(int64(query.Limit))
+	}
+	cursor, err := db.collection(tenant).Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var found []Event
+	err = cursor.All(context.TODO(), &found)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []models.Event{}
+	for _, event := range found {
+		result := event.toModel(tenant)
+		result.Steps = nil
+		events = append(events, result)
+	}
+	return events, nil
+}
+
+// Retrieves the steps of an event, ordered by step number, with their labels.
+func (db *MongoDB) GetSteps(tenant string, eventName string, eventId string) ([]models.Step, error) {
+	event, err := db.GetEvent(tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return []models.Step{}, nil
+	}
+	return event.Steps, nil
+}
+
+// Retrieves the labels of an event, ordered by step number then key.
+func (db *MongoDB) GetLabels(tenant string, eventName string, eventId string) ([]models.Label, error) {
+	steps, err := db.GetSteps(tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	labels := []models.Label{}
+	for _, step := range steps {
+		labels = append(labels, step.Labels...)
+	}
+	return labels, nil
+}
+
+// Sorts steps by number (then name), the order in which
+// the other backends return them.
+func sortSteps(steps []models.Step) {
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].Number != steps[j].Number {
+			return steps[i].Number < steps[j].Number
+		}
+		return steps[i].Name < steps[j].Name
+	})
+}
+
+// Sorts the labels of a step by key.
+func sortLabels(labels []models.Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Key < labels[j].Key
+	})
+}
@@ -0,0 +1,15 @@
+package mongodb
+
+import (
+	"owl_server/config"
+	"owl_server/db"
+)
+
+// Name of the backend, as set in the "backend" setting
+const BACKEND_NAME = "mongodb"
+
+func init() {
+	db.Register(BACKEND_NAME, func(cfg config.Config) (db.DB, error) {
+		return NewMongoDB(cfg.MongoDB, cfg.MergePolicy), nil
+	})
+}
@@ -0,0 +1,144 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"owl_server/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Prefix of the names of the TTL indexes deleting the events of a name
+const RETENTION_INDEX_PREFIX = "retention_"
+
+// Deletes the events created before their retention, in the collections
+// of every tenant. Events without creation time are kept.
+//
+// Each event name with its own retention also gets a TTL index on the
+// creation time, so that MongoDB deletes its events if they aren't purged
+// (e.g. while the server is stopped). The TTL indexes expire the events
+// policy.Grace after the retention, to leave the purge (which reports
+// what it deletes) the time to run first.
+func (db *MongoDB) PurgeExpired(policy models.RetentionPolicy, now time.Time) ([]models.PurgedEvents, error) {
+	if db.database == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.TODO()
+	tenants, err := db.database.ListCollectionNames(ctx, bson.M{"type": "collection"})
+	if err != nil {
+		return nil, err
+	}
+	purged := []models.PurgedEvents{}
+	names := policy.Names()
+	for _, tenant := range tenants {
+		// the other collections don't hold events
+		if !models.TENANT_PATTERN.MatchString(tenant) {
+			continue
+		}
+		collection := db.database.Collection(tenant)
+		err = syncRetentionIndexes(ctx, collection, policy)
+		if err != nil {
+			// not fatal, the events are still purged
+			log.Printf("unable to update the TTL indexes of collection %s: %s", tenant, err)
+		}
+
+		for _, name := range names {
+			count, err := deleteExpired(ctx, collection, name, now.Add(-policy.Events[name]))
+			if err != nil {
+				return models.MergePurgedEvents(purged), fmt.Errorf("unable to purge the %s events of %s. Underlying error: %w", name, tenant, err)
+			}
+			purged = append(purged, models.PurgedEvents{Tenant: tenant, EventName: name, Count: count})
+		}
+		if policy.Default <= 0 {
+			continue
+		}
+		// the other names are deleted one at a time, to count them by name
+		cutoff := now.Add(-policy.Default)
+		others, err := collection.Distinct(ctx, "name", bson.M{
+			"name": bson.M{"$nin": names},
+			"creationTime": bson.M{"$lt": cutoff},
+		})
+		if err != nil {
+			return models.MergePurgedEvents(purged), fmt.Errorf("unable to list the expired events of %s. Underlying error: %w", tenant, err)
+		}
+		for _, other := range others {
+			name, ok := other.(string)
+			if !ok {
+				continue
+			}
+			count, err := deleteExpired(ctx, collection, name, cutoff)
+			if err != nil {
+				return models.MergePurgedEvents(purged), fmt.Errorf("unable to purge the %s events of %s. Underlying error: %w", name, tenant, err)
+			}
+			purged = append(purged, models.PurgedEvents{Tenant: tenant, EventName: name, Count: count})
+		}
+	}
+	return models.MergePurgedEvents(purged), nil
+}
+
+// Deletes the events of the given name created before the cutoff
+func deleteExpired(ctx context.Context, collection *mongo.Collection, eventName string, cutoff time.Time) (int64, error) {
+	result, err := collection.DeleteMany(ctx, bson.M{
+		"name": eventName,
+		"creationTime": bson.M{"$lt": cutoff},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Creates the TTL indexes of the event names with their own retention,
+// and drops the ones of the names without (or with another) retention
+func syncRetentionIndexes(ctx context.Context, collection *mongo.Collection, policy models.RetentionPolicy) error {
+	expected := map[string]int32{}
+	for name, retention := range policy.Events {
+		expected[RETENTION_INDEX_PREFIX+name] = int32((retention + policy.Grace).Seconds())
+	}
+
+	specifications, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	for _, specification := range specifications {
+		if !strings.HasPrefix(specification.Name, RETENTION_INDEX_PREFIX) {
+			continue
+		}
+		expireAfter, ok := expected[specification.Name]
+		if ok && specification.ExpireAfterSeconds != nil && *specification.ExpireAfterSeconds == expireAfter {
+			delete(expected, specification.Name)
+			continue
+		}
+		_, err = collection.Indexes().DropOne(ctx, specification.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var indexes []mongo.IndexModel
+	for name, retention := range policy.Events {
+		indexName := RETENTION_INDEX_PREFIX + name
+		expireAfter, missing := expected[indexName]
+		if !missing {
+			continue
+		}
+		indexes = append(indexes, mongo.IndexModel{
+			Keys: bson.D{{Key: "creationTime", Value: 1}},
+			Options: options.Index().
+				SetName(indexName).
+				SetExpireAfterSeconds(expireAfter).
+				SetPartialFilterExpression(bson.M{"name": name}),
+		})
+		log.Printf("Creating the TTL index of the %s events of %s (%s)", name, collection.Name(), retention)
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	_, err = collection.Indexes().CreateMany(ctx, indexes)
+	return err
+}
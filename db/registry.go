@@ -0,0 +1,113 @@
+package db
+
+import (
+	"fmt"
+	"owl_server/config"
+	"owl_server/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Creates a (disconnected) database from the server configuration
+type Factory func(cfg config.Config) (DB, error)
+
+// Optional interface for databases that need to create their
+// schema (tables, indexes, ...) before being used.
+// Called once at startup, right after Connect.
+type SchemaCreator interface {
+	// Creates the schema if it doesn't exist yet
+	CreateTables() error
+}
+
+// Optional interface for databases whose schema is versioned by
+// migrations, managed with the "migrate" subcommand.
+type Migrator interface {
+	// Lists the migrations known by the server, and the ones applied to
+	// the database by a newer server, ordered by version
+	Migrations() ([]Migration, error)
+	// Applies (or reverts) migrations until the schema has the given version
+	Migrate(version int) error
+}
+
+// Optional interface for databases able to delete the events older
+// than their retention. Called periodically by the retention job.
+type Purger interface {
+	// Deletes the events of every tenant which are older than their
+	// retention at the given time, and returns how many were deleted.
+	// On failure, also returns what was deleted before it.
+	PurgeExpired(policy models.RetentionPolicy, now time.Time) ([]models.PurgedEvents, error)
+}
+
+// Optional interface for databases able to mark the events which never
+// received their end update as abandoned. Called periodically by the sweeper.
+type Sweeper interface {
+	// Marks the events of every tenant without end update, inactive for
+	// longer than their timeout at the given time, as abandoned (see
+	// models.Abandonment), and returns how many were marked.
+	// On failure, also returns what was marked before it.
+	MarkAbandoned(policy models.AbandonmentPolicy, now time.Time) ([]models.AbandonedEvents, error)
+}
+
+// Optional interface for databases computing analytics over the
+// events of a tenant, for the /analytics endpoints.
+type Analyzer interface {
+	// Returns how long the events of a name took, and their steps
+	EventDurations(tenant string, query models.AnalyticsQuery) (*models.DurationAnalytics, error)
+	// Returns how many of the events of a name go through the steps of the funnel
+	Funnel(tenant string, query models.FunnelQuery) (*models.Funnel, error)
+	// Returns the number of events of a name by result, overall and over time
+	EventResults(tenant string, query models.ResultQuery) (*models.ResultBreakdown, error)
+	// Returns the number of abandoned events of a name, by last step reached
+	Abandonment(tenant string, query models.AnalyticsQuery) (*models.AbandonmentBreakdown, error)
+}
+
+// A versioned change of the schema of a database
+type Migration struct {
+	Version int
+	Name string
+	// nil if the migration isn't applied
+	AppliedAt *time.Time
+	// applied by a newer server: this server can't revert it
+	Unknown bool
+}
+
+var factoriesLock sync.RWMutex
+var factories = map[string]Factory{}
+
+// Makes a backend available under the given name, for the "backend" setting.
+// Backends register themselves in an init function, so importing the
+// backend package is enough to make it available.
+// Panics if the name is already taken.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, exists := factories[name]; exists {
+		panic(fmt.Sprintf("db backend %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Creates a (disconnected) database using the backend registered under the given name.
+func Open(name string, cfg config.Config) (DB, error) {
+	factoriesLock.RLock()
+	factory, ok := factories[name]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, available backends: %s", name, strings.Join(Backends(), ", "))
+	}
+	return factory(cfg)
+}
+
+// Returns the names of the registered backends, sorted
+func Backends() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
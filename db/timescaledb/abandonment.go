@@ -0,0 +1,77 @@
+package timescaledb
+
+import (
+	"context"
+	"fmt"
+	"owl_server/models"
+	"time"
+)
+
+// Marks the events without end update inactive for longer than their
+// timeout as abandoned, recording the step with the highest number.
+// Events without any creation time are kept waiting.
+func (db *TimescaleDB) MarkAbandoned(policy models.AbandonmentPolicy, now time.Time) ([]models.AbandonedEvents, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+	abandoned := []models.AbandonedEvents{}
+	names := policy.Names()
+	for _, name := range names {
+		marked, err := db.markAbandoned(ctx, `event_name = $1`, name, now.Add(-policy.Timeouts[name]), now)
+		if err != nil {
+			return models.SortAbandonedEvents(abandoned), fmt.Errorf("unable to mark the abandoned %s events. Underlying error: %w", name, err)
+		}
+		abandoned = append(abandoned, marked...)
+	}
+	if policy.Default > 0 {
+		marked, err := db.markAbandoned(ctx, `event_name <> ALL($1)`, names, now.Add(-policy.Default), now)
+		if err != nil {
+			return models.SortAbandonedEvents(abandoned), fmt.Errorf("unable to mark the abandoned events. Underlying error: %w", err)
+		}
+		abandoned = append(abandoned, marked...)
+	}
+	return models.SortAbandonedEvents(abandoned), nil
+}
+
+// Marks the events matching the condition (whose argument is $1) without
+// end update, and whose last activity is before the cutoff, as abandoned
+func (db *TimescaleDB) markAbandoned(ctx context.Context, condition string, arg interface{}, cutoff time.Time, now time.Time) ([]models.AbandonedEvents, error) {
+	rows, err := db.dbPool.Query(ctx, `
+		WITH inactive AS (
+			SELECT e.id, e.received_at FROM events e
+			WHERE `+condition+` AND e.event_result IS NULL
+			AND GREATEST(e.creation_time, (
+				SELECT max(s.creation_time) FROM steps s
+				WHERE s.event_ref = e.id AND s.received_at = e.received_at
+			)) < $2
+		), marked AS (
+			UPDATE events e
+			SET event_result = $4, abandoned_at = $3, last_step_name = last_step.step_name, last_step_number = last_step.step_number
+			FROM inactive
+			LEFT JOIN LATERAL (
+				SELECT s.step_name, s.step_number FROM steps s
+				WHERE s.event_ref = inactive.id AND s.received_at = inactive.received_at
+				ORDER BY s.step_number DESC, s.step_name DESC LIMIT 1
+			) last_step ON true
+			WHERE e.id = inactive.id AND e.received_at = inactive.received_at AND e.event_result IS NULL
+			RETURNING e.tenant, e.event_name
+		)
+		SELECT tenant, event_name, count(*) FROM marked
+		GROUP BY tenant, event_name
+	`, arg, cutoff, now, models.ABANDONED_RESULT)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	marked := []models.AbandonedEvents{}
+	for rows.Next() {
+		var a models.AbandonedEvents
+		err = rows.Scan(&a.Tenant, &a.EventName, &a.Count)
+		if err != nil {
+			return nil, err
+		}
+		marked = append(marked, a)
+	}
+	return marked, rows.Err()
+}
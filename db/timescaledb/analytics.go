@@ -0,0 +1,308 @@
+package timescaledb
+
+import (
+	"context"
+	"fmt"
+	"owl_server/models"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Condition selecting the events of a tenant and name whose creation time is
+// within a range. The tenant, name, and bounds of the range (NULL when
+// unbounded) are the first 4 arguments of the statement
+const ANALYTICS_CONDITION = `e.tenant = $1 AND e.event_name = $2 AND e.creation_time IS NOT NULL
+	AND ($3::TIMESTAMPTZ IS NULL OR e.creation_time >= $3) AND ($4::TIMESTAMPTZ IS NULL OR e.creation_time < $4)`
+
+// Columns computing the models.DurationStats of the duration column
+const DURATION_STATS_COLUMNS = `count(*), min(duration),
+	percentile_disc(ARRAY[0.5, 0.9, 0.95, 0.99]) WITHIN GROUP (ORDER BY duration), max(duration)`
+
+// Creation time and duration (in milliseconds) of the events having an end step
+const EVENT_DURATIONS = `
+	SELECT e.creation_time, (extract(epoch FROM max(s.creation_time) - e.creation_time) * 1000)::BIGINT AS duration
+	FROM events e
+	JOIN steps s ON s.event_ref = e.id AND s.received_at = e.received_at
+	WHERE ` + ANALYTICS_CONDITION + ` AND s.step_name = 'end' AND s.creation_time IS NOT NULL
+	GROUP BY e.id, e.received_at, e.creation_time
+`
+
+// Latency (in milliseconds) between the steps of consecutive numbers
+const STEP_LATENCIES = `
+	SELECT a.step_name AS from_name, a.step_number AS from_number, b.step_name AS to_name, b.step_number AS to_number,
+		(extract(epoch FROM b.creation_time - a.creation_time) * 1000)::BIGINT AS duration
+	FROM events e
+	JOIN steps a ON a.event_ref = e.id AND a.received_at = e.received_at
+	JOIN steps b ON b.event_ref = e.id AND b.received_at = e.received_at AND b.step_number = a.step_number + 1
+	WHERE ` + ANALYTICS_CONDITION + ` AND a.creation_time IS NOT NULL AND b.creation_time IS NOT NULL
+`
+
+func (db *TimescaleDB) EventDurations(tenant string, query models.AnalyticsQuery) (*models.DurationAnalytics, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+	args := []interface{}{tenant, query.EventName, optionalTime(query.From), optionalTime(query.To)}
+	result := &models.DurationAnalytics{
+		EventName: query.EventName,
+		Transitions: []models.StepTransition{},
+		Series: []models.DurationBucket{},
+	}
+
+	row := db.dbPool.QueryRow(ctx, `
+		WITH durations AS (`+EVENT_DURATIONS+`)
+		SELECT `+DURATION_STATS_COLUMNS+` FROM durations
+	`, args...)
+	err := scanDurationStats(row, &result.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.dbPool.Query(ctx, `
+		WITH durations AS (`+STEP_LATENCIES+`)
+		SELECT from_name, from_number, to_name, to_number, `+DURATION_STATS_COLUMNS+` FROM durations
+		GROUP BY from_name, from_number, to_name, to_number
+		ORDER BY from_number, from_name, to_number, to_name
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var transition models.StepTransition
+		err = scanDurationStats(rows, &transition.Latency, &transition.From.Name, &transition.From.Number, &transition.To.Name, &transition.To.Number)
+		if err != nil {
+			return nil, err
+		}
+		result.Transitions = append(result.Transitions, transition)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if query.Bucket <= 0 {
+		return result, nil
+	}
+	bucket, err := db.bucketExpression(ctx, "creation_time", len(args) + 1)
+	if err != nil {
+		return nil, err
+	}
+	rows, err = db.dbPool.Query(ctx, `
+		WITH durations AS (`+EVENT_DURATIONS+`)
+		SELECT `+bucket+` AS bucket, `+DURATION_STATS_COLUMNS+` FROM durations
+		GROUP BY bucket
+		ORDER BY bucket
+	`, append(args, query.Bucket.Milliseconds())...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket models.DurationBucket
+		err = scanDurationStats(rows, &bucket.Duration, &bucket.Start)
+		if err != nil {
+			return nil, err
+		}
+		bucket.Start = bucket.Start.UTC()
+		result.Series = append(result.Series, bucket)
+	}
+	return result, rows.Err()
+}
+
+// Counts the events reaching each stage with one lateral join per stage,
+// finding the smallest number of a step of the stage name following the
+// step of the previous stage (NULL if there is none).
+func (db *TimescaleDB) Funnel(tenant string, query models.FunnelQuery) (*models.Funnel, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+	args := []interface{}{tenant, query.EventName, optionalTime(query.From), optionalTime(query.To)}
+
+	segment := "NULL::TEXT"
+	if query.SegmentBy != "" {
+		args = append(args, query.SegmentBy)
+		segment = fmt.Sprintf(`(
+			SELECT l.value FROM labels l
+			WHERE l.event_ref = e.id AND l.received_at = e.received_at AND l.key = $%d
+			ORDER BY l.step_number, l.step_name LIMIT 1
+		)`, len(args))
+	}
+	var counts, joins strings.Builder
+	for i, step := range query.Steps {
+		args = append(args, step)
+		fmt.Fprintf(&counts, ", count(s%d.n)", i)
+		previous := ""
+		if i > 0 {
+			previous = fmt.Sprintf(" AND s.step_number > s%d.n", i - 1)
+		}
+		fmt.Fprintf(&joins, `
+			LEFT JOIN LATERAL (
+				SELECT min(s.step_number) AS n FROM steps s
+				WHERE s.event_ref = e.id AND s.received_at = e.received_at AND s.step_name = $%d%s
+			) s%d ON true`, len(args), previous, i)
+	}
+
+	rows, err := db.dbPool.Query(ctx, `
+		SELECT `+segment+` AS segment, count(*)`+counts.String()+`
+		FROM events e`+joins.String()+`
+		WHERE `+ANALYTICS_CONDITION+`
+		GROUP BY segment
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []models.FunnelCounts{}
+	for rows.Next() {
+		c := models.FunnelCounts{Stages: make([]int64, len(query.Steps))}
+		columns := []interface{}{&c.Segment, &c.Events}
+		for i := range c.Stages {
+			columns = append(columns, &c.Stages[i])
+		}
+		err = rows.Scan(columns...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return models.NewFunnel(query, result), nil
+}
+
+func (db *TimescaleDB) EventResults(tenant string, query models.ResultQuery) (*models.ResultBreakdown, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+	args := []interface{}{tenant, query.EventName, optionalTime(query.From), optionalTime(query.To)}
+
+	bucket := "NULL::TIMESTAMPTZ"
+	if query.Bucket > 0 {
+		var err error
+		bucket, err = db.bucketExpression(ctx, "e.creation_time", len(args) + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, query.Bucket.Milliseconds())
+	}
+	rows, err := db.dbPool.Query(ctx, `
+		SELECT `+bucket+` AS bucket, COALESCE(e.event_result, '') AS result, count(*)
+		FROM events e
+		WHERE `+ANALYTICS_CONDITION+`
+		GROUP BY bucket, result
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []models.ResultCount{}
+	for rows.Next() {
+		var c models.ResultCount
+		err = rows.Scan(&c.Bucket, &c.Result, &c.Count)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return models.NewResultBreakdown(query, counts), nil
+}
+
+func (db *TimescaleDB) Abandonment(tenant string, query models.AnalyticsQuery) (*models.AbandonmentBreakdown, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	rows, err := db.dbPool.Query(context.Background(), `
+		SELECT e.last_step_name, e.last_step_number, count(*)
+		FROM events e
+		WHERE `+ANALYTICS_CONDITION+` AND e.abandoned_at IS NOT NULL
+		GROUP BY e.last_step_name, e.last_step_number
+	`, tenant, query.EventName, optionalTime(query.From), optionalTime(query.To))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []models.LastStepCount{}
+	for rows.Next() {
+		var c models.LastStepCount
+		var name *string
+		var number *int
+		err = rows.Scan(&name, &number, &c.Count)
+		if err != nil {
+			return nil, err
+		}
+		if name != nil && number != nil {
+			c.Step = &models.StepRef{Name: *name, Number: *number}
+		}
+		counts = append(counts, c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return models.NewAbandonmentBreakdown(query.EventName, counts), nil
+}
+
+// SQL expression of the start of the bucket holding the given time column.
+// The width of the buckets, in milliseconds, is the argument at the given
+// position. Buckets are aligned on the Unix epoch (see models.BucketStart).
+// Uses time_bucket when TimescaleDB is available, date_bin otherwise.
+func (db *TimescaleDB) bucketExpression(ctx context.Context, column string, argument int) (string, error) {
+	timescale, err := db.hasTimescale(ctx)
+	if err != nil {
+		return "", err
+	}
+	function := "date_bin"
+	if timescale {
+		function = "time_bucket"
+	}
+	return fmt.Sprintf(`%s($%d::BIGINT * INTERVAL '1 millisecond', %s, TIMESTAMPTZ 'epoch')`, function, argument, column), nil
+}
+
+// Returns true if the TimescaleDB extension is installed in the database
+func (db *TimescaleDB) hasTimescale(ctx context.Context) (bool, error) {
+	var timescale bool
+	err := db.dbPool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')
+	`).Scan(&timescale)
+	return timescale, err
+}
+
+// Scans the given columns followed by the DURATION_STATS_COLUMNS
+func scanDurationStats(row pgx.Row, stats *models.DurationStats, columns ...interface{}) error {
+	var minimum, maximum *int64
+	var percentiles []int64
+	err := row.Scan(append(columns, &stats.Count, &minimum, &percentiles, &maximum)...)
+	if err != nil || stats.Count == 0 {
+		return err
+	}
+	if minimum == nil || maximum == nil || len(percentiles) != len(models.DURATION_PERCENTILES) {
+		return fmt.Errorf("unexpected duration statistics")
+	}
+	stats.MinMs = *minimum
+	stats.P50Ms = percentiles[0]
+	stats.P90Ms = percentiles[1]
+	stats.P95Ms = percentiles[2]
+	stats.P99Ms = percentiles[3]
+	stats.MaxMs = *maximum
+	return nil
+}
+
+// Argument of an optional time bound: NULL if the time is zero
+func optionalTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
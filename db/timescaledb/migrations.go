@@ -0,0 +1,319 @@
+package timescaledb
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"owl_server/db"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// SQL files of the migrations, named <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Versions start at 1 and have no gaps.
+// A migration must never be modified once released: change the
+// schema by adding a new one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// A versioned change of the schema, with the SQL applying it (up)
+// and the SQL reverting it (down)
+type migration struct {
+	version int
+	name string
+	up string
+	down string
+}
+
+// Migrations known by the server, ordered by version
+var MIGRATIONS = loadMigrations()
+
+// Version of the first layout, whose tables were created without
+// schema_migrations table
+const LEGACY_SCHEMA_VERSION = 1
+
+// Version of the layout partitioned by received_at, whose tables
+// were created without schema_migrations table
+const PARTITIONED_SCHEMA_VERSION = 4
+
+// Key of the advisory lock held while migrating, so that servers
+// starting at the same time don't migrate the schema twice
+const MIGRATION_LOCK_KEY = 7_295_114_801
+
+const CREATE_MIGRATIONS_TABLE = `
+	CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)
+`
+
+func loadMigrations() []migration {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		panic(err)
+	}
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+		name := file.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		versionText, migrationName, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionText)
+		if !ok || !found || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			panic(fmt.Sprintf("invalid migration file name %q", name))
+		}
+		content, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			panic(err)
+		}
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{version: version, name: migrationName}
+			byVersion[version] = m
+		}
+		if m.name != migrationName {
+			panic(fmt.Sprintf("migration %d has two names: %s and %s", version, m.name, migrationName))
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := []migration{}
+	for version := 1; version <= len(byVersion); version++ {
+		m, exists := byVersion[version]
+		if !exists {
+			panic(fmt.Sprintf("migration %d is missing", version))
+		}
+		if m.up == "" || m.down == "" {
+			panic(fmt.Sprintf("migration %d needs an up and a down file", version))
+		}
+		migrations = append(migrations, *m)
+	}
+	return migrations
+}
+
+// Version of the latest migration known by the server
+func latestVersion() int {
+	return len(MIGRATIONS)
+}
+
+// Lists the migrations known by the server, and the ones applied
+// to the database by a newer server, ordered by version.
+func (db *TimescaleDB) Migrations() (migrations []db.Migration, err error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	err = db.withMigrationLock(context.Background(), func(ctx context.Context, conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		migrations = listMigrations(applied)
+		return nil
+	})
+	return migrations, err
+}
+
+// Applies (or reverts) the migrations, one transaction per migration,
+// until the schema has the given version.
+// Refuses to touch a schema newer than the latest known version.
+func (db *TimescaleDB) Migrate(version int) error {
+	if db.dbPool == nil {
+		return fmt.Errorf("database is disconnected")
+	}
+	if version < 0 || version > latestVersion() {
+		return fmt.Errorf("unknown schema version %d, the latest version is %d", version, latestVersion())
+	}
+	return db.withMigrationLock(context.Background(), func(ctx context.Context, conn *pgxpool.Conn) error {
+		current, err := schemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return migrate(ctx, conn, current, version)
+	})
+}
+
+// Runs f on a connection holding the migration lock, after creating
+// the schema_migrations table if needed
+func (db *TimescaleDB) withMigrationLock(ctx context.Context, f func(ctx context.Context, conn *pgxpool.Conn) error) error {
+	conn, err := db.dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, MIGRATION_LOCK_KEY)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, MIGRATION_LOCK_KEY)
+
+	err = createMigrationsTable(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("unable to create the schema_migrations table. Underlying error: %w", err)
+	}
+	return f(ctx, conn)
+}
+
+// Creates the schema_migrations table if it doesn't exist.
+// If the tables were created by a server without migrations, the
+// migrations of their layout are recorded as applied.
+func createMigrationsTable(ctx context.Context, conn *pgxpool.Conn) error {
+	var exists bool
+	err := conn.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, CREATE_MIGRATIONS_TABLE)
+	if err != nil {
+		return err
+	}
+	baseline, err := existingLayoutVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, m := range MIGRATIONS[:baseline] {
+		_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name)
+		if err != nil {
+			return err
+		}
+	}
+	if baseline > 0 {
+		log.Printf("Existing tables recorded at schema version %d.", baseline)
+	}
+	return tx.Commit(ctx)
+}
+
+// Returns the version of the tables created before the migrations
+// existed, or 0 if there are none
+func existingLayoutVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	var hasEvents, partitioned bool
+	err := tx.QueryRow(ctx, `
+		SELECT
+			EXISTS (
+				SELECT 1 FROM information_schema.tables
+				WHERE table_schema = current_schema() AND table_name = 'events'
+			),
+			EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'events' AND column_name = 'received_at'
+			)
+	`).Scan(&hasEvents, &partitioned)
+	switch {
+	case err != nil:
+		return 0, err
+	case partitioned:
+		return PARTITIONED_SCHEMA_VERSION, nil
+	case hasEvents:
+		return LEGACY_SCHEMA_VERSION, nil
+	default:
+		return 0, nil
+	}
+}
+
+// Migrations recorded in the schema_migrations table, by version
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int]db.Migration, error) {
+	rows, err := conn.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]db.Migration{}
+	for rows.Next() {
+		var m db.Migration
+		var appliedAt time.Time
+		err = rows.Scan(&m.Version, &m.Name, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		m.AppliedAt = &appliedAt
+		applied[m.Version] = m
+	}
+	return applied, rows.Err()
+}
+
+// Merges the known migrations with the applied ones
+func listMigrations(applied map[int]db.Migration) []db.Migration {
+	result := []db.Migration{}
+	for _, m := range MIGRATIONS {
+		entry := db.Migration{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			entry.AppliedAt = a.AppliedAt
+		}
+		result = append(result, entry)
+	}
+	for version, a := range applied {
+		if version > latestVersion() {
+			a.Unknown = true
+			result = append(result, a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result
+}
+
+// Version of the last migration applied to the database, 0 if none
+func schemaVersion(ctx context.Context, conn *pgxpool.Conn) (int, error) {
+	var version int
+	err := conn.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Applies or reverts the migrations between the current and the target version
+func migrate(ctx context.Context, conn *pgxpool.Conn, current int, target int) error {
+	if current > latestVersion() {
+		return fmt.Errorf("the database schema has version %d, newer than the latest version known by this server (%d): upgrade the server", current, latestVersion())
+	}
+	for version := current + 1; version <= target; version++ {
+		m := MIGRATIONS[version-1]
+		log.Printf("Applying migration %d (%s)...", m.version, m.name)
+		err := runMigration(ctx, conn, m.up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m)
+		if err != nil {
+			return fmt.Errorf("unable to apply migration %d (%s). Underlying error: %w", m.version, m.name, err)
+		}
+	}
+	for version := current; version > target; version-- {
+		m := MIGRATIONS[version-1]
+		log.Printf("Reverting migration %d (%s)...", m.version, m.name)
+		err := runMigration(ctx, conn, m.down, `DELETE FROM schema_migrations WHERE version = $1 AND name = $2`, m)
+		if err != nil {
+			return fmt.Errorf("unable to revert migration %d (%s). Underlying error: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// Runs the SQL of a migration and records it in schema_migrations,
+// in the same transaction
+func runMigration(ctx context.Context, conn *pgxpool.Conn, sql string, record string, m migration) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, record, m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,23 @@
+-- First layout: events, steps and labels are identified by text keys
+-- built from the event name and the IDs.
+CREATE TABLE IF NOT EXISTS events (
+	event_id TEXT PRIMARY KEY,
+	event_name TEXT NOT NULL,
+	creation_time TIMESTAMPTZ NULL,
+	event_result TEXT NULL
+);
+
+CREATE TABLE IF NOT EXISTS steps (
+	step_id TEXT PRIMARY KEY,
+	step_name TEXT NOT NULL,
+	event_id TEXT REFERENCES events(event_id),
+	creation_time TIMESTAMPTZ NULL,
+	step_number INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS labels (
+	label_id TEXT PRIMARY KEY,
+	step_id TEXT REFERENCES steps(step_id),
+	key TEXT NOT NULL,
+	value TEXT NOT NULL
+);
@@ -0,0 +1,6 @@
+-- Scope events by tenant. Events created before tenants existed
+-- belong to the tenant prefixing their ID
+ALTER TABLE events ADD COLUMN IF NOT EXISTS tenant TEXT NULL;
+UPDATE events SET tenant = split_part(event_id, '-', 1) WHERE tenant IS NULL;
+ALTER TABLE events ALTER COLUMN tenant SET NOT NULL;
+CREATE INDEX IF NOT EXISTS events_tenant_name_idx ON events (tenant, event_name, event_id);
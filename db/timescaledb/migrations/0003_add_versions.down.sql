@@ -0,0 +1,4 @@
+ALTER TABLE labels DROP COLUMN IF EXISTS version;
+ALTER TABLE steps DROP COLUMN IF EXISTS creation_version;
+ALTER TABLE events DROP COLUMN IF EXISTS result_version;
+ALTER TABLE events DROP COLUMN IF EXISTS creation_version;
@@ -0,0 +1,5 @@
+-- Versions of the updates which set the values, compared by the merge policy
+ALTER TABLE events ADD COLUMN IF NOT EXISTS creation_version BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS result_version BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE steps ADD COLUMN IF NOT EXISTS creation_version BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE labels ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
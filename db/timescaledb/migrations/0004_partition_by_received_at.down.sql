@@ -0,0 +1,49 @@
+-- Back to text keys built from the tenant, event name and IDs.
+-- The compression settings and policies go with the hypertables.
+CREATE TEMPORARY TABLE current_events ON COMMIT DROP AS SELECT * FROM events;
+CREATE TEMPORARY TABLE current_steps ON COMMIT DROP AS SELECT * FROM steps;
+CREATE TEMPORARY TABLE current_labels ON COMMIT DROP AS SELECT * FROM labels;
+DROP TABLE labels, steps, events;
+
+CREATE TABLE events (
+	event_id TEXT PRIMARY KEY,
+	event_name TEXT NOT NULL,
+	creation_time TIMESTAMPTZ NULL,
+	event_result TEXT NULL,
+	tenant TEXT NOT NULL,
+	creation_version BIGINT NOT NULL DEFAULT 0,
+	result_version BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX events_tenant_name_idx ON events (tenant, event_name, event_id);
+
+CREATE TABLE steps (
+	step_id TEXT PRIMARY KEY,
+	step_name TEXT NOT NULL,
+	event_id TEXT REFERENCES events(event_id),
+	creation_time TIMESTAMPTZ NULL,
+	step_number INTEGER NOT NULL,
+	creation_version BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE labels (
+	label_id TEXT PRIMARY KEY,
+	step_id TEXT REFERENCES steps(step_id),
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 0
+);
+
+INSERT INTO events (event_id, event_name, creation_time, event_result, tenant, creation_version, result_version)
+SELECT tenant || '-' || event_name || '-' || event_id, event_name, creation_time, event_result, tenant, creation_version, result_version
+FROM current_events;
+
+INSERT INTO steps (step_id, step_name, event_id, creation_time, step_number, creation_version)
+SELECT e.tenant || '-' || e.event_name || '-' || e.event_id || '-' || s.step_name || '-' || s.step_number,
+	s.step_name, e.tenant || '-' || e.event_name || '-' || e.event_id, s.creation_time, s.step_number, s.creation_version
+FROM current_steps s JOIN current_events e ON e.id = s.event_ref AND e.received_at = s.received_at;
+
+INSERT INTO labels (label_id, step_id, key, value, version)
+SELECT e.tenant || '-' || e.event_name || '-' || e.event_id || '-' || l.step_name || '-' || l.step_number || '-' || l.key,
+	e.tenant || '-' || e.event_name || '-' || e.event_id || '-' || l.step_name || '-' || l.step_number,
+	l.key, l.value, l.version
+FROM current_labels l JOIN current_events e ON e.id = l.event_ref AND e.received_at = l.received_at;
@@ -0,0 +1,82 @@
+-- Events are partitioned by received_at, the time the server first
+-- received an update of the event. Unlike the creation time (unknown
+-- until the start update arrives, and overwritten by later updates),
+-- it is known when the event row is created and never changes.
+-- Steps and labels copy the received_at of their event, so the three
+-- tables can be TimescaleDB hypertables partitioned on the same time,
+-- whose unique keys all include it. The hypertables are created at
+-- startup, when the extension is available.
+--
+-- Steps and labels reference their event by its surrogate id. Names,
+-- IDs, results and label values are compared byte-wise (COLLATE "C"),
+-- as in the other backends.
+--
+-- Events without creation time are given the migration time as received_at.
+CREATE TEMPORARY TABLE legacy_events ON COMMIT DROP AS
+SELECT event_id AS legacy_id, tenant, event_name,
+	substr(event_id, length(tenant) + length(event_name) + 3) AS event_id,
+	COALESCE(creation_time, now()) AS received_at,
+	creation_time, creation_version, event_result, result_version
+FROM events;
+CREATE TEMPORARY TABLE legacy_steps ON COMMIT DROP AS
+SELECT step_id, event_id AS legacy_event_id, step_name, step_number, creation_time, creation_version
+FROM steps;
+CREATE TEMPORARY TABLE legacy_labels ON COMMIT DROP AS
+SELECT step_id, key, value, version
+FROM labels;
+DROP TABLE labels, steps, events;
+
+CREATE TABLE events (
+	id BIGINT GENERATED ALWAYS AS IDENTITY,
+	received_at TIMESTAMPTZ NOT NULL,
+	tenant TEXT COLLATE "C" NOT NULL,
+	event_name TEXT COLLATE "C" NOT NULL,
+	event_id TEXT COLLATE "C" NOT NULL,
+	creation_time TIMESTAMPTZ NULL,
+	creation_version BIGINT NOT NULL DEFAULT 0,
+	event_result TEXT COLLATE "C" NULL,
+	result_version BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (id, received_at),
+	UNIQUE (tenant, event_name, event_id, received_at)
+);
+CREATE INDEX events_tenant_name_creation_idx ON events (tenant, event_name, creation_time);
+CREATE INDEX events_tenant_result_idx ON events (tenant, event_result, received_at);
+
+CREATE TABLE steps (
+	event_ref BIGINT NOT NULL,
+	received_at TIMESTAMPTZ NOT NULL,
+	step_name TEXT COLLATE "C" NOT NULL,
+	step_number INTEGER NOT NULL,
+	creation_time TIMESTAMPTZ NULL,
+	creation_version BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (event_ref, step_name, step_number, received_at)
+);
+
+CREATE TABLE labels (
+	event_ref BIGINT NOT NULL,
+	received_at TIMESTAMPTZ NOT NULL,
+	step_name TEXT COLLATE "C" NOT NULL,
+	step_number INTEGER NOT NULL,
+	key TEXT COLLATE "C" NOT NULL,
+	value TEXT COLLATE "C" NOT NULL,
+	version BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (event_ref, step_name, step_number, key, received_at)
+);
+CREATE INDEX labels_key_value_idx ON labels (key, value, received_at);
+
+INSERT INTO events (received_at, tenant, event_name, event_id, creation_time, creation_version, event_result, result_version)
+SELECT received_at, tenant, event_name, event_id, creation_time, creation_version, event_result, result_version
+FROM legacy_events;
+
+INSERT INTO steps (event_ref, received_at, step_name, step_number, creation_time, creation_version)
+SELECT e.id, e.received_at, s.step_name, s.step_number, s.creation_time, s.creation_version
+FROM legacy_steps s
+JOIN legacy_events l ON l.legacy_id = s.legacy_event_id
+JOIN events e ON e.tenant = l.tenant AND e.event_name = l.event_name AND e.event_id = l.event_id;
+
+INSERT INTO labels (event_ref, received_at, step_name, step_number, key, value, version)
+SELECT e.id, e.received_at, s.step_name, s.step_number, lb.key, lb.value, lb.version
+FROM legacy_labels lb
+JOIN legacy_steps s ON s.step_id = lb.step_id
+JOIN legacy_events l ON l.legacy_id = s.legacy_event_id
+JOIN events e ON e.tenant = l.tenant AND e.event_name = l.event_name AND e.event_id = l.event_id;
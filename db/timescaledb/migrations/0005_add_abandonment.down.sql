@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS events_unended_idx;
+-- abandoned events go back to waiting for their end update
+UPDATE events SET event_result = NULL WHERE abandoned_at IS NOT NULL;
+ALTER TABLE events DROP COLUMN IF EXISTS last_step_number;
+ALTER TABLE events DROP COLUMN IF EXISTS last_step_name;
+ALTER TABLE events DROP COLUMN IF EXISTS abandoned_at;
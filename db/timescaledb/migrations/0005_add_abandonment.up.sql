@@ -0,0 +1,6 @@
+-- Events marked as abandoned by the sweeper, with the last step they reached
+ALTER TABLE events ADD COLUMN IF NOT EXISTS abandoned_at TIMESTAMPTZ NULL;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS last_step_name TEXT COLLATE "C" NULL;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS last_step_number INTEGER NULL;
+-- Events still waiting for their end update, scanned by the sweeper
+CREATE INDEX IF NOT EXISTS events_unended_idx ON events (event_name, creation_time) WHERE event_result IS NULL;
@@ -0,0 +1,364 @@
+package timescaledb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"owl_server/config"
+	"owl_server/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Migrations are numbered from 1, without gaps, and can all be reverted
+func TestLoadMigrations(t *testing.T) {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		t.Fatalf("listing the migration files: %v", err)
+	}
+	migrations := loadMigrations()
+	if len(migrations) == 0 || 2 * len(migrations) != len(files) {
+		t.Fatalf("got %d migrations for %d files, want an up and a down file per migration", len(migrations), len(files))
+	}
+	names := map[string]bool{}
+	for i, m := range migrations {
+		if m.version != i + 1 {
+			t.Errorf("migration %d: got version %d", i, m.version)
+		}
+		if strings.TrimSpace(m.up) == "" || strings.TrimSpace(m.down) == "" {
+			t.Errorf("migration %d (%s): up or down SQL is empty", m.version, m.name)
+		}
+		if names[m.name] {
+			t.Errorf("migration %d: the name %s is already used", m.version, m.name)
+		}
+		names[m.name] = true
+	}
+	if latestVersion() != len(migrations) || PARTITIONED_SCHEMA_VERSION > latestVersion() {
+		t.Errorf("latest version: got %d for %d migrations", latestVersion(), len(migrations))
+	}
+}
+
+// Connects to a new, empty, schema of the test database, dropped at the end
+// of the test. Skips the test when the test database isn't set.
+func newTestSchema(t *testing.T, schema string) *TimescaleDB {
+	dsn := os.Getenv(TEST_DSN_ENV)
+	if dsn == "" {
+		t.Skipf("%s is not set", TEST_DSN_ENV)
+	}
+	cfg := config.TimescaleDBConfig{
+		DSN: dsn,
+		PoolSize: 2,
+		ConnectTimeout: config.Duration(10 * time.Second),
+		ChunkInterval: config.Duration(7 * 24 * time.Hour),
+	}
+	admin := NewTimescaleDB(cfg, models.MERGE_LAST_WRITER_WINS)
+	err := admin.Connect()
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	_, err = admin.dbPool.Exec(context.Background(), fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE; CREATE SCHEMA %s`, schema, schema))
+	if err != nil {
+		t.Fatalf("creating the %s schema: %v", schema, err)
+	}
+
+	// the tables are created in the schema
+	switch {
+	case !strings.Contains(dsn, "://"):
+		cfg.DSN = dsn + " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		cfg.DSN = dsn + "&search_path=" + schema
+	default:
+		cfg.DSN = dsn + "?search_path=" + schema
+	}
+	database := NewTimescaleDB(cfg, models.MERGE_LAST_WRITER_WINS)
+	err = database.Connect()
+	if err != nil {
+		t.Fatalf("connecting to the %s schema: %v", schema, err)
+	}
+	t.Cleanup(func() {
+		database.Disconnect()
+		admin.dbPool.Exec(context.Background(), fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE`, schema))
+		admin.Disconnect()
+	})
+	return database
+}
+
+// Runs the up SQL of the first migrations, as the servers without
+// migrations created the tables: without schema_migrations table
+func createLegacyTables(t *testing.T, database *TimescaleDB, version int) {
+	for _, m := range MIGRATIONS[:version] {
+		tx, err := database.dbPool.Begin(context.Background())
+		if err != nil {
+			t.Fatalf("starting a transaction: %v", err)
+		}
+		_, err = tx.Exec(context.Background(), m.up)
+		if err == nil {
+			err = tx.Commit(context.Background())
+		}
+		tx.Rollback(context.Background())
+		if err != nil {
+			t.Fatalf("creating the tables of version %d: %v", m.version, err)
+		}
+	}
+}
+
+// Returns the number of applied migrations, and fails if they aren't
+// the first ones
+func appliedCount(t *testing.T, database *TimescaleDB) int {
+	t.Helper()
+	migrations, err := database.Migrations()
+	if err != nil {
+		t.Fatalf("listing the migrations: %v", err)
+	}
+	applied := 0
+	for _, m := range migrations {
+		if m.AppliedAt != nil {
+			if m.Version != applied + 1 {
+				t.Fatalf("migration %d is applied after %d", m.Version, applied)
+			}
+			applied++
+		}
+	}
+	return applied
+}
+
+// Returns true if the column of the table exists in the schema
+func hasColumn(t *testing.T, database *TimescaleDB, table string, column string) bool {
+	var exists bool
+	err := database.dbPool.QueryRow(context.Background(), `
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+		)
+	`, table, column).Scan(&exists)
+	if err != nil {
+		t.Fatalf("reading the columns: %v", err)
+	}
+	return exists
+}
+
+// Every migration can be applied and reverted, in turn
+func TestMigrateUpAndDown(t *testing.T) {
+	database := newTestSchema(t, "owl_test_up_down")
+	latest := latestVersion()
+	steps := []struct {
+		name string
+		target int
+	}{
+		{name: "up", target: latest},
+		{name: "down", target: 0},
+		{name: "up again", target: latest},
+		{name: "to the legacy layout", target: PARTITIONED_SCHEMA_VERSION - 1},
+		{name: "to the partitioned layout", target: PARTITIONED_SCHEMA_VERSION},
+		{name: "to the first version", target: 1},
+		{name: "up from the first version", target: latest},
+		{name: "already up", target: latest},
+	}
+	for _, step := range steps {
+		err := database.Migrate(step.target)
+		if err != nil {
+			t.Fatalf("%s: migrating to version %d: %v", step.name, step.target, err)
+		}
+		if applied := appliedCount(t, database); applied != step.target {
+			t.Fatalf("%s: got %d applied migrations, want %d", step.name, applied, step.target)
+		}
+		if got, want := hasColumn(t, database, "events", "tenant"), step.target >= 2; got != want {
+			t.Errorf("%s: events.tenant exists: got %v, want %v", step.name, got, want)
+		}
+		if got, want := hasColumn(t, database, "events", "received_at"), step.target >= PARTITIONED_SCHEMA_VERSION; got != want {
+			t.Errorf("%s: events.received_at exists: got %v, want %v", step.name, got, want)
+		}
+	}
+
+	err := database.Migrate(latest + 1)
+	if err == nil {
+		t.Errorf("migrating to an unknown version: got no error")
+	}
+}
+
+// The tables created before the migrations existed are recorded at the
+// version of their layout
+func TestExistingLayoutVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		// version of the tables created without schema_migrations table
+		tables int
+		want int
+	}{
+		{name: "empty", tables: 0, want: 0},
+		{name: "legacy", tables: 1, want: LEGACY_SCHEMA_VERSION},
+		{name: "partitioned", tables: PARTITIONED_SCHEMA_VERSION, want: PARTITIONED_SCHEMA_VERSION},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := newTestSchema(t, "owl_test_layout_" + test.name)
+			createLegacyTables(t, database, test.tables)
+			if applied := appliedCount(t, database); applied != test.want {
+				t.Fatalf("got %d applied migrations, want %d", applied, test.want)
+			}
+			// the remaining migrations apply on top of them
+			err := database.Migrate(latestVersion())
+			if err != nil {
+				t.Fatalf("migrating: %v", err)
+			}
+		})
+	}
+}
+
+// Servers refuse to start on a schema migrated by a newer server, and on
+// an outdated schema unless they migrate it at startup
+func TestCreateTablesVersionCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		// applied migrations, and an unknown one applied by a newer server
+		version int
+		newer bool
+		autoMigrate bool
+		wantErr string
+	}{
+		{name: "newer schema", version: latestVersion(), newer: true, autoMigrate: true, wantErr: "newer than the latest version known by this server"},
+		{name: "outdated schema", version: 2, wantErr: `run "owl_server migrate up"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			database := newTestSchema(t, "owl_test_version_" + strings.ReplaceAll(test.name, " ", "_"))
+			database.config.AutoMigrate = test.autoMigrate
+			err := database.Migrate(test.version)
+			if err != nil {
+				t.Fatalf("migrating: %v", err)
+			}
+			if test.newer {
+				_, err = database.dbPool.Exec(context.Background(), `INSERT INTO schema_migrations (version, name) VALUES ($1, 'from_the_future')`, latestVersion() + 1)
+				if err != nil {
+					t.Fatalf("recording the newer migration: %v", err)
+				}
+			}
+
+			err = database.CreateTables()
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("got %v, want %q", err, test.wantErr)
+			}
+			if test.newer {
+				// the newer migration is listed, and the schema isn't touched
+				migrations, err := database.Migrations()
+				if err != nil || !migrations[len(migrations) - 1].Unknown {
+					t.Errorf("migrations: got %+v, %v, want the newer one listed as unknown", migrations, err)
+				}
+				err = database.Migrate(0)
+				if err == nil {
+					t.Errorf("reverting a newer schema: got no error")
+				}
+			}
+		})
+	}
+}
+
+// Describes the event as read back, to compare it across migrations
+func describeEvent(event *models.Event) string {
+	if event == nil {
+		return "none"
+	}
+	format := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	description := fmt.Sprintf("%s/%s created %s result %q:", event.Name, event.Id, format(event.CreationTime), event.Result)
+	for _, step := range event.Steps {
+		description += fmt.Sprintf(" %s#%d created %s", step.Name, step.Number, format(step.CreationTime))
+		for _, label := range step.Labels {
+			description += fmt.Sprintf(" %s=%s", label.Key, label.Val)
+		}
+	}
+	return description
+}
+
+// Events saved in the text-keyed tables of the servers without migrations
+// are read back unchanged once migrated to the partitioned layout, and
+// after reverting to it and migrating again
+func TestMigrateLegacyEvents(t *testing.T) {
+	database := newTestSchema(t, "owl_test_legacy_events")
+	createLegacyTables(t, database, LEGACY_SCHEMA_VERSION)
+	created := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	paid := created.Add(90 * time.Second)
+	signedUp := time.Date(2025, 3, 2, 8, 30, 0, 0, time.UTC)
+	// tenants prefix the event IDs, which may contain "-" themselves
+	inserts := []struct {
+		sql string
+		args []interface{}
+	}{
+		{
+			sql: `INSERT INTO events (event_id, event_name, creation_time, event_result) VALUES
+				('morel-checkout-1', 'checkout', $1, 'success'),
+				('morel-checkout-a-b', 'checkout', NULL, NULL),
+				('acme-signup-7', 'signup', $2, NULL)`,
+			args: []interface{}{created, signedUp},
+		},
+		{
+			sql: `INSERT INTO steps (step_id, step_name, event_id, creation_time, step_number) VALUES
+				('morel-checkout-1-start-0', 'start', 'morel-checkout-1', $1, 0),
+				('morel-checkout-1-pay-1', 'pay', 'morel-checkout-1', $2, 1),
+				('morel-checkout-a-b-pay-1', 'pay', 'morel-checkout-a-b', NULL, 1)`,
+			args: []interface{}{created, paid},
+		},
+		{
+			sql: `INSERT INTO labels (label_id, step_id, key, value) VALUES
+				('morel-checkout-1-pay-1-method', 'morel-checkout-1-pay-1', 'method', 'card'),
+				('morel-checkout-a-b-pay-1-plan', 'morel-checkout-a-b-pay-1', 'plan', 'pro yearly')`,
+		},
+	}
+	for _, insert := range inserts {
+		_, err := database.dbPool.Exec(context.Background(), insert.sql, insert.args...)
+		if err != nil {
+			t.Fatalf("inserting the legacy events: %v", err)
+		}
+	}
+
+	events := []struct {
+		tenant string
+		eventName string
+		eventId string
+		want string
+	}{
+		{
+			tenant: "morel", eventName: "checkout", eventId: "1",
+			want: `checkout/1 created 2025-03-01T10:00:00Z result "success": start#0 created 2025-03-01T10:00:00Z pay#1 created 2025-03-01T10:01:30Z method=card`,
+		},
+		{
+			tenant: "morel", eventName: "checkout", eventId: "a-b",
+			want: `checkout/a-b created - result "": pay#1 created - plan=pro yearly`,
+		},
+		{tenant: "acme", eventName: "signup", eventId: "7", want: `signup/7 created 2025-03-02T08:30:00Z result "":`},
+		{tenant: "acme", eventName: "checkout", eventId: "1", want: "none"},
+	}
+	for _, target := range []int{latestVersion(), PARTITIONED_SCHEMA_VERSION - 1, latestVersion()} {
+		err := database.Migrate(target)
+		if err != nil {
+			t.Fatalf("migrating to version %d: %v", target, err)
+		}
+		if target < PARTITIONED_SCHEMA_VERSION {
+			continue
+		}
+		for _, event := range events {
+			got, err := database.GetEvent(event.tenant, event.eventName, event.eventId)
+			if err != nil {
+				t.Fatalf("reading %s/%s/%s: %v", event.tenant, event.eventName, event.eventId, err)
+			}
+			if describeEvent(got) != event.want {
+				t.Errorf("%s/%s/%s at version %d:\ngot  %s\nwant %s", event.tenant, event.eventName, event.eventId, target, describeEvent(got), event.want)
+			}
+		}
+	}
+
+	// the legacy values have the oldest version: newer updates override them
+	err := database.InsertUpdate("morel", models.Update{UpdateType: models.UPDATE_TYPE_LABEL, EventName: "checkout", EventId: "1", StepName: "pay", StepNumber: 1, LabelKey: "method", LabelVal: "cash", Sequence: 1})
+	if err != nil {
+		t.Fatalf("inserting a label: %v", err)
+	}
+	event, err := database.GetEvent("morel", "checkout", "1")
+	if err != nil || event == nil || !event.HasLabel("method", "cash") || event.HasLabel("method", "card") {
+		t.Errorf("got %s, %v, want the label overridden", describeEvent(event), err)
+	}
+}
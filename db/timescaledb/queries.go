@@ -0,0 +1,202 @@
+package timescaledb
+
+import (
+	"context"
+	"fmt"
+	"owl_server/models"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Columns of the events scanned by eventRow
+const EVENT_COLUMNS = "creation_time, COALESCE(event_result, ''), abandoned_at, last_step_name, last_step_number"
+
+// The EVENT_COLUMNS of an event
+type eventRow struct {
+	creationTime *time.Time
+	result string
+	abandonedAt *time.Time
+	lastStepName *string
+	lastStepNumber *int
+}
+
+// Returns the destinations of the scan of the EVENT_COLUMNS
+func (r *eventRow) columns() []interface{} {
+	return []interface{}{&r.creationTime, &r.result, &r.abandonedAt, &r.lastStepName, &r.lastStepNumber}
+}
+
+// Sets the scanned columns on the event
+func (r *eventRow) apply(event *models.Event) {
+	event.CreationTime = r.creationTime
+	event.Result = r.result
+	if r.abandonedAt == nil {
+		return
+	}
+	event.Abandoned = &models.Abandonment{Time: *r.abandonedAt}
+	if r.lastStepName != nil && r.lastStepNumber != nil {
+		event.Abandoned.LastStep = &models.StepRef{Name: *r.lastStepName, Number: *r.lastStepNumber}
+	}
+}
+
+// Retrieves an event, with its steps and labels.
+// Returns (nil, nil) if the event doesn't exist.
+func (db *TimescaleDB) GetEvent(tenant string, eventName string, eventId string) (*models.Event, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+
+	var row eventRow
+	err := db.dbPool.QueryRow(ctx, `
+		SELECT `+EVENT_COLUMNS+`
+		FROM events
+		WHERE `+EVENT_CONDITION, tenant, eventName, eventId).Scan(row.columns()...)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	steps, err := db.GetSteps(tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+
+	event := models.Event{Name: eventName, Id: eventId, Steps: steps}
+	row.apply(&event)
+	return &event, nil
+}
+
+// Lists the events matching the query, ordered by name then ID.
+// Steps are not retrieved.
+func (db *TimescaleDB) ListEvents(tenant string, query models.EventQuery) ([]models.Event, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	addCondition("tenant = $%d", tenant)
+	if query.EventName != "" {
+		addCondition("event_name = $%d", query.EventName)
+	}
+	if !query.From.IsZero() {
+		addCondition("creation_time >= $%d", query.From)
+	}
+	if !query.To.IsZero() {
+		addCondition("creation_time < $%d", query.To)
+	}
+	if query.Result != "" {
+		addCondition("event_result = $%d", query.Result)
+	}
+	for key, value := range query.Labels {
+		args = append(args, key, value)
+		conditions = append(conditions, fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM labels l
+			WHERE l.event_ref = events.id AND l.received_at = events.received_at
+			AND l.key = $%d AND l.value = $%d
+		)`, len(args) - 1, len(args)))
+	}
+	if query.AfterName != "" {
+		args = append(args, query.AfterName, query.AfterId)
+		conditions = append(conditions, fmt.Sprintf("(event_name, event_id) > ($%d, $%d)", len(args) - 1, len(args)))
+	}
+
+	sql := "SELECT event_id, event_name, " + EVENT_COLUMNS + " FROM events WHERE " + strings.Join(conditions, " AND ")
+	sql += " ORDER BY event_name, event_id"
+	if query.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+
+	rows, err := db.dbPool.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.Event{}
+	for rows.Next() {
+		var event models.Event
+		var row eventRow
+		err = rows.Scan(append([]interface{}{&event.Id, &event.Name}, row.columns()...)...)
+		if err != nil {
+			return nil, err
+		}
+		row.apply(&event)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Retrieves the steps of an event, ordered by step number, with their labels.
+func (db *TimescaleDB) GetSteps(tenant string, eventName string, eventId string) ([]models.Step, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	rows, err := db.dbPool.Query(context.Background(), `
+		SELECT s.step_name, s.step_number, s.creation_time
+		FROM steps s
+		JOIN events e ON s.event_ref = e.id AND s.received_at = e.received_at
+		WHERE e.tenant = $1 AND e.event_name = $2 AND e.event_id = $3
+		ORDER BY s.step_number, s.step_name
+	`, tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []models.Step{}
+	for rows.Next() {
+		var step models.Step
+		err = rows.Scan(&step.Name, &step.Number, &step.CreationTime)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	labels, err := db.GetLabels(tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	return models.AttachLabels(steps, labels), nil
+}
+
+// Retrieves the labels of an event, ordered by step number then key.
+func (db *TimescaleDB) GetLabels(tenant string, eventName string, eventId string) ([]models.Label, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	rows, err := db.dbPool.Query(context.Background(), `
+		SELECT l.step_name, l.step_number, l.key, l.value
+		FROM labels l
+		JOIN events e ON l.event_ref = e.id AND l.received_at = e.received_at
+		WHERE e.tenant = $1 AND e.event_name = $2 AND e.event_id = $3
+		ORDER BY l.step_number, l.step_name, l.key
+	`, tenant, eventName, eventId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []models.Label{}
+	for rows.Next() {
+		var label models.Label
+		err = rows.Scan(&label.StepName, &label.StepNumber, &label.Key, &label.Val)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, rows.Err()
+}
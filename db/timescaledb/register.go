@@ -0,0 +1,15 @@
+package timescaledb
+
+import (
+	"owl_server/config"
+	"owl_server/db"
+)
+
+// Name of the backend, as set in the "backend" setting
+const BACKEND_NAME = "timescaledb"
+
+func init() {
+	db.Register(BACKEND_NAME, func(cfg config.Config) (db.DB, error) {
+		return NewTimescaleDB(cfg.TimescaleDB, cfg.MergePolicy), nil
+	})
+}
@@ -0,0 +1,141 @@
+package timescaledb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"owl_server/models"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Deletes the events created before their retention, with their steps
+// and labels. The age of the events without creation time is counted
+// from the time their first update was received.
+//
+// When every event name has a retention, the chunks received before the
+// longest one are dropped whole (drop_chunks), which is much cheaper than
+// deleting their rows. The rows of the other expired events are then deleted.
+func (db *TimescaleDB) PurgeExpired(policy models.RetentionPolicy, now time.Time) ([]models.PurgedEvents, error) {
+	if db.dbPool == nil {
+		return nil, fmt.Errorf("database is disconnected")
+	}
+	ctx := context.Background()
+	purged := []models.PurgedEvents{}
+	if longest := policy.Longest(); longest > 0 {
+		dropped, err := db.dropChunks(ctx, now.Add(-longest))
+		if err != nil {
+			return purged, fmt.Errorf("unable to drop the expired chunks. Underlying error: %w", err)
+		}
+		purged = append(purged, dropped...)
+	}
+
+	names := policy.Names()
+	for _, name := range names {
+		deleted, err := db.deleteExpired(ctx, `event_name = $1`, name, now.Add(-policy.Events[name]))
+		if err != nil {
+			return models.MergePurgedEvents(purged), fmt.Errorf("unable to purge the %s events. Underlying error: %w", name, err)
+		}
+		purged = append(purged, deleted...)
+	}
+	if policy.Default > 0 {
+		deleted, err := db.deleteExpired(ctx, `event_name <> ALL($1)`, names, now.Add(-policy.Default))
+		if err != nil {
+			return models.MergePurgedEvents(purged), fmt.Errorf("unable to purge the events. Underlying error: %w", err)
+		}
+		purged = append(purged, deleted...)
+	}
+	return models.MergePurgedEvents(purged), nil
+}
+
+// Drops the chunks of the hypertables which only hold events received
+// before the given time. Does nothing without the TimescaleDB extension.
+func (db *TimescaleDB) dropChunks(ctx context.Context, olderThan time.Time) ([]models.PurgedEvents, error) {
+	timescale, err := db.hasTimescale(ctx)
+	if err != nil || !timescale {
+		return nil, err
+	}
+
+	tx, err := db.dbPool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	// end of the most recent chunk to drop
+	var boundary *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT max(range_end) FROM timescaledb_information.chunks
+		WHERE hypertable_schema = current_schema() AND hypertable_name = 'events' AND range_end <= $1
+	`, olderThan).Scan(&boundary)
+	if err != nil || boundary == nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT tenant, event_name, count(*) FROM events
+		WHERE received_at < $1
+		GROUP BY tenant, event_name
+	`, *boundary)
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := scanPurgedEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	chunks := 0
+	for _, table := range []string{"labels", "steps", "events"} {
+		var count int
+		err = tx.QueryRow(ctx, fmt.Sprintf(`
+			SELECT count(*) FROM drop_chunks('%s', older_than => $1::TIMESTAMPTZ)
+		`, table), olderThan).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		chunks += count
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Dropped %d chunks received before %s.", chunks, boundary.Format(time.RFC3339))
+	return dropped, nil
+}
+
+// Deletes the events matching the condition (whose argument is $1)
+// created before the cutoff, with their steps and labels
+func (db *TimescaleDB) deleteExpired(ctx context.Context, condition string, arg interface{}, cutoff time.Time) ([]models.PurgedEvents, error) {
+	rows, err := db.dbPool.Query(ctx, `
+		WITH purged AS (
+			DELETE FROM events WHERE `+condition+` AND COALESCE(creation_time, received_at) < $2
+			RETURNING id, received_at, tenant, event_name
+		), purged_steps AS (
+			DELETE FROM steps USING purged
+			WHERE steps.event_ref = purged.id AND steps.received_at = purged.received_at
+		), purged_labels AS (
+			DELETE FROM labels USING purged
+			WHERE labels.event_ref = purged.id AND labels.received_at = purged.received_at
+		)
+		SELECT tenant, event_name, count(*) FROM purged
+		GROUP BY tenant, event_name
+	`, arg, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return scanPurgedEvents(rows)
+}
+
+// Reads rows of tenant, event name and count
+func scanPurgedEvents(rows pgx.Rows) ([]models.PurgedEvents, error) {
+	defer rows.Close()
+	purged := []models.PurgedEvents{}
+	for rows.Next() {
+		var p models.PurgedEvents
+		err := rows.Scan(&p.Tenant, &p.EventName, &p.Count)
+		if err != nil {
+			return nil, err
+		}
+		purged = append(purged, p)
+	}
+	return purged, rows.Err()
+}
@@ -0,0 +1,129 @@
+package timescaledb
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Brings the schema to the latest version known by the server, then turns
+// the tables into hypertables (with their compression policies) when
+// TimescaleDB is available. On a plain PostgreSQL database, the tables
+// stay regular tables.
+//
+// Refuses to start on a schema newer than the latest known version (the
+// database was migrated by a newer server), and on an outdated schema
+// when the migrations aren't applied at startup (see AutoMigrate).
+func (db *TimescaleDB) CreateTables() error {
+	ctx := context.Background()
+	var timescale bool
+	err := db.withMigrationLock(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		current, err := schemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		latest := latestVersion()
+		if current > latest {
+			return fmt.Errorf("the database schema has version %d, newer than the latest version known by this server (%d): upgrade the server", current, latest)
+		}
+		if current < latest {
+			if !db.config.AutoMigrate {
+				return fmt.Errorf("the database schema has version %d, this server needs version %d: run \"owl_server migrate up\"", current, latest)
+			}
+			log.Printf("Migrating the schema from version %d to version %d...", current, latest)
+			err = migrate(ctx, conn, current, latest)
+			if err != nil {
+				return err
+			}
+			log.Printf("Migration done.")
+		}
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		timescale, err = db.enableTimescale(ctx, tx)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	if !timescale {
+		log.Printf("The TimescaleDB extension is not available: events, steps and labels are regular tables.")
+	}
+	return nil
+}
+
+// Turns the tables into hypertables, and sets up their compression,
+// if the TimescaleDB extension is available. Returns false if it isn't.
+func (db *TimescaleDB) enableTimescale(ctx context.Context, tx pgx.Tx) (bool, error) {
+	var available bool
+	err := tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')
+	`).Scan(&available)
+	if err != nil || !available {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS timescaledb`)
+	if err != nil {
+		return false, err
+	}
+
+	chunkInterval := interval(db.config.ChunkInterval.Duration().Seconds())
+	// Segment by and order by columns of the compressed chunks. Events are
+	// mostly searched by tenant and name, steps and labels by event.
+	// The columns of the unique keys must all be used.
+	compression := map[string][2]string{
+		"events": {"tenant, event_name", "received_at DESC, event_id, id"},
+		"steps": {"", "event_ref, step_number, step_name, received_at"},
+		"labels": {"key", "event_ref, step_number, step_name, received_at"},
+	}
+	for _, table := range []string{"events", "steps", "labels"} {
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+			SELECT create_hypertable('%s', 'received_at', chunk_time_interval => %s, if_not_exists => TRUE, migrate_data => TRUE)
+		`, table, chunkInterval))
+		if err != nil {
+			return false, fmt.Errorf("unable to create the %s hypertable. Underlying error: %w", table, err)
+		}
+		if db.config.CompressAfter <= 0 {
+			continue
+		}
+		// the compression settings can't be changed once chunks are compressed
+		var compressed bool
+		err = tx.QueryRow(ctx, `
+			SELECT compression_enabled FROM timescaledb_information.hypertables
+			WHERE hypertable_schema = current_schema() AND hypertable_name = $1
+		`, table).Scan(&compressed)
+		if err != nil {
+			return false, err
+		}
+		if compressed {
+			continue
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+			ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_segmentby = '%s', timescaledb.compress_orderby = '%s')
+		`, table, compression[table][0], compression[table][1]))
+		if err != nil {
+			return false, fmt.Errorf("unable to enable the compression of %s. Underlying error: %w", table, err)
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+			SELECT add_compression_policy('%s', %s, if_not_exists => TRUE)
+		`, table, interval(db.config.CompressAfter.Duration().Seconds())))
+		if err != nil {
+			return false, fmt.Errorf("unable to add the compression policy of %s. Underlying error: %w", table, err)
+		}
+	}
+	return true, nil
+}
+
+// SQL interval of the given number of seconds
+func interval(seconds float64) string {
+	return fmt.Sprintf("INTERVAL '%d seconds'", int64(seconds))
+}
@@ -2,56 +2,40 @@ package timescaledb
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/url"
-	"os"
+	"owl_server/config"
 	"owl_server/models"
+	"sort"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-const USER = "morel"
 type TimescaleDB struct {
+	config config.TimescaleDBConfig
+	mergePolicy models.MergePolicy
 	dbPool *pgxpool.Pool
 }
 
-type ConnectionConfig struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host string `json:"host"`
-	Port string `json:"port"`
-	Database string `json:"database"`
-	SSL bool `json:"ssl"`
+// Creates a (disconnected) TimescaleDB.
+func NewTimescaleDB(dbConfig config.TimescaleDBConfig, mergePolicy models.MergePolicy) *TimescaleDB {
+	return &TimescaleDB{config: dbConfig, mergePolicy: mergePolicy}
 }
 
-func getConnectionString() (string, error) {
-	configString, err := os.ReadFile("connectionConfigs/timescaledbConnectionConfig.json")
+func (db *TimescaleDB) Connect() error {
+	poolConfig, err := pgxpool.ParseConfig(db.config.DSN)
 	if err != nil {
-		return "", fmt.Errorf("unable to retrieve connection string. Underlying error: %s", err.Error())
+		return fmt.Errorf("invalid timescaledb connection string. Underlying error: %s", err.Error())
 	}
-	var config ConnectionConfig
-	err = json.Unmarshal(configString, &config)
-	if err != nil {
-		return "", fmt.Errorf("unable to retrieve connection string. Underlying error: %s", err.Error())
+	if db.config.PoolSize > 0 {
+		poolConfig.MaxConns = int32(db.config.PoolSize)
 	}
-	var ssl string
-	if config.SSL {
-		ssl = "?sslmode=require"
-	} else {
-		ssl = ""
-	}
-	return "postgres://" + config.Username + ":" + url.QueryEscape(config.Password) + "@" + config.Host + ":" + config.Port + "/" + config.Database + ssl, nil
-}
-
-func (db *TimescaleDB) Connect() error {
-	connectionString, err := getConnectionString()
-	if err != nil {
-		return err
+	if db.config.ConnectTimeout > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = db.config.ConnectTimeout.Duration()
 	}
-	dbPool, err := pgxpool.Connect(context.Background(), connectionString)
+	dbPool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
 	if err != nil {
 		return err
 	}
@@ -69,217 +53,229 @@ func (db *TimescaleDB) Disconnect() error {
 	return nil
 }
 
-func (db *TimescaleDB) CreateTables() error {
-	ctx := context.Background()
+func (db *TimescaleDB) InsertUpdate(tenant string, update models.Update) error {
+	return db.InsertUpdates(tenant, []models.Update{update})
+}
+
+// Inserts all the given updates in a single transaction:
+// either every update is saved, or none is.
+// The statements of all the updates are sent to the database
+// as one batch, so the whole insertion costs a few round trips
+// regardless of the number of updates.
+func (db *TimescaleDB) InsertUpdates(tenant string, updates []models.Update) error {
+	if db.dbPool == nil {
+		return fmt.Errorf("database is disconnected")
+	}
+	if len(updates) == 0 {
+		return nil
+	}
 
-	// Create EVENT table
-	_, err := db.dbPool.Exec(ctx, `
-        CREATE TABLE IF NOT EXISTS events (
-            event_id TEXT PRIMARY KEY,
-            event_name TEXT NOT NULL,
-            creation_time TIMESTAMPTZ NULL,
-            event_result TEXT NULL
-        )
-    `)
+	batch := newUpdateBatch(tenant, db.mergePolicy)
+	for _, update := range updates {
+		switch update.UpdateType {
+		case models.UPDATE_TYPE_START, models.UPDATE_TYPE_STEP, models.UPDATE_TYPE_LABEL, models.UPDATE_TYPE_END:
+			batch.addEvent(update.EventName, update.EventId)
+		default:
+			return fmt.Errorf("%w: %v", models.ErrUnknownUpdateType, update.UpdateType)
+		}
+	}
+	batch.createEvents()
+	for _, update := range updates {
+		switch update.UpdateType {
+		case models.UPDATE_TYPE_START:
+			batch.insertStartUpdate(update)
+		case models.UPDATE_TYPE_STEP:
+			batch.insertStepUpdate(update)
+		case models.UPDATE_TYPE_LABEL:
+			batch.insertLabelUpdate(update)
+		case models.UPDATE_TYPE_END:
+			batch.insertEndUpdate(update)
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := db.dbPool.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	// Create STEPS table
-    _, err = db.dbPool.Exec(ctx, `
-        CREATE TABLE IF NOT EXISTS steps (
-            step_id TEXT PRIMARY KEY,
-            step_name TEXT NOT NULL,
-            event_id TEXT REFERENCES events(event_id),
-            creation_time TIMESTAMPTZ NULL,
-            step_number INTEGER NOT NULL
-        )
-    `)
-    if err != nil {
-        return err
-    }
+	results := tx.SendBatch(ctx, batch.batch)
+	for i := 0; i < batch.batch.Len(); i++ {
+		_, err = results.Exec()
+		if err != nil {
+			results.Close()
+			return err
+		}
+	}
+	err = results.Close()
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
 
-	// Create LABELS table
-    _, err = db.dbPool.Exec(ctx, `
-        CREATE TABLE IF NOT EXISTS labels (
-            label_id TEXT PRIMARY KEY,
-            step_id TEXT REFERENCES steps(step_id),
-            key TEXT NOT NULL,
-            value TEXT NOT NULL
-        )
-    `)
-    if err != nil {
-        return err
-    }
+// Statements needed to insert a list of updates.
+// Keeps track of the events and steps already created by
+// the batch, to avoid queuing the same statement several times.
+type updateBatch struct {
+	tenant string
+	mergePolicy models.MergePolicy
+	batch *pgx.Batch
+	// events of the updates, identified by their db event ID
+	events map[string]eventKey
+	steps map[stepKey]bool
+}
 
-	// Convert STEPS table to a hypertable
-	// Skip this for now, getting the error:
-	// cannot create a unique index without the column "creation_time" (used in partitioning) (SQLSTATE TS103)
-    // _, err = db.dbPool.Exec(ctx, `
-    //     SELECT create_hypertable('steps', 'creation_time', if_not_exists => TRUE)
-    // `)
-	// if err != nil {
-	// 	return err
-	// }
+type eventKey struct {
+	name string
+	id string
+}
 
-	return nil
+type stepKey struct {
+	event eventKey
+	name string
+	number int
 }
 
-func (db *TimescaleDB) InsertUpdate(update models.Update) error {
-	if db.dbPool == nil {
-		return fmt.Errorf("database is disconnected")
-	}
-	switch update.UpdateType {
-	case models.UPDATE_TYPE_START:
-		return db.insertStartUpdate(update)
-	case models.UPDATE_TYPE_STEP:
-		return db.insertStepUpdate(update)
-	case models.UPDATE_TYPE_LABEL:
-		return db.insertLabelUpdate(update)
-	case models.UPDATE_TYPE_END:
-		return db.insertEndUpdate(update)
-	default:
-		return fmt.Errorf("unknown update: %v", update.UpdateType)
+func newUpdateBatch(tenant string, mergePolicy models.MergePolicy) *updateBatch {
+	return &updateBatch{
+		tenant: tenant,
+		mergePolicy: mergePolicy,
+		batch: &pgx.Batch{},
+		events: map[string]eventKey{},
+		steps: map[stepKey]bool{},
 	}
 }
 
-func (db *TimescaleDB) createEvent(eventName string, eventID string, creationTime int64) error {
-	ctx := context.Background()
-	dbEventId := getDBEventID(eventName, eventID)
-	if creationTime <= 0 {
-		_, err := db.dbPool.Exec(ctx, `
-		INSERT INTO events (event_id, event_name)
-		VALUES ($1, $2)
-		`, dbEventId, eventName)
-		return err
-	} else {
-		_, err := db.dbPool.Exec(ctx, `
-		INSERT INTO events (event_id, event_name, creation_time)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (event_id)
-		DO UPDATE SET creation_time = EXCLUDED.creation_time
-		`, dbEventId, eventName, getConvertedTimestamp(creationTime))
-		return err
+// Condition selecting an event, whose tenant, name and ID
+// are the first 3 arguments of the statement
+const EVENT_CONDITION = "tenant = $1 AND event_name = $2 AND event_id = $3"
+
+// SQL condition, true when a value set by an update replaces the current
+// value according to the merge policy. Same as models.Overrides.
+func (b *updateBatch) overrides(version string, value string, currentVersion string, currentValue string) string {
+	operator := ">"
+	if b.mergePolicy.FirstWriterWins() {
+		operator = "<"
 	}
+	return fmt.Sprintf("(%[1]s %[5]s %[3]s OR (%[1]s = %[3]s AND %[2]s %[5]s %[4]s))",
+		version, value, currentVersion, currentValue, operator)
 }
 
-func (db *TimescaleDB) insertStartUpdate(update models.Update) error {
-	return db.createEvent(update.EventName, update.EventId, update.Timestamp)
+// Records that the updates of the batch touch the given event
+func (b *updateBatch) addEvent(eventName string, eventID string) {
+	b.events[getDBEventID(b.tenant, eventName, eventID)] = eventKey{name: eventName, id: eventID}
 }
 
-func (db *TimescaleDB) createStep(eventName string, eventID string, stepName string, stepNumber int, timestamp int64) error {
-	ctx := context.Background()
-
-	// Check if event exists. If not, create it
-	dbEventId := getDBEventID(eventName, eventID)
-	var exists bool
-	err := db.dbPool.QueryRow(ctx, `
-		SELECT EXISTS ( SELECT 1 FROM events WHERE event_id = $1 )
-		`, dbEventId).Scan(&exists)
-	if err != nil {
-		return err
+// Creates the events of the batch that don't exist yet.
+//
+// The unique keys of the events table include received_at, so they can't
+// prevent two transactions from creating the same event. Instead, each
+// transaction takes a lock on the events it creates, in the same order
+// (so that two transactions never wait for each other's locks).
+func (b *updateBatch) createEvents() {
+	var dbEventIds []string
+	for dbEventId := range b.events {
+		dbEventIds = append(dbEventIds, dbEventId)
 	}
-	if !exists {
-		// Create event
-		err = db.createEvent(eventName, eventID, -1)
-		if err != nil {
-			return err
-		}
+	sort.Strings(dbEventIds)
+	for _, dbEventId := range dbEventIds {
+		event := b.events[dbEventId]
+		b.batch.Queue(`SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, dbEventId)
+		b.batch.Queue(`
+		INSERT INTO events (tenant, event_name, event_id, received_at)
+		SELECT $1::TEXT, $2::TEXT, $3::TEXT, now()
+		WHERE NOT EXISTS (SELECT 1 FROM events WHERE `+EVENT_CONDITION+`)
+		`, b.tenant, event.name, event.id)
+	}
+}
+
+// The creation time is written unless the merge policy keeps the current one
+func (b *updateBatch) insertStartUpdate(update models.Update) {
+	if update.Timestamp <= 0 {
+		return
 	}
+	b.batch.Queue(`
+		UPDATE events
+		SET creation_time = $4, creation_version = $5
+		WHERE `+EVENT_CONDITION+` AND (creation_time IS NULL OR `+
+		b.overrides("$5::BIGINT", "$4::TIMESTAMPTZ", "creation_version", "creation_time")+`)
+	`, b.tenant, update.EventName, update.EventId, getConvertedTimestamp(update.Timestamp), update.Version())
+}
 
-	// Once events exist, create step
-	stepID := getStepID(eventName, eventID, stepName, stepNumber)
+// Creates the step if it doesn't exist yet (its event must exist).
+// If timestamp is positive, it is written as the step creation time,
+// unless the merge policy keeps the current one.
+func (b *updateBatch) createStep(eventName string, eventID string, stepName string, stepNumber int, timestamp int64, version int64) {
+	key := stepKey{event: eventKey{name: eventName, id: eventID}, name: stepName, number: stepNumber}
 	if timestamp <= 0 {
-		_, err = db.dbPool.Exec(ctx, `
-			INSERT INTO steps (step_id, step_name, event_id, step_number)
-			VALUES ($1, $2, $3, $4)
-		`, stepID, stepName, dbEventId, stepNumber)
+		if b.steps[key] {
+			return
+		}
+		b.batch.Queue(`
+		INSERT INTO steps (event_ref, received_at, step_name, step_number)
+		SELECT id, received_at, $4::TEXT, $5::INTEGER FROM events WHERE `+EVENT_CONDITION+`
+		ON CONFLICT (event_ref, step_name, step_number, received_at) DO NOTHING
+		`, b.tenant, eventName, eventID, stepName, stepNumber)
 	} else {
-		_, err = db.dbPool.Exec(ctx, `
-		INSERT INTO steps (step_id, step_name, event_id, creation_time, step_number)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (step_id)
-		DO UPDATE SET creation_time = EXCLUDED.creation_time
-		`, stepID, stepName, dbEventId, getConvertedTimestamp(timestamp), stepNumber)
+		b.batch.Queue(`
+		INSERT INTO steps (event_ref, received_at, step_name, step_number, creation_time, creation_version)
+		SELECT id, received_at, $4::TEXT, $5::INTEGER, $6::TIMESTAMPTZ, $7::BIGINT FROM events WHERE `+EVENT_CONDITION+`
+		ON CONFLICT (event_ref, step_name, step_number, received_at)
+		DO UPDATE SET creation_time = EXCLUDED.creation_time, creation_version = EXCLUDED.creation_version
+		WHERE steps.creation_time IS NULL OR `+
+			b.overrides("EXCLUDED.creation_version", "EXCLUDED.creation_time", "steps.creation_version", "steps.creation_time"),
+			b.tenant, eventName, eventID, stepName, stepNumber, getConvertedTimestamp(timestamp), version)
 	}
-	return err
+	b.steps[key] = true
 }
 
-func (db *TimescaleDB) insertStepUpdate(update models.Update) error {
-	return db.createStep(update.EventName, update.EventId, update.StepName, update.StepNumber, update.Timestamp)
+func (b *updateBatch) insertStepUpdate(update models.Update) {
+	b.createStep(update.EventName, update.EventId, update.StepName, update.StepNumber, update.Timestamp, update.Version())
 }
 
-func (db *TimescaleDB) insertLabelUpdate(update models.Update) error {
-	// Check if step exists. If not, create it
-	labelID := getLabelID(update.EventName, update.EventId, update.StepName, update.StepNumber, update.LabelKey)
-	stepID := getStepID(update.EventName, update.EventId, update.StepName, update.StepNumber)
-	ctx := context.Background()
-	var exists bool
-	err := db.dbPool.QueryRow(ctx, `
-		SELECT EXISTS ( SELECT 1 FROM steps WHERE step_id = $1 )
-		`, stepID).Scan(&exists)
-	if err != nil {
-		return err
-	}
-	if !exists {
-		// Create step
-		err = db.createStep(update.EventName, update.EventId, update.StepName, update.StepNumber, -1)
-		if err != nil {
-			return err
-		}
-	}
+func (b *updateBatch) insertLabelUpdate(update models.Update) {
+	// Create the step if it doesn't exist
+	b.createStep(update.EventName, update.EventId, update.StepName, update.StepNumber, -1, 0)
 
-	// Now insert the label
-	_, err = db.dbPool.Exec(ctx, `
-		INSERT INTO labels (label_id, step_id, key, value)
-        VALUES ($1, $2, $3, $4)
-		ON CONFLICT (label_id)
-		DO UPDATE SET value = EXCLUDED.value
-    `, labelID, stepID, update.LabelKey, update.LabelVal)
-	return err
+	// Now insert the label. Label values are compared byte-wise
+	// (COLLATE "C"), as the other backends do
+	b.batch.Queue(`
+		INSERT INTO labels (event_ref, received_at, step_name, step_number, key, value, version)
+		SELECT id, received_at, $4::TEXT, $5::INTEGER, $6::TEXT, $7::TEXT, $8::BIGINT FROM events WHERE `+EVENT_CONDITION+`
+		ON CONFLICT (event_ref, step_name, step_number, key, received_at)
+		DO UPDATE SET value = EXCLUDED.value, version = EXCLUDED.version
+		WHERE `+
+		b.overrides("EXCLUDED.version", `EXCLUDED.value COLLATE "C"`, "labels.version", `labels.value COLLATE "C"`),
+		b.tenant, update.EventName, update.EventId, update.StepName, update.StepNumber, update.LabelKey, update.LabelVal, update.Version())
 }
 
-func (db *TimescaleDB) insertEndUpdate(update models.Update) error {
-	// Update the event with the result
-	ctx := context.Background()
-	eventID := getDBEventID(update.EventName, update.EventId)
-    _, err := db.dbPool.Exec(ctx, `
-        UPDATE events
-        SET event_result = $1
-        WHERE event_id = $2
-    `, update.Result, eventID)
-    if err != nil {
-		return err
-	}
+func (b *updateBatch) insertEndUpdate(update models.Update) {
+	// Save the result (the event exists), unless the merge policy keeps the current one.
+	// The result of an abandoned event is replaced by the first end update
+	b.batch.Queue(`
+		UPDATE events
+		SET event_result = $4, result_version = $5, abandoned_at = NULL, last_step_name = NULL, last_step_number = NULL
+		WHERE `+EVENT_CONDITION+` AND (event_result IS NULL OR abandoned_at IS NOT NULL OR `+
+		b.overrides("$5::BIGINT", `$4::TEXT COLLATE "C"`, "result_version", `event_result COLLATE "C"`)+`)
+	`, b.tenant, update.EventName, update.EventId, update.Result, update.Version())
 
 	// Insert the end step
-	return db.createStep(update.EventName, update.EventId, "end", update.StepNumber, update.Timestamp)
+	b.createStep(update.EventName, update.EventId, "end", update.StepNumber, update.Timestamp, update.Version())
 }
 
 // Converts an eventID to a db event ID
 // an eventID is simply a UUID generated on the client
-// A DBEventID is a combination of that UUID, the event name and the user
-// 	The DBEventID will be used as a key in the events database
-func getDBEventID(eventName string, eventID string) string {
-	return fmt.Sprintf("%s-%s-%s", USER, eventName, eventID)
-}
-
-// Returns the stepID, which will be used as key in the steps database
-func getStepID(eventName string, eventID string, stepName string, stepNumber int) string {
-	dbEventId := getDBEventID(eventName, eventID)
-	return fmt.Sprintf("%s-%s-%d", dbEventId, stepName, stepNumber)
+// A DBEventID is a combination of that UUID, the event name and the tenant.
+// It identifies the event across the tenants and names, and is used as
+// the key of the lock taken while creating the event.
+func getDBEventID(tenant string, eventName string, eventID string) string {
+	return fmt.Sprintf("%s-%s-%s", tenant, eventName, eventID)
 }
 
-// Returns the labelID, which will be used as key in the labels database
-func getLabelID(eventName string, eventID string, stepName string, stepNumber int, labelKey string) string{
-	stepID := getStepID(eventName, eventID, stepName, stepNumber)
-	return fmt.Sprintf("%s-%s", stepID, labelKey)
+// Converts a client timestamp to the time stored in TimescaleDB,
+// keeping the milliseconds.
+func getConvertedTimestamp(timestamp int64) time.Time {
+	return models.TimestampToTime(timestamp)
 }
-
-func getConvertedTimestamp(timestamp int64) string {
-	referenceDate := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
-    t := referenceDate.Add(time.Duration(timestamp) * time.Millisecond)
-	// Format the time for TimescaleDB (RFC3339 format)
-    formattedTime := t.Format(time.RFC3339)
-	return formattedTime
-}
\ No newline at end of file
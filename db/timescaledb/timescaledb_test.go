@@ -0,0 +1,41 @@
+package timescaledb
+
+import (
+	"os"
+	"owl_server/config"
+	"owl_server/db"
+	"owl_server/db/conformance"
+	"owl_server/models"
+	"testing"
+	"time"
+)
+
+// Connection string of the TimescaleDB (or plain PostgreSQL) database
+// the conformance suite runs against. The suite is skipped when it isn't set.
+const TEST_DSN_ENV = "OWL_TEST_TIMESCALEDB_DSN"
+
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv(TEST_DSN_ENV)
+	if dsn == "" {
+		t.Skipf("%s is not set", TEST_DSN_ENV)
+	}
+	conformance.Run(t, func(t *testing.T, mergePolicy models.MergePolicy) db.DB {
+		database := NewTimescaleDB(config.TimescaleDBConfig{
+			DSN: dsn,
+			PoolSize: 4,
+			ConnectTimeout: config.Duration(10 * time.Second),
+			ChunkInterval: config.Duration(7 * 24 * time.Hour),
+			AutoMigrate: true,
+		}, mergePolicy)
+		err := database.Connect()
+		if err != nil {
+			t.Fatalf("connecting: %v", err)
+		}
+		t.Cleanup(func() { database.Disconnect() })
+		err = database.CreateTables()
+		if err != nil {
+			t.Fatalf("creating the tables: %v", err)
+		}
+		return database
+	})
+}
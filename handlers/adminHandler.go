@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"owl_server/alerting"
+	"owl_server/retention"
+	"owl_server/tenants"
+	"owl_server/webhooks"
+	"strings"
+	"time"
+)
+
+// Handler for the /admin endpoints, used to manage the API keys of the tenants
+// to follow the retention job and the alerts, and to handle the failed
+// webhook deliveries.
+// Every request must carry the admin token as a bearer token.
+type AdminHandler struct {
+	keys *tenants.KeyStore
+	// nil if no events are ever purged
+	retention *retention.Job
+	// nil if no alert rules are configured
+	alerts *alerting.Engine
+	// nil if no webhook subscriptions are configured
+	webhooks *webhooks.Dispatcher
+	token string
+}
+
+func NewAdminHandler(keys *tenants.KeyStore, retentionJob *retention.Job, alerts *alerting.Engine, dispatcher *webhooks.Dispatcher, token string) *AdminHandler {
+	return &AdminHandler{keys: keys, retention: retentionJob, alerts: alerts, webhooks: dispatcher, token: token}
+}
+
+// Body of POST /admin/keys
+type issueKeyRequest struct {
+	Tenant string `json:"tenant"`
+	Description string `json:"description"`
+}
+
+// Response of POST /admin/keys. The key is only ever returned here
+type issuedKey struct {
+	Key string `json:"key"`
+	ID string `json:"id"`
+	Tenant string `json:"tenant"`
+	Description string `json:"description"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Handler for POST /admin/keys.
+// Issues a new API key for a tenant.
+func (h *AdminHandler) IssueKey(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+	var request issueKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, apiKey, err := h.keys.Issue(request.Tenant, request.Description)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Issued api key %s for tenant %s", apiKey.ID, apiKey.Tenant)
+	writeJSON(w, http.StatusCreated, issuedKey{
+		Key: key,
+		ID: apiKey.ID,
+		Tenant: apiKey.Tenant,
+		Description: apiKey.Description,
+		CreatedAt: apiKey.CreatedAt,
+	})
+}
+
+// Handler for GET /admin/keys.
+// Lists the API keys (without the keys themselves), including revoked ones.
+func (h *AdminHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.keys.List())
+}
+
+// Handler for DELETE /admin/keys/{id}.
+// Revokes an API key: requests using it are rejected from now on.
+func (h *AdminHandler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+	err := h.keys.Revoke(r.PathValue("id"))
+	if errors.Is(err, tenants.ErrKeyNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Revoked api key %s", r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /admin/retention.
+// Lists the reports of the last purges of the expired events, most recent first.
+func (h *AdminHandler) GetRetentionReports(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+	if h.retention == nil {
+		http.Error(w, "No retention is configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.retention.Reports())
+}
+
+// Handler for GET /admin/alerts.
+// Lists the alerts of the configured rules, ordered by rule name.
+func (h *AdminHandler) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) {
+		return
+	}
+	if h.alerts == nil {
+		http.Error(w, "No alert rules are configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.alerts.Alerts())
+}
+
+// Handler for GET /admin/webhooks/dead-letters.
+// Lists the webhook deliveries which failed all their attempts, oldest first.
+func (h *AdminHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) || !h.requireWebhooks(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.webhooks.DeadLetters())
+}
+
+// Handler for POST /admin/webhooks/dead-letters/{id}/retry.
+// Removes a dead letter and delivers its event again, as it is now.
+func (h *AdminHandler) RetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) || !h.requireWebhooks(w) {
+		return
+	}
+	err := h.webhooks.Retry(r.PathValue("id"))
+	if errors.Is(err, webhooks.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Retrying dead letter %s", r.PathValue("id"))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Handler for DELETE /admin/webhooks/dead-letters/{id}.
+// Removes a dead letter without delivering its event.
+func (h *AdminHandler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !h.authorize(w, r) || !h.requireWebhooks(w) {
+		return
+	}
+	err := h.webhooks.Discard(r.PathValue("id"))
+	if errors.Is(err, webhooks.ErrDeadLetterNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Discarded dead letter %s", r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Responds with a 404 and returns false if no webhook subscriptions are configured
+func (h *AdminHandler) requireWebhooks(w http.ResponseWriter) bool {
+	if h.webhooks == nil {
+		http.Error(w, "No webhook subscriptions are configured", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// Checks the admin token. Responds with a 401 and returns false if it is wrong.
+func (h *AdminHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"owl_server/tenants"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const ADMIN_TOKEN = "admin-s3cret"
+
+// Issues, lists and revokes API keys through /admin/keys, in turn
+func TestAdminKeys(t *testing.T) {
+	keys, err := tenants.OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("opening the key store: %v", err)
+	}
+	adminHandler := NewAdminHandler(keys, nil, nil, nil, ADMIN_TOKEN)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/keys", adminHandler.IssueKey)
+	mux.HandleFunc("GET /admin/keys", adminHandler.ListKeys)
+	mux.HandleFunc("DELETE /admin/keys/{id}", adminHandler.RevokeKey)
+
+	// the key issued by the first step, and its ID
+	var issued issuedKey
+	steps := []struct {
+		name string
+		method string
+		path func() string
+		body string
+		token string
+		wantStatus int
+		check func(t *testing.T, body []byte)
+	}{
+		{name: "no token", method: http.MethodGet, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, body: `{"tenant": "acme"}`, token: "admin", wantStatus: http.StatusUnauthorized},
+		{
+			name: "issue",
+			method: http.MethodPost,
+			body: `{"tenant": "acme", "description": "ci"}`,
+			token: ADMIN_TOKEN,
+			wantStatus: http.StatusCreated,
+			check: func(t *testing.T, body []byte) {
+				err := json.Unmarshal(body, &issued)
+				if err != nil || issued.Tenant != "acme" || issued.Description != "ci" || !strings.HasPrefix(issued.Key, tenants.API_KEY_PREFIX) {
+					t.Fatalf("got %s", body)
+				}
+				if tenant, ok := keys.Lookup(issued.Key); !ok || tenant != "acme" {
+					t.Errorf("the issued key isn't valid")
+				}
+			},
+		},
+		{name: "invalid tenant", method: http.MethodPost, body: `{"tenant": "ac-me"}`, token: ADMIN_TOKEN, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", method: http.MethodPost, body: `{"tenant":`, token: ADMIN_TOKEN, wantStatus: http.StatusBadRequest},
+		{
+			name: "list",
+			method: http.MethodGet,
+			token: ADMIN_TOKEN,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				// the key itself is never listed
+				if strings.Contains(string(body), issued.Key) || strings.Contains(string(body), `"key"`) {
+					t.Errorf("the key is listed: %s", body)
+				}
+				var listed []tenants.APIKey
+				err := json.Unmarshal(body, &listed)
+				if err != nil || len(listed) != 1 || listed[0].ID != issued.ID || listed[0].RevokedAt != nil {
+					t.Errorf("got %s", body)
+				}
+			},
+		},
+		{
+			name: "revoke",
+			method: http.MethodDelete,
+			path: func() string { return "/admin/keys/" + issued.ID },
+			token: ADMIN_TOKEN,
+			wantStatus: http.StatusNoContent,
+			check: func(t *testing.T, body []byte) {
+				if _, ok := keys.Lookup(issued.Key); ok {
+					t.Errorf("the revoked key is still valid")
+				}
+			},
+		},
+		{
+			name: "revoke unknown",
+			method: http.MethodDelete,
+			path: func() string { return "/admin/keys/unknown" },
+			token: ADMIN_TOKEN,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, step := range steps {
+		path := "/admin/keys"
+		if step.path != nil {
+			path = step.path()
+		}
+		request := httptest.NewRequest(step.method, path, strings.NewReader(step.body))
+		if step.token != "" {
+			request.Header.Set("Authorization", "Bearer " + step.token)
+		}
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		if response.Code != step.wantStatus {
+			t.Fatalf("%s: got status %d (%s), want %d", step.name, response.Code, response.Body, step.wantStatus)
+		}
+		if step.check != nil {
+			step.check(t, response.Body.Bytes())
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"owl_server/db"
+	"owl_server/models"
+	"strings"
+	"time"
+)
+
+// Maximum number of buckets of a time series
+const MAX_SERIES_BUCKETS = 1000
+// Narrowest bucket of a time series
+const MIN_BUCKET_WIDTH = time.Second
+
+// Handler for the /analytics endpoints, computing statistics
+// over the events of a name.
+type AnalyticsHandler struct {
+	database db.Analyzer
+}
+
+// Creates a handler reading from the given (already connected) database.
+func NewAnalyticsHandler(database db.Analyzer) *AnalyticsHandler {
+	return &AnalyticsHandler{database: database}
+}
+
+// Handler for GET /analytics/durations.
+// Supported query parameters:
+//   - name: event name (required)
+//   - from, to: creation time range (RFC3339), from inclusive, to exclusive
+//   - bucket: width of the buckets of the time series, e.g. 1h. Requires from and to
+//
+// Returns the percentiles of the event durations, of the latencies
+// between consecutive steps, and (with bucket) the durations over time.
+func (h *AnalyticsHandler) GetDurations(w http.ResponseWriter, r *http.Request) {
+	query, err := parseAnalyticsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	analytics, err := h.database.EventDurations(TenantFromRequest(r), query)
+	if err != nil {
+		log.Printf("error while computing event durations: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, analytics)
+}
+
+// Handler for GET /analytics/funnel.
+// Supported query parameters:
+//   - name: event name (required)
+//   - steps: comma separated step names of the stages, in order (required)
+//   - from, to: creation time range (RFC3339), from inclusive, to exclusive
+//   - segmentBy: label key splitting the events into segments
+//
+// Returns how many events reach each stage, with the conversion
+// and drop-off rates, overall and (with segmentBy) per segment.
+func (h *AnalyticsHandler) GetFunnel(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if params.Has("bucket") {
+		http.Error(w, "the bucket parameter isn't supported by funnels", http.StatusBadRequest)
+		return
+	}
+	analyticsQuery, err := parseAnalyticsQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := models.FunnelQuery{AnalyticsQuery: analyticsQuery, SegmentBy: params.Get("segmentBy")}
+	if params.Get("steps") != "" {
+		query.Steps = strings.Split(params.Get("steps"), ",")
+	}
+	if len(query.Steps) == 0 || len(query.Steps) > models.MAX_FUNNEL_STEPS {
+		http.Error(w, fmt.Sprintf("invalid steps parameter, expected between 1 and %d comma separated step names", models.MAX_FUNNEL_STEPS), http.StatusBadRequest)
+		return
+	}
+	for _, step := range query.Steps {
+		if step == "" {
+			http.Error(w, "invalid steps parameter, step names can't be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	funnel, err := h.database.Funnel(TenantFromRequest(r), query)
+	if err != nil {
+		log.Printf("error while computing funnel: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, funnel)
+}
+
+// Handler for GET /analytics/results.
+// Supported query parameters:
+//   - name: event name (required)
+//   - from, to: creation time range (RFC3339), from inclusive, to exclusive
+//   - bucket: width of the buckets of the time series, e.g. 1h. Requires from and to
+//   - success: comma separated results counted as successes, "success" by default
+//
+// Returns the number of events by result, the number of events without
+// end update and the success rate, overall and (with bucket) over time.
+func (h *AnalyticsHandler) GetResults(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	analyticsQuery, err := parseAnalyticsQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := models.ResultQuery{AnalyticsQuery: analyticsQuery, SuccessResults: models.DEFAULT_SUCCESS_RESULTS}
+	if params.Get("success") != "" {
+		query.SuccessResults = strings.Split(params.Get("success"), ",")
+		for _, result := range query.SuccessResults {
+			if result == "" {
+				http.Error(w, "invalid success parameter, results can't be empty", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	breakdown, err := h.database.EventResults(TenantFromRequest(r), query)
+	if err != nil {
+		log.Printf("error while computing event results: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, breakdown)
+}
+
+// Handler for GET /analytics/abandoned.
+// Supported query parameters:
+//   - name: event name (required)
+//   - from, to: creation time range (RFC3339), from inclusive, to exclusive
+//
+// Returns the number of events marked as abandoned, by last step reached.
+func (h *AnalyticsHandler) GetAbandoned(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if params.Has("bucket") {
+		http.Error(w, "the bucket parameter isn't supported by abandoned events", http.StatusBadRequest)
+		return
+	}
+	query, err := parseAnalyticsQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	breakdown, err := h.database.Abandonment(TenantFromRequest(r), query)
+	if err != nil {
+		log.Printf("error while counting abandoned events: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, breakdown)
+}
+
+// Builds a models.AnalyticsQuery from the /analytics query parameters
+func parseAnalyticsQuery(params url.Values) (models.AnalyticsQuery, error) {
+	query := models.AnalyticsQuery{EventName: params.Get("name")}
+	if query.EventName == "" {
+		return query, fmt.Errorf("missing name parameter")
+	}
+
+	var err error
+	if from := params.Get("from"); from != "" {
+		query.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return query, fmt.Errorf("invalid from parameter: %s", err)
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		query.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return query, fmt.Errorf("invalid to parameter: %s", err)
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, fmt.Errorf("from must be before to")
+	}
+
+	if bucket := params.Get("bucket"); bucket != "" {
+		query.Bucket, err = time.ParseDuration(bucket)
+		if err != nil || query.Bucket < MIN_BUCKET_WIDTH || query.Bucket % time.Millisecond != 0 {
+			return query, fmt.Errorf("invalid bucket parameter: %s, expected a duration of at least %s", bucket, MIN_BUCKET_WIDTH)
+		}
+		if query.From.IsZero() || query.To.IsZero() {
+			return query, fmt.Errorf("the bucket parameter requires from and to")
+		}
+		if query.To.Sub(query.From) / query.Bucket >= MAX_SERIES_BUCKETS {
+			return query, fmt.Errorf("too many buckets, at most %d are allowed", MAX_SERIES_BUCKETS)
+		}
+	}
+	return query, nil
+}
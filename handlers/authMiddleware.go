@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"owl_server/auth"
+)
+
+// Maximum size of the body of an authenticated request
+const MAX_BODY_BYTES = 10 << 20
+
+type tenantContextKey struct{}
+
+// Body of the 401/403 responses
+type authErrorResponse struct {
+	Error string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// Middleware authenticating requests, and identifying their tenant.
+// The authenticators are tried in order: the first one finding its kind
+// of credentials in the request decides whether the request is accepted.
+type Authentication struct {
+	authenticators []auth.Authenticator
+	// if false, requests without credentials belong to defaultTenant
+	required bool
+	defaultTenant string
+}
+
+func NewAuthentication(authenticators []auth.Authenticator, required bool, defaultTenant string) *Authentication {
+	return &Authentication{
+		authenticators: authenticators,
+		required: required,
+		defaultTenant: defaultTenant,
+	}
+}
+
+// Wraps the handler so that it is only called for authenticated requests
+// (or requests without credentials, if they are allowed).
+// Rejected requests get a 401 (unknown credentials) or a 403 (refused
+// credentials) with the reason.
+// The handler gets the tenant of the request with TenantFromRequest.
+func (a *Authentication) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Signatures cover the body, so it has to be read here.
+		// It is then put back for the handler.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_BODY_BYTES))
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.As(err, new(*http.MaxBytesError)) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		tenant, err := a.authenticate(r, body)
+		if err != nil {
+			var authError *auth.Error
+			if !errors.As(err, &authError) {
+				authError = &auth.Error{Status: http.StatusUnauthorized, Reason: err.Error()}
+			}
+			log.Printf("rejected request to %s from %s: %s", r.URL.Path, r.RemoteAddr, authError.Reason)
+			writeJSON(w, authError.Status, authErrorResponse{
+				Error: http.StatusText(authError.Status),
+				Reason: authError.Reason,
+			})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)))
+	}
+}
+
+// Returns the tenant of the request, or an error if it is refused
+func (a *Authentication) authenticate(r *http.Request, body []byte) (string, error) {
+	for _, authenticator := range a.authenticators {
+		tenant, err := authenticator.Authenticate(r, body)
+		if err == auth.ErrNoCredentials {
+			continue
+		}
+		return tenant, err
+	}
+	if a.required {
+		return "", &auth.Error{Status: http.StatusUnauthorized, Reason: "missing credentials"}
+	}
+	return a.defaultTenant, nil
+}
+
+// Returns the tenant of a request that went through Authentication.Wrap
+func TenantFromRequest(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
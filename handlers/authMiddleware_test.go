@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"owl_server/auth"
+	"owl_server/config"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// The tenant of a request is the one of the first authenticator finding
+// its credentials, or the default tenant when credentials aren't required
+func TestAuthentication(t *testing.T) {
+	authenticators := []auth.Authenticator{
+		auth.NewBearerAuthenticator([]config.BearerToken{{Token: "t1", Tenant: "acme"}}),
+		auth.NewHMACAuthenticator([]config.HMACKey{{ID: "k1", Secret: "s3cret", Tenant: "globex"}}, time.Minute),
+	}
+	tests := []struct {
+		name string
+		required bool
+		headers map[string]string
+		wantStatus int
+		wantTenant string
+		wantReason string
+	}{
+		{name: "bearer", required: true, headers: map[string]string{"Authorization": "Bearer t1"}, wantStatus: http.StatusOK, wantTenant: "acme"},
+		{name: "missing credentials", required: true, headers: map[string]string{}, wantStatus: http.StatusUnauthorized, wantReason: "missing credentials"},
+		{name: "default tenant", required: false, headers: map[string]string{}, wantStatus: http.StatusOK, wantTenant: "morel"},
+		// invalid credentials are refused, even when credentials aren't required
+		{name: "unknown token", required: false, headers: map[string]string{"Authorization": "Bearer t2"}, wantStatus: http.StatusUnauthorized, wantReason: "invalid bearer token"},
+		{
+			name: "refused signature",
+			required: true,
+			headers: map[string]string{auth.KEY_ID_HEADER: "k1", auth.TIMESTAMP_HEADER: "1", auth.SIGNATURE_HEADER: "00"},
+			wantStatus: http.StatusForbidden,
+			wantReason: "signature mismatch",
+		},
+		{
+			// the bearer authenticator comes first
+			name: "several credentials",
+			required: true,
+			headers: map[string]string{"Authorization": "Bearer t1", auth.KEY_ID_HEADER: "k1", auth.TIMESTAMP_HEADER: "1", auth.SIGNATURE_HEADER: "00"},
+			wantStatus: http.StatusOK,
+			wantTenant: "acme",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authentication := NewAuthentication(authenticators, test.required, "morel")
+			var tenant, body string
+			handler := authentication.Wrap(func(w http.ResponseWriter, r *http.Request) {
+				tenant = TenantFromRequest(r)
+				// the body is put back for the handler
+				content, _ := io.ReadAll(r.Body)
+				body = string(content)
+			})
+
+			request := httptest.NewRequest(http.MethodPost, "/receive", strings.NewReader(TEST_BODY))
+			for header, value := range test.headers {
+				request.Header.Set(header, value)
+			}
+			response := httptest.NewRecorder()
+			handler(response, request)
+
+			if response.Code != test.wantStatus {
+				t.Fatalf("status: got %d, want %d", response.Code, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusOK {
+				if tenant != test.wantTenant || body != TEST_BODY {
+					t.Errorf("got tenant %q and body %q, want %q and the request body", tenant, body, test.wantTenant)
+				}
+				return
+			}
+			var errorResponse authErrorResponse
+			err := json.Unmarshal(response.Body.Bytes(), &errorResponse)
+			if err != nil || errorResponse.Reason != test.wantReason {
+				t.Errorf("got %s, want the reason %q", response.Body, test.wantReason)
+			}
+		})
+	}
+}
+
+// Only bodies beyond the maximum size are answered with a 413
+func TestBodyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body io.Reader
+		wantStatus int
+	}{
+		{name: "valid", body: strings.NewReader(TEST_BODY), wantStatus: http.StatusOK},
+		{name: "too large", body: strings.NewReader(strings.Repeat(" ", MAX_BODY_BYTES + 1)), wantStatus: http.StatusRequestEntityTooLarge},
+		// e.g. the client disconnected, or sent a malformed chunked body
+		{name: "read error", body: iotest.ErrReader(io.ErrUnexpectedEOF), wantStatus: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authentication := NewAuthentication(nil, false, "morel")
+			handler := authentication.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+			response := httptest.NewRecorder()
+			handler(response, httptest.NewRequest(http.MethodPost, "/receive", test.body))
+			if response.Code != test.wantStatus {
+				t.Errorf("status: got %d, want %d (%s)", response.Code, test.wantStatus, response.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"owl_server/db"
+	"owl_server/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of events returned per page when the client doesn't specify a limit
+const DEFAULT_PAGE_SIZE = 50
+// Maximum number of events returned per page
+const MAX_PAGE_SIZE = 500
+// Query parameters starting with this prefix filter events by label,
+// e.g. label.country=FR
+const LABEL_PARAM_PREFIX = "label."
+
+// Handler for the /events endpoints, used to read back recorded events.
+type EventsHandler struct {
+	database db.DB
+}
+
+// Creates a handler reading from the given (already connected) database.
+func NewEventsHandler(database db.DB) *EventsHandler {
+	return &EventsHandler{database: database}
+}
+
+// Page of events returned by SearchEvents.
+type eventsPage struct {
+	Events []models.Event `json:"events"`
+	// opaque cursor to pass as the cursor parameter to get the next page.
+	// Empty if this is the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Position of the last event of a page
+type pageCursor struct {
+	EventName string `json:"n"`
+	EventId string `json:"i"`
+}
+
+// Handler for GET /events/{name}/{id}.
+// Returns the full event, with its steps (ordered by step number) and labels.
+func (h *EventsHandler) GetEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	event, err := h.database.GetEvent(TenantFromRequest(r), r.PathValue("name"), r.PathValue("id"))
+	if err != nil {
+		log.Printf("error while retrieving event: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, event)
+}
+
+// Handler for GET /events.
+// Supported query parameters:
+//   - name: event name
+//   - result: event result
+//   - from, to: creation time range (RFC3339), from inclusive, to exclusive
+//   - label.<key>=<value>: events having that label on any step
+//   - limit: page size (default DEFAULT_PAGE_SIZE, at most MAX_PAGE_SIZE)
+//   - cursor: nextCursor returned by the previous page
+//
+// Events are returned without their steps, ordered by name then ID.
+func (h *EventsHandler) SearchEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseEventQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.database.ListEvents(TenantFromRequest(r), query)
+	if err != nil {
+		log.Printf("error while listing events: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := eventsPage{Events: events}
+	if len(events) == query.Limit {
+		last := events[len(events) - 1]
+		page.NextCursor = encodeCursor(pageCursor{EventName: last.Name, EventId: last.Id})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Builds a models.EventQuery from the /events query parameters
+func parseEventQuery(params url.Values) (models.EventQuery, error) {
+	query := models.EventQuery{
+		EventName: params.Get("name"),
+		Result: params.Get("result"),
+		Limit: DEFAULT_PAGE_SIZE,
+	}
+
+	var err error
+	if from := params.Get("from"); from != "" {
+		query.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return query, fmt.Errorf("invalid from parameter: %s", err)
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		query.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return query, fmt.Errorf("invalid to parameter: %s", err)
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 {
+			return query, fmt.Errorf("invalid limit parameter: %s", limit)
+		}
+		if query.Limit > MAX_PAGE_SIZE {
+			query.Limit = MAX_PAGE_SIZE
+		}
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		position, err := decodeCursor(cursor)
+		if err != nil {
+			return query, fmt.Errorf("invalid cursor parameter")
+		}
+		query.AfterName = position.EventName
+		query.AfterId = position.EventId
+	}
+
+	for param, values := range params {
+		if !strings.HasPrefix(param, LABEL_PARAM_PREFIX) {
+			continue
+		}
+		key := strings.TrimPrefix(param, LABEL_PARAM_PREFIX)
+		if key == "" || len(values) == 0 {
+			return query, fmt.Errorf("invalid label filter: %s", param)
+		}
+		if query.Labels == nil {
+			query.Labels = map[string]string{}
+		}
+		query.Labels[key] = values[0]
+	}
+	return query, nil
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (pageCursor, error) {
+	var position pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return position, err
+	}
+	err = json.Unmarshal(data, &position)
+	if err == nil && position.EventName == "" {
+		err = fmt.Errorf("empty cursor")
+	}
+	return position, err
+}
+
+// Writes the given value as a JSON response body, with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Printf("error while writing response: %s", err)
+	}
+}
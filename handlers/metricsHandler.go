@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"owl_server/abandonment"
+	"owl_server/alerting"
+	"owl_server/ingestion"
+	"owl_server/retention"
+	"owl_server/spool"
+	"owl_server/webhooks"
+)
+
+// Handler for the /metrics endpoint.
+// Exposes the ingestion queue, deduplication, spool, retention, abandonment, alerting and webhook metrics in the Prometheus text format.
+type MetricsHandler struct {
+	queue *ingestion.Queue
+	dedupe *ingestion.Deduplicator
+	spool *spool.Spool
+	// nil if no events are ever purged
+	retention *retention.Job
+	// nil if no events are ever abandoned
+	sweeper *abandonment.Sweeper
+	// nil if no alert rules are configured
+	alerts *alerting.Engine
+	// nil if no webhook subscriptions are configured
+	webhooks *webhooks.Dispatcher
+}
+
+func NewMetricsHandler(queue *ingestion.Queue, dedupe *ingestion.Deduplicator, updatesSpool *spool.Spool, retentionJob *retention.Job, sweeper *abandonment.Sweeper, alerts *alerting.Engine, dispatcher *webhooks.Dispatcher) *MetricsHandler {
+	return &MetricsHandler{queue: queue, dedupe: dedupe, spool: updatesSpool, retention: retentionJob, sweeper: sweeper, alerts: alerts, webhooks: dispatcher}
+}
+
+// Handler for GET /metrics
+func (h *MetricsHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := h.queue.Stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "owl_ingestion_queue_depth", "gauge", "Number of update batches waiting to be written.", stats.Depth)
+	writeMetric(w, "owl_ingestion_queue_capacity", "gauge", "Maximum number of update batches the queue can hold.", stats.Capacity)
+	writeMetric(w, "owl_ingestion_pending_updates", "gauge", "Number of updates waiting to be written.", stats.PendingUpdates)
+	writeMetric(w, "owl_ingestion_workers", "gauge", "Number of workers writing to the database.", stats.Workers)
+	writeMetric(w, "owl_ingestion_inserted_updates_total", "counter", "Number of updates written to the database.", stats.InsertedUpdates)
+	writeMetric(w, "owl_ingestion_failed_updates_total", "counter", "Number of updates that failed to be written to the database.", stats.FailedUpdates)
+	writeMetric(w, "owl_ingestion_rejected_batches_total", "counter", "Number of update batches left to the spool replayer because the queue was full.", stats.RejectedBatches)
+
+	dedupeStats := h.dedupe.Stats()
+	writeMetric(w, "owl_ingestion_duplicate_updates_total", "counter", "Number of updates dropped because they had already been received.", dedupeStats.Duplicates)
+	writeMetric(w, "owl_dedupe_entries", "gauge", "Number of update IDs remembered to detect duplicates.", dedupeStats.Entries)
+
+	spoolStats := h.spool.Stats()
+	writeMetric(w, "owl_spool_segments", "gauge", "Number of spool segment files.", spoolStats.Segments)
+	writeMetric(w, "owl_spool_bytes", "gauge", "Size of the spool segment files, in bytes.", spoolStats.Bytes)
+	writeMetric(w, "owl_spool_pending_batches", "gauge", "Number of spooled update batches not saved in the database yet.", spoolStats.PendingRecords)
+	writeMetric(w, "owl_spool_dead_letters_total", "counter", "Number of spooled update batches moved to the dead letters because they can't be saved.", spoolStats.DeadLetters)
+
+	if h.retention != nil {
+		retentionStats := h.retention.Stats()
+		writeMetric(w, "owl_retention_runs_total", "counter", "Number of purges of the expired events.", retentionStats.Runs)
+		writeMetric(w, "owl_retention_failed_runs_total", "counter", "Number of purges of the expired events that failed.", retentionStats.FailedRuns)
+		writeMetric(w, "owl_retention_purged_events_total", "counter", "Number of expired events purged.", retentionStats.PurgedEvents)
+	}
+	if h.sweeper != nil {
+		sweeperStats := h.sweeper.Stats()
+		writeMetric(w, "owl_abandonment_runs_total", "counter", "Number of sweeps of the abandoned events.", sweeperStats.Runs)
+		writeMetric(w, "owl_abandonment_failed_runs_total", "counter", "Number of sweeps of the abandoned events that failed.", sweeperStats.FailedRuns)
+		writeMetric(w, "owl_abandonment_abandoned_events_total", "counter", "Number of events marked as abandoned.", sweeperStats.AbandonedEvents)
+	}
+	if h.alerts != nil {
+		alertingStats := h.alerts.Stats()
+		writeMetric(w, "owl_alerting_evaluations_total", "counter", "Number of evaluations of the alert rules.", alertingStats.Evaluations)
+		writeMetric(w, "owl_alerting_failed_evaluations_total", "counter", "Number of evaluations of the alert rules that failed.", alertingStats.FailedEvaluations)
+		writeMetric(w, "owl_alerting_notifications_total", "counter", "Number of alert notifications sent to webhooks.", alertingStats.Notifications)
+		writeMetric(w, "owl_alerting_failed_notifications_total", "counter", "Number of alert notifications that failed to be delivered.", alertingStats.FailedNotifications)
+		writeMetric(w, "owl_alerting_firing_alerts", "gauge", "Number of alerts currently firing.", alertingStats.Firing)
+	}
+	if h.webhooks != nil {
+		webhookStats := h.webhooks.Stats()
+		writeMetric(w, "owl_webhooks_deliveries_total", "counter", "Number of events delivered to webhooks.", webhookStats.Deliveries)
+		writeMetric(w, "owl_webhooks_failed_attempts_total", "counter", "Number of webhook delivery attempts that failed.", webhookStats.FailedAttempts)
+		writeMetric(w, "owl_webhooks_dead_letters_total", "counter", "Number of webhook deliveries saved as dead letters.", webhookStats.DeadLetters)
+		writeMetric(w, "owl_webhooks_dropped_dead_letters_total", "counter", "Number of dead letters dropped because there were too many.", webhookStats.DroppedDeadLetters)
+		writeMetric(w, "owl_webhooks_skipped_ends_total", "counter", "Number of end updates not delivered because they did not change the result of their event.", webhookStats.SkippedEnds)
+		writeMetric(w, "owl_webhooks_pending_deliveries", "gauge", "Number of webhook deliveries in progress or waiting for a retry.", webhookStats.Pending)
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name string, metricType string, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+}
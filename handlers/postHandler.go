@@ -5,17 +5,40 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"owl_server/db"
-	// "owl_server/db/mongodb"
-	"owl_server/db/timescaledb"
+	"owl_server/ingestion"
 	"owl_server/models"
+	"owl_server/spool"
 )
 
+// Handler for the /receive endpoint.
+// Valid updates are not written to the database by the request itself:
+// they are first appended to the spool, so they survive a database
+// outage or a restart, then handed to the ingestion queue, whose workers
+// share the database connection created at startup.
+// Updates already received (with the same update ID) are dropped.
+type UpdatesHandler struct {
+	spool *spool.Spool
+	queue *ingestion.Queue
+	dedupe *ingestion.Deduplicator
+}
+
+// Creates a handler saving updates to the given spool, and forwarding
+// them to the given (started) queue. The deduplicator drops the updates
+// sent several times.
+func NewUpdatesHandler(updatesSpool *spool.Spool, queue *ingestion.Queue, dedupe *ingestion.Deduplicator) *UpdatesHandler {
+	return &UpdatesHandler{spool: updatesSpool, queue: queue, dedupe: dedupe}
+}
+
 // Handler for post requests.
 // Parses the response body as an array of models.Update
-// objects, and forwards each update to the database
-// to save them.
-func PostUpdates(w http.ResponseWriter, r *http.Request) {
+// objects, validates them, appends the valid updates to the
+// spool and enqueues them so they are saved in the background.
+// Responds with a models.IngestReport listing the updates
+// that were accepted and the ones that were rejected.
+// Updates already received are accepted, listed as duplicates, and not saved again.
+// If the spool is full (or closed, as the server stops), responds with
+// a 503 and nothing is saved.
+func (h *UpdatesHandler) PostUpdates(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -32,30 +55,64 @@ func PostUpdates(w http.ResponseWriter, r *http.Request) {
 
 	err = json.Unmarshal(body, &updates)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// db logic
-	var database db.DB = &timescaledb.TimescaleDB{}
-	err = database.Connect()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer func() {
-		err := database.Disconnect()
+	report := models.NewIngestReport()
+	var valid []models.Update
+	var validIndexes []int
+	for i, update := range updates {
+		err := update.Validate()
 		if err != nil {
-			log.Fatalf("error while disconnecting: %s", err)
+			report.Reject(i, err.Error(), false)
+			continue
 		}
-	}()
+		valid = append(valid, update)
+		validIndexes = append(validIndexes, i)
+	}
 
-	for _, update := range updates {
-		err := database.InsertUpdate(update)
+	tenant := TenantFromRequest(r)
+	duplicates := map[int]bool{}
+	for _, i := range h.dedupe.Duplicates(tenant, valid) {
+		duplicates[i] = true
+		report.Duplicate(validIndexes[i])
+	}
+	var fresh []models.Update
+	for i, update := range valid {
+		if !duplicates[i] {
+			fresh = append(fresh, update)
+		}
+	}
+
+	// The new valid updates are spooled (or rejected) all together
+	if len(fresh) > 0 {
+		id, err := h.spool.Append(tenant, fresh)
 		if err != nil {
-			log.Printf("error while saving update: %s, update=%v\n", err, update)
+			log.Printf("unable to spool %d updates: %s\n", len(fresh), err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
+		// Spooled updates will be saved: retries of them are duplicates
+		h.dedupe.Remember(tenant, fresh)
+		err = h.queue.Enqueue(tenant, fresh, func(err error) {
+			if err != nil {
+				// leave the updates to the spool replayer
+				h.spool.Release(id)
+			} else {
+				h.spool.Ack(id)
+			}
+		})
+		if err != nil {
+			// The updates are safe in the spool, the replayer will save them
+			log.Printf("unable to enqueue %d updates, leaving them to the spool replayer: %s\n", len(fresh), err)
+			h.spool.Release(id)
+		}
+	}
+	for _, i := range validIndexes {
+		report.Accept(i)
 	}
 
-	w.WriteHeader(http.StatusCreated)
-}
\ No newline at end of file
+	writeJSON(w, report.StatusCode(), report)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"owl_server/db/memory"
+	"owl_server/ingestion"
+	"owl_server/models"
+	"owl_server/spool"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_BODY = `[{"updateType": "start", "eventName": "checkout", "eventId": "event0", "timestamp": 800000000000}]`
+
+// Posted updates are spooled, then queued. When they can't be queued,
+// they stay in the spool for the replayer
+func TestPostUpdatesFallback(t *testing.T) {
+	tests := []struct {
+		name string
+		// maximum size of the spool, 0 for no maximum
+		spoolBytes int64
+		// puts the queue in the tested state
+		prepare func(queue *ingestion.Queue)
+		wantStatus int
+		wantQueued int
+		// the record is left to the replayer
+		wantReplayed bool
+	}{
+		{
+			name: "queued",
+			prepare: func(queue *ingestion.Queue) {},
+			wantStatus: http.StatusAccepted,
+			wantQueued: 1,
+		},
+		{
+			name: "queue full",
+			prepare: func(queue *ingestion.Queue) {
+				queue.Enqueue("other", []models.Update{{UpdateType: models.UPDATE_TYPE_START}}, nil)
+			},
+			wantStatus: http.StatusAccepted,
+			wantQueued: 1,
+			wantReplayed: true,
+		},
+		{
+			name: "queue stopped",
+			prepare: func(queue *ingestion.Queue) { queue.Stop() },
+			wantStatus: http.StatusAccepted,
+			wantReplayed: true,
+		},
+		{
+			name: "spool full",
+			spoolBytes: 1,
+			prepare: func(queue *ingestion.Queue) {},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updatesSpool, err := spool.Open(t.TempDir(), 1 << 20, test.spoolBytes)
+			if err != nil {
+				t.Fatalf("opening the spool: %v", err)
+			}
+			defer updatesSpool.Close()
+			// the queue isn't started, so that it keeps its batches
+			queue := ingestion.NewQueue(memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS), 1, 1, nil)
+			test.prepare(queue)
+			handler := NewUpdatesHandler(updatesSpool, queue, ingestion.NewDeduplicator(time.Minute, 100))
+
+			request := httptest.NewRequest(http.MethodPost, "/receive", strings.NewReader(TEST_BODY))
+			request = request.WithContext(context.WithValue(request.Context(), tenantContextKey{}, "acme"))
+			response := httptest.NewRecorder()
+			handler.PostUpdates(response, request)
+
+			if response.Code != test.wantStatus {
+				t.Errorf("status: got %d, want %d (%s)", response.Code, test.wantStatus, response.Body)
+			}
+			if depth := queue.Stats().Depth; depth != test.wantQueued {
+				t.Errorf("queued batches: got %d, want %d", depth, test.wantQueued)
+			}
+			record, _, err := updatesSpool.NextPending()
+			if err != nil {
+				t.Fatalf("reading the spool: %v", err)
+			}
+			if replayed := record != nil; replayed != test.wantReplayed {
+				t.Fatalf("left to the replayer: got %v, want %v", replayed, test.wantReplayed)
+			}
+			if record != nil && (record.Tenant != "acme" || len(record.Updates) != 1 || record.Updates[0].EventId != "event0") {
+				t.Errorf("spooled record: got %+v", record)
+			}
+		})
+	}
+}
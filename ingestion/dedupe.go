@@ -0,0 +1,127 @@
+package ingestion
+
+import (
+	"log"
+	"owl_server/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Remembers the IDs (models.Update.UpdateId) of the updates accepted
+// recently, so that the updates sent again by clients retrying a request
+// are not saved twice.
+//
+// Deduplication only spares the database the work: every insert is
+// idempotent, so an update that slips through (e.g. after a restart, or
+// once the window has passed) is saved again without changing the event.
+type Deduplicator struct {
+	// how long an update ID is remembered. 0 disables the deduplication
+	window time.Duration
+	// maximum number of remembered IDs
+	maxEntries int
+
+	lock sync.Mutex
+	// when each update ID was accepted
+	seen map[dedupeKey]time.Time
+	lastSweep time.Time
+
+	// metrics
+	duplicates atomic.Int64
+}
+
+type dedupeKey struct {
+	tenant string
+	updateId string
+}
+
+// Snapshot of the deduplicator metrics
+type DedupeStats struct {
+	// number of remembered update IDs
+	Entries int
+	// number of duplicate updates dropped since startup
+	Duplicates int64
+}
+
+// Creates a deduplicator remembering at most maxEntries update IDs,
+// each for the given window. A window of 0 disables it.
+func NewDeduplicator(window time.Duration, maxEntries int) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		maxEntries: maxEntries,
+		seen: map[dedupeKey]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Returns the indexes of the updates of the tenant which are duplicates:
+// their ID was accepted within the window, or an update before them in
+// the list has the same ID. Updates without ID are never duplicates.
+func (d *Deduplicator) Duplicates(tenant string, updates []models.Update) []int {
+	if d.window <= 0 {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	var duplicates []int
+	inList := map[string]bool{}
+	for i, update := range updates {
+		if update.UpdateId == "" {
+			continue
+		}
+		acceptedAt, seen := d.seen[dedupeKey{tenant: tenant, updateId: update.UpdateId}]
+		if inList[update.UpdateId] || (seen && now.Sub(acceptedAt) < d.window) {
+			duplicates = append(duplicates, i)
+		}
+		inList[update.UpdateId] = true
+	}
+	d.duplicates.Add(int64(len(duplicates)))
+	return duplicates
+}
+
+// Remembers the IDs of the given updates of the tenant, accepted
+// (that is, safely spooled) just now.
+func (d *Deduplicator) Remember(tenant string, updates []models.Update) {
+	if d.window <= 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) >= d.window || len(d.seen) >= d.maxEntries {
+		d.sweep(now)
+	}
+	for _, update := range updates {
+		if update.UpdateId == "" {
+			continue
+		}
+		if len(d.seen) >= d.maxEntries {
+			log.Printf("deduplication: %d update IDs already remembered, not remembering more", len(d.seen))
+			return
+		}
+		d.seen[dedupeKey{tenant: tenant, updateId: update.UpdateId}] = now
+	}
+}
+
+// Forgets the IDs accepted before the window. Must be called with the lock held.
+func (d *Deduplicator) sweep(now time.Time) {
+	for key, acceptedAt := range d.seen {
+		if now.Sub(acceptedAt) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// Returns a snapshot of the deduplicator metrics
+func (d *Deduplicator) Stats() DedupeStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return DedupeStats{
+		Entries: len(d.seen),
+		Duplicates: d.duplicates.Load(),
+	}
+}
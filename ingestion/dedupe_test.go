@@ -0,0 +1,136 @@
+package ingestion
+
+import (
+	"fmt"
+	"owl_server/models"
+	"testing"
+	"time"
+)
+
+const WINDOW = 10 * time.Minute
+
+// Returns updates with the given IDs
+func withIds(ids ...string) []models.Update {
+	updates := []models.Update{}
+	for _, id := range ids {
+		updates = append(updates, models.Update{UpdateType: models.UPDATE_TYPE_START, UpdateId: id})
+	}
+	return updates
+}
+
+// Makes the remembered IDs older, as if the given time had passed
+func age(d *Deduplicator, by time.Duration) {
+	for key, acceptedAt := range d.seen {
+		d.seen[key] = acceptedAt.Add(-by)
+	}
+	d.lastSweep = d.lastSweep.Add(-by)
+}
+
+func TestDuplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		window time.Duration
+		// IDs remembered for tenant "acme", then how long ago
+		remembered []string
+		elapsed time.Duration
+		tenant string
+		ids []string
+		want []int
+	}{
+		{name: "new", window: WINDOW, remembered: []string{"a"}, tenant: "acme", ids: []string{"b", "c"}, want: nil},
+		{name: "remembered", window: WINDOW, remembered: []string{"a", "b"}, tenant: "acme", ids: []string{"b", "c", "a"}, want: []int{0, 2}},
+		{name: "repeated in the batch", window: WINDOW, tenant: "acme", ids: []string{"a", "b", "a", "a"}, want: []int{2, 3}},
+		{name: "without ID", window: WINDOW, remembered: []string{""}, tenant: "acme", ids: []string{"", ""}, want: nil},
+		{name: "other tenant", window: WINDOW, remembered: []string{"a"}, tenant: "globex", ids: []string{"a"}, want: nil},
+		{name: "within the window", window: WINDOW, remembered: []string{"a"}, elapsed: WINDOW - time.Second, tenant: "acme", ids: []string{"a"}, want: []int{0}},
+		{name: "window passed", window: WINDOW, remembered: []string{"a"}, elapsed: WINDOW, tenant: "acme", ids: []string{"a"}, want: nil},
+		{name: "disabled", window: 0, remembered: []string{"a"}, tenant: "acme", ids: []string{"a", "a"}, want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDeduplicator(test.window, 100)
+			d.Remember("acme", withIds(test.remembered...))
+			age(d, test.elapsed)
+			got := d.Duplicates(test.tenant, withIds(test.ids...))
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			if d.Stats().Duplicates != int64(len(test.want)) {
+				t.Errorf("duplicates metric: got %d, want %d", d.Stats().Duplicates, len(test.want))
+			}
+		})
+	}
+}
+
+// IDs are forgotten once the window has passed, and at most
+// maxEntries IDs are remembered
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		maxEntries int
+		// batches of IDs remembered, each after the given time passed
+		batches [][]string
+		elapsed []time.Duration
+		wantEntries int
+		wantDuplicate map[string]bool
+	}{
+		{
+			name: "within the window",
+			maxEntries: 10,
+			batches: [][]string{{"a", "b"}, {"c"}},
+			elapsed: []time.Duration{0, WINDOW / 2},
+			wantEntries: 3,
+			wantDuplicate: map[string]bool{"a": true, "b": true, "c": true},
+		},
+		{
+			name: "swept after the window",
+			maxEntries: 10,
+			batches: [][]string{{"a", "b"}, {"c"}},
+			elapsed: []time.Duration{0, WINDOW},
+			wantEntries: 1,
+			wantDuplicate: map[string]bool{"a": false, "b": false, "c": true},
+		},
+		{
+			name: "full",
+			maxEntries: 2,
+			batches: [][]string{{"a", "b", "c"}},
+			elapsed: []time.Duration{0},
+			wantEntries: 2,
+			wantDuplicate: map[string]bool{"a": true, "b": true, "c": false},
+		},
+		{
+			// a full deduplicator sweeps before remembering
+			name: "full then swept",
+			maxEntries: 2,
+			batches: [][]string{{"a", "b"}, {"c"}},
+			elapsed: []time.Duration{0, WINDOW},
+			wantEntries: 1,
+			wantDuplicate: map[string]bool{"a": false, "b": false, "c": true},
+		},
+		{
+			name: "full within the window",
+			maxEntries: 2,
+			batches: [][]string{{"a", "b"}, {"c"}},
+			elapsed: []time.Duration{0, WINDOW / 2},
+			wantEntries: 2,
+			wantDuplicate: map[string]bool{"a": true, "b": true, "c": false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDeduplicator(WINDOW, test.maxEntries)
+			for i, batch := range test.batches {
+				age(d, test.elapsed[i])
+				d.Remember("acme", withIds(batch...))
+			}
+			if entries := d.Stats().Entries; entries != test.wantEntries {
+				t.Errorf("entries: got %d, want %d", entries, test.wantEntries)
+			}
+			for id, want := range test.wantDuplicate {
+				if got := len(d.Duplicates("acme", withIds(id))) == 1; got != want {
+					t.Errorf("%s duplicate: got %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
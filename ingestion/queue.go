@@ -0,0 +1,166 @@
+package ingestion
+
+import (
+	"fmt"
+	"log"
+	"owl_server/db"
+	"owl_server/models"
+	"sync"
+	"sync/atomic"
+)
+
+// Returned by Enqueue when the queue can't take more batches
+var ErrQueueFull = fmt.Errorf("ingestion queue is full")
+// Returned by Enqueue once the queue has been stopped
+var ErrQueueStopped = fmt.Errorf("ingestion queue is stopped")
+
+// Bounded in-process queue of update batches, drained by a pool of
+// workers writing to the database.
+// Each batch (usually the updates of one request) is written with a
+// single call to db.DB.InsertUpdates.
+type Queue struct {
+	database db.DB
+	batches chan batch
+	workers int
+	// called with each batch written successfully, may be nil
+	inserted func(tenant string, updates []models.Update)
+
+	// protects stopped, and the batches channel from being closed
+	// while a batch is being enqueued
+	lock sync.RWMutex
+	stopped bool
+	wg sync.WaitGroup
+
+	// metrics
+	pendingUpdates atomic.Int64
+	insertedUpdates atomic.Int64
+	failedUpdates atomic.Int64
+	rejectedBatches atomic.Int64
+}
+
+// A batch of updates of a tenant, and the callback to call once it is written
+type batch struct {
+	tenant string
+	updates []models.Update
+	done func(err error)
+}
+
+// Snapshot of the queue metrics
+type Stats struct {
+	// number of batches waiting to be written
+	Depth int
+	// maximum number of batches the queue can hold
+	Capacity int
+	// number of updates waiting to be written
+	PendingUpdates int64
+	Workers int
+	// number of updates written since startup
+	InsertedUpdates int64
+	// number of updates that failed to be written since startup
+	FailedUpdates int64
+	// number of batches that couldn't be queued because the queue was full
+	RejectedBatches int64
+}
+
+// Creates a queue holding at most capacity batches, written to the
+// given (already connected) database by the given number of workers.
+// inserted (if not nil) is called with each batch once it is written.
+// Call Start to start the workers.
+func NewQueue(database db.DB, capacity int, workers int, inserted func(tenant string, updates []models.Update)) *Queue {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Queue{
+		database: database,
+		batches: make(chan batch, capacity),
+		workers: workers,
+		inserted: inserted,
+	}
+}
+
+// Starts the workers
+func (q *Queue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Adds a batch of updates of the tenant to the queue, without blocking.
+// Returns ErrQueueFull if the queue is full.
+// Once the batch is written (or failed to be), done is called
+// with the error returned by the database. done may be nil.
+func (q *Queue) Enqueue(tenant string, updates []models.Update, done func(err error)) error {
+	if len(updates) == 0 {
+		if done != nil {
+			done(nil)
+		}
+		return nil
+	}
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	select {
+	case q.batches <- batch{tenant: tenant, updates: updates, done: done}:
+		q.pendingUpdates.Add(int64(len(updates)))
+		return nil
+	default:
+		q.rejectedBatches.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Stops accepting new batches, and waits for the workers
+// to write the batches already in the queue.
+func (q *Queue) Stop() {
+	q.lock.Lock()
+	if q.stopped {
+		q.lock.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.batches)
+	q.lock.Unlock()
+
+	log.Printf("Waiting for %d queued batches to be written...", len(q.batches))
+	q.wg.Wait()
+}
+
+// Returns a snapshot of the queue metrics
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Depth: len(q.batches),
+		Capacity: cap(q.batches),
+		PendingUpdates: q.pendingUpdates.Load(),
+		Workers: q.workers,
+		InsertedUpdates: q.insertedUpdates.Load(),
+		FailedUpdates: q.failedUpdates.Load(),
+		RejectedBatches: q.rejectedBatches.Load(),
+	}
+}
+
+// Writes batches to the database until the queue is stopped and empty
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for b := range q.batches {
+		err := q.database.InsertUpdates(b.tenant, b.updates)
+		q.pendingUpdates.Add(-int64(len(b.updates)))
+		if err != nil {
+			log.Printf("error while saving %d queued updates: %s\n", len(b.updates), err)
+			q.failedUpdates.Add(int64(len(b.updates)))
+		} else {
+			q.insertedUpdates.Add(int64(len(b.updates)))
+			if q.inserted != nil {
+				q.inserted(b.tenant, b.updates)
+			}
+		}
+		if b.done != nil {
+			b.done(err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package ingestion
+
+import (
+	"errors"
+	"owl_server/db/memory"
+	"owl_server/models"
+	"sync"
+	"testing"
+)
+
+const TEST_TENANT = "acme"
+
+// Returns a batch of start updates of the events
+func startUpdates(ids ...string) []models.Update {
+	updates := []models.Update{}
+	for _, id := range ids {
+		updates = append(updates, models.Update{UpdateType: models.UPDATE_TYPE_START, EventName: "checkout", EventId: id, Timestamp: 800_000_000_000})
+	}
+	return updates
+}
+
+// Enqueue never blocks: batches beyond the capacity, or enqueued once
+// the queue is stopped, are rejected
+func TestEnqueue(t *testing.T) {
+	tests := []struct {
+		name string
+		// number of batches enqueued
+		batches int
+		stopped bool
+		wantErrs []error
+		wantDepth int
+		wantRejected int64
+	}{
+		{name: "within capacity", batches: 2, wantErrs: []error{nil, nil}, wantDepth: 2},
+		{name: "full", batches: 4, wantErrs: []error{nil, nil, ErrQueueFull, ErrQueueFull}, wantDepth: 2, wantRejected: 2},
+		{name: "stopped", batches: 1, stopped: true, wantErrs: []error{ErrQueueStopped}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// not started, so that it keeps its batches
+			queue := NewQueue(memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS), 2, 1, nil)
+			if test.stopped {
+				queue.Stop()
+			}
+			for i := 0; i < test.batches; i++ {
+				err := queue.Enqueue(TEST_TENANT, startUpdates("a", "b"), nil)
+				if err != test.wantErrs[i] {
+					t.Errorf("batch %d: got %v, want %v", i, err, test.wantErrs[i])
+				}
+			}
+			stats := queue.Stats()
+			if stats.Depth != test.wantDepth || stats.PendingUpdates != int64(2 * test.wantDepth) || stats.RejectedBatches != test.wantRejected || stats.Capacity != 2 {
+				t.Errorf("stats: got %+v", stats)
+			}
+		})
+	}
+}
+
+// The workers write every queued batch, even once the queue is stopped,
+// and call back with the result of each
+func TestWorkers(t *testing.T) {
+	database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+	database.Connect()
+	var lock sync.Mutex
+	inserted := []string{}
+	queue := NewQueue(database, 10, 3, func(tenant string, updates []models.Update) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, update := range updates {
+			inserted = append(inserted, tenant + "/" + update.EventId)
+		}
+	})
+	batches := []struct {
+		updates []models.Update
+		wantErr error
+	}{
+		{updates: startUpdates("a", "b")},
+		{updates: startUpdates("c")},
+		// written atomically: none of the updates is saved
+		{updates: append(startUpdates("d"), models.Update{UpdateType: "stop", EventName: "checkout", EventId: "d"}), wantErr: models.ErrUnknownUpdateType},
+		// nothing to write, called back right away
+		{updates: []models.Update{}},
+	}
+	errs := make([]error, len(batches))
+	called := make([]int, len(batches))
+	for i, b := range batches {
+		err := queue.Enqueue(TEST_TENANT, b.updates, func(err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			errs[i] = err
+			called[i]++
+		})
+		if err != nil {
+			t.Fatalf("enqueuing batch %d: %v", i, err)
+		}
+	}
+	if depth := queue.Stats().Depth; depth != 3 {
+		t.Errorf("depth before the workers start: got %d, want 3", depth)
+	}
+	queue.Start()
+	queue.Stop()
+
+	for i, b := range batches {
+		if called[i] != 1 || !errors.Is(errs[i], b.wantErr) {
+			t.Errorf("batch %d: called %d times with %v, want once with %v", i, called[i], errs[i], b.wantErr)
+		}
+	}
+	if len(inserted) != 3 {
+		t.Errorf("inserted callback: got %v, want the 3 saved updates", inserted)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if event, _ := database.GetEvent(TEST_TENANT, "checkout", id); event == nil {
+			t.Errorf("event %s wasn't saved", id)
+		}
+	}
+	if event, _ := database.GetEvent(TEST_TENANT, "checkout", "d"); event != nil {
+		t.Errorf("event d of the failed batch was saved")
+	}
+	stats := queue.Stats()
+	if stats.Depth != 0 || stats.PendingUpdates != 0 || stats.InsertedUpdates != 3 || stats.FailedUpdates != 2 || stats.Workers != 3 {
+		t.Errorf("stats: got %+v", stats)
+	}
+}
@@ -1,42 +1,192 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"owl_server/db/timescaledb"
+	"owl_server/abandonment"
+	"owl_server/alerting"
+	"owl_server/auth"
+	"owl_server/config"
+	"owl_server/db"
+	_ "owl_server/db/memory"
+	_ "owl_server/db/mongodb"
+	_ "owl_server/db/timescaledb"
 	"owl_server/handlers"
+	"owl_server/ingestion"
+	"owl_server/models"
+	"owl_server/retention"
+	"owl_server/spool"
+	"owl_server/tenants"
+	"owl_server/webhooks"
 	"syscall"
+	"time"
 )
 
-const PORT int = 3030
-var database *timescaledb.TimescaleDB
+// How long the requests being served are waited for when the server stops
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+var database db.DB
+var updatesSpool *spool.Spool
+var spoolReplayer *spool.Replayer
+var ingestionQueue *ingestion.Queue
+var retentionJob *retention.Job
+var abandonmentSweeper *abandonment.Sweeper
+var alertingEngine *alerting.Engine
+var webhookDispatcher *webhooks.Dispatcher
+var server *http.Server
 
 func main() {
-	database = &timescaledb.TimescaleDB{}
-	log.Printf("Connecting to the timescaledb database...")
-	err := database.Connect()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrate(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Connected successfully. Creating tables (if needed)...")
-	err = database.CreateTables()
+	log.Printf("Effective configuration:\n%s", cfg)
+
+	database, err = db.Open(cfg.Backend, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Tables created! (Or they already existed.)")
-	go gracefulShutdown()
+	log.Printf("Connecting to the %s database...", cfg.Backend)
+	err = database.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if schemaCreator, ok := database.(db.SchemaCreator); ok {
+		log.Printf("Connected successfully. Creating tables (if needed)...")
+		err = schemaCreator.CreateTables()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Tables created! (Or they already existed.)")
+	}
 
-	http.HandleFunc("/receive", handlers.PostUpdates)
-	log.Printf("Owl server listening on port %v", PORT)
-	
-	var port = fmt.Sprintf(":%d", PORT)
-	var error = http.ListenAndServe(port, nil)
-	if error != nil {
+	// the events whose end update is written are delivered to the webhooks
+	var inserted func(tenant string, updates []models.Update)
+	subscriptions := cfg.WebhookSubscriptions()
+	if len(subscriptions) > 0 {
+		webhookDispatcher, err = webhooks.NewDispatcher(database, subscriptions, cfg.MergePolicy, cfg.Webhooks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		inserted = webhookDispatcher.Inserted
+	}
+
+	updatesSpool, err = spool.Open(cfg.Spool.Dir, cfg.Spool.SegmentBytes, cfg.Spool.MaxBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Spool opened, %d batches left to replay.", updatesSpool.Stats().PendingRecords)
+	spoolReplayer = spool.NewReplayer(updatesSpool, database, cfg.Spool.ReplayInterval.Duration(), cfg.DefaultTenant, inserted)
+	spoolReplayer.Start()
+
+	workers := cfg.Queue.Workers
+	if workers == 0 {
+		workers = cfg.PoolSize()
+	}
+	ingestionQueue = ingestion.NewQueue(database, cfg.Queue.Capacity, workers, inserted)
+	ingestionQueue.Start()
+
+	retentionPolicy := cfg.Retention.Policy()
+	if retentionPolicy.Enabled() {
+		purger, ok := database.(db.Purger)
+		if !ok {
+			log.Fatalf("the %s backend can't purge expired events, remove the retention settings", cfg.Backend)
+		}
+		retentionJob = retention.NewJob(purger, retentionPolicy, cfg.Retention.Interval.Duration())
+		retentionJob.Start()
+	}
+	abandonmentPolicy := cfg.Abandonment.Policy()
+	if abandonmentPolicy.Enabled() {
+		sweeper, ok := database.(db.Sweeper)
+		if !ok {
+			log.Fatalf("the %s backend can't mark abandoned events, remove the abandonment settings", cfg.Backend)
+		}
+		abandonmentSweeper = abandonment.NewSweeper(sweeper, abandonmentPolicy, cfg.Abandonment.Interval.Duration())
+		abandonmentSweeper.Start()
+	}
+	alertRules := cfg.AlertRules()
+	if len(alertRules) > 0 {
+		analyzer, ok := database.(db.Analyzer)
+		if !ok {
+			log.Fatalf("the %s backend can't evaluate alert rules, remove the alerting rules", cfg.Backend)
+		}
+		notifier := alerting.NewNotifier(cfg.Alerting.WebhookTimeout.Duration())
+		alertingEngine, err = alerting.NewEngine(analyzer, alertRules, cfg.Abandonment.Policy(), cfg.Alerting.Interval.Duration(), cfg.Alerting.StateFile, notifier)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertingEngine.Start()
+	}
+	dedupe := ingestion.NewDeduplicator(cfg.Dedupe.Window.Duration(), cfg.Dedupe.MaxEntries)
+
+	apiKeys, err := tenants.OpenKeyStore(cfg.APIKeysFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authenticators, err := auth.NewAuthenticators(cfg.Auth, apiKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authentication := handlers.NewAuthentication(authenticators, cfg.Auth.Required, cfg.DefaultTenant)
+	if !cfg.Auth.Required {
+		log.Printf("WARNING: authentication is not required, requests without credentials can read and write the events of the %s tenant", cfg.DefaultTenant)
+	}
+
+	updatesHandler := handlers.NewUpdatesHandler(updatesSpool, ingestionQueue, dedupe)
+	http.HandleFunc("/receive", authentication.Wrap(updatesHandler.PostUpdates))
+
+	metricsHandler := handlers.NewMetricsHandler(ingestionQueue, dedupe, updatesSpool, retentionJob, abandonmentSweeper, alertingEngine, webhookDispatcher)
+	http.HandleFunc("GET /metrics", metricsHandler.GetMetrics)
+
+	eventsHandler := handlers.NewEventsHandler(database)
+	http.HandleFunc("GET /events", authentication.Wrap(eventsHandler.SearchEvents))
+	http.HandleFunc("GET /events/{name}/{id}", authentication.Wrap(eventsHandler.GetEvent))
+
+	if analyzer, ok := database.(db.Analyzer); ok {
+		analyticsHandler := handlers.NewAnalyticsHandler(analyzer)
+		http.HandleFunc("GET /analytics/durations", authentication.Wrap(analyticsHandler.GetDurations))
+		http.HandleFunc("GET /analytics/funnel", authentication.Wrap(analyticsHandler.GetFunnel))
+		http.HandleFunc("GET /analytics/results", authentication.Wrap(analyticsHandler.GetResults))
+		http.HandleFunc("GET /analytics/abandoned", authentication.Wrap(analyticsHandler.GetAbandoned))
+	}
+
+	if cfg.AdminToken != "" {
+		adminHandler := handlers.NewAdminHandler(apiKeys, retentionJob, alertingEngine, webhookDispatcher, cfg.AdminToken)
+		http.HandleFunc("POST /admin/keys", adminHandler.IssueKey)
+		http.HandleFunc("GET /admin/keys", adminHandler.ListKeys)
+		http.HandleFunc("DELETE /admin/keys/{id}", adminHandler.RevokeKey)
+		http.HandleFunc("GET /admin/retention", adminHandler.GetRetentionReports)
+		http.HandleFunc("GET /admin/alerts", adminHandler.GetAlerts)
+		http.HandleFunc("GET /admin/webhooks/dead-letters", adminHandler.ListDeadLetters)
+		http.HandleFunc("POST /admin/webhooks/dead-letters/{id}/retry", adminHandler.RetryDeadLetter)
+		http.HandleFunc("DELETE /admin/webhooks/dead-letters/{id}", adminHandler.DiscardDeadLetter)
+	}
+	log.Printf("Owl server listening on %v", cfg.ListenAddress)
+
+	server = &http.Server{
+		Addr: cfg.ListenAddress,
+		ReadTimeout: cfg.ReadTimeout.Duration(),
+		WriteTimeout: cfg.WriteTimeout.Duration(),
+	}
+	go gracefulShutdown()
+	var error = server.ListenAndServe()
+	if error != http.ErrServerClosed {
 		log.Fatal(error)
 	}
+	// gracefulShutdown exits once everything is stopped
+	select {}
 }
 
 func gracefulShutdown() {
@@ -44,6 +194,28 @@ func gracefulShutdown() {
     signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
     s := <-quit
 	fmt.Println("Closing application", s)
+	// no new updates are received while the queue and the spool are stopped
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	err := server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("unable to wait for the requests being served: %s", err)
+	}
+	ingestionQueue.Stop()
+	spoolReplayer.Stop()
+	if retentionJob != nil {
+		retentionJob.Stop()
+	}
+	if abandonmentSweeper != nil {
+		abandonmentSweeper.Stop()
+	}
+	if alertingEngine != nil {
+		alertingEngine.Stop()
+	}
+	if webhookDispatcher != nil {
+		webhookDispatcher.Stop()
+	}
+	updatesSpool.Close()
 	database.Disconnect()
     os.Exit(0)
-}
\ No newline at end of file
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"owl_server/config"
+	"owl_server/db"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const MIGRATE_USAGE = `usage: owl_server migrate <command> [flags]
+
+commands:
+  status        lists the migrations, and when they were applied
+  up            applies the pending migrations
+  down          reverts the last applied migration
+  to <version>  applies or reverts migrations until the schema has the given version
+
+flags: the same as the server (e.g. -config or -timescaledb-dsn)`
+
+// Runs the "migrate" subcommand, with the arguments following it
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", MIGRATE_USAGE)
+	}
+	command, args := args[0], args[1:]
+	target := -1
+	switch command {
+	case "status", "up", "down":
+	case "to":
+		if len(args) == 0 {
+			return fmt.Errorf("missing version\n%s", MIGRATE_USAGE)
+		}
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid version %q\n%s", args[0], MIGRATE_USAGE)
+		}
+		target, args = version, args[1:]
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", command, MIGRATE_USAGE)
+	}
+
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	database, err := db.Open(cfg.Backend, cfg)
+	if err != nil {
+		return err
+	}
+	migrator, ok := database.(db.Migrator)
+	if !ok {
+		return fmt.Errorf("the %s backend has no schema migrations", cfg.Backend)
+	}
+	err = database.Connect()
+	if err != nil {
+		return err
+	}
+	defer database.Disconnect()
+
+	migrations, err := migrator.Migrations()
+	if err != nil {
+		return err
+	}
+	current, latest := 0, 0
+	for _, m := range migrations {
+		if m.AppliedAt != nil {
+			current = max(current, m.Version)
+		}
+		if !m.Unknown {
+			latest = max(latest, m.Version)
+		}
+	}
+	switch command {
+	case "status":
+		printMigrations(migrations)
+		return nil
+	case "up":
+		target = latest
+	case "down":
+		if current == 0 {
+			return fmt.Errorf("no migration to revert")
+		}
+		target = current - 1
+	}
+	if target == current {
+		fmt.Printf("The schema already has version %d.\n", current)
+		return nil
+	}
+
+	err = migrator.Migrate(target)
+	if err != nil {
+		return err
+	}
+	migrations, err = migrator.Migrations()
+	if err != nil {
+		return err
+	}
+	printMigrations(migrations)
+	return nil
+}
+
+func printMigrations(migrations []db.Migration) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tNAME\tAPPLIED AT")
+	for _, m := range migrations {
+		appliedAt := "pending"
+		if m.AppliedAt != nil {
+			appliedAt = m.AppliedAt.Format(time.RFC3339)
+		}
+		if m.Unknown {
+			appliedAt += " (unknown to this server)"
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\n", m.Version, m.Name, appliedAt)
+	}
+	writer.Flush()
+}
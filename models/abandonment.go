@@ -0,0 +1,136 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// Result of the events marked as abandoned by the sweeper
+const ABANDONED_RESULT = "abandoned"
+
+// How long the events without end update are waited for, by event name.
+// A timeout of 0 waits forever.
+//
+// The inactivity of an event is counted from its last activity: the latest
+// creation time of the event and of its steps. Events without any creation
+// time are never abandoned.
+type AbandonmentPolicy struct {
+	// timeout of the events of each name
+	Timeouts map[string]time.Duration
+	// timeout of the events of the other names
+	Default time.Duration
+}
+
+// Returns how long the events of the given name are waited for, 0 if forever
+func (p AbandonmentPolicy) Timeout(eventName string) time.Duration {
+	if timeout, ok := p.Timeouts[eventName]; ok {
+		return timeout
+	}
+	return p.Default
+}
+
+// Returns true if some events are ever abandoned
+func (p AbandonmentPolicy) Enabled() bool {
+	return p.Default > 0 || len(p.Timeouts) > 0
+}
+
+// Returns the names with their own timeout, sorted
+func (p AbandonmentPolicy) Names() []string {
+	names := []string{}
+	for name := range p.Timeouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set on the events marked as abandoned (whose result is ABANDONED_RESULT).
+// Cleared if the end update of the event arrives later
+type Abandonment struct {
+	// when the event was marked
+	Time time.Time `json:"time"`
+	// step with the highest number (then name), nil if the event has no step
+	LastStep *StepRef `json:"lastStep"`
+}
+
+// Number of events of a tenant and name marked as abandoned by a sweep
+type AbandonedEvents struct {
+	Tenant string `json:"tenant"`
+	EventName string `json:"eventName"`
+	Count int64 `json:"count"`
+}
+
+// Number of abandoned events having the same last step
+type LastStepCount struct {
+	// nil for the events without step
+	Step *StepRef `json:"step"`
+	Count int64 `json:"count"`
+}
+
+// The abandoned events of a name, by last step reached
+type AbandonmentBreakdown struct {
+	EventName string `json:"eventName"`
+	Abandoned int64 `json:"abandoned"`
+	// ordered by step number then name, the events without step first
+	ByLastStep []LastStepCount `json:"byLastStep"`
+}
+
+// Builds the breakdown from the counts of each last step
+func NewAbandonmentBreakdown(eventName string, counts []LastStepCount) *AbandonmentBreakdown {
+	breakdown := &AbandonmentBreakdown{EventName: eventName, ByLastStep: []LastStepCount{}}
+	for _, c := range counts {
+		breakdown.Abandoned += c.Count
+		breakdown.ByLastStep = append(breakdown.ByLastStep, c)
+	}
+	sort.Slice(breakdown.ByLastStep, func(i, j int) bool {
+		a, b := breakdown.ByLastStep[i].Step, breakdown.ByLastStep[j].Step
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		if a.Number != b.Number {
+			return a.Number < b.Number
+		}
+		return a.Name < b.Name
+	})
+	return breakdown
+}
+
+// Drops the zero counts, and sorts the counts by tenant then event name
+func SortAbandonedEvents(abandoned []AbandonedEvents) []AbandonedEvents {
+	result := []AbandonedEvents{}
+	for _, a := range abandoned {
+		if a.Count > 0 {
+			result = append(result, a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Tenant != result[j].Tenant {
+			return result[i].Tenant < result[j].Tenant
+		}
+		return result[i].EventName < result[j].EventName
+	})
+	return result
+}
+
+// Returns the step with the highest number (then name), nil if there is none
+func LastStep(steps []Step) *StepRef {
+	var last *StepRef
+	for _, step := range steps {
+		if last == nil || step.Number > last.Number || step.Number == last.Number && step.Name > last.Name {
+			last = &StepRef{Name: step.Name, Number: step.Number}
+		}
+	}
+	return last
+}
+
+// Returns the last activity of the event: the latest creation time
+// of the event and of its steps, nil if none is known
+func LastActivity(event *Event) *time.Time {
+	last := event.CreationTime
+	for _, step := range event.Steps {
+		if step.CreationTime != nil && (last == nil || step.CreationTime.After(*last)) {
+			last = step.CreationTime
+		}
+	}
+	return last
+}
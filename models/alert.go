@@ -0,0 +1,114 @@
+package models
+
+import (
+	"time"
+)
+
+// Kinds of alert rules, by the value they compare to their threshold
+const (
+	// fraction of the ended events whose result isn't a success
+	ALERT_FAILURE_RATE = "failureRate"
+	// 95th percentile of the event durations, in milliseconds
+	ALERT_P95_DURATION = "p95Duration"
+	// number of abandoned events
+	ALERT_ABANDONED = "abandoned"
+)
+
+var ALERT_KINDS = []string{ALERT_FAILURE_RATE, ALERT_P95_DURATION, ALERT_ABANDONED}
+
+// A rule evaluated periodically against the events of a name created
+// within a window before the evaluation. Its alert fires when the value
+// of the rule stays above the threshold for the For duration.
+type AlertRule struct {
+	// identifies the rule, and its alert
+	Name string
+	Tenant string
+	EventName string
+	// one of ALERT_KINDS
+	Kind string
+	Window time.Duration
+	Threshold float64
+	For time.Duration
+	// fewer events (ended events for ALERT_FAILURE_RATE, events with a
+	// duration for ALERT_P95_DURATION) don't give a value
+	MinEvents int64
+	// results counted as successes by ALERT_FAILURE_RATE
+	SuccessResults []string
+	// where the notifications of the alert are sent, none if empty
+	WebhookURL string
+}
+
+type AlertState string
+
+const (
+	// the value of the rule is below its threshold (or unknown)
+	ALERT_INACTIVE AlertState = "inactive"
+	// the value is above the threshold, for less than the For duration of the rule
+	ALERT_PENDING AlertState = "pending"
+	// the value has been above the threshold for the For duration of the rule
+	ALERT_FIRING AlertState = "firing"
+	// the value went back below the threshold after the alert fired
+	ALERT_RESOLVED AlertState = "resolved"
+)
+
+// The state of the alert of a rule
+type Alert struct {
+	Rule string `json:"rule"`
+	State AlertState `json:"state"`
+	// since when the alert is in its state
+	Since time.Time `json:"since"`
+	// value of the rule at the last evaluation, nil if there were too few events
+	Value *float64 `json:"value"`
+	EvaluatedAt *time.Time `json:"evaluatedAt,omitempty"`
+	// set if the last evaluation failed: the state is kept
+	Error string `json:"error,omitempty"`
+	// when the alert last fired, and was last resolved
+	FiredAt *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	// state whose notification was last delivered. The notification of the
+	// firing and resolved states is retried until it is delivered
+	Notified AlertState `json:"notified,omitempty"`
+}
+
+// Creates the alert of a rule never evaluated
+func NewAlert(rule string, now time.Time) *Alert {
+	return &Alert{Rule: rule, State: ALERT_INACTIVE, Since: now}
+}
+
+// Records the value of the rule evaluated at the given time (nil if
+// there were too few events), and moves the alert to its next state.
+// Returns true if the state changed.
+func (a *Alert) Update(rule AlertRule, value *float64, now time.Time) bool {
+	a.Value = value
+	a.EvaluatedAt = &now
+	a.Error = ""
+	above := value != nil && *value > rule.Threshold
+
+	previous := a.State
+	switch {
+	case above && a.State == ALERT_PENDING && now.Sub(a.Since) >= rule.For:
+		a.fire(now)
+	case above && (a.State == ALERT_INACTIVE || a.State == ALERT_RESOLVED):
+		if rule.For <= 0 {
+			a.fire(now)
+		} else {
+			a.State, a.Since = ALERT_PENDING, now
+		}
+	case !above && a.State == ALERT_PENDING:
+		a.State, a.Since = ALERT_INACTIVE, now
+	case !above && a.State == ALERT_FIRING:
+		a.State, a.Since = ALERT_RESOLVED, now
+		a.ResolvedAt = &now
+	}
+	return a.State != previous
+}
+
+func (a *Alert) fire(now time.Time) {
+	a.State, a.Since = ALERT_FIRING, now
+	a.FiredAt = &now
+}
+
+// Returns true if the current state must be notified
+func (a *Alert) NeedsNotification() bool {
+	return (a.State == ALERT_FIRING || a.State == ALERT_RESOLVED) && a.Notified != a.State
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// An evaluation of a rule: its value (nil for too few events), the time
+// since the previous evaluation, and the state expected afterwards
+type evaluation struct {
+	value *float64
+	after time.Duration
+	want AlertState
+	wantChanged bool
+}
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func TestAlertUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		// For duration of the rule, whose threshold is 10
+		forDuration time.Duration
+		evaluations []evaluation
+		wantNotification bool
+	}{
+		{
+			name: "below",
+			evaluations: []evaluation{
+				{value: value(5), want: ALERT_INACTIVE},
+				{value: value(10), after: time.Minute, want: ALERT_INACTIVE},
+			},
+		},
+		{
+			name: "fires right away",
+			evaluations: []evaluation{
+				{value: value(11), want: ALERT_FIRING, wantChanged: true},
+				{value: value(12), after: time.Minute, want: ALERT_FIRING},
+			},
+			wantNotification: true,
+		},
+		{
+			name: "pending then firing",
+			forDuration: 5 * time.Minute,
+			evaluations: []evaluation{
+				{value: value(11), want: ALERT_PENDING, wantChanged: true},
+				{value: value(11), after: 4 * time.Minute, want: ALERT_PENDING},
+				{value: value(11), after: time.Minute, want: ALERT_FIRING, wantChanged: true},
+			},
+			wantNotification: true,
+		},
+		{
+			name: "pending then back below",
+			forDuration: 5 * time.Minute,
+			evaluations: []evaluation{
+				{value: value(11), want: ALERT_PENDING, wantChanged: true},
+				{value: value(9), after: time.Minute, want: ALERT_INACTIVE, wantChanged: true},
+				// the For duration starts again
+				{value: value(11), after: time.Minute, want: ALERT_PENDING, wantChanged: true},
+				{value: value(11), after: 4 * time.Minute, want: ALERT_PENDING},
+			},
+		},
+		{
+			name: "resolved",
+			evaluations: []evaluation{
+				{value: value(11), want: ALERT_FIRING, wantChanged: true},
+				{value: value(3), after: time.Minute, want: ALERT_RESOLVED, wantChanged: true},
+				{value: value(3), after: time.Minute, want: ALERT_RESOLVED},
+			},
+			wantNotification: true,
+		},
+		{
+			name: "fires again",
+			forDuration: time.Minute,
+			evaluations: []evaluation{
+				{value: value(11), want: ALERT_PENDING, wantChanged: true},
+				{value: value(11), after: time.Minute, want: ALERT_FIRING, wantChanged: true},
+				{value: value(3), after: time.Minute, want: ALERT_RESOLVED, wantChanged: true},
+				{value: value(11), after: time.Minute, want: ALERT_PENDING, wantChanged: true},
+				{value: value(11), after: time.Minute, want: ALERT_FIRING, wantChanged: true},
+			},
+			wantNotification: true,
+		},
+		{
+			// too few events are not above the threshold
+			name: "unknown value",
+			evaluations: []evaluation{
+				{value: value(11), want: ALERT_FIRING, wantChanged: true},
+				{value: nil, after: time.Minute, want: ALERT_RESOLVED, wantChanged: true},
+				{value: nil, after: time.Minute, want: ALERT_RESOLVED},
+			},
+			wantNotification: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := AlertRule{Name: "slow", Threshold: 10, For: test.forDuration}
+			now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+			alert := NewAlert(rule.Name, now)
+			for i, e := range test.evaluations {
+				now = now.Add(e.after)
+				previous := alert.State
+				changed := alert.Update(rule, e.value, now)
+				if alert.State != e.want || changed != e.wantChanged {
+					t.Fatalf("evaluation %d: got %s (changed: %v), want %s (changed: %v)", i, alert.State, changed, e.want, e.wantChanged)
+				}
+				if changed && !alert.Since.Equal(now) {
+					t.Errorf("evaluation %d: since %v, want %v", i, alert.Since, now)
+				}
+				if changed && alert.State == ALERT_FIRING && !alert.FiredAt.Equal(now) {
+					t.Errorf("evaluation %d: fired at %v, want %v", i, alert.FiredAt, now)
+				}
+				if changed && previous == ALERT_FIRING && !alert.ResolvedAt.Equal(now) {
+					t.Errorf("evaluation %d: resolved at %v, want %v", i, alert.ResolvedAt, now)
+				}
+			}
+			if alert.NeedsNotification() != test.wantNotification {
+				t.Errorf("needs notification: got %v, want %v", alert.NeedsNotification(), test.wantNotification)
+			}
+			// delivered notifications aren't sent again
+			alert.Notified = alert.State
+			if alert.NeedsNotification() {
+				t.Errorf("needs notification after it was delivered")
+			}
+		})
+	}
+}
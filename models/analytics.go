@@ -0,0 +1,130 @@
+package models
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Percentiles of the durations, as returned in DurationStats
+var DURATION_PERCENTILES = []float64{0.5, 0.9, 0.95, 0.99}
+
+// Parameters of the analytics of an event name
+type AnalyticsQuery struct {
+	EventName string
+	// inclusive lower bound on the event creation time. Zero means no bound
+	From time.Time
+	// exclusive upper bound on the event creation time. Zero means no bound
+	To time.Time
+	// width of the buckets of the time series (see BucketStart).
+	// 0 means no series
+	Bucket time.Duration
+}
+
+// Returns true if the creation time is within the range of the query
+func (q AnalyticsQuery) Contains(creationTime time.Time) bool {
+	return (q.From.IsZero() || !creationTime.Before(q.From)) && (q.To.IsZero() || creationTime.Before(q.To))
+}
+
+// Returns the start of the bucket of the given width holding the time.
+// Buckets are aligned on the Unix epoch, so they are the same whatever the range.
+func BucketStart(t time.Time, width time.Duration) time.Time {
+	millis := t.UnixMilli()
+	widthMillis := width.Milliseconds()
+	bucket := millis - millis % widthMillis
+	if millis % widthMillis < 0 {
+		bucket -= widthMillis
+	}
+	return time.UnixMilli(bucket).UTC()
+}
+
+// Statistics of a set of durations, in milliseconds.
+// Percentiles are nearest-rank percentiles: the smallest duration
+// greater than or equal to that percentage of the durations
+// (percentile_disc in SQL).
+type DurationStats struct {
+	Count int64 `json:"count"`
+	MinMs int64 `json:"minMs"`
+	P50Ms int64 `json:"p50Ms"`
+	P90Ms int64 `json:"p90Ms"`
+	P95Ms int64 `json:"p95Ms"`
+	P99Ms int64 `json:"p99Ms"`
+	MaxMs int64 `json:"maxMs"`
+}
+
+// Computes the statistics of the durations (in milliseconds)
+func NewDurationStats(durations []int64) DurationStats {
+	if len(durations) == 0 {
+		return DurationStats{}
+	}
+	sorted := append([]int64{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return DurationStats{
+		Count: int64(len(sorted)),
+		MinMs: sorted[0],
+		P50Ms: sorted[PercentileIndex(0.5, len(sorted))],
+		P90Ms: sorted[PercentileIndex(0.9, len(sorted))],
+		P95Ms: sorted[PercentileIndex(0.95, len(sorted))],
+		P99Ms: sorted[PercentileIndex(0.99, len(sorted))],
+		MaxMs: sorted[len(sorted) - 1],
+	}
+}
+
+// Index, in count sorted values, of the nearest-rank percentile.
+// Computed with the same floating point operations as percentile_disc.
+func PercentileIndex(percentile float64, count int) int {
+	return max(int(math.Ceil(percentile * float64(count))) - 1, 0)
+}
+
+// Identifies a step of the events of a name
+type StepRef struct {
+	Name string `json:"stepName"`
+	Number int `json:"stepNumber"`
+}
+
+// Latency between the steps of two consecutive numbers
+// (the creation time of the second minus the one of the first)
+type StepTransition struct {
+	From StepRef `json:"from"`
+	To StepRef `json:"to"`
+	Latency DurationStats `json:"latency"`
+}
+
+// Durations of the events created during a bucket of time
+type DurationBucket struct {
+	Start time.Time `json:"start"`
+	Duration DurationStats `json:"duration"`
+}
+
+// How long the events of a name took.
+//
+// The duration of an event runs from its creation time to the creation
+// time of its (latest) "end" step. Events without either are ignored,
+// and so are steps without creation time.
+type DurationAnalytics struct {
+	EventName string `json:"eventName"`
+	Duration DurationStats `json:"duration"`
+	// latencies from each step number N to N + 1, ordered by the
+	// numbers then names of the steps
+	Transitions []StepTransition `json:"transitions"`
+	// durations by bucket of creation time, ordered by time. Only the
+	// buckets with events are listed. Empty unless the query has a bucket
+	Series []DurationBucket `json:"series"`
+}
+
+// Orders the transitions by step numbers then names
+func SortTransitions(transitions []StepTransition) {
+	sort.Slice(transitions, func(i, j int) bool {
+		a, b := transitions[i], transitions[j]
+		if a.From.Number != b.From.Number {
+			return a.From.Number < b.From.Number
+		}
+		if a.From.Name != b.From.Name {
+			return a.From.Name < b.From.Name
+		}
+		if a.To.Number != b.To.Number {
+			return a.To.Number < b.To.Number
+		}
+		return a.To.Name < b.To.Name
+	})
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"time"
+)
+
+// Reference date of the timestamps sent by the client.
+// Timestamps are expressed in milliseconds since that date.
+var TIMESTAMP_REFERENCE_DATE = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Converts a client timestamp (milliseconds since TIMESTAMP_REFERENCE_DATE)
+// to a time.Time
+func TimestampToTime(timestamp int64) time.Time {
+	return TIMESTAMP_REFERENCE_DATE.Add(time.Duration(timestamp) * time.Millisecond)
+}
+
+// Represents an event as returned by the databases,
+// whichever backend it was read from.
+type Event struct {
+	Name string `json:"eventName"`
+	Id string `json:"eventId"`
+	// nil if the start update hasn't been received yet
+	CreationTime *time.Time `json:"creationTime"`
+	// empty if the end update hasn't been received yet
+	Result string `json:"result"`
+	// set if the event was marked as abandoned before its end update
+	Abandoned *Abandonment `json:"abandoned,omitempty"`
+	// ordered by step number
+	Steps []Step `json:"steps,omitempty"`
+}
+
+// Represents a step of an event
+type Step struct {
+	Name string `json:"stepName"`
+	Number int `json:"stepNumber"`
+	// nil if the step was only created by one of its labels
+	CreationTime *time.Time `json:"creationTime"`
+	Labels []Label `json:"labels"`
+}
+
+// Represents a label attached to a step of an event
+type Label struct {
+	StepName string `json:"stepName"`
+	StepNumber int `json:"stepNumber"`
+	Key string `json:"labelKey"`
+	Val string `json:"labelVal"`
+}
+
+// Returns true if one of the steps of the event has the label
+func (e *Event) HasLabel(key string, value string) bool {
+	for _, step := range e.Steps {
+		for _, label := range step.Labels {
+			if label.Key == key && label.Val == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Filters used to list events.
+// Zero values mean "no filter".
+type EventQuery struct {
+	EventName string
+	// inclusive lower bound on the event creation time
+	From time.Time
+	// exclusive upper bound on the event creation time
+	To time.Time
+	// result of the event (set by the end update)
+	Result string
+	// label key -> value. Events must have all of these labels, on any step
+	Labels map[string]string
+
+	// Pagination: only events strictly after (AfterName, AfterId),
+	// in (name, ID) order, are returned. Ignored if AfterName is empty
+	AfterName string
+	AfterId string
+	// maximum number of events returned. 0 means no limit
+	Limit int
+}
+
+// Attaches each label to its step, and returns the steps.
+// Labels that don't match any step are dropped.
+func AttachLabels(steps []Step, labels []Label) []Step {
+	for i := range steps {
+		if steps[i].Labels == nil {
+			steps[i].Labels = []Label{}
+		}
+	}
+	for _, label := range labels {
+		for i := range steps {
+			if steps[i].Number == label.StepNumber && steps[i].Name == label.StepName {
+				steps[i].Labels = append(steps[i].Labels, label)
+				break
+			}
+		}
+	}
+	return steps
+}
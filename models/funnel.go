@@ -0,0 +1,136 @@
+package models
+
+import (
+	"sort"
+)
+
+// Maximum number of steps of a funnel
+const MAX_FUNNEL_STEPS = 20
+
+// Parameters of a funnel: which events of a name, created in a range,
+// go through the steps in order
+type FunnelQuery struct {
+	// the Bucket is ignored
+	AnalyticsQuery
+	// names of the steps of the stages, in order
+	Steps []string
+	// label key splitting the events into segments. Empty means no segments
+	SegmentBy string
+}
+
+// Counts of a funnel (or of one of its segments), as computed by the databases.
+//
+// An event reaches the first stage if it has a step of the first name, and
+// each following stage if it has a step of the stage name whose number is
+// greater than the step matching the previous stage (the smallest one
+// which can match is used). Steps are matched by number, whether or not
+// they have a creation time.
+type FunnelCounts struct {
+	// value of the SegmentBy label of the events, nil for the events
+	// without that label. The label of the smallest step (by number then
+	// name) is used if the event has several
+	Segment *string
+	// events of the name created in the range
+	Events int64
+	// number of events reaching each stage
+	Stages []int64
+}
+
+// A stage of a funnel
+type FunnelStage struct {
+	StepName string `json:"stepName"`
+	// number of events reaching the stage
+	Count int64 `json:"count"`
+	// fraction of the events (of the name, created in the range) reaching the stage
+	Conversion float64 `json:"conversion"`
+	// fraction of the events reaching the previous stage (or of the events,
+	// for the first stage) which reach this stage
+	StepConversion float64 `json:"stepConversion"`
+	// fraction of the events reaching the previous stage (or of the events,
+	// for the first stage) which don't reach this stage
+	DropOff float64 `json:"dropOff"`
+}
+
+// The events having a value of the SegmentBy label
+type FunnelSegment struct {
+	// nil for the events without the label
+	Value *string `json:"value"`
+	Events int64 `json:"events"`
+	Stages []FunnelStage `json:"stages"`
+}
+
+// How many of the events of a name go through each stage of a funnel
+type Funnel struct {
+	EventName string `json:"eventName"`
+	Events int64 `json:"events"`
+	Stages []FunnelStage `json:"stages"`
+	SegmentBy string `json:"segmentBy,omitempty"`
+	// ordered by value, the events without the label first.
+	// Only set if the query has a SegmentBy key
+	Segments []FunnelSegment `json:"segments,omitempty"`
+}
+
+// Builds the funnel from the counts of its segments
+// (a single segment, with a nil value, if the query has no SegmentBy key)
+func NewFunnel(query FunnelQuery, counts []FunnelCounts) *Funnel {
+	funnel := &Funnel{EventName: query.EventName, SegmentBy: query.SegmentBy}
+	total := make([]int64, len(query.Steps))
+	for _, c := range counts {
+		funnel.Events += c.Events
+		for i := range total {
+			if i < len(c.Stages) {
+				total[i] += c.Stages[i]
+			}
+		}
+	}
+	funnel.Stages = funnelStages(query.Steps, funnel.Events, total)
+	if query.SegmentBy == "" {
+		return funnel
+	}
+
+	funnel.Segments = []FunnelSegment{}
+	for _, c := range counts {
+		stages := make([]int64, len(query.Steps))
+		copy(stages, c.Stages)
+		funnel.Segments = append(funnel.Segments, FunnelSegment{
+			Value: c.Segment,
+			Events: c.Events,
+			Stages: funnelStages(query.Steps, c.Events, stages),
+		})
+	}
+	sort.Slice(funnel.Segments, func(i, j int) bool {
+		a, b := funnel.Segments[i].Value, funnel.Segments[j].Value
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return *a < *b
+	})
+	return funnel
+}
+
+func funnelStages(steps []string, events int64, counts []int64) []FunnelStage {
+	stages := []FunnelStage{}
+	previous := events
+	for i, step := range steps {
+		stage := FunnelStage{
+			StepName: step,
+			Count: counts[i],
+			Conversion: ratio(counts[i], events),
+			StepConversion: ratio(counts[i], previous),
+		}
+		if previous > 0 {
+			stage.DropOff = 1 - stage.StepConversion
+		}
+		stages = append(stages, stage)
+		previous = counts[i]
+	}
+	return stages
+}
+
+// Returns count / total, 0 if total is 0
+func ratio(count int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"cmp"
+	"fmt"
+)
+
+// Decides which update wins when several updates set the same value:
+// the value of a label, the creation time of a step or of an event,
+// or the result of an event.
+//
+// Updates are compared by version (see Update.Version), then by the value
+// they set, so that the stored event doesn't depend on the order in which
+// the updates arrive: replayed or reordered batches converge to the same event.
+type MergePolicy string
+
+const (
+	// The update with the highest version wins (the default)
+	MERGE_LAST_WRITER_WINS MergePolicy = "last-writer-wins"
+	// The update with the lowest version wins
+	MERGE_FIRST_WRITER_WINS MergePolicy = "first-writer-wins"
+)
+
+var MERGE_POLICIES = []MergePolicy{MERGE_LAST_WRITER_WINS, MERGE_FIRST_WRITER_WINS}
+
+// Returns an error if the policy is not one of MERGE_POLICIES.
+// The empty policy is valid, and means MERGE_LAST_WRITER_WINS.
+func (p MergePolicy) Validate() error {
+	if p == "" {
+		return nil
+	}
+	for _, policy := range MERGE_POLICIES {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown merge policy %q, expected one of %v", p, MERGE_POLICIES)
+}
+
+// True if the policy keeps the first writer, false if it keeps the last one.
+func (p MergePolicy) FirstWriterWins() bool {
+	return p == MERGE_FIRST_WRITER_WINS
+}
+
+// Returns true if a value set by an update of the given version
+// replaces the current value, set by an update of version currentVersion.
+// Equal versions are decided by comparing the values.
+func Overrides[V cmp.Ordered](policy MergePolicy, version int64, value V, currentVersion int64, currentValue V) bool {
+	order := cmp.Compare(version, currentVersion)
+	if order == 0 {
+		order = cmp.Compare(value, currentValue)
+	}
+	if policy.FirstWriterWins() {
+		return order < 0
+	}
+	return order > 0
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Returned (wrapped) by the databases when an update has an unsupported updateType
+var ErrUnknownUpdateType = errors.New("unknown update type")
+
+// Represents the JSON object sent back to the client after
+// a batch of updates was posted, telling which updates were
+// accepted (queued to be saved) and which were not.
+type IngestReport struct {
+	// indexes (in the posted array) of the updates that were accepted
+	Accepted []int `json:"accepted"`
+	// indexes of the accepted updates that were dropped because
+	// they had already been received (see Update.UpdateId)
+	Duplicates []int `json:"duplicates"`
+	Rejected []RejectedUpdate `json:"rejected"`
+}
+
+// An update that was not saved, and why
+type RejectedUpdate struct {
+	// index of the update in the posted array
+	Index int `json:"index"`
+	Reason string `json:"reason"`
+	// true if the update was rejected because of a server side issue,
+	// in which case the client can send it again later.
+	// false if the update itself is invalid
+	Retryable bool `json:"retryable"`
+}
+
+func NewIngestReport() *IngestReport {
+	return &IngestReport{
+		Accepted: []int{},
+		Duplicates: []int{},
+		Rejected: []RejectedUpdate{},
+	}
+}
+
+// Records that the update at the given index was accepted
+func (r *IngestReport) Accept(index int) {
+	r.Accepted = append(r.Accepted, index)
+}
+
+// Records that the update at the given index was a duplicate.
+// Duplicates count as accepted: the client must not send them again.
+func (r *IngestReport) Duplicate(index int) {
+	r.Duplicates = append(r.Duplicates, index)
+}
+
+// Records that the update at the given index was rejected
+func (r *IngestReport) Reject(index int, reason string, retryable bool) {
+	r.Rejected = append(r.Rejected, RejectedUpdate{
+		Index: index,
+		Reason: reason,
+		Retryable: retryable,
+	})
+}
+
+// Returns the HTTP status matching the report:
+//   - 202 if every update was accepted
+//   - 207 if some updates were accepted and others rejected
+//   - 400 if every update was rejected because it was invalid
+//   - 500 if every update was rejected, some because of server side errors
+func (r *IngestReport) StatusCode() int {
+	if len(r.Rejected) == 0 {
+		return http.StatusAccepted
+	}
+	if len(r.Accepted) > 0 {
+		return http.StatusMultiStatus
+	}
+	for _, rejected := range r.Rejected {
+		if rejected.Retryable {
+			return http.StatusInternalServerError
+		}
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIngestReportStatusCode(t *testing.T) {
+	// a rejected update: its reason, and whether it is retryable
+	type rejection struct {
+		reason string
+		retryable bool
+	}
+	tests := []struct {
+		name string
+		accepted []int
+		duplicates []int
+		rejected []rejection
+		want int
+	}{
+		{name: "all accepted", accepted: []int{0, 1}, want: http.StatusAccepted},
+		{name: "duplicates", accepted: []int{0, 1}, duplicates: []int{1}, want: http.StatusAccepted},
+		{name: "empty batch", want: http.StatusAccepted},
+		{name: "mixed", accepted: []int{0}, rejected: []rejection{{"invalid", false}}, want: http.StatusMultiStatus},
+		{name: "mixed with retryable", accepted: []int{0}, rejected: []rejection{{"database down", true}}, want: http.StatusMultiStatus},
+		{name: "all rejected", rejected: []rejection{{"invalid", false}, {"invalid", false}}, want: http.StatusBadRequest},
+		{name: "retryable rejected", rejected: []rejection{{"invalid", false}, {"database down", true}}, want: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := NewIngestReport()
+			for _, index := range test.accepted {
+				report.Accept(index)
+			}
+			for _, index := range test.duplicates {
+				report.Duplicate(index)
+			}
+			for i, rejected := range test.rejected {
+				report.Reject(len(test.accepted) + i, rejected.reason, rejected.retryable)
+			}
+			if got := report.StatusCode(); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
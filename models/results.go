@@ -0,0 +1,103 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// Results counted as successes when the query doesn't list any
+var DEFAULT_SUCCESS_RESULTS = []string{"success"}
+
+// Parameters of a result breakdown: the results of the events of a
+// name created in a range, overall and (with a Bucket) over time
+type ResultQuery struct {
+	AnalyticsQuery
+	// results counted as successes
+	SuccessResults []string
+}
+
+// Number of events of a result, as computed by the databases
+type ResultCount struct {
+	// start of the bucket of the creation time of the events, nil without Bucket
+	Bucket *time.Time
+	// empty for the events without end update
+	Result string
+	Count int64
+}
+
+// Results of a set of events
+type ResultStats struct {
+	Events int64 `json:"events"`
+	// number of events by result, without the events missing an end update
+	ByResult map[string]int64 `json:"byResult"`
+	// events without end update
+	Unended int64 `json:"unended"`
+	// fraction of the ended events whose result is a success, 0 if none ended
+	SuccessRate float64 `json:"successRate"`
+}
+
+// Results of the events created in a bucket of a time series
+type ResultBucket struct {
+	Start time.Time `json:"start"`
+	Stats ResultStats `json:"stats"`
+}
+
+// Results of the events of a name
+type ResultBreakdown struct {
+	EventName string `json:"eventName"`
+	SuccessResults []string `json:"successResults"`
+	Overall ResultStats `json:"overall"`
+	// ordered by start, only the buckets having events
+	Series []ResultBucket `json:"series"`
+}
+
+// Builds the breakdown from the counts of each result (and bucket)
+func NewResultBreakdown(query ResultQuery, counts []ResultCount) *ResultBreakdown {
+	breakdown := &ResultBreakdown{
+		EventName: query.EventName,
+		SuccessResults: query.SuccessResults,
+		Overall: ResultStats{ByResult: map[string]int64{}},
+		Series: []ResultBucket{},
+	}
+	successes := map[string]bool{}
+	for _, result := range query.SuccessResults {
+		successes[result] = true
+	}
+	buckets := map[time.Time]*ResultStats{}
+	overallSuccesses := int64(0)
+	bucketSuccesses := map[time.Time]int64{}
+	for _, c := range counts {
+		addResult(&breakdown.Overall, c)
+		if successes[c.Result] {
+			overallSuccesses += c.Count
+		}
+		if c.Bucket == nil {
+			continue
+		}
+		start := c.Bucket.UTC()
+		if buckets[start] == nil {
+			buckets[start] = &ResultStats{ByResult: map[string]int64{}}
+		}
+		addResult(buckets[start], c)
+		if successes[c.Result] {
+			bucketSuccesses[start] += c.Count
+		}
+	}
+
+	breakdown.Overall.SuccessRate = ratio(overallSuccesses, breakdown.Overall.Events - breakdown.Overall.Unended)
+	for start, stats := range buckets {
+		stats.SuccessRate = ratio(bucketSuccesses[start], stats.Events - stats.Unended)
+		breakdown.Series = append(breakdown.Series, ResultBucket{Start: start, Stats: *stats})
+	}
+	sort.Slice(breakdown.Series, func(i, j int) bool { return breakdown.Series[i].Start.Before(breakdown.Series[j].Start) })
+	return breakdown
+}
+
+func addResult(stats *ResultStats, count ResultCount) {
+	stats.Events += count.Count
+	if count.Result == "" {
+		stats.Unended += count.Count
+	} else {
+		stats.ByResult[count.Result] += count.Count
+	}
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// How long events are kept, by event name. A retention of 0 keeps
+// the events forever.
+//
+// The age of an event is counted from its creation time. Events without
+// creation time are kept by the MongoDB and memory backends, TimescaleDB
+// counts their age from the time it received their first update. TimescaleDB
+// also drops whole chunks of events received before the longest retention.
+type RetentionPolicy struct {
+	// retention of the events of each name
+	Events map[string]time.Duration
+	// retention of the events of the other names
+	Default time.Duration
+	// delay after the retention before the database deletes the expired
+	// events itself (MongoDB TTL indexes), if they weren't purged
+	Grace time.Duration
+}
+
+// Returns how long the events of the given name are kept, 0 if forever
+func (p RetentionPolicy) Retention(eventName string) time.Duration {
+	if retention, ok := p.Events[eventName]; ok {
+		return retention
+	}
+	return p.Default
+}
+
+// Returns true if some events are ever purged
+func (p RetentionPolicy) Enabled() bool {
+	return p.Default > 0 || len(p.Events) > 0
+}
+
+// Returns the longest retention, after which every event can be purged,
+// or 0 if the events of some names are kept forever
+func (p RetentionPolicy) Longest() time.Duration {
+	if p.Default == 0 {
+		return 0
+	}
+	longest := p.Default
+	for _, retention := range p.Events {
+		if retention == 0 {
+			return 0
+		}
+		longest = max(longest, retention)
+	}
+	return longest
+}
+
+// Returns the names with their own retention, sorted
+func (p RetentionPolicy) Names() []string {
+	names := []string{}
+	for name := range p.Events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Number of events of a tenant and name deleted by a purge
+type PurgedEvents struct {
+	Tenant string `json:"tenant"`
+	EventName string `json:"eventName"`
+	Count int64 `json:"count"`
+}
+
+// Outcome of a run of the retention job
+type PurgeReport struct {
+	Time time.Time `json:"time"`
+	Duration string `json:"duration"`
+	// sorted by tenant then event name
+	Purged []PurgedEvents `json:"purged"`
+	Total int64 `json:"total"`
+	// set if the purge failed. Purged lists what was deleted before the failure
+	Error string `json:"error,omitempty"`
+}
+
+// Adds the counts of the same tenant and name, drops the zero counts,
+// and sorts them by tenant then event name
+func MergePurgedEvents(purged []PurgedEvents) []PurgedEvents {
+	type key struct {
+		tenant string
+		eventName string
+	}
+	counts := map[key]int64{}
+	for _, p := range purged {
+		counts[key{p.Tenant, p.EventName}] += p.Count
+	}
+	result := []PurgedEvents{}
+	for k, count := range counts {
+		if count > 0 {
+			result = append(result, PurgedEvents{Tenant: k.tenant, EventName: k.eventName, Count: count})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Tenant != result[j].Tenant {
+			return result[i].Tenant < result[j].Tenant
+		}
+		return result[i].EventName < result[j].EventName
+	})
+	return result
+}
@@ -30,6 +30,38 @@ type Update struct {
 
 	// end metadata
 	Result string `json:"result"`
+
+	// optional sequence number, increasing with each update of the event
+	// sent by the client. Orders the updates setting the same value
+	// (see MergePolicy) when they arrive out of order.
+	// Clients should set it on all the updates of an event or on none:
+	// see Version
+	Sequence int64 `json:"sequence,omitempty"`
+
+	// optional ID, unique to the update, generated by the client.
+	// The server drops the updates whose ID it has recently seen,
+	// so that retried requests don't save them twice
+	UpdateId string `json:"updateId,omitempty"`
+}
+
+// Version of the update, compared by the merge policy when several
+// updates set the same value: the sequence number if the client
+// sent one, the timestamp otherwise.
+//
+// Sequence numbers and timestamps are compared as plain numbers, so when
+// only some updates of an event have a sequence, the ones without (whose
+// timestamps are much larger) always win under MERGE_LAST_WRITER_WINS,
+// and always lose under MERGE_FIRST_WRITER_WINS.
+//
+// Label updates usually carry the timestamp of their step, so without a
+// sequence, two values of the same label have the same version. They are
+// then ordered by value (byte-wise), not by arrival: a label whose value
+// must be replaced by a later update needs a sequence.
+func (u Update) Version() int64 {
+	if u.Sequence > 0 {
+		return u.Sequence
+	}
+	return u.Timestamp
 }
 
 func (u Update) String() string {
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const MAX_NAME_LENGTH = 128
+const MAX_ID_LENGTH = 128
+const MAX_LABEL_VAL_LENGTH = 1024
+
+// Event names, step names, label keys and results are used to build
+// the database IDs, where "-" is the separator, so it is not allowed in them.
+var NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_.: ]+$`)
+// Tenants name database collections and prefix database IDs
+var TENANT_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+// Event IDs and update IDs are usually UUIDs generated by the client
+var ID_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Names (as in the JSON payload) of the fields of an Update
+const FIELD_EVENT_NAME = "eventName"
+const FIELD_EVENT_ID = "eventId"
+const FIELD_UPDATE_TYPE = "updateType"
+const FIELD_TIMESTAMP = "timestamp"
+const FIELD_STEP_NUMBER = "stepNumber"
+const FIELD_STEP_NAME = "stepName"
+const FIELD_LABEL_KEY = "labelKey"
+const FIELD_LABEL_VAL = "labelVal"
+const FIELD_RESULT = "result"
+const FIELD_SEQUENCE = "sequence"
+const FIELD_UPDATE_ID = "updateId"
+
+// Fields that must be set for each update type.
+// A timestamp is set if it is strictly positive.
+var UPDATE_SCHEMAS = map[string][]string{
+	UPDATE_TYPE_START: {FIELD_EVENT_NAME, FIELD_EVENT_ID, FIELD_TIMESTAMP},
+	UPDATE_TYPE_STEP: {FIELD_EVENT_NAME, FIELD_EVENT_ID, FIELD_TIMESTAMP, FIELD_STEP_NAME},
+	UPDATE_TYPE_LABEL: {FIELD_EVENT_NAME, FIELD_EVENT_ID, FIELD_STEP_NAME, FIELD_LABEL_KEY},
+	UPDATE_TYPE_END: {FIELD_EVENT_NAME, FIELD_EVENT_ID, FIELD_TIMESTAMP, FIELD_RESULT},
+}
+
+// Format constraints of the string fields, checked whenever the field is set
+type stringRule struct {
+	maxLength int
+	// nil if any character is allowed
+	pattern *regexp.Regexp
+	value func(u Update) string
+}
+
+var STRING_RULES = map[string]stringRule{
+	FIELD_EVENT_NAME: {MAX_NAME_LENGTH, NAME_PATTERN, func(u Update) string { return u.EventName }},
+	FIELD_EVENT_ID: {MAX_ID_LENGTH, ID_PATTERN, func(u Update) string { return u.EventId }},
+	FIELD_STEP_NAME: {MAX_NAME_LENGTH, NAME_PATTERN, func(u Update) string { return u.StepName }},
+	FIELD_LABEL_KEY: {MAX_NAME_LENGTH, NAME_PATTERN, func(u Update) string { return u.LabelKey }},
+	FIELD_LABEL_VAL: {MAX_LABEL_VAL_LENGTH, nil, func(u Update) string { return u.LabelVal }},
+	FIELD_RESULT: {MAX_NAME_LENGTH, NAME_PATTERN, func(u Update) string { return u.Result }},
+	FIELD_UPDATE_ID: {MAX_ID_LENGTH, ID_PATTERN, func(u Update) string { return u.UpdateId }},
+}
+
+// Order in which fields are checked, so that error messages are stable
+var FIELD_ORDER = []string{
+	FIELD_EVENT_NAME, FIELD_EVENT_ID, FIELD_TIMESTAMP, FIELD_STEP_NUMBER,
+	FIELD_STEP_NAME, FIELD_LABEL_KEY, FIELD_LABEL_VAL, FIELD_RESULT, FIELD_SEQUENCE, FIELD_UPDATE_ID,
+}
+
+// A single invalid field of an update
+type FieldError struct {
+	Field string
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// Returned by Update.Validate. Lists every invalid field of the update.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var messages []string
+	for _, fieldError := range e.Errors {
+		messages = append(messages, fieldError.Error())
+	}
+	return "invalid update: " + strings.Join(messages, "; ")
+}
+
+// Unwraps to ErrUnknownUpdateType if the update type is not supported
+func (e *ValidationError) Unwrap() error {
+	for _, fieldError := range e.Errors {
+		if fieldError.Field == FIELD_UPDATE_TYPE {
+			return ErrUnknownUpdateType
+		}
+	}
+	return nil
+}
+
+// Checks that the update can be saved: the update type is known,
+// the fields required by that type (see UPDATE_SCHEMAS) are set,
+// and every field respects its length and format constraints.
+// Returns a *ValidationError if it doesn't.
+func (u Update) Validate() error {
+	required, ok := UPDATE_SCHEMAS[u.UpdateType]
+	if !ok {
+		return &ValidationError{Errors: []FieldError{
+			{FIELD_UPDATE_TYPE, fmt.Sprintf("unknown update type %q, expected one of start, step, label, end", u.UpdateType)},
+		}}
+	}
+	isRequired := map[string]bool{}
+	for _, field := range required {
+		isRequired[field] = true
+	}
+
+	var errors []FieldError
+	for _, field := range FIELD_ORDER {
+		switch field {
+		case FIELD_TIMESTAMP:
+			if u.Timestamp < 0 || (isRequired[field] && u.Timestamp == 0) {
+				errors = append(errors, FieldError{field, fmt.Sprintf("must be a positive number of milliseconds, got %d", u.Timestamp)})
+			}
+		case FIELD_STEP_NUMBER:
+			if u.StepNumber < 0 {
+				errors = append(errors, FieldError{field, fmt.Sprintf("must not be negative, got %d", u.StepNumber)})
+			}
+		case FIELD_SEQUENCE:
+			if u.Sequence < 0 {
+				errors = append(errors, FieldError{field, fmt.Sprintf("must not be negative, got %d", u.Sequence)})
+			}
+		default:
+			rule := STRING_RULES[field]
+			value := rule.value(u)
+			if value == "" {
+				if isRequired[field] {
+					errors = append(errors, FieldError{field, fmt.Sprintf("is required for %s updates", u.UpdateType)})
+				}
+				continue
+			}
+			if len(value) > rule.maxLength {
+				errors = append(errors, FieldError{field, fmt.Sprintf("must be at most %d characters long, got %d", rule.maxLength, len(value))})
+			} else if rule.pattern != nil && !rule.pattern.MatchString(value) {
+				errors = append(errors, FieldError{field, fmt.Sprintf("contains invalid characters, must match %s", rule.pattern)})
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return &ValidationError{Errors: errors}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Returns a valid update of the type
+func validUpdate(updateType string) Update {
+	return Update{
+		UpdateType: updateType,
+		EventName: "checkout",
+		EventId: "3f2c-41d8.a",
+		Timestamp: 800_000_000_000,
+		StepNumber: 1,
+		StepName: "payment",
+		LabelKey: "plan",
+		LabelVal: "pro, yearly!",
+		Result: "success",
+		UpdateId: "u-1",
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		update Update
+		// the messages clients see, in order, none if the update is valid
+		want []string
+	}{
+		{name: "start", update: validUpdate(UPDATE_TYPE_START)},
+		{name: "label without timestamp", update: func() Update { u := validUpdate(UPDATE_TYPE_LABEL); u.Timestamp = 0; return u }()},
+		{
+			name: "unknown type",
+			update: validUpdate("stop"),
+			want: []string{`updateType: unknown update type "stop", expected one of start, step, label, end`},
+		},
+		{
+			name: "start without event name",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_START); u.EventName = ""; return u }(),
+			want: []string{"eventName: is required for start updates"},
+		},
+		{
+			name: "start without timestamp",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_START); u.Timestamp = 0; return u }(),
+			want: []string{"timestamp: must be a positive number of milliseconds, got 0"},
+		},
+		{
+			name: "step without step name",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_STEP); u.StepName = ""; return u }(),
+			want: []string{"stepName: is required for step updates"},
+		},
+		{
+			name: "label without label key",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_LABEL); u.LabelKey = ""; return u }(),
+			want: []string{"labelKey: is required for label updates"},
+		},
+		{
+			name: "end without event ID and result",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_END); u.EventId, u.Result = "", ""; return u }(),
+			want: []string{"eventId: is required for end updates", "result: is required for end updates"},
+		},
+		{
+			name: "negative numbers",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_LABEL); u.Timestamp, u.StepNumber, u.Sequence = -1, -2, -3; return u }(),
+			want: []string{
+				"timestamp: must be a positive number of milliseconds, got -1",
+				"stepNumber: must not be negative, got -2",
+				"sequence: must not be negative, got -3",
+			},
+		},
+		{
+			name: "longest values",
+			update: func() Update {
+				u := validUpdate(UPDATE_TYPE_LABEL)
+				u.EventName, u.EventId, u.LabelVal = strings.Repeat("a", MAX_NAME_LENGTH), strings.Repeat("1", MAX_ID_LENGTH), strings.Repeat("x", MAX_LABEL_VAL_LENGTH)
+				return u
+			}(),
+		},
+		{
+			name: "too long",
+			update: func() Update {
+				u := validUpdate(UPDATE_TYPE_LABEL)
+				u.EventName, u.EventId, u.LabelVal = strings.Repeat("a", MAX_NAME_LENGTH + 1), strings.Repeat("1", MAX_ID_LENGTH + 1), strings.Repeat("x", MAX_LABEL_VAL_LENGTH + 1)
+				return u
+			}(),
+			want: []string{
+				"eventName: must be at most 128 characters long, got 129",
+				"eventId: must be at most 128 characters long, got 129",
+				"labelVal: must be at most 1024 characters long, got 1025",
+			},
+		},
+		{
+			// "-" separates the parts of the database IDs
+			name: "dash in a name",
+			update: func() Update { u := validUpdate(UPDATE_TYPE_STEP); u.StepName = "check-out"; return u }(),
+			want: []string{"stepName: contains invalid characters, must match ^[A-Za-z0-9_.: ]+$"},
+		},
+		{
+			name: "invalid characters",
+			update: func() Update {
+				u := validUpdate(UPDATE_TYPE_END)
+				u.EventName, u.EventId, u.Result, u.UpdateId = "café", "a/b", "ok!", "u 1"
+				return u
+			}(),
+			want: []string{
+				"eventName: contains invalid characters, must match ^[A-Za-z0-9_.: ]+$",
+				"eventId: contains invalid characters, must match ^[A-Za-z0-9_.-]+$",
+				"result: contains invalid characters, must match ^[A-Za-z0-9_.: ]+$",
+				"updateId: contains invalid characters, must match ^[A-Za-z0-9_.-]+$",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.update.Validate()
+			if len(test.want) == 0 {
+				if err != nil {
+					t.Fatalf("got %v, want a valid update", err)
+				}
+				return
+			}
+			var validationError *ValidationError
+			if !errors.As(err, &validationError) {
+				t.Fatalf("got %v, want a *ValidationError", err)
+			}
+			got := []string{}
+			for _, fieldError := range validationError.Errors {
+				got = append(got, fieldError.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if err.Error() != "invalid update: " + strings.Join(test.want, "; ") {
+				t.Errorf("message: got %q", err.Error())
+			}
+			if errors.Is(err, ErrUnknownUpdateType) != (test.update.UpdateType == "stop") {
+				t.Errorf("unwraps to ErrUnknownUpdateType: got %v", errors.Is(err, ErrUnknownUpdateType))
+			}
+		})
+	}
+}
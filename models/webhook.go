@@ -0,0 +1,57 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// A webhook notified of the events of a tenant receiving their end update.
+// The events must match every filter: an empty filter matches all events.
+type WebhookSubscription struct {
+	// identifies the subscription
+	Name string
+	Tenant string
+	EventNames []string
+	Results []string
+	// label key -> value. Events must have all of these labels, on any step
+	Labels map[string]string
+	URL string
+	// signs the deliveries with HMAC-SHA256, unsigned if empty
+	Secret string
+}
+
+// Returns true if the subscription may be notified of the end of an
+// event of the name, before its result and labels are known
+func (s WebhookSubscription) Watches(tenant string, eventName string) bool {
+	return s.Tenant == tenant && (len(s.EventNames) == 0 || slices.Contains(s.EventNames, eventName))
+}
+
+// Returns true if the subscription is notified of the end of the event
+func (s WebhookSubscription) Matches(tenant string, event *Event) bool {
+	if !s.Watches(tenant, event.Name) {
+		return false
+	}
+	if len(s.Results) > 0 && !slices.Contains(s.Results, event.Result) {
+		return false
+	}
+	for key, value := range s.Labels {
+		if !event.HasLabel(key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// A delivery which failed its last attempt. It can be retried
+// by hand, with the event as it is when retried
+type DeadLetter struct {
+	// ID of the delivery, sent in every attempt
+	ID string `json:"id"`
+	Subscription string `json:"subscription"`
+	Tenant string `json:"tenant"`
+	EventName string `json:"eventName"`
+	EventId string `json:"eventId"`
+	Attempts int `json:"attempts"`
+	LastError string `json:"lastError"`
+	FailedAt time.Time `json:"failedAt"`
+}
@@ -0,0 +1,130 @@
+package retention
+
+import (
+	"fmt"
+	"log"
+	"owl_server/db"
+	"owl_server/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of purge reports kept, most recent first
+const MAX_REPORTS = 48
+
+// Periodically deletes the events older than their retention
+// (see models.RetentionPolicy), and reports what was purged.
+type Job struct {
+	database db.Purger
+	policy models.RetentionPolicy
+	interval time.Duration
+
+	lock sync.Mutex
+	reports []models.PurgeReport
+	stats Stats
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+// Counters of the job since the server started
+type Stats struct {
+	Runs int64
+	FailedRuns int64
+	PurgedEvents int64
+}
+
+// Creates a job purging the expired events every interval.
+// Call Start to start it.
+func NewJob(database db.Purger, policy models.RetentionPolicy, interval time.Duration) *Job {
+	return &Job{
+		database: database,
+		policy: policy,
+		interval: interval,
+		reports: []models.PurgeReport{},
+		stop: make(chan struct{}),
+	}
+}
+
+func (j *Job) Start() {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			j.Purge()
+			select {
+			case <-ticker.C:
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the job, waiting for the ongoing purge (if any) to finish
+func (j *Job) Stop() {
+	close(j.stop)
+	j.wg.Wait()
+}
+
+// Purges the expired events now, and returns the report of the purge
+func (j *Job) Purge() models.PurgeReport {
+	start := time.Now()
+	purged, err := j.database.PurgeExpired(j.policy, start)
+	report := models.PurgeReport{
+		Time: start,
+		Duration: time.Since(start).String(),
+		Purged: purged,
+	}
+	if report.Purged == nil {
+		report.Purged = []models.PurgedEvents{}
+	}
+	for _, p := range report.Purged {
+		report.Total += p.Count
+	}
+	if err != nil {
+		report.Error = err.Error()
+		log.Printf("unable to purge the expired events, will retry in %v: %s", j.interval, err)
+	}
+	if report.Total > 0 {
+		log.Printf("Purged %d expired events: %s", report.Total, describe(report.Purged))
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.reports = append([]models.PurgeReport{report}, j.reports...)
+	if len(j.reports) > MAX_REPORTS {
+		j.reports = j.reports[:MAX_REPORTS]
+	}
+	j.stats.Runs++
+	if err != nil {
+		j.stats.FailedRuns++
+	}
+	j.stats.PurgedEvents += report.Total
+	return report
+}
+
+// Returns the reports of the last purges, most recent first
+func (j *Job) Reports() []models.PurgeReport {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return append([]models.PurgeReport{}, j.reports...)
+}
+
+func (j *Job) Stats() Stats {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.stats
+}
+
+// Formats the counts for the logs, e.g. "morel/checkout: 12, morel/debug_probe: 3"
+func describe(purged []models.PurgedEvents) string {
+	var parts []string
+	for _, p := range purged {
+		parts = append(parts, fmt.Sprintf("%s/%s: %d", p.Tenant, p.EventName, p.Count))
+	}
+	return strings.Join(parts, ", ")
+}
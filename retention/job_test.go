@@ -0,0 +1,123 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"owl_server/db/memory"
+	"owl_server/models"
+	"testing"
+	"time"
+)
+
+// Purges the memory database, then fails if asked to, as a database
+// failing partway through would
+type failingPurger struct {
+	*memory.MemoryDB
+	fail bool
+}
+
+func (p *failingPurger) PurgeExpired(policy models.RetentionPolicy, now time.Time) ([]models.PurgedEvents, error) {
+	purged, err := p.MemoryDB.PurgeExpired(policy, now)
+	if err == nil && p.fail {
+		err = errors.New("connection lost")
+	}
+	return purged, err
+}
+
+// Saves events of the tenant created at the time
+func insertEvents(t *testing.T, database *memory.MemoryDB, tenant string, eventName string, count int, createdAt time.Time) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		err := database.InsertUpdate(tenant, models.Update{
+			UpdateType: models.UPDATE_TYPE_START,
+			EventName: eventName,
+			EventId: fmt.Sprintf("%s%d_%d", eventName, i, createdAt.UnixNano()),
+			Timestamp: createdAt.Sub(models.TIMESTAMP_REFERENCE_DATE).Milliseconds(),
+		})
+		if err != nil {
+			t.Fatalf("inserting: %v", err)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	database := &failingPurger{MemoryDB: memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)}
+	database.Connect()
+	expired := time.Now().Add(-48 * time.Hour)
+	job := NewJob(database, models.RetentionPolicy{Default: 24 * time.Hour}, time.Hour)
+
+	steps := []struct {
+		name string
+		// inserts the events of the step
+		prepare func()
+		fail bool
+		wantPurged string
+		wantError string
+		wantStats Stats
+	}{
+		{
+			name: "expired events",
+			prepare: func() {
+				insertEvents(t, database.MemoryDB, "globex", "checkout", 1, expired)
+				insertEvents(t, database.MemoryDB, "acme", "debug", 1, expired)
+				insertEvents(t, database.MemoryDB, "acme", "checkout", 2, expired)
+				insertEvents(t, database.MemoryDB, "acme", "checkout", 1, time.Now())
+			},
+			wantPurged: "[{acme checkout 2} {acme debug 1} {globex checkout 1}]",
+			wantStats: Stats{Runs: 1, PurgedEvents: 4},
+		},
+		{name: "nothing expired", prepare: func() {}, wantPurged: "[]", wantStats: Stats{Runs: 2, PurgedEvents: 4}},
+		{
+			// what was purged before the failure is reported
+			name: "failed",
+			prepare: func() { insertEvents(t, database.MemoryDB, "acme", "checkout", 3, expired.Add(-time.Minute)) },
+			fail: true,
+			wantPurged: "[{acme checkout 3}]",
+			wantError: "connection lost",
+			wantStats: Stats{Runs: 3, FailedRuns: 1, PurgedEvents: 7},
+		},
+	}
+	for i, step := range steps {
+		step.prepare()
+		database.fail = step.fail
+		report := job.Purge()
+		if got := fmt.Sprint(report.Purged); got != step.wantPurged || report.Error != step.wantError {
+			t.Errorf("%s: got %s (error %q), want %s (error %q)", step.name, got, report.Error, step.wantPurged, step.wantError)
+		}
+		if stats := job.Stats(); stats != step.wantStats {
+			t.Errorf("%s: stats: got %+v, want %+v", step.name, stats, step.wantStats)
+		}
+		// the latest report comes first
+		reports := job.Reports()
+		if len(reports) != i + 1 || fmt.Sprint(reports[0]) != fmt.Sprint(report) {
+			t.Errorf("%s: got %d reports, starting with %+v", step.name, len(reports), reports[0])
+		}
+	}
+	if total := job.Reports()[0].Total; total != 3 {
+		t.Errorf("total of the failed purge: got %d, want 3", total)
+	}
+}
+
+// Only the latest MAX_REPORTS reports are kept
+func TestReportsCap(t *testing.T) {
+	database := &failingPurger{MemoryDB: memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)}
+	database.Connect()
+	job := NewJob(database, models.RetentionPolicy{Default: 24 * time.Hour}, time.Hour)
+	var first, last models.PurgeReport
+	for i := 0; i < MAX_REPORTS + 5; i++ {
+		// tells the reports apart
+		database.fail = i == 5
+		report := job.Purge()
+		if i == 5 {
+			first = report
+		}
+		last = report
+	}
+	reports := job.Reports()
+	if len(reports) != MAX_REPORTS {
+		t.Fatalf("got %d reports, want %d", len(reports), MAX_REPORTS)
+	}
+	if !reports[0].Time.Equal(last.Time) || reports[MAX_REPORTS - 1].Error != first.Error || first.Error == "" {
+		t.Errorf("got %+v first and %+v last, want the latest first and the oldest kept last", reports[0], reports[MAX_REPORTS - 1])
+	}
+}
@@ -0,0 +1,142 @@
+package spool
+
+import (
+	"errors"
+	"log"
+	"owl_server/db"
+	"owl_server/models"
+	"sync"
+	"time"
+)
+
+// Periodically writes the records left pending in the spool (because the
+// database was unreachable, or the server restarted before saving them)
+// to the database.
+type Replayer struct {
+	spool *Spool
+	database db.DB
+	interval time.Duration
+	// tenant of the records spooled before tenants existed
+	defaultTenant string
+	// called with each record written successfully, may be nil
+	inserted func(tenant string, updates []models.Update)
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+// Creates a replayer draining the spool into the database every interval.
+// Records without a tenant are saved for defaultTenant.
+// inserted (if not nil) is called with the updates of each record once they are written.
+// Call Start to start it.
+func NewReplayer(spool *Spool, database db.DB, interval time.Duration, defaultTenant string, inserted func(tenant string, updates []models.Update)) *Replayer {
+	return &Replayer{
+		spool: spool,
+		database: database,
+		interval: interval,
+		defaultTenant: defaultTenant,
+		inserted: inserted,
+		stop: make(chan struct{}),
+	}
+}
+
+func (r *Replayer) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			r.replay()
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the replayer, waiting for the ongoing replay (if any) to finish
+func (r *Replayer) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// Writes pending records to the database, oldest first.
+// Records which can never be saved (see isPermanent) are moved to the
+// dead letter file of the spool. Stops at the first other failure: the
+// database is most likely unreachable, and will be retried at the next
+// tick, for as long as it takes.
+func (r *Replayer) replay() {
+	replayed := 0
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		record, attempts, err := r.spool.NextPending()
+		if err != nil {
+			log.Printf("unable to read the spool: %s", err)
+			return
+		}
+		if record == nil {
+			break
+		}
+
+		tenant := record.Tenant
+		if tenant == "" {
+			tenant = r.defaultTenant
+		}
+		err = validate(record.Updates)
+		if err == nil {
+			err = r.database.InsertUpdates(tenant, record.Updates)
+		}
+		if err != nil && isPermanent(err) {
+			record.Tenant = tenant
+			deadLetterErr := r.spool.DeadLetter(record, err)
+			if deadLetterErr != nil {
+				log.Printf("unable to move %d spooled updates which can't be saved (%s), will retry in %v: %s", len(record.Updates), err, r.interval, deadLetterErr)
+				r.spool.Release(record.ID)
+				return
+			}
+			log.Printf("moved %d spooled updates to the spool dead letters, they can't be saved: %s", len(record.Updates), err)
+			continue
+		}
+		if err != nil {
+			log.Printf("unable to replay spooled updates (%d failed attempts), will retry in %v: %s", attempts + 1, r.interval, err)
+			r.spool.Release(record.ID)
+			return
+		}
+		r.spool.Ack(record.ID)
+		if r.inserted != nil {
+			r.inserted(tenant, record.Updates)
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d spooled batches", replayed)
+	}
+}
+
+// Returns the first validation error of the updates. Updates are
+// validated before being spooled, but not by the versions of the
+// server which wrote the oldest records
+func validate(updates []models.Update) error {
+	for _, update := range updates {
+		err := update.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the error comes from the updates themselves, which
+// will never be saved however many times they are retried
+func isPermanent(err error) bool {
+	var validationError *models.ValidationError
+	return errors.Is(err, models.ErrUnknownUpdateType) || errors.As(err, &validationError)
+}
@@ -0,0 +1,148 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"owl_server/db"
+	"owl_server/db/memory"
+	"owl_server/models"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// In-memory database whose inserts fail with the given errors, in turn
+type failingDB struct {
+	db.DB
+	errors []error
+}
+
+func (f *failingDB) InsertUpdates(tenant string, updates []models.Update) error {
+	if len(f.errors) > 0 {
+		err := f.errors[0]
+		f.errors = f.errors[1:]
+		if err != nil {
+			return err
+		}
+	}
+	return f.DB.InsertUpdates(tenant, updates)
+}
+
+func TestReplay(t *testing.T) {
+	valid := testUpdates(1)[0]
+	invalid := []models.Update{{UpdateType: models.UPDATE_TYPE_END, EventName: "checkout", EventId: "event0", Timestamp: 800_000_000_000}}
+	tests := []struct {
+		name string
+		tenant string
+		updates []models.Update
+		// errors of the successive inserts, nil for the ones which succeed
+		errors []error
+		// number of replays
+		replays int
+		wantSaved bool
+		wantDeadLetters int
+		wantPending int
+	}{
+		{name: "saved", tenant: TEST_TENANT, updates: valid, replays: 1, wantSaved: true},
+		{name: "spooled before tenants", tenant: "", updates: valid, replays: 1, wantSaved: true},
+		{
+			name: "database down",
+			tenant: TEST_TENANT,
+			updates: valid,
+			errors: []error{fmt.Errorf("connection refused")},
+			replays: 1,
+			wantPending: 1,
+		},
+		{
+			// retried for as long as it takes
+			name: "database back",
+			tenant: TEST_TENANT,
+			updates: valid,
+			errors: []error{fmt.Errorf("connection refused"), fmt.Errorf("connection refused"), fmt.Errorf("timeout")},
+			replays: 4,
+			wantSaved: true,
+		},
+		{name: "invalid update", tenant: TEST_TENANT, updates: invalid, replays: 1, wantDeadLetters: 1},
+		{
+			name: "unknown update type",
+			tenant: TEST_TENANT,
+			updates: valid,
+			errors: []error{fmt.Errorf("update 0: %w: pause", models.ErrUnknownUpdateType)},
+			replays: 1,
+			wantDeadLetters: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, 1 << 20, 0)
+			if err != nil {
+				t.Fatalf("opening: %v", err)
+			}
+			defer s.Close()
+			id, err := s.Append(test.tenant, test.updates)
+			if err != nil {
+				t.Fatalf("appending: %v", err)
+			}
+			s.Release(id)
+
+			database := &failingDB{DB: memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS), errors: test.errors}
+			database.Connect()
+			insertedTenants := []string{}
+			replayer := NewReplayer(s, database, time.Minute, TEST_TENANT, func(tenant string, updates []models.Update) {
+				insertedTenants = append(insertedTenants, tenant)
+			})
+			for i := 0; i < test.replays; i++ {
+				replayer.replay()
+			}
+
+			event, err := database.GetEvent(TEST_TENANT, "checkout", "event0")
+			if err != nil {
+				t.Fatalf("reading the event: %v", err)
+			}
+			if saved := event != nil; saved != test.wantSaved {
+				t.Errorf("saved: got %v, want %v", saved, test.wantSaved)
+			}
+			if test.wantSaved && fmt.Sprint(insertedTenants) != fmt.Sprint([]string{TEST_TENANT}) {
+				t.Errorf("inserted callbacks: got %v, want one for %s", insertedTenants, TEST_TENANT)
+			}
+			stats := s.Stats()
+			if stats.PendingRecords != test.wantPending || stats.DeadLetters != test.wantDeadLetters {
+				t.Errorf("got %d pending records and %d dead letters, want %d and %d", stats.PendingRecords, stats.DeadLetters, test.wantPending, test.wantDeadLetters)
+			}
+			deadLetters := readDeadLetters(t, dir)
+			if len(deadLetters) != test.wantDeadLetters {
+				t.Fatalf("dead letter file: got %d lines, want %d", len(deadLetters), test.wantDeadLetters)
+			}
+			for _, deadLetter := range deadLetters {
+				if deadLetter.Tenant != TEST_TENANT || len(deadLetter.Updates) != len(test.updates) || deadLetter.Error == "" {
+					t.Errorf("dead letter: got %+v", deadLetter)
+				}
+			}
+		})
+	}
+}
+
+func readDeadLetters(t *testing.T, dir string) []DeadLetter {
+	file, err := os.Open(filepath.Join(dir, DEAD_LETTER_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("opening the dead letters: %v", err)
+	}
+	defer file.Close()
+	deadLetters := []DeadLetter{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var deadLetter DeadLetter
+		err = json.Unmarshal(scanner.Bytes(), &deadLetter)
+		if err != nil {
+			t.Fatalf("decoding a dead letter: %v", err)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters
+}
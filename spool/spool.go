@@ -0,0 +1,491 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"owl_server/models"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by Append when the spool already holds MaxBytes of updates
+var ErrSpoolFull = fmt.Errorf("spool is full")
+// Returned by Append once the spool is closed
+var ErrSpoolClosed = fmt.Errorf("spool is closed")
+
+const SEGMENT_EXTENSION = ".seg"
+// File of the spool directory where the records which can never be
+// saved are moved, one JSON DeadLetter per line
+const DEAD_LETTER_FILE = "dead_letters.jsonl"
+const ACK_EXTENSION = ".ack"
+// Size of the header preceding each record: payload length + CRC32 of the payload
+const RECORD_HEADER_SIZE = 8
+
+// On-disk, append-only log of update batches.
+//
+// Every batch posted to the server is appended to the spool (and synced
+// to disk) before being written to the database. Once a batch is saved
+// in the database it is acknowledged; batches that are never acknowledged
+// (database down, server crash, ...) are handed to the Replayer.
+//
+// The spool is made of segment files, named <sequence>.seg. Each record
+// of a segment is a batch of updates and its tenant encoded in JSON, preceded by its
+// length and CRC32 checksum. Indexes of the acknowledged records of a
+// segment are appended to <sequence>.ack. Segments are deleted once all
+// their records are acknowledged.
+type Spool struct {
+	dir string
+	maxSegmentBytes int64
+	maxBytes int64
+
+	lock sync.Mutex
+	// ordered by sequence. The last one is the one being appended to
+	segments []*segment
+	// total size of the segments
+	totalBytes int64
+	// records moved to the dead letter file since the spool was opened
+	deadLetters int
+	closed bool
+}
+
+// Identifies a record of the spool
+type RecordID struct {
+	Segment uint64
+	Index int
+}
+
+// A batch of updates read back from the spool
+type Record struct {
+	ID RecordID `json:"-"`
+	// empty for records written before tenants existed
+	Tenant string `json:"tenant"`
+	Updates []models.Update `json:"updates"`
+}
+
+// A record which can never be saved, as written to DEAD_LETTER_FILE
+type DeadLetter struct {
+	Tenant string `json:"tenant"`
+	Updates []models.Update `json:"updates"`
+	// why the record can't be saved
+	Error string `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// Snapshot of the spool metrics
+type Stats struct {
+	Segments int
+	Bytes int64
+	// records not acknowledged yet
+	PendingRecords int
+	// records moved to the dead letter file since the spool was opened
+	DeadLetters int
+}
+
+type segment struct {
+	sequence uint64
+	file *os.File
+	ackFile *os.File
+	size int64
+	records []*recordState
+	acked int
+}
+
+type recordState struct {
+	offset int64
+	length uint32
+	acked bool
+	// true while the record is being written to the database
+	// by someone (the ingestion queue or the replayer)
+	inFlight bool
+	// number of failed attempts to write the record
+	attempts int
+}
+
+// Opens the spool stored in the given directory, creating it if needed.
+// Records left unacknowledged by a previous run are kept, and will be
+// returned by NextPending.
+// A new segment is started at every opening; segments of previous runs
+// are only read.
+func Open(dir string, maxSegmentBytes int64, maxBytes int64) (*Spool, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create spool directory. Underlying error: %s", err)
+	}
+	s := &Spool{
+		dir: dir,
+		maxSegmentBytes: maxSegmentBytes,
+		maxBytes: maxBytes,
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sequences []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, SEGMENT_EXTENSION) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, SEGMENT_EXTENSION), 10, 64)
+		if err != nil {
+			log.Printf("ignoring unexpected file %s in the spool", name)
+			continue
+		}
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	var next uint64 = 1
+	for _, sequence := range sequences {
+		seg, err := s.loadSegment(sequence)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		next = sequence + 1
+		if seg.acked == len(seg.records) {
+			s.deleteSegment(seg)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.totalBytes += seg.size
+	}
+
+	err = s.startSegment(next)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Appends a batch of updates of the tenant to the spool and syncs it to disk.
+// The returned record is considered in flight: the caller is
+// responsible for calling Ack or Release once it is done with it.
+func (s *Spool) Append(tenant string, updates []models.Update) (RecordID, error) {
+	payload, err := json.Marshal(Record{Tenant: tenant, Updates: updates})
+	if err != nil {
+		return RecordID{}, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return RecordID{}, ErrSpoolClosed
+	}
+
+	// Rotating first deletes the active segment if all its records are
+	// acknowledged, which frees its space before the spool is found full
+	size := int64(RECORD_HEADER_SIZE + len(payload))
+	active := s.segments[len(s.segments) - 1]
+	if active.size > 0 && active.size + size > s.maxSegmentBytes {
+		err = s.startSegment(active.sequence + 1)
+		if err != nil {
+			return RecordID{}, err
+		}
+		active = s.segments[len(s.segments) - 1]
+	}
+
+	if s.maxBytes > 0 && s.totalBytes + size > s.maxBytes {
+		return RecordID{}, ErrSpoolFull
+	}
+
+	record := make([]byte, size)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[RECORD_HEADER_SIZE:], payload)
+
+	_, err = active.file.WriteAt(record, active.size)
+	if err == nil {
+		err = active.file.Sync()
+	}
+	if err != nil {
+		// Drop whatever was partially written, so the next record starts at a clean offset
+		active.file.Truncate(active.size)
+		return RecordID{}, fmt.Errorf("unable to write to the spool. Underlying error: %s", err)
+	}
+
+	active.records = append(active.records, &recordState{
+		offset: active.size,
+		length: uint32(len(payload)),
+		inFlight: true,
+	})
+	active.size += size
+	s.totalBytes += size
+	return RecordID{Segment: active.sequence, Index: len(active.records) - 1}, nil
+}
+
+// Marks the record as saved in the database.
+// Segments whose records are all acknowledged are deleted,
+// except the one being appended to.
+func (s *Spool) Ack(id RecordID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seg, record := s.find(id)
+	if record == nil || record.acked {
+		return
+	}
+	record.acked = true
+	record.inFlight = false
+	seg.acked++
+
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(id.Index))
+	_, err := seg.ackFile.Write(index[:])
+	if err != nil {
+		// Not fatal: the record will be replayed again after a restart
+		log.Printf("unable to persist spool acknowledgement: %s", err)
+	}
+
+	if seg.acked == len(seg.records) && seg != s.segments[len(s.segments) - 1] {
+		s.removeSegment(seg)
+	}
+}
+
+// Appends the record to the dead letter file (and syncs it to disk) with
+// the error which prevents saving it, then acknowledges it.
+// The record is left in flight if it can't be written.
+func (s *Spool) DeadLetter(record *Record, reason error) error {
+	line, err := json.Marshal(DeadLetter{Tenant: record.Tenant, Updates: record.Updates, Error: reason.Error(), FailedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	file, err := os.OpenFile(filepath.Join(s.dir, DEAD_LETTER_FILE), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err == nil {
+		_, err = file.Write(line)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+	}
+	if err != nil {
+		s.lock.Unlock()
+		return fmt.Errorf("unable to write to the spool dead letters. Underlying error: %s", err)
+	}
+	s.deadLetters++
+	s.lock.Unlock()
+
+	s.Ack(record.ID)
+	return nil
+}
+
+// Marks the record as not being written anymore, after a failed attempt,
+// so that NextPending returns it again.
+func (s *Spool) Release(id RecordID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, record := s.find(id)
+	if record == nil {
+		return
+	}
+	record.inFlight = false
+	record.attempts++
+}
+
+// Returns the oldest record that is neither acknowledged nor in flight,
+// and marks it in flight. Returns nil if there is none.
+// The second value is the number of failed attempts to write the record.
+func (s *Spool) NextPending() (*Record, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, seg := range s.segments {
+		for index, record := range seg.records {
+			if record.acked || record.inFlight {
+				continue
+			}
+			payload := make([]byte, record.length)
+			_, err := seg.file.ReadAt(payload, record.offset + RECORD_HEADER_SIZE)
+			if err != nil {
+				return nil, 0, err
+			}
+			var result Record
+			if len(payload) > 0 && payload[0] == '[' {
+				// written before tenants existed: just the updates
+				err = json.Unmarshal(payload, &result.Updates)
+			} else {
+				err = json.Unmarshal(payload, &result)
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			result.ID = RecordID{Segment: seg.sequence, Index: index}
+			record.inFlight = true
+			return &result, record.attempts, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// Returns a snapshot of the spool metrics
+func (s *Spool) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := Stats{Segments: len(s.segments), Bytes: s.totalBytes, DeadLetters: s.deadLetters}
+	for _, seg := range s.segments {
+		stats.PendingRecords += len(seg.records) - seg.acked
+	}
+	return stats
+}
+
+// Closes the segment files. Unacknowledged records stay on disk.
+// Append returns ErrSpoolClosed afterwards.
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+
+	for _, seg := range s.segments {
+		seg.close()
+	}
+	s.segments = nil
+	return nil
+}
+
+// Creates a new, empty segment and makes it the one being appended to.
+// The previous active segment is deleted if all its records are acknowledged.
+func (s *Spool) startSegment(sequence uint64) error {
+	file, err := os.OpenFile(s.segmentPath(sequence, SEGMENT_EXTENSION), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to create spool segment. Underlying error: %s", err)
+	}
+	ackFile, err := os.OpenFile(s.segmentPath(sequence, ACK_EXTENSION), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to create spool segment. Underlying error: %s", err)
+	}
+
+	if len(s.segments) > 0 {
+		previous := s.segments[len(s.segments) - 1]
+		if previous.acked == len(previous.records) {
+			s.removeSegment(previous)
+		}
+	}
+	s.segments = append(s.segments, &segment{sequence: sequence, file: file, ackFile: ackFile})
+	return nil
+}
+
+// Reads the records and acknowledgements of a segment written by a previous run.
+// Reading stops at the first truncated or corrupted record.
+func (s *Spool) loadSegment(sequence uint64) (*segment, error) {
+	file, err := os.OpenFile(s.segmentPath(sequence, SEGMENT_EXTENSION), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{sequence: sequence, file: file}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]byte, RECORD_HEADER_SIZE)
+	for {
+		_, err := file.ReadAt(header, seg.size)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("spool segment %d is truncated after %d records", sequence, len(seg.records))
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		// a corrupted length must not make us allocate more than the file holds
+		if seg.size + RECORD_HEADER_SIZE + int64(length) > info.Size() {
+			log.Printf("spool segment %d is corrupted after %d records", sequence, len(seg.records))
+			break
+		}
+		payload := make([]byte, length)
+		_, err = file.ReadAt(payload, seg.size + RECORD_HEADER_SIZE)
+		if err != nil || crc32.ChecksumIEEE(payload) != checksum {
+			log.Printf("spool segment %d is corrupted after %d records", sequence, len(seg.records))
+			break
+		}
+		seg.records = append(seg.records, &recordState{offset: seg.size, length: length})
+		seg.size += int64(RECORD_HEADER_SIZE + length)
+	}
+
+	acks, err := os.ReadFile(s.segmentPath(sequence, ACK_EXTENSION))
+	if err != nil && !os.IsNotExist(err) {
+		file.Close()
+		return nil, err
+	}
+	for i := 0; i + 4 <= len(acks); i += 4 {
+		index := int(binary.BigEndian.Uint32(acks[i : i + 4]))
+		if index < len(seg.records) && !seg.records[index].acked {
+			seg.records[index].acked = true
+			seg.acked++
+		}
+	}
+
+	seg.ackFile, err = os.OpenFile(s.segmentPath(sequence, ACK_EXTENSION), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (s *Spool) find(id RecordID) (*segment, *recordState) {
+	for _, seg := range s.segments {
+		if seg.sequence == id.Segment {
+			if id.Index < 0 || id.Index >= len(seg.records) {
+				return seg, nil
+			}
+			return seg, seg.records[id.Index]
+		}
+	}
+	return nil, nil
+}
+
+// Removes the segment from the spool and deletes its files
+func (s *Spool) removeSegment(seg *segment) {
+	for i, other := range s.segments {
+		if other == seg {
+			s.segments = append(s.segments[:i], s.segments[i + 1:]...)
+			s.totalBytes -= seg.size
+			break
+		}
+	}
+	s.deleteSegment(seg)
+}
+
+func (s *Spool) deleteSegment(seg *segment) {
+	seg.close()
+	for _, extension := range []string{SEGMENT_EXTENSION, ACK_EXTENSION} {
+		err := os.Remove(s.segmentPath(seg.sequence, extension))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("unable to delete spool segment %d: %s", seg.sequence, err)
+		}
+	}
+}
+
+func (s *Spool) segmentPath(sequence uint64, extension string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", sequence, extension))
+}
+
+func (seg *segment) close() {
+	if seg.file != nil {
+		seg.file.Close()
+	}
+	if seg.ackFile != nil {
+		seg.ackFile.Close()
+	}
+}
@@ -0,0 +1,300 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"owl_server/models"
+	"path/filepath"
+	"testing"
+)
+
+const TEST_TENANT = "acme"
+
+// Returns n valid updates of an event, distinguished by their event ID
+func testUpdates(n int) [][]models.Update {
+	batches := [][]models.Update{}
+	for i := 0; i < n; i++ {
+		batches = append(batches, []models.Update{{
+			UpdateType: models.UPDATE_TYPE_START,
+			EventName: "checkout",
+			EventId: fmt.Sprintf("event%d", i),
+			Timestamp: 800_000_000_000 + int64(i),
+		}})
+	}
+	return batches
+}
+
+// Size of the record of the batch in a segment
+func recordSize(t *testing.T, updates []models.Update) int64 {
+	payload, err := json.Marshal(Record{Tenant: TEST_TENANT, Updates: updates})
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	return int64(RECORD_HEADER_SIZE + len(payload))
+}
+
+// Returns the event IDs of the pending records, oldest first
+func drain(t *testing.T, s *Spool) []string {
+	ids := []string{}
+	for {
+		record, _, err := s.NextPending()
+		if err != nil {
+			t.Fatalf("reading the spool: %v", err)
+		}
+		if record == nil {
+			return ids
+		}
+		if record.Tenant != TEST_TENANT {
+			t.Errorf("tenant: got %q, want %q", record.Tenant, TEST_TENANT)
+		}
+		ids = append(ids, record.Updates[0].EventId)
+	}
+}
+
+// Records left by a previous run are read back, up to the first
+// truncated or corrupted one, without the acknowledged ones
+func TestRecovery(t *testing.T) {
+	batches := testUpdates(3)
+	tests := []struct {
+		name string
+		// indexes of the records acknowledged before the restart
+		acked []int
+		// damages the segment, given the offsets of its records
+		damage func(t *testing.T, path string, offsets []int64)
+		want []string
+		wantSegments int
+	}{
+		{
+			name: "clean",
+			acked: []int{0},
+			want: []string{"event1", "event2"},
+			wantSegments: 2,
+		},
+		{
+			name: "truncated last record",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				info, _ := os.Stat(path)
+				truncate(t, path, info.Size() - 3)
+			},
+			want: []string{"event0", "event1"},
+			wantSegments: 2,
+		},
+		{
+			name: "truncated header",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				truncate(t, path, offsets[2] + 4)
+			},
+			want: []string{"event0", "event1"},
+			wantSegments: 2,
+		},
+		{
+			name: "corrupted record",
+			acked: []int{0},
+			damage: func(t *testing.T, path string, offsets []int64) {
+				flipByte(t, path, offsets[1] + RECORD_HEADER_SIZE + 2)
+			},
+			// the records after the corrupted one are lost too
+			want: []string{},
+			wantSegments: 1,
+		},
+		{
+			// rejected without allocating the length read from the header
+			name: "corrupted length",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				flipByte(t, path, offsets[1])
+			},
+			want: []string{"event0"},
+			wantSegments: 2,
+		},
+		{
+			name: "all acknowledged",
+			acked: []int{0, 1, 2},
+			want: []string{},
+			wantSegments: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, 1 << 20, 0)
+			if err != nil {
+				t.Fatalf("opening: %v", err)
+			}
+			offsets := []int64{}
+			var offset int64
+			for _, batch := range batches {
+				id, err := s.Append(TEST_TENANT, batch)
+				if err != nil {
+					t.Fatalf("appending: %v", err)
+				}
+				offsets = append(offsets, offset)
+				offset += recordSize(t, batch)
+				s.Release(id)
+			}
+			for _, index := range test.acked {
+				s.Ack(RecordID{Segment: 1, Index: index})
+			}
+			s.Close()
+			if test.damage != nil {
+				test.damage(t, filepath.Join(dir, fmt.Sprintf("%020d%s", 1, SEGMENT_EXTENSION)), offsets)
+			}
+
+			s, err = Open(dir, 1 << 20, 0)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer s.Close()
+			got := drain(t, s)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("pending records: got %v, want %v", got, test.want)
+			}
+			if stats := s.Stats(); stats.Segments != test.wantSegments {
+				t.Errorf("segments: got %d, want %d", stats.Segments, test.wantSegments)
+			}
+		})
+	}
+}
+
+// Segments are rotated when full, and deleted once all their
+// records are acknowledged
+func TestSegments(t *testing.T) {
+	batches := testUpdates(4)
+	tests := []struct {
+		name string
+		acked []int
+		wantSegments int
+		wantPending int
+	}{
+		{name: "none acknowledged", acked: []int{}, wantSegments: 4, wantPending: 4},
+		{name: "oldest acknowledged", acked: []int{0, 1}, wantSegments: 2, wantPending: 2},
+		{name: "out of order", acked: []int{2, 1}, wantSegments: 2, wantPending: 2},
+		// the active segment is kept
+		{name: "all acknowledged", acked: []int{0, 1, 2, 3}, wantSegments: 1, wantPending: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// one record per segment
+			s, err := Open(t.TempDir(), recordSize(t, batches[0]), 0)
+			if err != nil {
+				t.Fatalf("opening: %v", err)
+			}
+			defer s.Close()
+			ids := []RecordID{}
+			for _, batch := range batches {
+				id, err := s.Append(TEST_TENANT, batch)
+				if err != nil {
+					t.Fatalf("appending: %v", err)
+				}
+				ids = append(ids, id)
+			}
+			for _, index := range test.acked {
+				s.Ack(ids[index])
+			}
+			stats := s.Stats()
+			if stats.Segments != test.wantSegments || stats.PendingRecords != test.wantPending {
+				t.Errorf("got %d segments and %d pending records, want %d and %d", stats.Segments, stats.PendingRecords, test.wantSegments, test.wantPending)
+			}
+		})
+	}
+}
+
+// Appending beyond the maximum size of the spool fails
+func TestSpoolFull(t *testing.T) {
+	batches := testUpdates(2)
+	s, err := Open(t.TempDir(), 1 << 20, recordSize(t, batches[0]) + 1)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	defer s.Close()
+	id, err := s.Append(TEST_TENANT, batches[0])
+	if err != nil {
+		t.Fatalf("appending: %v", err)
+	}
+	_, err = s.Append(TEST_TENANT, batches[1])
+	if err != ErrSpoolFull {
+		t.Errorf("got %v, want ErrSpoolFull", err)
+	}
+	// acknowledged records free their space once their segment is deleted
+	s.Close()
+	s, err = Open(s.dir, 1 << 20, recordSize(t, batches[0]) + 1)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer s.Close()
+	record, _, _ := s.NextPending()
+	if record == nil || record.ID != id {
+		t.Fatalf("got %v, want the record %v", record, id)
+	}
+	s.Ack(record.ID)
+	_, err = s.Append(TEST_TENANT, batches[1])
+	if err != nil {
+		t.Errorf("appending after the acknowledgement: %v", err)
+	}
+}
+
+// The active segment whose records are all acknowledged is rotated,
+// which frees its space, instead of keeping the spool full
+func TestFullActiveSegment(t *testing.T) {
+	batches := testUpdates(3)
+	size := recordSize(t, batches[0])
+	s, err := Open(t.TempDir(), 2 * size, 2 * size)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	defer s.Close()
+	for _, batch := range batches[:2] {
+		id, err := s.Append(TEST_TENANT, batch)
+		if err != nil {
+			t.Fatalf("appending: %v", err)
+		}
+		s.Ack(id)
+	}
+	_, err = s.Append(TEST_TENANT, batches[2])
+	if err != nil {
+		t.Fatalf("appending to the full spool of acknowledged records: %v", err)
+	}
+	if stats := s.Stats(); stats.Segments != 1 || stats.Bytes != size {
+		t.Errorf("got %d segments of %d bytes, want the new one only", stats.Segments, stats.Bytes)
+	}
+}
+
+// Updates received while the server stops are refused, and the records
+// in flight can still be released
+func TestClosed(t *testing.T) {
+	batches := testUpdates(2)
+	s, err := Open(t.TempDir(), 1 << 20, 0)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	id, err := s.Append(TEST_TENANT, batches[0])
+	if err != nil {
+		t.Fatalf("appending: %v", err)
+	}
+	s.Close()
+	_, err = s.Append(TEST_TENANT, batches[1])
+	if err != ErrSpoolClosed {
+		t.Errorf("got %v, want ErrSpoolClosed", err)
+	}
+	s.Release(id)
+	s.Ack(id)
+}
+
+func truncate(t *testing.T, path string, size int64) {
+	err := os.Truncate(path, size)
+	if err != nil {
+		t.Fatalf("truncating: %v", err)
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	content[offset] ^= 0xff
+	err = os.WriteFile(path, content, 0o644)
+	if err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package tenants
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"owl_server/models"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Prefix of every API key, to make them easy to recognize (e.g. in leaked logs)
+const API_KEY_PREFIX = "owl_"
+
+// Returned by Revoke when there is no key with the given ID
+var ErrKeyNotFound = fmt.Errorf("api key not found")
+
+// An API key, as stored. The key itself is never stored, only its hash:
+// it is returned once, by Issue.
+type APIKey struct {
+	// public identifier of the key, used to revoke it
+	ID string `json:"id"`
+	Tenant string `json:"tenant"`
+	Description string `json:"description"`
+	// hex encoded SHA-256 of the key
+	Hash string `json:"hash"`
+	CreatedAt time.Time `json:"createdAt"`
+	// nil while the key is valid
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Stores the API keys of the tenants in a JSON file.
+// Every change is written to the file right away.
+type KeyStore struct {
+	path string
+
+	lock sync.RWMutex
+	// ID -> key
+	keys map[string]*APIKey
+	// hash -> key, for the valid keys only
+	byHash map[string]*APIKey
+}
+
+// Opens the key store saved in the given file.
+// The file is created on the first issued key.
+func OpenKeyStore(path string) (*KeyStore, error) {
+	store := &KeyStore{
+		path: path,
+		keys: map[string]*APIKey{},
+		byHash: map[string]*APIKey{},
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the api keys. Underlying error: %s", err)
+	}
+	var keys []*APIKey
+	err = json.Unmarshal(content, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the api keys file %s. Underlying error: %s", path, err)
+	}
+	for _, key := range keys {
+		store.keys[key.ID] = key
+		if key.RevokedAt == nil {
+			store.byHash[key.Hash] = key
+		}
+	}
+	return store, nil
+}
+
+// Creates a new API key for the tenant.
+// Returns the key, which can't be retrieved later, and its stored version.
+func (s *KeyStore) Issue(tenant string, description string) (string, APIKey, error) {
+	if !models.TENANT_PATTERN.MatchString(tenant) {
+		return "", APIKey{}, fmt.Errorf("invalid tenant %q, must match %s", tenant, models.TENANT_PATTERN)
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	id, err := randomString(9)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	key := API_KEY_PREFIX + secret
+	apiKey := &APIKey{
+		ID: id,
+		Tenant: tenant,
+		Description: description,
+		Hash: hash(key),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys[apiKey.ID] = apiKey
+	s.byHash[apiKey.Hash] = apiKey
+	err = s.save()
+	if err != nil {
+		delete(s.keys, apiKey.ID)
+		delete(s.byHash, apiKey.Hash)
+		return "", APIKey{}, err
+	}
+	return key, *apiKey, nil
+}
+
+// Revokes the key with the given ID. Revoking a revoked key does nothing.
+func (s *KeyStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	apiKey, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if apiKey.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	apiKey.RevokedAt = &now
+	delete(s.byHash, apiKey.Hash)
+	err := s.save()
+	if err != nil {
+		apiKey.RevokedAt = nil
+		s.byHash[apiKey.Hash] = apiKey
+	}
+	return err
+}
+
+// Returns every key (including revoked ones), oldest first
+func (s *KeyStore) List() []APIKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := []APIKey{}
+	for _, apiKey := range s.keys {
+		keys = append(keys, *apiKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Returns the tenant owning the key.
+// Returns false if the key doesn't exist or was revoked.
+func (s *KeyStore) Lookup(key string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	apiKey, ok := s.byHash[hash(key)]
+	if !ok {
+		return "", false
+	}
+	return apiKey.Tenant, true
+}
+
+// Writes the keys to the file, atomically. Must be called with the lock held.
+func (s *KeyStore) save() error {
+	keys := []*APIKey{}
+	for _, apiKey := range s.keys {
+		keys = append(keys, apiKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	content, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, content, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to save the api keys. Underlying error: %s", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns a random URL-safe string encoding the given number of random bytes
+func randomString(bytes int) (string, error) {
+	buffer := make([]byte, bytes)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
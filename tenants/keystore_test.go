@@ -0,0 +1,162 @@
+package tenants
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIssue(t *testing.T) {
+	tests := []struct {
+		tenant string
+		wantErr bool
+	}{
+		{tenant: "acme"},
+		{tenant: "acme_2"},
+		{tenant: strings.Repeat("a", 64)},
+		{tenant: "", wantErr: true},
+		{tenant: strings.Repeat("a", 65), wantErr: true},
+		// tenants name database collections and prefix database IDs
+		{tenant: "ac-me", wantErr: true},
+		{tenant: "ac.me", wantErr: true},
+		{tenant: "acme corp", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.tenant, func(t *testing.T) {
+			store, err := OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+			if err != nil {
+				t.Fatalf("opening: %v", err)
+			}
+			key, apiKey, err := store.Issue(test.tenant, "ci")
+			if test.wantErr {
+				if err == nil || len(store.List()) != 0 {
+					t.Errorf("got %v and %d keys, want an error and no key", err, len(store.List()))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("issuing: %v", err)
+			}
+			if !strings.HasPrefix(key, API_KEY_PREFIX) || apiKey.Tenant != test.tenant || apiKey.Description != "ci" {
+				t.Errorf("got %q, %+v", key, apiKey)
+			}
+			tenant, ok := store.Lookup(key)
+			if !ok || tenant != test.tenant {
+				t.Errorf("lookup: got %q, %v, want %q", tenant, ok, test.tenant)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	store, err := OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	acmeKey, _, _ := store.Issue("acme", "")
+	globexKey, _, _ := store.Issue("globex", "")
+	revokedKey, revoked, _ := store.Issue("acme", "leaked")
+	err = store.Revoke(revoked.ID)
+	if err != nil {
+		t.Fatalf("revoking: %v", err)
+	}
+	tests := []struct {
+		name string
+		key string
+		wantTenant string
+		wantOk bool
+	}{
+		{name: "acme", key: acmeKey, wantTenant: "acme", wantOk: true},
+		{name: "globex", key: globexKey, wantTenant: "globex", wantOk: true},
+		{name: "revoked", key: revokedKey},
+		{name: "unknown", key: API_KEY_PREFIX + "unknown"},
+		{name: "empty", key: ""},
+	}
+	for _, test := range tests {
+		tenant, ok := store.Lookup(test.key)
+		if tenant != test.wantTenant || ok != test.wantOk {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, tenant, ok, test.wantTenant, test.wantOk)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	store, err := OpenKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	_, apiKey, _ := store.Issue("acme", "")
+	tests := []struct {
+		name string
+		id string
+		wantErr error
+	}{
+		{name: "valid key", id: apiKey.ID},
+		// revoking a revoked key does nothing
+		{name: "revoked key", id: apiKey.ID},
+		{name: "unknown key", id: "unknown", wantErr: ErrKeyNotFound},
+	}
+	for _, test := range tests {
+		err := store.Revoke(test.id)
+		if err != test.wantErr {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+	keys := store.List()
+	if len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("got %+v, want the revoked key", keys)
+	}
+}
+
+// Keys survive a restart, and only their hashes are written to the file
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants", "keys.json")
+	store, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	validKey, valid, _ := store.Issue("acme", "ci")
+	revokedKey, revoked, _ := store.Issue("globex", "")
+	store.Revoke(revoked.ID)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading the file: %v", err)
+	}
+	for _, key := range []string{validKey, revokedKey} {
+		if strings.Contains(string(content), strings.TrimPrefix(key, API_KEY_PREFIX)) {
+			t.Errorf("the key %q is written to the file", key)
+		}
+	}
+	if !strings.Contains(string(content), hash(validKey)) {
+		t.Errorf("the hash of the key isn't written to the file")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("file permissions: got %v, want 0600", info.Mode().Perm())
+	}
+
+	reopened, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	if tenant, ok := reopened.Lookup(validKey); !ok || tenant != "acme" {
+		t.Errorf("valid key: got %q, %v", tenant, ok)
+	}
+	if _, ok := reopened.Lookup(revokedKey); ok {
+		t.Errorf("revoked key accepted after reopening")
+	}
+	keys := reopened.List()
+	if len(keys) != 2 || keys[0].ID != valid.ID || keys[1].RevokedAt == nil {
+		t.Errorf("got %+v, want the 2 keys, oldest first", keys)
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte("{"), 0o600)
+	_, err := OpenKeyStore(path)
+	if err == nil || !strings.Contains(err.Error(), "unable to parse the api keys file") {
+		t.Errorf("got %v, want a parsing error", err)
+	}
+}
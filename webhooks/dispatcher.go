@@ -0,0 +1,442 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"owl_server/auth"
+	"owl_server/config"
+	"owl_server/db"
+	"owl_server/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ID of the delivery, the same in every attempt
+const DELIVERY_HEADER = "X-Owl-Delivery"
+const SUBSCRIPTION_HEADER = "X-Owl-Subscription"
+
+// Maximum number of events whose delivered end update is remembered
+const MAX_REMEMBERED_ENDS = 100_000
+
+// Returned by Retry and Discard when there is no dead letter with the given ID
+var ErrDeadLetterNotFound = fmt.Errorf("dead letter not found")
+
+// Delivers the events receiving their end update to the webhooks of the
+// subscriptions they match.
+//
+// Each delivery reads the event once its end update is saved, and POSTs it
+// to the webhook, signed with the secret of the subscription. Failed
+// attempts are retried with an exponential backoff, then the delivery is
+// saved as a dead letter, which can be retried by hand.
+//
+// An end update is only delivered if it changes the result of the event,
+// as decided by the merge policy, compared to the last end update delivered
+// for the event: end updates saved again (e.g. replayed from the spool) and
+// the ones the merge policy discarded aren't delivered twice.
+type Dispatcher struct {
+	database db.DB
+	subscriptions []models.WebhookSubscription
+	mergePolicy models.MergePolicy
+	client *http.Client
+	maxAttempts int
+	initialBackoff time.Duration
+	maxBackoff time.Duration
+	maxPending int
+	deadLetterPath string
+	maxDeadLetters int
+
+	lock sync.Mutex
+	// deliveries in progress, or waiting for a retry
+	pending int
+	// oldest first
+	deadLetters []models.DeadLetter
+	// last end update delivered for each event, and the events in the
+	// order they were added, to forget the oldest ones
+	ended map[eventKey]endVersion
+	endedOrder []eventKey
+	stats Stats
+	stopped bool
+
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+// Counters of the dispatcher since the server started
+type Stats struct {
+	Deliveries int64
+	FailedAttempts int64
+	DeadLetters int64
+	// dead letters dropped because there were more than the maximum
+	DroppedDeadLetters int64
+	// end updates not delivered because they don't change the result
+	SkippedEnds int64
+	Pending int64
+}
+
+// A delivery of an event to the webhook of a subscription
+type delivery struct {
+	id string
+	subscription models.WebhookSubscription
+	tenant string
+	eventName string
+	eventId string
+}
+
+// Identifies an event of a tenant
+type eventKey struct {
+	tenant string
+	eventName string
+	eventId string
+}
+
+// Version and result of an end update, compared by the merge policy
+type endVersion struct {
+	version int64
+	result string
+}
+
+// Body of the deliveries POSTed to the webhooks
+type payload struct {
+	DeliveryID string `json:"deliveryId"`
+	Subscription string `json:"subscription"`
+	Tenant string `json:"tenant"`
+	// starts at 1, and again at 1 when a dead letter is retried
+	Attempt int `json:"attempt"`
+	Event *models.Event `json:"event"`
+}
+
+// Creates a dispatcher delivering the events of the (already connected)
+// database to the subscriptions, restoring the dead letters saved in
+// the dead letter file. The merge policy is the one of the database.
+func NewDispatcher(database db.DB, subscriptions []models.WebhookSubscription, mergePolicy models.MergePolicy, cfg config.WebhooksConfig) (*Dispatcher, error) {
+	deadLetters, err := loadDeadLetters(cfg.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Dispatcher{
+		database: database,
+		subscriptions: subscriptions,
+		mergePolicy: mergePolicy,
+		client: &http.Client{Timeout: cfg.Timeout.Duration()},
+		maxAttempts: cfg.MaxAttempts,
+		initialBackoff: cfg.InitialBackoff.Duration(),
+		maxBackoff: cfg.MaxBackoff.Duration(),
+		maxPending: cfg.MaxPending,
+		deadLetterPath: cfg.DeadLetterFile,
+		maxDeadLetters: cfg.MaxDeadLetters,
+		deadLetters: deadLetters,
+		ended: map[eventKey]endVersion{},
+		stop: make(chan struct{}),
+	}, nil
+}
+
+// Starts the deliveries of the events whose end update is among the
+// updates of the tenant, once they are saved in the database.
+// Only the end updates changing the result of their event are delivered.
+func (d *Dispatcher) Inserted(tenant string, updates []models.Update) {
+	// the end update of each event which wins in the batch, in order
+	ends := map[eventKey]endVersion{}
+	keys := []eventKey{}
+	for _, update := range updates {
+		if update.UpdateType != models.UPDATE_TYPE_END {
+			continue
+		}
+		key := eventKey{tenant: tenant, eventName: update.EventName, eventId: update.EventId}
+		end := endVersion{version: update.Version(), result: update.Result}
+		current, seen := ends[key]
+		if !seen {
+			keys = append(keys, key)
+		}
+		if !seen || models.Overrides(d.mergePolicy, end.version, end.result, current.version, current.result) {
+			ends[key] = end
+		}
+	}
+
+	for _, key := range keys {
+		end := ends[key]
+		if !d.remember(key, end) {
+			continue
+		}
+		for _, subscription := range d.subscriptions {
+			if !subscription.Watches(tenant, key.eventName) {
+				continue
+			}
+			id := deliveryID(subscription.Name, key, end)
+			d.start(delivery{id: id, subscription: subscription, tenant: tenant, eventName: key.eventName, eventId: key.eventId}, 0)
+		}
+	}
+}
+
+// Remembers the end update as the last one delivered for the event, and
+// returns true, unless the last one delivered wins over it (or is the same)
+func (d *Dispatcher) remember(key eventKey, end endVersion) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	current, seen := d.ended[key]
+	if seen && !models.Overrides(d.mergePolicy, end.version, end.result, current.version, current.result) {
+		d.stats.SkippedEnds++
+		return false
+	}
+	if !seen {
+		d.endedOrder = append(d.endedOrder, key)
+		if len(d.endedOrder) > MAX_REMEMBERED_ENDS {
+			delete(d.ended, d.endedOrder[0])
+			d.endedOrder = d.endedOrder[1:]
+		}
+	}
+	d.ended[key] = end
+	return true
+}
+
+// Stops retrying the deliveries, saving the ones waiting for a retry as
+// dead letters, and waits for the ongoing attempts to finish
+func (d *Dispatcher) Stop() {
+	d.lock.Lock()
+	d.stopped = true
+	d.lock.Unlock()
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// Returns the dead letters, oldest first
+func (d *Dispatcher) DeadLetters() []models.DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]models.DeadLetter{}, d.deadLetters...)
+}
+
+// Removes the dead letter, and delivers its event again
+func (d *Dispatcher) Retry(id string) error {
+	d.lock.Lock()
+	deadLetter, ok := d.find(id)
+	if !ok {
+		d.lock.Unlock()
+		return ErrDeadLetterNotFound
+	}
+	var subscription *models.WebhookSubscription
+	for i := range d.subscriptions {
+		if d.subscriptions[i].Name == deadLetter.Subscription {
+			subscription = &d.subscriptions[i]
+		}
+	}
+	if subscription == nil {
+		d.lock.Unlock()
+		return fmt.Errorf("the %s subscription doesn't exist anymore, discard the dead letter instead", deadLetter.Subscription)
+	}
+	err := d.remove(id)
+	d.lock.Unlock()
+	if err != nil {
+		log.Printf("unable to save the dead letters: %s", err)
+	}
+
+	d.start(delivery{id: deadLetter.ID, subscription: *subscription, tenant: deadLetter.Tenant, eventName: deadLetter.EventName, eventId: deadLetter.EventId}, 0)
+	return nil
+}
+
+// Removes the dead letter without delivering its event.
+// Returns an error if the remaining dead letters can't be saved.
+func (d *Dispatcher) Discard(id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.find(id); !ok {
+		return ErrDeadLetterNotFound
+	}
+	err := d.remove(id)
+	if err != nil {
+		return fmt.Errorf("unable to save the dead letters. Underlying error: %w", err)
+	}
+	return nil
+}
+
+func (d *Dispatcher) Stats() Stats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stats := d.stats
+	stats.Pending = int64(d.pending)
+	return stats
+}
+
+// Runs the delivery in the background, unless too many are in progress
+func (d *Dispatcher) start(del delivery, attempts int) {
+	d.lock.Lock()
+	if d.stopped || d.pending >= d.maxPending {
+		reason := "too many deliveries in progress"
+		if d.stopped {
+			reason = "the server was stopping"
+		}
+		d.lock.Unlock()
+		d.deadLetter(del, attempts, reason)
+		return
+	}
+	d.pending++
+	d.wg.Add(1)
+	d.lock.Unlock()
+
+	go func() {
+		defer d.wg.Done()
+		d.deliver(del, attempts)
+		d.lock.Lock()
+		d.pending--
+		d.lock.Unlock()
+	}()
+}
+
+// Attempts the delivery until it succeeds, or was attempted
+// maxAttempts times
+func (d *Dispatcher) deliver(del delivery, attempts int) {
+	for {
+		attempts++
+		err := d.attempt(del, attempts)
+		if err == nil {
+			return
+		}
+		d.lock.Lock()
+		d.stats.FailedAttempts++
+		d.lock.Unlock()
+		if attempts >= d.maxAttempts {
+			d.deadLetter(del, attempts, err.Error())
+			return
+		}
+		select {
+		case <-time.After(d.backoff(attempts)):
+		case <-d.stop:
+			d.deadLetter(del, attempts, fmt.Sprintf("the server stopped before the delivery succeeded: %s", err))
+			return
+		}
+	}
+}
+
+// Reads the event and POSTs it to the webhook. Events which don't match
+// the subscription (or don't exist anymore) aren't delivered
+func (d *Dispatcher) attempt(del delivery, attempt int) error {
+	event, err := d.database.GetEvent(del.tenant, del.eventName, del.eventId)
+	if err != nil {
+		return fmt.Errorf("unable to read the event. Underlying error: %w", err)
+	}
+	if event == nil || !del.subscription.Matches(del.tenant, event) {
+		return nil
+	}
+	body, err := json.Marshal(payload{
+		DeliveryID: del.id,
+		Subscription: del.subscription.Name,
+		Tenant: del.tenant,
+		Attempt: attempt,
+		Event: event,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, del.subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(DELIVERY_HEADER, del.id)
+	request.Header.Set(SUBSCRIPTION_HEADER, del.subscription.Name)
+	if del.subscription.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(auth.TIMESTAMP_HEADER, timestamp)
+		request.Header.Set(auth.SIGNATURE_HEADER, "sha256=" + sign(del.subscription.Secret, timestamp, body))
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64 << 10))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("the webhook answered %s", response.Status)
+	}
+
+	d.lock.Lock()
+	d.stats.Deliveries++
+	d.lock.Unlock()
+	return nil
+}
+
+// Returns the wait before the retry following the given number of attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.initialBackoff
+	for i := 1; i < attempts && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.maxBackoff)
+}
+
+// Saves the failed delivery, dropping the oldest dead letters beyond the maximum
+func (d *Dispatcher) deadLetter(del delivery, attempts int, reason string) {
+	log.Printf("unable to deliver %s/%s to the %s webhook after %d attempts, saved as dead letter %s: %s", del.eventName, del.eventId, del.subscription.Name, attempts, del.id, reason)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.deadLetters = append(d.deadLetters, models.DeadLetter{
+		ID: del.id,
+		Subscription: del.subscription.Name,
+		Tenant: del.tenant,
+		EventName: del.eventName,
+		EventId: del.eventId,
+		Attempts: attempts,
+		LastError: reason,
+		FailedAt: time.Now(),
+	})
+	d.stats.DeadLetters++
+	if dropped := len(d.deadLetters) - d.maxDeadLetters; dropped > 0 {
+		d.deadLetters = d.deadLetters[dropped:]
+		d.stats.DroppedDeadLetters += int64(dropped)
+	}
+	err := saveDeadLetters(d.deadLetterPath, d.deadLetters)
+	if err != nil {
+		log.Printf("unable to save the dead letters: %s", err)
+	}
+}
+
+// Must be called with the lock held
+func (d *Dispatcher) find(id string) (models.DeadLetter, bool) {
+	for _, deadLetter := range d.deadLetters {
+		if deadLetter.ID == id {
+			return deadLetter, true
+		}
+	}
+	return models.DeadLetter{}, false
+}
+
+// Removes the dead letter and saves the others. Must be called with the lock held
+func (d *Dispatcher) remove(id string) error {
+	for i, deadLetter := range d.deadLetters {
+		if deadLetter.ID == id {
+			d.deadLetters = append(d.deadLetters[:i:i], d.deadLetters[i + 1:]...)
+			return saveDeadLetters(d.deadLetterPath, d.deadLetters)
+		}
+	}
+	return nil
+}
+
+// Returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>",
+// as checked by auth.HMACAuthenticator
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the ID of the delivery of the end update to the subscription.
+// The same end update always gets the same ID, even after a restart,
+// so that webhooks can recognize the deliveries they already received.
+func deliveryID(subscription string, key eventKey, end endVersion) string {
+	hash := sha256.New()
+	for _, field := range []string{subscription, key.tenant, key.eventName, key.eventId, strconv.FormatInt(end.version, 10), end.result} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
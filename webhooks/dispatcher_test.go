@@ -0,0 +1,384 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"owl_server/auth"
+	"owl_server/config"
+	"owl_server/db/memory"
+	"owl_server/models"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_TENANT = "acme"
+
+// Webhook answering the given statuses in turn, then 200
+type testWebhook struct {
+	server *httptest.Server
+	lock sync.Mutex
+	statuses []int
+	// deliveries received, including the failed attempts
+	received []payload
+	headers []http.Header
+	bodies [][]byte
+}
+
+func newTestWebhook(t *testing.T, statuses ...int) *testWebhook {
+	webhook := &testWebhook{statuses: statuses}
+	webhook.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var delivery payload
+		json.Unmarshal(body, &delivery)
+		webhook.lock.Lock()
+		defer webhook.lock.Unlock()
+		webhook.received = append(webhook.received, delivery)
+		webhook.headers = append(webhook.headers, r.Header)
+		webhook.bodies = append(webhook.bodies, body)
+		status := http.StatusOK
+		if len(webhook.statuses) > 0 {
+			status, webhook.statuses = webhook.statuses[0], webhook.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(webhook.server.Close)
+	return webhook
+}
+
+func (w *testWebhook) setStatuses(statuses ...int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.statuses = statuses
+}
+
+func (w *testWebhook) deliveries() []payload {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]payload{}, w.received...)
+}
+
+// Configuration retrying quickly, saving the dead letters in a temporary directory
+func testConfig(t *testing.T) config.WebhooksConfig {
+	return config.WebhooksConfig{
+		Timeout: config.Duration(time.Second),
+		MaxAttempts: 3,
+		InitialBackoff: config.Duration(time.Millisecond),
+		MaxBackoff: config.Duration(4 * time.Millisecond),
+		MaxPending: 100,
+		DeadLetterFile: filepath.Join(t.TempDir(), "dead-letters.json"),
+		MaxDeadLetters: 10,
+	}
+}
+
+func newTestDispatcher(t *testing.T, database *memory.MemoryDB, subscription models.WebhookSubscription, cfg config.WebhooksConfig) *Dispatcher {
+	dispatcher, err := NewDispatcher(database, []models.WebhookSubscription{subscription}, models.MERGE_LAST_WRITER_WINS, cfg)
+	if err != nil {
+		t.Fatalf("creating the dispatcher: %v", err)
+	}
+	return dispatcher
+}
+
+// Saves the updates, then hands them to the dispatcher as the ingestion does
+func insert(t *testing.T, database *memory.MemoryDB, dispatcher *Dispatcher, updates ...models.Update) {
+	t.Helper()
+	err := database.InsertUpdates(TEST_TENANT, updates)
+	if err != nil {
+		t.Fatalf("inserting: %v", err)
+	}
+	dispatcher.Inserted(TEST_TENANT, updates)
+}
+
+// Start and end updates of the checkout event
+func checkout(id string, sequence int64, result string) []models.Update {
+	return []models.Update{
+		{UpdateType: models.UPDATE_TYPE_START, EventName: "checkout", EventId: id, Timestamp: 1000},
+		{UpdateType: models.UPDATE_TYPE_END, EventName: "checkout", EventId: id, StepNumber: 1, Timestamp: 2000, Sequence: sequence, Result: result},
+	}
+}
+
+// Waits for the deliveries in progress to succeed or to be saved as dead letters
+func wait(t *testing.T, dispatcher *Dispatcher) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for dispatcher.Stats().Pending > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries still in progress: %+v", dispatcher.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := &Dispatcher{initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	tests := []struct {
+		attempts int
+		want time.Duration
+	}{
+		{attempts: 1, want: 100 * time.Millisecond},
+		{attempts: 2, want: 200 * time.Millisecond},
+		{attempts: 3, want: 400 * time.Millisecond},
+		{attempts: 4, want: 800 * time.Millisecond},
+		{attempts: 5, want: time.Second},
+		{attempts: 100, want: time.Second},
+	}
+	for _, test := range tests {
+		if got := dispatcher.backoff(test.attempts); got != test.want {
+			t.Errorf("after %d attempts: got %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+// Failed attempts are retried, up to the maximum number of attempts,
+// then the delivery is saved as a dead letter
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name string
+		statuses []int
+		// results of the subscription, any if empty
+		results []string
+		wantAttempts int
+		wantDeliveries int64
+		wantDeadLetters int
+	}{
+		{name: "delivered", wantAttempts: 1, wantDeliveries: 1},
+		{name: "retried", statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}, wantAttempts: 3, wantDeliveries: 1},
+		{name: "dead letter", statuses: []int{500, 500, 500, 200}, wantAttempts: 3, wantDeadLetters: 1},
+		{name: "not matching", results: []string{"failure"}, wantAttempts: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhook := newTestWebhook(t, test.statuses...)
+			database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+			database.Connect()
+			subscription := models.WebhookSubscription{Name: "orders", Tenant: TEST_TENANT, Results: test.results, URL: webhook.server.URL}
+			dispatcher := newTestDispatcher(t, database, subscription, testConfig(t))
+			insert(t, database, dispatcher, checkout("1", 1, "success")...)
+			wait(t, dispatcher)
+			dispatcher.Stop()
+
+			received := webhook.deliveries()
+			if len(received) != test.wantAttempts {
+				t.Fatalf("attempts: got %d, want %d", len(received), test.wantAttempts)
+			}
+			for i, delivery := range received {
+				// the delivery ID is the same in every attempt
+				if delivery.Attempt != i + 1 || delivery.DeliveryID != received[0].DeliveryID || delivery.Event == nil || delivery.Event.Result != "success" {
+					t.Errorf("attempt %d: got %+v", i, delivery)
+				}
+			}
+			stats := dispatcher.Stats()
+			if stats.Deliveries != test.wantDeliveries || stats.FailedAttempts != int64(len(received)) - test.wantDeliveries {
+				t.Errorf("stats: got %+v", stats)
+			}
+			deadLetters := dispatcher.DeadLetters()
+			if len(deadLetters) != test.wantDeadLetters {
+				t.Fatalf("dead letters: got %+v, want %d", deadLetters, test.wantDeadLetters)
+			}
+			for _, deadLetter := range deadLetters {
+				if deadLetter.ID != received[0].DeliveryID || deadLetter.Attempts != test.wantAttempts || !strings.Contains(deadLetter.LastError, "500") {
+					t.Errorf("dead letter: got %+v", deadLetter)
+				}
+			}
+		})
+	}
+}
+
+// Deliveries are signed with the secret of the subscription, as the
+// clients sign their requests
+func TestSignature(t *testing.T) {
+	webhook := newTestWebhook(t)
+	database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+	database.Connect()
+	subscription := models.WebhookSubscription{Name: "orders", Tenant: TEST_TENANT, URL: webhook.server.URL, Secret: "s3cret"}
+	dispatcher := newTestDispatcher(t, database, subscription, testConfig(t))
+	insert(t, database, dispatcher, checkout("1", 1, "success")...)
+	wait(t, dispatcher)
+	dispatcher.Stop()
+
+	webhook.lock.Lock()
+	defer webhook.lock.Unlock()
+	if len(webhook.headers) != 1 {
+		t.Fatalf("deliveries: got %d, want 1", len(webhook.headers))
+	}
+	headers := webhook.headers[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(headers.Get(auth.TIMESTAMP_HEADER) + "." + string(webhook.bodies[0])))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if headers.Get(auth.SIGNATURE_HEADER) != want {
+		t.Errorf("signature: got %q, want %q", headers.Get(auth.SIGNATURE_HEADER), want)
+	}
+	if headers.Get(SUBSCRIPTION_HEADER) != "orders" || headers.Get(DELIVERY_HEADER) != webhook.received[0].DeliveryID {
+		t.Errorf("headers: got %v", headers)
+	}
+}
+
+// End updates are only delivered if they change the result of the event
+func TestSkippedEnds(t *testing.T) {
+	tests := []struct {
+		name string
+		// batches of end updates of the event, in the order they are received
+		batches [][]models.Update
+		wantResults []string
+		wantSkipped int64
+	}{
+		{
+			name: "replayed",
+			batches: [][]models.Update{checkout("1", 1, "success"), checkout("1", 1, "success")},
+			wantResults: []string{"success"},
+			wantSkipped: 1,
+		},
+		{
+			name: "newer",
+			batches: [][]models.Update{checkout("1", 1, "failure"), checkout("1", 2, "success")},
+			wantResults: []string{"failure", "success"},
+		},
+		{
+			name: "older",
+			batches: [][]models.Update{checkout("1", 2, "success"), checkout("1", 1, "failure")},
+			wantResults: []string{"success"},
+			wantSkipped: 1,
+		},
+		{
+			// only the winning end update of the batch is delivered
+			name: "same batch",
+			batches: [][]models.Update{append(checkout("1", 2, "success"), checkout("1", 1, "failure")[1])},
+			wantResults: []string{"success"},
+		},
+		{
+			name: "other event",
+			batches: [][]models.Update{checkout("1", 1, "success"), checkout("2", 1, "success")},
+			wantResults: []string{"success", "success"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhook := newTestWebhook(t)
+			database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+			database.Connect()
+			subscription := models.WebhookSubscription{Name: "orders", Tenant: TEST_TENANT, URL: webhook.server.URL}
+			dispatcher := newTestDispatcher(t, database, subscription, testConfig(t))
+			for _, batch := range test.batches {
+				insert(t, database, dispatcher, batch...)
+				wait(t, dispatcher)
+			}
+			dispatcher.Stop()
+
+			received := webhook.deliveries()
+			results := []string{}
+			for _, delivery := range received {
+				results = append(results, delivery.Event.Result)
+			}
+			if strings.Join(results, ",") != strings.Join(test.wantResults, ",") {
+				t.Errorf("delivered results: got %v, want %v", results, test.wantResults)
+			}
+			if skipped := dispatcher.Stats().SkippedEnds; skipped != test.wantSkipped {
+				t.Errorf("skipped end updates: got %d, want %d", skipped, test.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestDeliveryID(t *testing.T) {
+	key := eventKey{tenant: TEST_TENANT, eventName: "checkout", eventId: "1"}
+	end := endVersion{version: 1, result: "success"}
+	tests := []struct {
+		name string
+		subscription string
+		key eventKey
+		end endVersion
+		wantSame bool
+	}{
+		{name: "same end update", subscription: "orders", key: key, end: end, wantSame: true},
+		{name: "other subscription", subscription: "billing", key: key, end: end},
+		{name: "other event", subscription: "orders", key: eventKey{tenant: TEST_TENANT, eventName: "checkout", eventId: "2"}, end: end},
+		{name: "other version", subscription: "orders", key: key, end: endVersion{version: 2, result: "success"}},
+		{name: "other result", subscription: "orders", key: key, end: endVersion{version: 1, result: "failure"}},
+	}
+	want := deliveryID("orders", key, end)
+	for _, test := range tests {
+		got := deliveryID(test.subscription, test.key, test.end)
+		if (got == want) != test.wantSame {
+			t.Errorf("%s: got %s, the first ID is %s", test.name, got, want)
+		}
+	}
+}
+
+// Dead letters are capped, saved across restarts, and can be retried or discarded
+func TestDeadLetters(t *testing.T) {
+	webhook := newTestWebhook(t)
+	webhook.setStatuses(500, 500, 500, 500, 500, 500)
+	database := memory.NewMemoryDB(models.MERGE_LAST_WRITER_WINS)
+	database.Connect()
+	subscription := models.WebhookSubscription{Name: "orders", Tenant: TEST_TENANT, URL: webhook.server.URL}
+	cfg := testConfig(t)
+	cfg.MaxAttempts = 1
+	cfg.MaxDeadLetters = 2
+	dispatcher := newTestDispatcher(t, database, subscription, cfg)
+	for _, id := range []string{"1", "2", "3"} {
+		insert(t, database, dispatcher, checkout(id, 1, "success")...)
+		wait(t, dispatcher)
+	}
+	dispatcher.Stop()
+
+	deadLetters := dispatcher.DeadLetters()
+	if len(deadLetters) != 2 || deadLetters[0].EventId != "2" || deadLetters[1].EventId != "3" {
+		t.Fatalf("dead letters: got %+v, want the last 2", deadLetters)
+	}
+	if stats := dispatcher.Stats(); stats.DeadLetters != 3 || stats.DroppedDeadLetters != 1 {
+		t.Errorf("stats: got %+v", stats)
+	}
+
+	// restarted
+	webhook.setStatuses()
+	dispatcher = newTestDispatcher(t, database, subscription, cfg)
+	defer dispatcher.Stop()
+	if restored := dispatcher.DeadLetters(); len(restored) != 2 || restored[0].ID != deadLetters[0].ID {
+		t.Fatalf("restored dead letters: got %+v", restored)
+	}
+	steps := []struct {
+		name string
+		retry bool
+		id string
+		wantErr error
+		wantRemaining int
+		wantDelivered string
+	}{
+		{name: "retry unknown", retry: true, id: "unknown", wantErr: ErrDeadLetterNotFound, wantRemaining: 2},
+		{name: "discard unknown", id: "unknown", wantErr: ErrDeadLetterNotFound, wantRemaining: 2},
+		{name: "retry", retry: true, id: deadLetters[0].ID, wantRemaining: 1, wantDelivered: "2"},
+		{name: "discard", id: deadLetters[1].ID, wantRemaining: 0},
+		{name: "discard twice", id: deadLetters[1].ID, wantErr: ErrDeadLetterNotFound, wantRemaining: 0},
+	}
+	for _, step := range steps {
+		before := len(webhook.deliveries())
+		var err error
+		if step.retry {
+			err = dispatcher.Retry(step.id)
+		} else {
+			err = dispatcher.Discard(step.id)
+		}
+		wait(t, dispatcher)
+		if err != step.wantErr {
+			t.Fatalf("%s: got error %v, want %v", step.name, err, step.wantErr)
+		}
+		if remaining := dispatcher.DeadLetters(); len(remaining) != step.wantRemaining {
+			t.Errorf("%s: remaining dead letters: got %+v, want %d", step.name, remaining, step.wantRemaining)
+		}
+		delivered := webhook.deliveries()[before:]
+		if step.wantDelivered == "" && len(delivered) > 0 || step.wantDelivered != "" && (len(delivered) != 1 || delivered[0].Event.Id != step.wantDelivered || delivered[0].DeliveryID != step.id) {
+			t.Errorf("%s: delivered %+v, want %q", step.name, delivered, step.wantDelivered)
+		}
+	}
+	saved, err := loadDeadLetters(cfg.DeadLetterFile)
+	if err != nil || len(saved) != 0 {
+		t.Errorf("saved dead letters: got %+v, %v, want none", saved, err)
+	}
+}
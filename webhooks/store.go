@@ -0,0 +1,45 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"owl_server/models"
+	"path/filepath"
+)
+
+// Reads the dead letters saved in the given file, oldest first.
+// Returns no dead letters if the file doesn't exist yet.
+func loadDeadLetters(path string) ([]models.DeadLetter, error) {
+	deadLetters := []models.DeadLetter{}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return deadLetters, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the dead letters. Underlying error: %w", err)
+	}
+	err = json.Unmarshal(content, &deadLetters)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the dead letters file %s. Underlying error: %w", path, err)
+	}
+	return deadLetters, nil
+}
+
+// Writes the dead letters to the file, atomically
+func saveDeadLetters(path string, deadLetters []models.DeadLetter) error {
+	content, err := json.MarshalIndent(deadLetters, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, content, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to save the dead letters. Underlying error: %w", err)
+	}
+	return os.Rename(tmp, path)
+}